@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+)
+
+//atRestKeyID is the key ID in the header of the files AtRestKey encrypts.
+const atRestKeyID = "at-rest"
+
+//writeAtRest returns r encrypted with the AtRestKey, or r if there is
+//none. The returned reader must be closed.
+func (s *Store) writeAtRest(r io.Reader) io.ReadCloser{
+	if s.atRest==nil{
+		return io.NopCloser(r)
+	}
+	pr,pw:= io.Pipe()
+	go func(){
+		_,err:= copyEncrypt(atRestKeyID,s.AtRestKey,r,pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+//readAtRest opens the file at p and returns the size and bytes of its
+//content, decrypted with the AtRestKey when there is one.
+func (s *Store) readAtRest(p string) (int64,io.ReadCloser,error){
+	n,rc,err:= s.Backend.Read(p)
+	if err!=nil || s.atRest==nil{
+		return n,rc,err
+	}
+	pr,pw:= io.Pipe()
+	go func(){
+		_,err:= copyDecrypt(s.atRest,rc,pw)
+		pw.CloseWithError(err)
+	}()
+	return plainSize(n),readCloser{pr,multiCloser{pr,rc}},nil
+}
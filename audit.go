@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//AuditOp is the operation an AuditEntry records.
+type AuditOp string
+
+const(
+	AuditStore 	AuditOp = "store"
+	AuditGet 		AuditOp = "get"
+	AuditDelete AuditOp = "delete"
+)
+
+//AuditEntry is one file operation of a FileServer. Size is the bytes
+//written or sent, like the Size of an Event.
+type AuditEntry struct{
+	Time 	time.Time
+	Op 		AuditOp
+	//ID is the node that stored the file, Key is the hashed key for
+	//the file of a peer.
+	ID 		string
+	Key 	string
+	Size 	int64
+	//Peer is the address of the peer that asked for the operation, it
+	//is empty for our own Store, Get and Delete.
+	Peer 	string 	`json:",omitempty"`
+	//Fetched is set for a Get of ours that fetched the file from the
+	//network and stored it.
+	Fetched bool 	`json:",omitempty"`
+}
+
+//AuditLog records the file operations of a FileServer once they
+//succeeded, see FileServerOpts.AuditLog. An error of Record is logged,
+//the operation it records has happened regardless. Files that expire or
+//are evicted are not recorded.
+type AuditLog interface{
+	Record(AuditEntry) error
+}
+
+//FileAuditLog appends the entries to a file as newline delimited JSON.
+type FileAuditLog struct{
+	mu 		sync.Mutex
+	file 	*os.File
+}
+
+func NewFileAuditLog(path string) (*FileAuditLog,error){
+	f,err:= os.OpenFile(path,os.O_WRONLY|os.O_APPEND|os.O_CREATE,0644)
+	if err!=nil{
+		return nil,err
+	}
+	return &FileAuditLog{file: f},nil
+}
+
+func (l *FileAuditLog) Record(e AuditEntry) error{
+	b,err:= json.Marshal(e)
+	if err!=nil{
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	//One write per entry, a crash can only cut off the last line.
+	_,err = l.file.Write(append(b,'\n'))
+	return err
+}
+
+func (l *FileAuditLog) Close() error{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+//ReplayAuditLog reads a log written by a FileAuditLog and returns the
+//keys of our own files it leaves stored, sorted. Like the Store, a
+//content key is only gone once it was deleted as often as it was stored.
+//A last line cut off by a crash is ignored.
+func ReplayAuditLog(r io.Reader) ([]string,error){
+	refs:= make(map[string]int)
+	sc:= bufio.NewScanner(r)
+	sc.Buffer(nil,1<<20)
+	var partial error
+	for line:=1;sc.Scan();line++{
+		if partial!=nil{
+			return nil,partial
+		}
+		var e AuditEntry
+		if err:= json.Unmarshal(sc.Bytes(),&e);err!=nil{
+			partial = fmt.Errorf("audit log line %d: %w",line,err)
+			continue
+		}
+		if e.Peer!=""{
+			continue
+		}
+		switch{
+		case e.Op==AuditStore || e.Op==AuditGet && e.Fetched:
+			if isContentKey(e.Key){
+				refs[e.Key]++
+			}else{
+				refs[e.Key] = 1
+			}
+		case e.Op==AuditDelete:
+			if refs[e.Key]--;refs[e.Key]<=0{
+				delete(refs,e.Key)
+			}
+		}
+	}
+	if err:= sc.Err();err!=nil{
+		return nil,err
+	}
+	keys:= make([]string,0,len(refs))
+	for key:= range refs{
+		keys = append(keys,key)
+	}
+	sort.Strings(keys)
+	return keys,nil
+}
+
+//audit records e in the AuditLog, if there is one.
+func (s *FileServer) audit(e AuditEntry){
+	if s.AuditLog==nil{
+		return
+	}
+	e.Time = time.Now()
+	if err:= s.AuditLog.Record(e);err!=nil{
+		s.Logger.With("key",e.Key).Errorf("audit log: %s",err)
+	}
+}
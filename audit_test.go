@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//memoryAuditLog keeps the entries, or fails every Record with err.
+type memoryAuditLog struct{
+	mu 			sync.Mutex
+	entries []AuditEntry
+	err 		error
+}
+
+func (l *memoryAuditLog) Record(e AuditEntry) error{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err!=nil{
+		return l.err
+	}
+	l.entries = append(l.entries,e)
+	return nil
+}
+
+func TestFileServerAudit(t *testing.T){
+	s:= newTestFileServer()
+	log:= &memoryAuditLog{}
+	s.AuditLog = log
+	if err:= s.Store("key",strings.NewReader("audited"));err!=nil{
+		t.Fatal(err)
+	}
+	r,err:= s.Get("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,[]byte("audited"))
+	if err:= s.Delete("key");err!=nil{
+		t.Fatal(err)
+	}
+
+	var ops []AuditOp
+	for _,e:= range log.entries{
+		if e.Key!="key" || e.ID!=s.ID || e.Peer!="" || e.Time.IsZero(){
+			t.Errorf("want our own entry for key, have %+v",e)
+		}
+		ops = append(ops,e.Op)
+	}
+	if want:= []AuditOp{AuditStore,AuditGet,AuditDelete};!reflect.DeepEqual(ops,want){
+		t.Errorf("want %v, have %v",want,ops)
+	}
+	if log.entries[0].Size==0 || log.entries[0].Size!=log.entries[1].Size{
+		t.Errorf("want the size of the stored file, have %+v",log.entries[:2])
+	}
+
+	//An audit log that fails doesn't fail the operation.
+	log.err = errors.New("disk full")
+	if err:= s.Store("other",strings.NewReader("not audited"));err!=nil{
+		t.Fatal(err)
+	}
+}
+
+func TestReplayAuditLog(t *testing.T){
+	path:= filepath.Join(t.TempDir(),"audit.log")
+	log,err:= NewFileAuditLog(path)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	sum:= sha256.Sum256([]byte("content"))
+	content:= hex.EncodeToString(sum[:])
+	for _,e:= range []AuditEntry{
+		{Op: AuditStore,Key: "name"},
+		{Op: AuditStore,Key: "name"},
+		{Op: AuditStore,Key: content},
+		{Op: AuditStore,Key: content},
+		{Op: AuditDelete,Key: content},
+		{Op: AuditStore,Key: "deleted"},
+		{Op: AuditDelete,Key: "deleted"},
+		{Op: AuditGet,Key: "local"},
+		{Op: AuditGet,Key: "fetched",Fetched: true},
+		{Op: AuditStore,Key: "of a peer",Peer: "127.0.0.1:3000"},
+	}{
+		if err:= log.Record(e);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if err:= log.Close();err!=nil{
+		t.Fatal(err)
+	}
+	//The last write was cut off by a crash.
+	f,err:= os.OpenFile(path,os.O_WRONLY|os.O_APPEND,0)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Op":"delete","Ke`)
+	f.Close()
+
+	f,err = os.Open(path)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	defer f.Close()
+	keys,err:= ReplayAuditLog(f)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if want:= []string{content,"fetched","name"};!reflect.DeepEqual(keys,want){
+		t.Errorf("want %v, have %v",want,keys)
+	}
+
+	if _,err:= ReplayAuditLog(strings.NewReader("garbage\n{}\n"));err==nil{
+		t.Error("want an error for a corrupt line that isn't the last")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//StorageBackend persists the files of a Store. The Store derives the
+//paths from the keys with its PathTransformFunc, a backend only deals
+//with those slash separated paths.
+type StorageBackend interface{
+	//Write replaces path with the content of r. It must be atomic: when
+	//reading r fails, path is left as it was and no partial file is seen.
+	Write(path string,r io.Reader) (int64,error)
+	Read(path string) (int64,io.ReadCloser,error)
+	Has(path string) bool
+	//Delete removes path and everything nested below it.
+	Delete(path string) error
+	//List returns the paths of all stored files.
+	List() ([]string,error)
+	//Clear removes all stored files.
+	Clear() error
+}
+
+//tempSuffix marks the files DiskBackend writes before they are renamed
+//into place, List skips them.
+const tempSuffix = ".tmp-"
+
+//DiskBackend stores files on the local filesystem below Root.
+type DiskBackend struct{
+	Root string
+	//Sync makes Write fsync the file before it is renamed into place and
+	//its directory after, so a file Write returned for survives a crash or
+	//power loss, see StoreOpts.SyncWrites.
+	Sync bool
+}
+
+func NewDiskBackend(root string) *DiskBackend{
+	return &DiskBackend{Root: root}
+}
+
+//ErrInvalidPath is returned for a path that would resolve outside the
+//Root of a DiskBackend: one that is absolute, has ".." elements or goes
+//through a symlink.
+var ErrInvalidPath = errors.New("path escapes the storage root")
+
+//fullPath returns where p is stored below Root. The paths hold keys and
+//ids peers send us, so they are checked to stay below Root: no element
+//may be ".." and none of those found on disk may be a symlink, which
+//could point anywhere. Root itself may be one.
+func (d *DiskBackend) fullPath(p string) (string,error){
+	if err:= checkPath(p);err!=nil{
+		return "",err
+	}
+	full:= d.Root
+	for _,elem:= range strings.Split(p,"/"){
+		full = full+"/"+elem
+		fi,err:= os.Lstat(full)
+		if errors.Is(err,fs.ErrNotExist){
+			//Write creates the rest as real directories.
+			break
+		}
+		if err!=nil{
+			return "",err
+		}
+		if fi.Mode()&fs.ModeSymlink!=0{
+			return "",fmt.Errorf("%w: %s is a symlink",ErrInvalidPath,full)
+		}
+	}
+	return fmt.Sprintf("%s/%s",d.Root,p),nil
+}
+
+//checkPath rejects a path with elements that lead out of the directory
+//it is relative to. Backslashes are separators on Windows and a NUL
+//ends the path the OS sees.
+func checkPath(p string) error{
+	if len(p)==0 || path.IsAbs(p) || strings.ContainsAny(p,"\\\x00"){
+		return fmt.Errorf("%w: %q",ErrInvalidPath,p)
+	}
+	for _,elem:= range strings.Split(p,"/"){
+		if elem==".."{
+			return fmt.Errorf("%w: %q",ErrInvalidPath,p)
+		}
+	}
+	return nil
+}
+
+//Write streams r into a temporary file next to p and renames it into
+//place once all of r was written.
+func (d *DiskBackend) Write(p string,r io.Reader) (int64,error){
+	full,err:= d.fullPath(p)
+	if err!=nil{
+		return 0,err
+	}
+	dir:= path.Dir(full)
+	if err:= os.MkdirAll(dir,os.ModePerm);err!=nil{
+		return 0,err
+	}
+	f,err:= os.CreateTemp(dir,"."+path.Base(p)+tempSuffix)
+	if err!=nil{
+		return 0,err
+	}
+	n,err:= io.Copy(f,r)
+	if err==nil && d.Sync{
+		err = f.Sync()
+	}
+	if cerr:= f.Close();err==nil{
+		err = cerr
+	}
+	if err==nil{
+		err = os.Rename(f.Name(),full)
+	}
+	if err!=nil{
+		os.Remove(f.Name())
+		return n,err
+	}
+	if d.Sync{
+		//The rename is only durable once the directory is.
+		return n,syncDir(dir)
+	}
+	return n,nil
+}
+
+func syncDir(dir string) error{
+	f,err:= os.Open(dir)
+	if err!=nil{
+		return err
+	}
+	err = f.Sync()
+	if cerr:= f.Close();err==nil{
+		err = cerr
+	}
+	return err
+}
+
+func (d *DiskBackend) Read(p string) (int64,io.ReadCloser,error){
+	full,err:= d.fullPath(p)
+	if err!=nil{
+		return 0,nil,err
+	}
+	file,err:= os.Open(full)
+	if err!=nil{
+		return 0,nil,err
+	}
+
+	fi,err:= file.Stat()
+	if err!=nil{
+		file.Close()
+		return 0,nil,err
+	}
+	return fi.Size(),file,nil
+}
+
+func (d *DiskBackend) Has(p string) bool{
+	full,err:= d.fullPath(p)
+	if err!=nil{
+		return false
+	}
+	_,err = os.Stat(full)
+	return !errors.Is(err,os.ErrNotExist)
+}
+
+//Delete also removes the directories it leaves empty.
+func (d *DiskBackend) Delete(p string) error{
+	full,err:= d.fullPath(p)
+	if err!=nil{
+		return err
+	}
+	if err:= os.RemoveAll(full);err!=nil{
+		return err
+	}
+	for dir:= path.Dir(p);dir!="." && dir!="/";dir = path.Dir(dir){
+		full,err:= d.fullPath(dir)
+		if err!=nil || os.Remove(full)!=nil{
+			//Not empty (or gone already), neither are its parents.
+			break
+		}
+	}
+	return nil
+}
+
+func (d *DiskBackend) List() ([]string,error){
+	paths:= []string{}
+	err:= filepath.WalkDir(d.Root,func(p string,e fs.DirEntry,err error) error{
+		if err!=nil{
+			if p==d.Root && errors.Is(err,fs.ErrNotExist){
+				return nil
+			}
+			return err
+		}
+		if e.IsDir() || isTempFile(e.Name()){
+			return nil
+		}
+		rel,err:= filepath.Rel(d.Root,p)
+		if err!=nil{
+			return err
+		}
+		paths = append(paths,filepath.ToSlash(rel))
+		return nil
+	})
+	return paths,err
+}
+
+//isTempFile reports whether name is a write in progress (or one a crash
+//left behind).
+func isTempFile(name string) bool{
+	return strings.HasPrefix(name,".") && strings.Contains(name,tempSuffix)
+}
+
+func (d *DiskBackend) Clear() error{
+	return os.RemoveAll(d.Root)
+}
+
+//MemoryBackend keeps all files in a map, it is meant for tests that
+//should not touch the disk.
+type MemoryBackend struct{
+	mu 		sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend{
+	return &MemoryBackend{files: make(map[string][]byte)}
+}
+
+func (m *MemoryBackend) Write(p string,r io.Reader) (int64,error){
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return 0,err
+	}
+	m.mu.Lock()
+	m.files[p] = b
+	m.mu.Unlock()
+	return int64(len(b)),nil
+}
+
+func (m *MemoryBackend) Read(p string) (int64,io.ReadCloser,error){
+	m.mu.RLock()
+	b,ok:= m.files[p]
+	m.mu.RUnlock()
+	if !ok{
+		return 0,nil,&fs.PathError{Op: "open",Path: p,Err: fs.ErrNotExist}
+	}
+	return int64(len(b)),io.NopCloser(bytes.NewReader(b)),nil
+}
+
+func (m *MemoryBackend) Has(p string) bool{
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _,ok:= m.files[p];ok{
+		return true
+	}
+	//Like on disk a path that only holds other files exists as well.
+	for f:= range m.files{
+		if strings.HasPrefix(f,p+"/"){
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryBackend) Delete(p string) error{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for f:= range m.files{
+		if f==p || strings.HasPrefix(f,p+"/"){
+			delete(m.files,f)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) List() ([]string,error){
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	paths:= make([]string,0,len(m.files))
+	for f:= range m.files{
+		paths = append(paths,f)
+	}
+	sort.Strings(paths)
+	return paths,nil
+}
+
+func (m *MemoryBackend) Clear() error{
+	m.mu.Lock()
+	m.files = make(map[string][]byte)
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+const(
+	defaultBanThreshold = 3
+	defaultBanWindow 		= 10*time.Minute
+	defaultBanDuration 	= time.Hour
+)
+
+//ErrBanned is returned when a banned address connects or is dialed, see
+//Ban.
+var ErrBanned = errors.New("address is banned")
+
+//banList holds the banned addresses with when their ban ends, zero for
+//never, and the recent strikes (integrity failures and handshake
+//rejections) by address.
+type banList struct{
+	mu 			sync.Mutex
+	bans 		map[string]time.Time
+	strikes map[string][]time.Time
+}
+
+func newBanList(blacklist []string) *banList{
+	l:= &banList{bans: make(map[string]time.Time),strikes: make(map[string][]time.Time)}
+	for _,addr:= range blacklist{
+		l.bans[addr] = time.Time{}
+	}
+	return l
+}
+
+//banned tells whether addr is banned itself or by its host.
+func (l *banList) banned(addr string) bool{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active(addr){
+		return true
+	}
+	host,_,err:= net.SplitHostPort(addr)
+	return err==nil && l.active(host)
+}
+
+//active tells whether the ban of entry is still on, one that ended is
+//removed. It must be called with mu held.
+func (l *banList) active(entry string) bool{
+	until,ok:= l.bans[entry]
+	if ok && !until.IsZero() && time.Now().After(until){
+		delete(l.bans,entry)
+		return false
+	}
+	return ok
+}
+
+//strike records one strike against addr and tells whether it made
+//threshold within window.
+func (l *banList) strike(addr string,threshold int,window time.Duration) bool{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now:= time.Now()
+	recent:= l.strikes[addr][:0]
+	for _,t:= range l.strikes[addr]{
+		if now.Sub(t)<window{
+			recent = append(recent,t)
+		}
+	}
+	recent = append(recent,now)
+	if len(recent)<threshold{
+		l.strikes[addr] = recent
+		return false
+	}
+	delete(l.strikes,addr)
+	return true
+}
+
+//Ban refuses the peer at addr for duration, 0 or less until Unban: it is
+//dropped if connected, not dialed and its connections are refused. addr
+//is either a host, banning all of its ports, or host:port as in Peers.
+func (s *FileServer) Ban(addr string,duration time.Duration){
+	var until time.Time
+	if duration>0{
+		until = time.Now().Add(duration)
+		s.Logger.With("peer",addr).Infof("banning remote for %s",duration)
+	}else{
+		s.Logger.With("peer",addr).Infof("banning remote until unbanned")
+	}
+	s.bans.mu.Lock()
+	s.bans.bans[addr] = until
+	s.bans.mu.Unlock()
+
+	s.peerLock.Lock()
+	var banned []p2p.Peer
+	for remote,p:= range s.peers{
+		if s.bans.banned(remote) || s.bans.banned(s.listenAddrs[remote]){
+			banned = append(banned,p)
+		}
+	}
+	s.peerLock.Unlock()
+	for _,p:= range banned{
+		s.dropPeer(p,fmt.Errorf("%w: %s",ErrBanned,addr))
+	}
+}
+
+//Unban lifts the ban of addr, a Blacklist entry included, and forgets
+//its strikes. Bans of its host or of its ports are kept.
+func (s *FileServer) Unban(addr string){
+	s.bans.mu.Lock()
+	delete(s.bans.bans,addr)
+	delete(s.bans.strikes,addr)
+	s.bans.mu.Unlock()
+	s.Logger.With("peer",addr).Infof("unbanned remote")
+}
+
+//Banned tells whether addr is banned, itself or by its host.
+func (s *FileServer) Banned(addr string) bool{
+	return s.bans.banned(addr)
+}
+
+//misbehaved counts a strike against the peer at addr, reason is logged.
+//At BanThreshold strikes within BanWindow it is banned for BanDuration,
+//and so is the address it listens on when it dialed us.
+func (s *FileServer) misbehaved(addr string,reason error){
+	s.Logger.With("peer",addr).Errorf("strike against remote: %s",reason)
+	if s.BanThreshold<0 || !s.bans.strike(addr,s.BanThreshold,s.BanWindow){
+		return
+	}
+	s.peerLock.Lock()
+	listen,ok:= s.listenAddrs[addr]
+	s.peerLock.Unlock()
+	s.Ban(addr,s.BanDuration)
+	if ok{
+		s.Ban(listen,s.BanDuration)
+	}
+}
+
+//OnHandshakeError counts a connection whose handshake failed as a strike
+//against the remote, see BanThreshold. It is to be set on the transport
+//like OnPeer. An inbound connection comes from a port picked for the
+//dial, so those are counted (and banned) by host.
+func (s *FileServer) OnHandshakeError(addr net.Addr,outbound bool,err error){
+	remote:= addr.String()
+	if host,_,serr:= net.SplitHostPort(remote);serr==nil && !outbound{
+		remote = host
+	}
+	s.misbehaved(remote,fmt.Errorf("handshake failed: %w",err))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+//defaultTransferBufferSize is the buffer io.Copy would use.
+const defaultTransferBufferSize = 32<<10
+
+//newBufferPool returns a pool of size byte transfer buffers, the
+//concurrent transfers take turns with them instead of allocating their own.
+func newBufferPool(size int) *sync.Pool{
+	return &sync.Pool{New: func() any{
+		b:= make([]byte,size)
+		return &b
+	}}
+}
+
+//copyBuffer is io.Copy through a pooled buffer of TransferBufferSize.
+//Neither side may bring its own copy (a file's ReadFrom, say), io.CopyBuffer
+//would ignore the buffer.
+func (s *FileServer) copyBuffer(dst io.Writer,src io.Reader) (int64,error){
+	buf:= s.buffers.Get().(*[]byte)
+	defer s.buffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst},struct{ io.Reader }{src},*buf)
+}
+
+//copyBufferN is io.CopyN through a pooled buffer, see copyBuffer.
+func (s *FileServer) copyBufferN(dst io.Writer,src io.Reader,n int64) (int64,error){
+	written,err:= s.copyBuffer(dst,io.LimitReader(src,n))
+	if err==nil && written<n{
+		err = io.EOF
+	}
+	return written,err
+}
+
+//bufferedReader has an io.Copy from r (like the one of a backend writing
+//what a peer streams) go through a pooled buffer.
+type bufferedReader struct{
+	s *FileServer
+	r io.Reader
+}
+
+func (r bufferedReader) Read(b []byte) (int,error){
+	return r.r.Read(b)
+}
+
+func (r bufferedReader) WriteTo(w io.Writer) (int64,error){
+	return r.s.copyBuffer(w,r.r)
+}
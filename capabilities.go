@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+const capabilitiesTimeout = 10*time.Second
+
+//Handshake exchanges the node IDs and the Compressions both sides read
+//with a peer that just connected, before OnPeer adds it, so a Store never
+//picks one without knowing what its targets read and the peer only ever
+//changes the copies of its own ID (see ownedBy). It is to be set as the
+//HandshakeFunc of the transport like OnPeer, on every node: each side
+//writes a count byte and the Compressions, the length of its ID as two
+//bytes and the ID, then reads the remote's.
+func (s *FileServer) Handshake(p p2p.Peer) error{
+	p.SetDeadline(time.Now().Add(capabilitiesTimeout))
+	defer p.SetDeadline(time.Time{})
+
+	if len(s.Compressions)>255 || len(s.ID)>65535{
+		return fmt.Errorf("[%s] the Compressions or the ID don't fit the handshake",s.Transport.Addr())
+	}
+	b:= []byte{byte(len(s.Compressions))}
+	for _,c:= range s.Compressions{
+		b = append(b,byte(c))
+	}
+	b = binary.BigEndian.AppendUint16(b,uint16(len(s.ID)))
+	b = append(b,s.ID...)
+	if _,err:= p.Write(b);err!=nil{
+		return fmt.Errorf("sending the capabilities: %w",err)
+	}
+	n:= make([]byte,1)
+	if _,err:= io.ReadFull(p,n);err!=nil{
+		return fmt.Errorf("reading the capabilities: %w",err)
+	}
+	remote:= make([]byte,n[0])
+	if _,err:= io.ReadFull(p,remote);err!=nil{
+		return fmt.Errorf("reading the capabilities: %w",err)
+	}
+	cs:= make([]Compression,len(remote))
+	for i,c:= range remote{
+		cs[i] = Compression(c)
+	}
+	var idLen uint16
+	if err:= binary.Read(p,binary.BigEndian,&idLen);err!=nil{
+		return fmt.Errorf("reading the peer's ID: %w",err)
+	}
+	id:= make([]byte,idLen)
+	if _,err:= io.ReadFull(p,id);err!=nil{
+		return fmt.Errorf("reading the peer's ID: %w",err)
+	}
+	addr:= p.RemoteAddr().String()
+	s.peerLock.Lock()
+	s.compressions[addr] = cs
+	s.peerIDs[addr] = string(id)
+	s.peerLock.Unlock()
+	return nil
+}
+
+//ownedBy tells whether the peer at from may store, delete or change the
+//copies of the node with id: never our own files, and only those of the
+//ID it named in the Handshake. A peer that connected without Handshake
+//is taken at its word for any other ID.
+func (s *FileServer) ownedBy(id string,from string) error{
+	if id==s.ID{
+		return fmt.Errorf("[%s] %w: %s named our own ID",s.Transport.Addr(),ErrNotOwner,from)
+	}
+	s.peerLock.Lock()
+	peerID,ok:= s.peerIDs[from]
+	s.peerLock.Unlock()
+	if ok && peerID!=id{
+		return fmt.Errorf("[%s] %w: %s named the ID %s",s.Transport.Addr(),ErrNotOwner,from,id)
+	}
+	return nil
+}
+
+//reads tells whether we accept files compressed with c. CompressionNone
+//is always accepted.
+func (s *FileServer) reads(c Compression) bool{
+	return c==CompressionNone || slices.Contains(s.Compressions,c)
+}
+
+//peerCompressions returns the Compressions each of targets read, a peer
+//that connected without Handshake is left out and sent any.
+func (s *FileServer) peerCompressions(targets []p2p.Peer) [][]Compression{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	var sets [][]Compression
+	for _,p:= range targets{
+		if cs,ok:= s.compressions[p.RemoteAddr().String()];ok{
+			sets = append(sets,cs)
+		}
+	}
+	return sets
+}
+
+//compressionFor returns the Compression a file replicated to targets is
+//stored with.
+func (s *FileServer) compressionFor(targets []p2p.Peer) Compression{
+	return negotiateCompression(s.Compression,append(s.peerCompressions(targets),s.Compressions))
+}
+
+//levelFor returns the level c is written at, CompressionLevel is that of
+//Compression only.
+func (s *FileServer) levelFor(c Compression) int{
+	if c==s.Compression{
+		return s.CompressionLevel
+	}
+	return 0
+}
+
+//recompressFor makes sure every one of targets reads our copy of the
+//file: one stored with a Compression some of them don't is written again
+//with one they all do. It returns the Compression and size of the copy.
+//Every peer is sent the same copy, so it is done once per transfer and
+//not per peer.
+func (s *FileServer) recompressFor(ctx context.Context,key string,size int64,targets []p2p.Peer) (Compression,int64,error){
+	stored,err:= s.storedCompression(key)
+	if err!=nil{
+		return 0,0,err
+	}
+	if negotiateCompression(stored,s.peerCompressions(targets))==stored{
+		return stored,size,nil
+	}
+	c:= s.compressionFor(targets)
+	_,local,err:= s.store.Read(s.ID,key)
+	if err!=nil{
+		return 0,0,err
+	}
+	r,err:= decompressReader(local)
+	if err!=nil{
+		return 0,0,err
+	}
+	defer r.Close()
+	cr:= compressReader(c,s.levelFor(c),ctxReader{ctx,r})
+	size,err = s.store.writeStream(s.ID,key,cr)
+	cr.Close()
+	if err!=nil{
+		return 0,0,err
+	}
+	s.Logger.With("key",key).Infof("not every target reads %s, stored the file again with %s",stored,c)
+	return c,size,nil
+}
+
+//checkCompressionLevel tells whether c can be written at level.
+func checkCompressionLevel(c Compression,level int) error{
+	switch{
+	case level==0:
+		return nil
+	case c==CompressionGzip && level>=gzip.HuffmanOnly && level<=gzip.BestCompression:
+		return nil
+	case c==CompressionZstd && level>=1 && level<=22:
+		return nil
+	}
+	return fmt.Errorf("invalid CompressionLevel %d for %s",level,c)
+}
+
+//negotiateCompression picks the Compression every one of sets reads:
+//want if they all do, else the preferred other one they all do, else
+//CompressionNone which every node reads.
+func negotiateCompression(want Compression,sets [][]Compression) Compression{
+	if want==CompressionNone{
+		return CompressionNone
+	}
+	for _,c:= range append([]Compression{want},supportedCompressions...){
+		if c==CompressionNone{
+			break
+		}
+		all:= true
+		for _,set:= range sets{
+			all = all && slices.Contains(set,c)
+		}
+		if all{
+			return c
+		}
+	}
+	return CompressionNone
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+const defaultChunkSize = 4<<20
+
+//chunkResends is how many more times a chunk that doesn't match the
+//sha256 its peer sent ahead of it is asked for before the fetch gives up
+//on that peer.
+const chunkResends = 2
+
+//errChunkCorrupt is returned for a chunk that doesn't match its sha256.
+var errChunkCorrupt = fmt.Errorf("%w: chunk doesn't match its sha256",ErrIntegrity)
+
+//fileChunk is a part of a peer's (encrypted) copy.
+type fileChunk struct{
+	index 	int64
+	offset 	int64
+	length 	int64
+}
+
+func chunkOf(index int64,chunkSize int64,size int64) fileChunk{
+	offset:= index*chunkSize
+	return fileChunk{index: index,offset: offset,length: min(chunkSize,size-offset)}
+}
+
+func chunkCount(size int64,chunkSize int64) int64{
+	return (size+chunkSize-1)/chunkSize
+}
+
+//probeFile asks the peers whether they have the file without streaming
+//it, and returns the ones that do with the size of their copy.
+func (s *FileServer) probeFile(ctx context.Context,key string,peers []p2p.Peer) ([]p2p.Peer,int64,error){
+	msg:= Message{
+		MessageGetFile{
+			Key: hashKey(key),
+			ID: s.ID,
+			Probe: true,
+		},
+	}
+	t:= s.addTransfer(hashKey(key),kindProbe,len(peers))
+	defer s.removeTransfer(hashKey(key),kindProbe)
+
+	reached,_:= s.multicast(ctx,&msg,peers)
+	if err:= ctx.Err();err!=nil{
+		return nil,0,err
+	}
+
+	var(
+		holders []p2p.Peer
+		size 		int64
+		timeout = time.After(s.AckTimeout)
+	)
+	for i:=0;i<len(reached);i++{
+		select{
+		case ack:= <-t.acks:
+			peer,ok:= s.peer(ack.From)
+			if !ok || !ack.Ready{
+				continue
+			}
+			//Every copy is the same encrypted file, one that differs is
+			//left out of the chunked fetch.
+			if len(holders)>0 && ack.Size!=size{
+				continue
+			}
+			size = ack.Size
+			holders = append(holders,peer)
+		case <-timeout:
+			i = len(reached)
+		case <-ctx.Done():
+			return nil,0,ctx.Err()
+		}
+	}
+	return holders,size,nil
+}
+
+//chunkPeer routes the served streams and declines of one holder to the
+//worker fetching from it.
+type chunkPeer struct{
+	streams 	chan p2p.Peer
+	declined 	chan struct{}
+}
+
+//fetchChunks fetches the chunks of st that are still missing into its
+//spool file, spread over the holders, and stores the file once all of
+//them arrived. A fetch that fails returns a TransferError to resume it.
+func (s *FileServer) fetchChunks(ctx context.Context,st *resumeState,holders []p2p.Peer,start time.Time) (io.Reader,error){
+	spool,err:= st.openSpool()
+	if err!=nil{
+		return nil,err
+	}
+	defer spool.Close()
+
+	var(
+		mu 			sync.Mutex
+		pending []int64
+	)
+	for i:=int64(0);i<chunkCount(st.Size,st.ChunkSize);i++{
+		if _,ok:= st.Chunks[i];!ok{
+			pending = append(pending,i)
+		}
+	}
+	next:= func() (int64,bool){
+		mu.Lock()
+		defer mu.Unlock()
+		if len(pending)==0{
+			return 0,false
+		}
+		i:= pending[0]
+		pending = pending[1:]
+		return i,true
+	}
+
+	key:= st.Key
+	t:= s.addStreamTransfer(hashKey(key),kindGet,len(pending)+len(holders),len(holders))
+	defer s.removeTransfer(hashKey(key),kindGet)
+
+	routes,stopRoutes:= s.routeChunks(t,holders)
+
+	//Every holder fetches one chunk after the other, a holder that fails
+	//hands its chunk back and stops.
+	var(
+		wg 		sync.WaitGroup
+		errs 	= make(chan error,len(holders))
+	)
+	for _,peer:= range holders{
+		wg.Add(1)
+		go func(peer p2p.Peer,route chunkPeer){
+			defer wg.Done()
+			for{
+				i,ok:= next()
+				if !ok{
+					return
+				}
+				c:= chunkOf(i,st.ChunkSize,st.Size)
+				sum,err:= s.fetchChunk(ctx,key,peer,route,spool,c)
+				if err!=nil{
+					mu.Lock()
+					pending = append(pending,i)
+					mu.Unlock()
+					errs <- fmt.Errorf("chunk %d from %s: %w",i,peer.RemoteAddr(),err)
+					return
+				}
+				mu.Lock()
+				st.Chunks[i] = sum
+				mu.Unlock()
+			}
+		}(peer,routes[peer.RemoteAddr().String()])
+	}
+	wg.Wait()
+	stopRoutes()
+
+	if len(pending)>0{
+		close(errs)
+		var failures []error
+		for err:= range errs{
+			failures = append(failures,err)
+		}
+		return nil,&TransferError{Err: errors.Join(failures...),Token: st.token()}
+	}
+
+	if _,err:= spool.Seek(0,io.SeekStart);err!=nil{
+		return nil,err
+	}
+	written,err:= s.store.writeDecrypt(s.keys,s.ID,key,ctxReader{ctx,io.LimitReader(spool,st.Size)},verifyingReader)
+	if err!=nil{
+		return nil,&TransferError{Err: err,Token: st.token()}
+	}
+	os.Remove(st.Spool)
+	s.Logger.With("key",key).Infof("received (%d) bytes in %d chunks over the network",written,chunkCount(st.Size,st.ChunkSize))
+	return s.completeFetch(key,written,start)
+}
+
+//routeChunks hands the streams and declines t gets to the chunkPeer of the
+//holder they come from until stop is called.
+func (s *FileServer) routeChunks(t *transfer,holders []p2p.Peer) (routes map[string]chunkPeer,stop func()){
+	routes = make(map[string]chunkPeer,len(holders))
+	for _,peer:= range holders{
+		routes[peer.RemoteAddr().String()] = chunkPeer{
+			streams: make(chan p2p.Peer,1),
+			declined: make(chan struct{},1),
+		}
+	}
+	done:= make(chan struct{})
+	routed:= make(chan struct{})
+	go func(){
+		defer close(routed)
+		for{
+			select{
+			case peer:= <-t.streams:
+				route,ok:= routes[peer.RemoteAddr().String()]
+				if !ok{
+					peer.CloseStream()
+					continue
+				}
+				select{
+				case route.streams <- peer:
+				default:
+					peer.CloseStream()
+				}
+			case ack:= <-t.acks:
+				if route,ok:= routes[ack.From];ok && !ack.Ready{
+					select{
+					case route.declined <- struct{}{}:
+					default:
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return routes,func(){
+		close(done)
+		<-routed
+		//A stream nobody takes anymore would keep the peer's connection
+		//stuck.
+		for _,route:= range routes{
+			select{
+			case peer:= <-route.streams:
+				peer.CloseStream()
+			default:
+			}
+		}
+	}
+}
+
+//fetchChunk asks peer for chunk c and writes it to w at its offset. It
+//returns the sha256 of the chunk. The peer sends the sha256 ahead of the
+//chunk, a chunk that doesn't match it is asked for again, up to
+//chunkResends times, rather than failing the file once it is assembled.
+func (s *FileServer) fetchChunk(ctx context.Context,key string,peer p2p.Peer,route chunkPeer,w io.WriterAt,c fileChunk) ([]byte,error){
+	msg:= Message{
+		MessageGetFile{
+			Key: hashKey(key),
+			ID: s.ID,
+			Offset: c.offset,
+			Length: c.length,
+			Sum: true,
+		},
+	}
+	for attempt:=0;;attempt++{
+		if err:= s.send(peer,&msg);err!=nil{
+			return nil,err
+		}
+		var(
+			sum []byte
+			err error
+		)
+		select{
+		case stream:= <-route.streams:
+			sum,err = s.receiveChunk(ctx,stream,w,c)
+		case <-route.declined:
+			return nil,fmt.Errorf("peer declined")
+		case <-time.After(s.AckTimeout):
+			return nil,fmt.Errorf("timed out waiting for chunk")
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+		if !errors.Is(err,errChunkCorrupt){
+			return sum,err
+		}
+		s.misbehaved(peer.RemoteAddr().String(),err)
+		if attempt>=chunkResends{
+			return sum,err
+		}
+		s.Logger.With("key",key,"peer",peer.RemoteAddr().String()).Errorf("%d bytes at %d: %s, asking again",c.length,c.offset,err)
+	}
+}
+
+//receiveChunk writes the chunk a peer is streaming to us at its offset,
+//checked against the sha256 ahead of it when the peer sent one.
+func (s *FileServer) receiveChunk(ctx context.Context,peer p2p.Peer,w io.WriterAt,c fileChunk) ([]byte,error){
+	var size int64
+	if err:= binary.Read(peer,binary.LittleEndian,&size);err!=nil{
+		peer.CloseStream()
+		s.dropPeer(peer,err)
+		return nil,err
+	}
+	//A peer that doesn't know Sum sends the chunk alone.
+	var want []byte
+	if size==c.length+sha256.Size{
+		want = make([]byte,sha256.Size)
+		if _,err:= io.ReadFull(peer,want);err!=nil{
+			peer.CloseStream()
+			s.dropPeer(peer,err)
+			return nil,err
+		}
+		size = c.length
+	}
+	lr:= io.LimitReader(peer,size)
+	if size!=c.length{
+		peer.CloseStream()
+		return nil,fmt.Errorf("peer %s served %d bytes of a %d byte chunk",peer.RemoteAddr(),size,c.length)
+	}
+
+	h:= sha256.New()
+	n,err:= s.copyBuffer(io.MultiWriter(io.NewOffsetWriter(w,c.offset),h),ctxReader{ctx,throttle(lr,s.downloads,ctx.Done())})
+	if err!=nil && ctx.Err()!=nil{
+		peer.CloseStream()
+		return nil,ctx.Err()
+	}
+	peer.CloseStream()
+	if err!=nil{
+		return nil,err
+	}
+	if n!=size{
+		s.dropPeer(peer,io.ErrUnexpectedEOF)
+		return nil,io.ErrUnexpectedEOF
+	}
+	sum:= h.Sum(nil)
+	if want!=nil && !bytes.Equal(sum,want){
+		return nil,errChunkCorrupt
+	}
+	return sum,nil
+}
+
+//chunkSum returns the sha256 of the length bytes at off of our copy of a
+//peer's file, see MessageGetFile.
+func (s *FileServer) chunkSum(id string,key string,off int64,length int64) ([]byte,error){
+	_,r,err:= s.store.Read(id,key)
+	if err!=nil{
+		return nil,err
+	}
+	if rc,ok:= r.(io.ReadCloser);ok{
+		defer rc.Close()
+	}
+	if sk,ok:= r.(io.Seeker);ok{
+		_,err = sk.Seek(off,io.SeekStart)
+	}else{
+		_,err = io.CopyN(io.Discard,r,off)
+	}
+	if err!=nil{
+		return nil,err
+	}
+	h:= sha256.New()
+	if _,err:= io.CopyN(h,r,length);err!=nil{
+		return nil,err
+	}
+	return h.Sum(nil),nil
+}
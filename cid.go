@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+//CIDs are the identifiers IPFS uses for content: a multibase prefix, then
+//the version, the codec of the content and the multihash of it, each as an
+//unsigned varint. We produce CIDv1 of raw bytes hashed with sha2-256 in
+//base32, the default of IPFS tooling for raw leaves ("bafkrei...").
+const(
+	cidVersion 				= 1
+	cidCodecRaw 			= 0x55
+	cidBase32Prefix 	= 'b'
+	multihashSHA1 		= 0x11
+	multihashSHA256 	= 0x12
+	multihashSHA512 	= 0x13
+)
+
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//multihashes are the hashes we can check the content of a CID with.
+var multihashes = map[uint64]struct{
+	newHash func() hash.Hash
+	size 		int
+}{
+	multihashSHA1: 		{sha1.New,sha1.Size},
+	multihashSHA256: 	{sha256.New,sha256.Size},
+	multihashSHA512: 	{sha512.New,sha512.Size},
+}
+
+type cid struct{
+	codec 	uint64
+	newHash func() hash.Hash
+	digest 	[]byte
+}
+
+//CIDv1 returns the CID of raw content with the given sha256 digest.
+func CIDv1(digest []byte) string{
+	b:= binary.AppendUvarint(nil,cidVersion)
+	b = binary.AppendUvarint(b,cidCodecRaw)
+	b = binary.AppendUvarint(b,multihashSHA256)
+	b = binary.AppendUvarint(b,uint64(len(digest)))
+	b = append(b,digest...)
+	return string(cidBase32Prefix)+strings.ToLower(cidBase32.EncodeToString(b))
+}
+
+//parseCID decodes a base32 CIDv1. Any codec is accepted since the digest
+//is all we need, the multihash has to be one we can check.
+func parseCID(s string) (cid,error){
+	if len(s)<2 || s[0]!=cidBase32Prefix{
+		return cid{},fmt.Errorf("not a base32 CID: %q",s)
+	}
+	b,err:= cidBase32.DecodeString(strings.ToUpper(s[1:]))
+	if err!=nil{
+		return cid{},fmt.Errorf("invalid CID %q: %s",s,err)
+	}
+	var fields [4]uint64
+	for i:= range fields{
+		v,n:= binary.Uvarint(b)
+		if n<=0{
+			return cid{},fmt.Errorf("invalid CID %q: truncated",s)
+		}
+		fields[i] = v
+		b = b[n:]
+	}
+	version,codec,code,size:= fields[0],fields[1],fields[2],fields[3]
+	if version!=cidVersion{
+		return cid{},fmt.Errorf("unsupported CID version %d",version)
+	}
+	mh,ok:= multihashes[code]
+	if !ok{
+		return cid{},fmt.Errorf("unsupported multihash 0x%x",code)
+	}
+	if size!=uint64(mh.size) || len(b)!=mh.size{
+		return cid{},fmt.Errorf("invalid CID %q: digest size",s)
+	}
+	return cid{codec: codec,newHash: mh.newHash,digest: b},nil
+}
+
+//CIDPathTransformFunc stores a file keyed by a CID under the hex of its
+//multihash digest, so the CID and the hex sha256 key StoreContent returns
+//for the same content name the same file. Other keys are hashed with
+//sha256 like CASpathTransformFuncWith(sha256.New).
+func CIDPathTransformFunc(key string) PathKey{
+	if _,digest,ok:= contentHashFunc(key);ok{
+		return blockPathKey(hex.EncodeToString(digest))
+	}
+	return casPathKey(sha256.New,key)
+}
+
+//StoreCID stores r under the CIDv1 of its content and returns the CID.
+//Like StoreContent, storing bytes that are already stored is a no-op.
+func (s *FileServer) StoreCID(r io.Reader) (string,error){
+	return s.StoreCIDContext(context.Background(),r)
+}
+
+//StoreCIDContext is like StoreCID but stops once ctx is done.
+func (s *FileServer) StoreCIDContext(ctx context.Context,r io.Reader) (string,error){
+	return s.storeContent(ctx,r,CIDv1)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+func TestCIDv1(t *testing.T){
+	//The CID `ipfs add --raw-leaves --cid-version 1` gives an empty file.
+	const want = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+	sum:= sha256.Sum256(nil)
+	if have:= CIDv1(sum[:]);have!=want{
+		t.Fatalf("want %s, have %s",want,have)
+	}
+
+	c,err:= parseCID(want)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if c.codec!=cidCodecRaw || hex.EncodeToString(c.digest)!=hex.EncodeToString(sum[:]){
+		t.Errorf("unexpected codec %x or digest %x",c.codec,c.digest)
+	}
+
+	for _,bad:= range []string{"","b","Qmfoo",want[:len(want)-4],"bafyfoo"}{
+		if _,err:= parseCID(bad);err==nil{
+			t.Errorf("want an error parsing %q",bad)
+		}
+	}
+}
+
+func TestStoreCID(t *testing.T){
+	s:= NewFileServer(FileServerOpts{
+		EncKey: 						newEncryptionKey(),
+		PathTransformFunc: 	CIDPathTransformFunc,
+		Backend: 						NewMemoryBackend(),
+		Transport: 					p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3401"}),
+	})
+	data:= "content with a CID"
+	sum:= sha256.Sum256([]byte(data))
+
+	key,err:= s.StoreCID(strings.NewReader(data))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if want:= CIDv1(sum[:]);key!=want{
+		t.Fatalf("want key %s, have %s",want,key)
+	}
+	if have,want:= CIDPathTransformFunc(key).FileName,hex.EncodeToString(sum[:]);have!=want{
+		t.Errorf("want the file named by the digest %s, have %s",want,have)
+	}
+
+	//The hex key of the same content names the same file.
+	for _,k:= range []string{key,hex.EncodeToString(sum[:])}{
+		r,err:= s.Get(k)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		b,err:= io.ReadAll(r)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if string(b)!=data{
+			t.Errorf("%s: want %q, have %q",k,data,b)
+		}
+	}
+	if err:= verifyContentHash(key,strings.NewReader("other content"));err==nil{
+		t.Error("want a hash mismatch for other content")
+	}
+}
@@ -0,0 +1,211 @@
+//Command cas talks to a running node over its HTTP gateway:
+//
+//	cas put <file>                 stores the file and prints its content hash
+//	cas get <key> <outfile>        writes the file for key to outfile
+//	cas delete <key>               deletes the file for key
+//	cas ls [-network] [-prefix p]  lists the stored keys
+//	cas peers                      lists the node's connected peers
+//	cas doctor                     runs the node's self test
+//
+//The node is given with -node or CAS_NODE and defaults to
+//http://localhost:3080.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultNode = "http://localhost:3080"
+
+func main() {
+	node:= os.Getenv("CAS_NODE")
+	if len(node)==0{
+		node = defaultNode
+	}
+	flag.StringVar(&node,"node",node,"gateway address of the node")
+	flag.Usage = usage
+	flag.Parse()
+
+	c:= &client{node: strings.TrimSuffix(node,"/")}
+	if err:= c.run(flag.Args());err!=nil{
+		fmt.Fprintf(os.Stderr,"cas: %s\n",err)
+		os.Exit(1)
+	}
+}
+
+func usage(){
+	fmt.Fprintf(os.Stderr,`usage: cas [-node addr] <command> [args]
+
+commands:
+  put <file>                 store the file and print its content hash
+  get <key> <outfile>        write the file for key to outfile
+  delete <key>               delete the file for key
+  ls [-network] [-prefix p]  list the stored keys
+  peers                      list the connected peers
+  doctor                     run the node's self test and print its report
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+var errUsage = errors.New("invalid arguments, see cas -h")
+
+type client struct{
+	node string
+}
+
+func (c *client) run(args []string) error{
+	if len(args)==0{
+		return errUsage
+	}
+	switch cmd,args:= args[0],args[1:];cmd{
+	case "put":
+		if len(args)!=1{
+			return errUsage
+		}
+		return c.put(args[0])
+	case "get":
+		if len(args)!=2{
+			return errUsage
+		}
+		return c.get(args[0],args[1])
+	case "delete":
+		if len(args)!=1{
+			return errUsage
+		}
+		return c.delete(args[0])
+	case "ls":
+		fs:= flag.NewFlagSet("ls",flag.ContinueOnError)
+		network:= fs.Bool("network",false,"include the keys of the node's peers")
+		prefix:= fs.String("prefix","","list only the keys starting with prefix")
+		if err:= fs.Parse(args);err!=nil || fs.NArg()!=0{
+			return errUsage
+		}
+		query:= url.Values{}
+		if *network{
+			query.Set("network","true")
+		}
+		if len(*prefix)>0{
+			query.Set("prefix",*prefix)
+		}
+		path:= "/files"
+		if len(query)>0{
+			path+="?"+query.Encode()
+		}
+		return c.print(path)
+	case "peers":
+		if len(args)!=0{
+			return errUsage
+		}
+		return c.print("/peers")
+	case "doctor":
+		if len(args)!=0{
+			return errUsage
+		}
+		return c.doctor()
+	default:
+		return fmt.Errorf("unknown command %q, see cas -h",cmd)
+	}
+}
+
+func (c *client) put(name string) error{
+	f,err:= os.Open(name)
+	if err!=nil{
+		return err
+	}
+	defer f.Close()
+
+	//The gateway keys a PUT without a key by the content hash.
+	resp,err:= c.do(http.MethodPut,"/file",f)
+	if err!=nil{
+		return err
+	}
+	defer resp.Body.Close()
+	_,err = io.Copy(os.Stdout,resp.Body)
+	return err
+}
+
+func (c *client) get(key string,out string) error{
+	resp,err:= c.do(http.MethodGet,"/file/"+url.PathEscape(key),nil)
+	if err!=nil{
+		return err
+	}
+	defer resp.Body.Close()
+
+	f,err:= os.Create(out)
+	if err!=nil{
+		return err
+	}
+	if _,err:= io.Copy(f,resp.Body);err!=nil{
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+func (c *client) delete(key string) error{
+	resp,err:= c.do(http.MethodDelete,"/file/"+url.PathEscape(key),nil)
+	if err!=nil{
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *client) print(path string) error{
+	resp,err:= c.do(http.MethodGet,path,nil)
+	if err!=nil{
+		return err
+	}
+	defer resp.Body.Close()
+	_,err = io.Copy(os.Stdout,resp.Body)
+	return err
+}
+
+//doctor prints the report of the node's self test, the gateway answers a
+//failed one with an error status.
+func (c *client) doctor() error{
+	req,err:= http.NewRequest(http.MethodPost,c.node+"/selftest",nil)
+	if err!=nil{
+		return err
+	}
+	resp,err:= http.DefaultClient.Do(req)
+	if err!=nil{
+		return err
+	}
+	defer resp.Body.Close()
+	if _,err:= io.Copy(os.Stdout,resp.Body);err!=nil{
+		return err
+	}
+	if resp.StatusCode!=http.StatusOK{
+		return fmt.Errorf("self test failed: %s",resp.Status)
+	}
+	return nil
+}
+
+//do sends a request to the node, a response other than 2xx is returned
+//as an error with the body the gateway sent.
+func (c *client) do(method string,path string,body io.Reader) (*http.Response,error){
+	req,err:= http.NewRequest(method,c.node+path,body)
+	if err!=nil{
+		return nil,err
+	}
+	resp,err:= http.DefaultClient.Do(req)
+	if err!=nil{
+		return nil,err
+	}
+	if resp.StatusCode/100!=2{
+		defer resp.Body.Close()
+		b,_:= io.ReadAll(io.LimitReader(resp.Body,4<<10))
+		return nil,fmt.Errorf("%s %s: %s: %s",method,path,resp.Status,strings.TrimSpace(string(b)))
+	}
+	return resp,nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//Codec encodes the control messages sent to the peers. Every message on
+//the wire starts with the ID of the codec that encoded it, so a node
+//decodes the messages of peers using another built in codec (or its own)
+//whatever Codec it sends with.
+type Codec interface{
+	ID() byte
+	Marshal(msg *Message) ([]byte,error)
+	Unmarshal(b []byte,msg *Message) error
+}
+
+const(
+	codecGob byte = iota+1
+	codecJSON
+	codecProtobuf
+)
+
+var codecs = map[byte]Codec{
+	codecGob: 			GobCodec{},
+	codecJSON: 			JSONCodec{},
+	codecProtobuf: 	ProtobufCodec{},
+}
+
+//messageTypes holds the payload types by name, see registerMessage.
+var messageTypes = make(map[string]reflect.Type)
+
+//registerMessage makes the type of v a payload all codecs can carry.
+func registerMessage(v any){
+	gob.Register(v)
+	t:= reflect.TypeOf(v)
+	messageTypes[t.Name()] = t
+}
+
+//payloadName returns the name JSON and protobuf tag the payload with.
+func payloadName(payload any) (string,error){
+	t:= reflect.TypeOf(payload)
+	if t==nil || messageTypes[t.Name()]!=t{
+		return "",fmt.Errorf("unregistered payload %T",payload)
+	}
+	return t.Name(),nil
+}
+
+func payloadType(name string) (reflect.Type,error){
+	t,ok:= messageTypes[name]
+	if !ok{
+		return nil,fmt.Errorf("unknown payload %q",name)
+	}
+	return t,nil
+}
+
+//encodeMessage encodes msg with c behind the ID of c.
+func encodeMessage(c Codec,msg *Message) ([]byte,error){
+	b,err:= c.Marshal(msg)
+	if err!=nil{
+		return nil,err
+	}
+	return append([]byte{c.ID()},b...),nil
+}
+
+//decodeMessage decodes a message encodeMessage encoded with c or one of
+//the built in codecs.
+func decodeMessage(c Codec,b []byte,msg *Message) error{
+	if len(b)==0{
+		return errors.New("empty message")
+	}
+	if b[0]!=c.ID(){
+		var ok bool
+		if c,ok = codecs[b[0]];!ok{
+			return fmt.Errorf("unknown codec %d",b[0])
+		}
+	}
+	return c.Unmarshal(b[1:],msg)
+}
+
+//GobCodec is the default Codec, only Go peers can decode it.
+type GobCodec struct{}
+
+func (GobCodec) ID() byte{
+	return codecGob
+}
+
+func (GobCodec) Marshal(msg *Message) ([]byte,error){
+	buf:= new(bytes.Buffer)
+	if err:= gob.NewEncoder(buf).Encode(msg);err!=nil{
+		return nil,err
+	}
+	return buf.Bytes(),nil
+}
+
+func (GobCodec) Unmarshal(b []byte,msg *Message) error{
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(msg)
+}
+
+//JSONCodec encodes a message as {"Type":"MessageAck","Payload":{...}},
+//the payload struct as encoding/json does.
+type JSONCodec struct{}
+
+type jsonMessage struct{
+	Type 		string
+	Payload json.RawMessage
+}
+
+func (JSONCodec) ID() byte{
+	return codecJSON
+}
+
+func (JSONCodec) Marshal(msg *Message) ([]byte,error){
+	name,err:= payloadName(msg.Payload)
+	if err!=nil{
+		return nil,err
+	}
+	payload,err:= json.Marshal(msg.Payload)
+	if err!=nil{
+		return nil,err
+	}
+	return json.Marshal(jsonMessage{Type: name,Payload: payload})
+}
+
+func (JSONCodec) Unmarshal(b []byte,msg *Message) error{
+	var m jsonMessage
+	if err:= json.Unmarshal(b,&m);err!=nil{
+		return err
+	}
+	t,err:= payloadType(m.Type)
+	if err!=nil{
+		return err
+	}
+	v:= reflect.New(t)
+	if err:= json.Unmarshal(m.Payload,v.Interface());err!=nil{
+		return err
+	}
+	msg.Payload = v.Elem().Interface()
+	return nil
+}
+
+//ProtobufCodec encodes a message as the protobuf message
+//
+//	message Message { string type = 1; bytes payload = 2; }
+//
+//The payload is the message whose field n is the nth field of the payload
+//struct: strings, []byte, bools and integers are the scalars of the same
+//name (int is int64), slices are repeated fields, time.Time is a
+//google.protobuf.Timestamp and structs are messages. Fields a newer peer
+//added are skipped.
+type ProtobufCodec struct{}
+
+//protoTimestamp is the layout of google.protobuf.Timestamp.
+type protoTimestamp struct{
+	Seconds int64
+	Nanos 	int32
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (ProtobufCodec) ID() byte{
+	return codecProtobuf
+}
+
+func (ProtobufCodec) Marshal(msg *Message) ([]byte,error){
+	name,err:= payloadName(msg.Payload)
+	if err!=nil{
+		return nil,err
+	}
+	payload,err:= appendProtoStruct(nil,reflect.ValueOf(msg.Payload))
+	if err!=nil{
+		return nil,err
+	}
+	b:= protowire.AppendTag(nil,1,protowire.BytesType)
+	b = protowire.AppendString(b,name)
+	b = protowire.AppendTag(b,2,protowire.BytesType)
+	return protowire.AppendBytes(b,payload),nil
+}
+
+func (ProtobufCodec) Unmarshal(b []byte,msg *Message) error{
+	var(
+		name 		string
+		payload []byte
+	)
+	for len(b)>0{
+		num,typ,n:= protowire.ConsumeTag(b)
+		if n<0{
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if (num==1 || num==2) && typ==protowire.BytesType{
+			var v []byte
+			if v,n = protowire.ConsumeBytes(b);n<0{
+				return protowire.ParseError(n)
+			}
+			if num==1{
+				name = string(v)
+			}else{
+				payload = v
+			}
+		}else if n = protowire.ConsumeFieldValue(num,typ,b);n<0{
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	t,err:= payloadType(name)
+	if err!=nil{
+		return err
+	}
+	v:= reflect.New(t).Elem()
+	if err:= consumeProtoStruct(payload,v);err!=nil{
+		return err
+	}
+	msg.Payload = v.Interface()
+	return nil
+}
+
+//isRepeated tells whether a field of type t is a repeated field.
+func isRepeated(t reflect.Type) bool{
+	return t.Kind()==reflect.Slice && t.Elem().Kind()!=reflect.Uint8
+}
+
+func appendProtoStruct(b []byte,v reflect.Value) ([]byte,error){
+	var err error
+	for i:=0;i<v.NumField();i++{
+		f:= v.Field(i)
+		num:= protowire.Number(i+1)
+		switch{
+		case !v.Type().Field(i).IsExported():
+		case f.Kind()==reflect.Map:
+			if b,err = appendProtoMap(b,num,f);err!=nil{
+				return nil,err
+			}
+		case isRepeated(f.Type()):
+			for j:=0;j<f.Len();j++{
+				if b,err = appendProtoValue(b,num,f.Index(j));err!=nil{
+					return nil,err
+				}
+			}
+		//Like proto3, zero values are left out.
+		case f.IsZero() || (f.Type()==timeType && f.Interface().(time.Time).IsZero()):
+		default:
+			if b,err = appendProtoValue(b,num,f);err!=nil{
+				return nil,err
+			}
+		}
+	}
+	return b,nil
+}
+
+func appendProtoValue(b []byte,num protowire.Number,v reflect.Value) ([]byte,error){
+	if v.Type()==timeType{
+		t:= v.Interface().(time.Time)
+		v = reflect.ValueOf(protoTimestamp{Seconds: t.Unix(),Nanos: int32(t.Nanosecond())})
+	}
+	switch v.Kind(){
+	case reflect.String:
+		b = protowire.AppendTag(b,num,protowire.BytesType)
+		return protowire.AppendString(b,v.String()),nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind()!=reflect.Uint8{
+			break
+		}
+		b = protowire.AppendTag(b,num,protowire.BytesType)
+		return protowire.AppendBytes(b,v.Bytes()),nil
+	case reflect.Bool:
+		b = protowire.AppendTag(b,num,protowire.VarintType)
+		return protowire.AppendVarint(b,protowire.EncodeBool(v.Bool())),nil
+	case reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64:
+		b = protowire.AppendTag(b,num,protowire.VarintType)
+		return protowire.AppendVarint(b,uint64(v.Int())),nil
+	case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64:
+		b = protowire.AppendTag(b,num,protowire.VarintType)
+		return protowire.AppendVarint(b,v.Uint()),nil
+	case reflect.Struct:
+		nested,err:= appendProtoStruct(nil,v)
+		if err!=nil{
+			return nil,err
+		}
+		b = protowire.AppendTag(b,num,protowire.BytesType)
+		return protowire.AppendBytes(b,nested),nil
+	}
+	return nil,fmt.Errorf("protobuf: unsupported field type %s",v.Type())
+}
+
+func consumeProtoStruct(b []byte,v reflect.Value) error{
+	for len(b)>0{
+		num,typ,n:= protowire.ConsumeTag(b)
+		if n<0{
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		i:= int(num)-1
+		if i<0 || i>=v.NumField() || !v.Type().Field(i).IsExported(){
+			if n = protowire.ConsumeFieldValue(num,typ,b);n<0{
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		f:= v.Field(i)
+		var err error
+		switch{
+		case f.Kind()==reflect.Map:
+			n,err = consumeProtoMapEntry(b,typ,f)
+		case !isRepeated(f.Type()):
+			n,err = consumeProtoValue(b,typ,f)
+		//Other encoders pack repeated scalars by default.
+		case typ==protowire.BytesType && isVarint(f.Type().Elem()):
+			var packed []byte
+			if packed,n = protowire.ConsumeBytes(b);n<0{
+				return protowire.ParseError(n)
+			}
+			for len(packed)>0{
+				elem:= reflect.New(f.Type().Elem()).Elem()
+				m,err:= consumeProtoValue(packed,protowire.VarintType,elem)
+				if err!=nil{
+					return err
+				}
+				f.Set(reflect.Append(f,elem))
+				packed = packed[m:]
+			}
+		default:
+			elem:= reflect.New(f.Type().Elem()).Elem()
+			if n,err = consumeProtoValue(b,typ,elem);err==nil{
+				f.Set(reflect.Append(f,elem))
+			}
+		}
+		if err!=nil{
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+//appendProtoMap appends the map v as protobuf does, a repeated field of
+//entry messages with the key as field 1 and the value as field 2. The
+//entries are sorted by key so the encoding doesn't change from one call
+//to the next.
+func appendProtoMap(b []byte,num protowire.Number,v reflect.Value) ([]byte,error){
+	keys:= v.MapKeys()
+	sort.Slice(keys,func(i,j int) bool{ return fmt.Sprint(keys[i])<fmt.Sprint(keys[j]) })
+	for _,k:= range keys{
+		entry,err:= appendProtoValue(nil,1,k)
+		if err!=nil{
+			return nil,err
+		}
+		if entry,err = appendProtoValue(entry,2,v.MapIndex(k));err!=nil{
+			return nil,err
+		}
+		b = protowire.AppendTag(b,num,protowire.BytesType)
+		b = protowire.AppendBytes(b,entry)
+	}
+	return b,nil
+}
+
+//consumeProtoMapEntry decodes the map entry at the start of b into the
+//map v and returns its length. A missing key or value is the zero value.
+func consumeProtoMapEntry(b []byte,typ protowire.Type,v reflect.Value) (int,error){
+	if typ!=protowire.BytesType{
+		return 0,fmt.Errorf("protobuf: wire type %d for a %s field",typ,v.Type())
+	}
+	entry,n:= protowire.ConsumeBytes(b)
+	if n<0{
+		return 0,protowire.ParseError(n)
+	}
+	key:= reflect.New(v.Type().Key()).Elem()
+	value:= reflect.New(v.Type().Elem()).Elem()
+	for len(entry)>0{
+		num,typ,m:= protowire.ConsumeTag(entry)
+		if m<0{
+			return 0,protowire.ParseError(m)
+		}
+		entry = entry[m:]
+		var err error
+		switch num{
+		case 1:
+			m,err = consumeProtoValue(entry,typ,key)
+		case 2:
+			m,err = consumeProtoValue(entry,typ,value)
+		default:
+			if m = protowire.ConsumeFieldValue(num,typ,entry);m<0{
+				err = protowire.ParseError(m)
+			}
+		}
+		if err!=nil{
+			return 0,err
+		}
+		entry = entry[m:]
+	}
+	if v.IsNil(){
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	v.SetMapIndex(key,value)
+	return n,nil
+}
+
+func isVarint(t reflect.Type) bool{
+	switch t.Kind(){
+	case reflect.Bool,reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64,
+		reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+//consumeProtoValue decodes the value of wire type typ at the start of b
+//into v and returns its length.
+func consumeProtoValue(b []byte,typ protowire.Type,v reflect.Value) (int,error){
+	if isVarint(v.Type()){
+		if typ!=protowire.VarintType{
+			return 0,fmt.Errorf("protobuf: wire type %d for a %s field",typ,v.Type())
+		}
+		x,n:= protowire.ConsumeVarint(b)
+		if n<0{
+			return 0,protowire.ParseError(n)
+		}
+		switch v.Kind(){
+		case reflect.Bool:
+			v.SetBool(protowire.DecodeBool(x))
+		case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64:
+			v.SetUint(x)
+		default:
+			v.SetInt(int64(x))
+		}
+		return n,nil
+	}
+
+	if typ!=protowire.BytesType{
+		return 0,fmt.Errorf("protobuf: wire type %d for a %s field",typ,v.Type())
+	}
+	data,n:= protowire.ConsumeBytes(b)
+	if n<0{
+		return 0,protowire.ParseError(n)
+	}
+	switch{
+	case v.Type()==timeType:
+		var ts protoTimestamp
+		if err:= consumeProtoStruct(data,reflect.ValueOf(&ts).Elem());err!=nil{
+			return 0,err
+		}
+		v.Set(reflect.ValueOf(time.Unix(ts.Seconds,int64(ts.Nanos))))
+	case v.Kind()==reflect.String:
+		v.SetString(string(data))
+	case v.Kind()==reflect.Slice && v.Type().Elem().Kind()==reflect.Uint8:
+		v.SetBytes(bytes.Clone(data))
+	case v.Kind()==reflect.Struct:
+		if err:= consumeProtoStruct(data,v);err!=nil{
+			return 0,err
+		}
+	default:
+		return 0,fmt.Errorf("protobuf: unsupported field type %s",v.Type())
+	}
+	return n,nil
+}
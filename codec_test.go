@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var codecTestMessages = []any{
+	MessageStoreFile{ID: "node1",Key: "key",Size: 1<<40,Expires: time.Unix(1700000000,42),ChunkSize: -1,StreamID: 7,Content: true,KeyFingerprint: []byte{1,2},Compression: CompressionGzip,Meta: map[string]string{"content-type": "text/plain","empty": ""}},
+	MessageFileMeta{ID: "node1",Key: "key",Meta: map[string]string{"a": "b"}},
+	MessageAck{Key: "key",Ready: true,Size: 3,Chunks: [][]byte{{1,2},{},{3}}},
+	MessageFileList{RequestID: "req",Keys: []string{"a","","b"}},
+	MessageGetFile{},
+}
+
+func TestCodecs(t *testing.T){
+	for _,c:= range codecs{
+		for _,payload:= range codecTestMessages{
+			b,err:= encodeMessage(c,&Message{Payload: payload})
+			if err!=nil{
+				t.Fatalf("codec %d: %s",c.ID(),err)
+			}
+			//Whatever codec a node sends with, it decodes the others.
+			var msg Message
+			if err:= decodeMessage(GobCodec{},b,&msg);err!=nil{
+				t.Fatalf("codec %d: %s",c.ID(),err)
+			}
+			if !codecEqual(msg.Payload,payload){
+				t.Errorf("codec %d: want %#v, have %#v",c.ID(),payload,msg.Payload)
+			}
+		}
+		if _,err:= c.Marshal(&Message{Payload: struct{}{}});c.ID()!=codecGob && err==nil{
+			t.Errorf("codec %d: want an error for an unregistered payload",c.ID())
+		}
+	}
+
+	var msg Message
+	if err:= decodeMessage(GobCodec{},[]byte{99,1,2},&msg);err==nil{
+		t.Error("want an error for an unknown codec")
+	}
+}
+
+//codecEqual compares payloads whose times may have lost their location.
+func codecEqual(a any,b any) bool{
+	if sa,ok:= a.(MessageStoreFile);ok{
+		sb:= b.(MessageStoreFile)
+		if !sa.Expires.Equal(sb.Expires){
+			return false
+		}
+		if string(sa.KeyFingerprint)!=string(sb.KeyFingerprint){
+			return false
+		}
+		sa.Expires,sb.Expires = time.Time{},time.Time{}
+		sa.KeyFingerprint,sb.KeyFingerprint = nil,nil
+		return reflect.DeepEqual(sa,sb)
+	}
+	if aa,ok:= a.(MessageAck);ok{
+		ab:= b.(MessageAck)
+		if len(aa.Chunks)!=len(ab.Chunks){
+			return false
+		}
+		for i:= range aa.Chunks{
+			if string(aa.Chunks[i])!=string(ab.Chunks[i]){
+				return false
+			}
+		}
+		aa.Chunks,ab.Chunks = nil,nil
+		return reflect.DeepEqual(aa,ab)
+	}
+	return reflect.DeepEqual(a,b)
+}
+
+func TestProtobufCodecForeignEncoding(t *testing.T){
+	//A newer peer sends a field we don't know, another encoder packs
+	//repeated scalars.
+	type withPacked struct{
+		Values []int64
+	}
+	messageTypes["withPacked"] = reflect.TypeOf(withPacked{})
+	defer delete(messageTypes,"withPacked")
+
+	var payload []byte
+	payload = protowire.AppendTag(payload,9,protowire.BytesType)
+	payload = protowire.AppendString(payload,"unknown")
+	packed:= protowire.AppendVarint(protowire.AppendVarint(nil,7),1<<33)
+	payload = protowire.AppendTag(payload,1,protowire.BytesType)
+	payload = protowire.AppendBytes(payload,packed)
+	b:= protowire.AppendTag(nil,1,protowire.BytesType)
+	b = protowire.AppendString(b,"withPacked")
+	b = protowire.AppendTag(b,2,protowire.BytesType)
+	b = protowire.AppendBytes(b,payload)
+
+	var msg Message
+	if err:= (ProtobufCodec{}).Unmarshal(b,&msg);err!=nil{
+		t.Fatal(err)
+	}
+	if v,ok:= msg.Payload.(withPacked);!ok || !reflect.DeepEqual(v.Values,[]int64{7,1<<33}){
+		t.Errorf("want values 7 and 1<<33, have %#v",msg.Payload)
+	}
+}
+
+func BenchmarkCodecs(b *testing.B){
+	for _,c:= range []Codec{GobCodec{},JSONCodec{},ProtobufCodec{}}{
+		msg:= &Message{Payload: codecTestMessages[0]}
+		b.Run(reflect.TypeOf(c).Name(),func(b *testing.B){
+			for i:=0;i<b.N;i++{
+				enc,err:= encodeMessage(c,msg)
+				if err!=nil{
+					b.Fatal(err)
+				}
+				var dec Message
+				if err:= decodeMessage(c,enc,&dec);err!=nil{
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"github.com/klauspost/compress/zstd"
+)
+
+//Compression is the algorithm a file is compressed with before it is
+//stored and encrypted. Every stored file starts with the Compression
+//byte it was written with, so changing the option keeps older files
+//readable.
+//
+//A copy is decompressed by whichever node with its ID and key reads it
+//back, not only the one that stored it. So the peers exchange the
+//Compressions they read in the Handshake, and every transfer of a copy
+//makes sure all of its targets read it, see recompressFor. A served Get
+//sends the copy as its owner stored it.
+type Compression byte
+
+const(
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+//supportedCompressions are the Compressions this build reads, the one
+//preferred first.
+var supportedCompressions = []Compression{CompressionZstd,CompressionGzip,CompressionNone}
+
+func (c Compression) String() string{
+	switch c{
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)",byte(c))
+}
+
+//compressWriter wraps w so everything written to it is compressed with c
+//at level, 0 being the default of c (see CompressionLevel).
+func compressWriter(c Compression,level int,w io.Writer) (io.WriteCloser,error){
+	switch c{
+	case CompressionNone:
+		return nopWriteCloser{w},nil
+	case CompressionGzip:
+		if level==0{
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w,level)
+	case CompressionZstd:
+		if level==0{
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w,zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return nil,fmt.Errorf("unknown compression %s",c)
+}
+
+type nopWriteCloser struct{
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error{
+	return nil
+}
+
+//compressReader returns the header byte and the bytes of r compressed
+//with c at level. The returned reader must be closed.
+func compressReader(c Compression,level int,r io.Reader) io.ReadCloser{
+	pr,pw:= io.Pipe()
+	go func(){
+		if _,err:= pw.Write([]byte{byte(c)});err!=nil{
+			pw.CloseWithError(err)
+			return
+		}
+		cw,err:= compressWriter(c,level,pw)
+		if err!=nil{
+			pw.CloseWithError(err)
+			return
+		}
+		if _,err:= io.Copy(cw,r);err!=nil{
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(cw.Close())
+	}()
+	return pr
+}
+
+//decompressReader reads the header byte written by compressReader and
+//returns the decompressed content of r. Closing the returned reader
+//closes r as well when it is an io.Closer.
+func decompressReader(r io.Reader) (io.ReadCloser,error){
+	header:= make([]byte,1)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return nil,err
+	}
+
+	var closer io.Closer = nopCloser{}
+	if rc,ok:= r.(io.Closer);ok{
+		closer = rc
+	}
+
+	switch c:= Compression(header[0]);c{
+	case CompressionNone:
+		return readCloser{r,closer},nil
+	case CompressionGzip:
+		gr,err:= gzip.NewReader(r)
+		if err!=nil{
+			return nil,err
+		}
+		return readCloser{gr,closer},nil
+	case CompressionZstd:
+		zr,err:= zstd.NewReader(r)
+		if err!=nil{
+			return nil,err
+		}
+		zrc:= zr.IOReadCloser()
+		return readCloser{zrc,multiCloser{zrc,closer}},nil
+	default:
+		return nil,fmt.Errorf("unknown compression %s",c)
+	}
+}
+
+type readCloser struct{
+	io.Reader
+	io.Closer
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error{
+	return nil
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error{
+	var err error
+	for _,c:= range m{
+		if cerr:= c.Close();err==nil{
+			err = cerr
+		}
+	}
+	return err
+}
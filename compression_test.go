@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T){
+	random:= make([]byte,1<<20)
+	if _,err:= rand.Read(random);err!=nil{
+		t.Fatal(err)
+	}
+	compressible:= bytes.Repeat([]byte("the same log line over and over\n"),1<<15)
+
+	for _,c:= range []Compression{CompressionNone,CompressionGzip,CompressionZstd}{
+		for name,data:= range map[string][]byte{"random": random,"compressible": compressible,"empty": {}}{
+			cr:= compressReader(c,0,bytes.NewReader(data))
+			stored,err:= io.ReadAll(cr)
+			if err!=nil{
+				t.Fatalf("%s/%s: %s",c,name,err)
+			}
+			if Compression(stored[0])!=c{
+				t.Errorf("%s/%s: want header %d, have %d",c,name,c,stored[0])
+			}
+			if c!=CompressionNone && name=="compressible" && len(stored)>=len(data)/10{
+				t.Errorf("%s/%s: expected the data to shrink, have %d of %d bytes",c,name,len(stored),len(data))
+			}
+
+			r,err:= decompressReader(bytes.NewReader(stored))
+			if err!=nil{
+				t.Fatalf("%s/%s: %s",c,name,err)
+			}
+			b,err:= io.ReadAll(r)
+			if err!=nil{
+				t.Fatalf("%s/%s: %s",c,name,err)
+			}
+			r.Close()
+			if !bytes.Equal(b,data){
+				t.Errorf("%s/%s: round trip changed the data",c,name)
+			}
+		}
+	}
+}
+
+func TestCompressionLevel(t *testing.T){
+	data:= bytes.Repeat([]byte("the same log line over and over\n"),1<<15)
+	for _,c:= range []Compression{CompressionGzip,CompressionZstd}{
+		for _,level:= range []int{1,9}{
+			stored,err:= io.ReadAll(compressReader(c,level,bytes.NewReader(data)))
+			if err!=nil{
+				t.Fatalf("%s/%d: %s",c,level,err)
+			}
+			r,err:= decompressReader(bytes.NewReader(stored))
+			if err!=nil{
+				t.Fatalf("%s/%d: %s",c,level,err)
+			}
+			b,err:= io.ReadAll(r)
+			if err!=nil || !bytes.Equal(b,data){
+				t.Errorf("%s/%d: round trip changed the data (%v)",c,level,err)
+			}
+		}
+	}
+	if _,err:= io.ReadAll(compressReader(CompressionGzip,42,bytes.NewReader(data)));err==nil{
+		t.Error("want an error for an invalid gzip level")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T){
+	all:= supportedCompressions
+	for _,tt:= range []struct{
+		want 	Compression
+		sets 	[][]Compression
+		have 	Compression
+	}{
+		{CompressionZstd,[][]Compression{all,all},CompressionZstd},
+		{CompressionGzip,[][]Compression{all,all},CompressionGzip},
+		{CompressionNone,[][]Compression{all},CompressionNone},
+		{CompressionZstd,[][]Compression{all,{CompressionGzip}},CompressionGzip},
+		{CompressionGzip,[][]Compression{all,{CompressionZstd,CompressionNone}},CompressionZstd},
+		{CompressionZstd,[][]Compression{{CompressionZstd},{CompressionGzip}},CompressionNone},
+		{CompressionZstd,[][]Compression{all,{}},CompressionNone},
+		{CompressionZstd,nil,CompressionZstd},
+	}{
+		if have:= negotiateCompression(tt.want,tt.sets);have!=tt.have{
+			t.Errorf("%s with %v: want %s, have %s",tt.want,tt.sets,tt.have,have)
+		}
+	}
+}
+
+func TestCompressionLevelValidated(t *testing.T){
+	s:= NewFileServer(FileServerOpts{
+		EncKey: 						newEncryptionKey(),
+		PathTransformFunc: 	CASpathTransformFunc,
+		Backend: 						NewMemoryBackend(),
+		Transport: 					newMockTransport(),
+		Compression: 				CompressionGzip,
+		CompressionLevel: 	19,
+	})
+	if err:= s.Start();err==nil{
+		t.Fatal("want an error for gzip at level 19")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//Config is the JSON file LoadConfig reads. ListenAddr, StorageRoot and one
+//of EncKey (the base64 of a 16, 24 or 32 byte AES key) or Passphrase are
+//required, the rest is optional like in FileServerOpts.
+type Config struct{
+	ListenAddr 				string 		`json:"listen_addr"`
+	AdvertiseAddr 		string 		`json:"advertise_addr"`
+	StorageRoot 			string 		`json:"storage_root"`
+	BootstrapNodes 		[]string 	`json:"bootstrap_nodes"`
+	EncKey 						string 		`json:"enc_key"`
+	Passphrase 				string 		`json:"passphrase"`
+	ReplicationFactor int 			`json:"replication_factor"`
+	StorageWeight 		int 			`json:"storage_weight"`
+	MaxBytes 					int64 		`json:"max_bytes"`
+}
+
+//LoadConfig reads the Config at path into FileServerOpts. The Transport is
+//a TCPTransport on the ListenAddr, its HandshakeFunc, OnPeer,
+//OnPeerDisconnect and OnHandshakeError are still to be set to those of
+//the server (see makeServer). Unknown fields are an error, so are typos.
+func LoadConfig(path string) (FileServerOpts,error){
+	b,err:= os.ReadFile(path)
+	if err!=nil{
+		return FileServerOpts{},err
+	}
+	var c Config
+	dec:= json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err:= dec.Decode(&c);err!=nil{
+		return FileServerOpts{},fmt.Errorf("config %s: %w",path,err)
+	}
+	opts,err:= c.opts()
+	if err!=nil{
+		return FileServerOpts{},fmt.Errorf("config %s: %w",path,err)
+	}
+	return opts,nil
+}
+
+//opts validates c and builds the FileServerOpts of it.
+func (c Config) opts() (FileServerOpts,error){
+	if c.ListenAddr==""{
+		return FileServerOpts{},fmt.Errorf("listen_addr is required")
+	}
+	if _,_,err:= net.SplitHostPort(c.ListenAddr);err!=nil{
+		return FileServerOpts{},fmt.Errorf("listen_addr: %w",err)
+	}
+	if c.AdvertiseAddr!=""{
+		if _,_,err:= net.SplitHostPort(c.AdvertiseAddr);err!=nil{
+			return FileServerOpts{},fmt.Errorf("advertise_addr: %w",err)
+		}
+	}
+	if c.StorageRoot==""{
+		return FileServerOpts{},fmt.Errorf("storage_root is required")
+	}
+	for _,addr:= range c.BootstrapNodes{
+		if _,_,err:= net.SplitHostPort(addr);err!=nil{
+			return FileServerOpts{},fmt.Errorf("bootstrap_nodes: %w",err)
+		}
+	}
+	if c.ReplicationFactor<0{
+		return FileServerOpts{},fmt.Errorf("replication_factor can't be negative, have %d",c.ReplicationFactor)
+	}
+	if c.StorageWeight<0{
+		return FileServerOpts{},fmt.Errorf("storage_weight can't be negative, have %d",c.StorageWeight)
+	}
+	if c.MaxBytes<0{
+		return FileServerOpts{},fmt.Errorf("max_bytes can't be negative, have %d",c.MaxBytes)
+	}
+
+	var key []byte
+	switch{
+	case c.EncKey!="" && c.Passphrase!="":
+		return FileServerOpts{},fmt.Errorf("enc_key and passphrase are exclusive")
+	case c.EncKey!="":
+		var err error
+		if key,err = base64.StdEncoding.DecodeString(c.EncKey);err!=nil{
+			return FileServerOpts{},fmt.Errorf("enc_key is not base64: %w",err)
+		}
+		if _,err:= aes.NewCipher(key);err!=nil{
+			return FileServerOpts{},fmt.Errorf("enc_key: %w",err)
+		}
+	case c.Passphrase=="":
+		return FileServerOpts{},fmt.Errorf("enc_key or passphrase is required")
+	}
+
+	return FileServerOpts{
+		EncKey: 						key,
+		Passphrase: 				c.Passphrase,
+		StorageRoot: 				c.StorageRoot,
+		PathTransformFunc: 	CASpathTransformFunc,
+		Transport: 					p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr: 		c.ListenAddr,
+			AdvertiseAddr: 	c.AdvertiseAddr,
+			HandshakeFunc: 	p2p.NOPHandshakeFunc,
+			Decoder: 				p2p.Defaultdecoder{},
+		}),
+		BootstrapNodes: 		c.BootstrapNodes,
+		ReplicationFactor: 	c.ReplicationFactor,
+		StorageWeight: 			c.StorageWeight,
+		MaxBytes: 					c.MaxBytes,
+	},nil
+}
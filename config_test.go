@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+func TestLoadConfig(t *testing.T){
+	dir:= t.TempDir()
+	write:= func(name string,content string) string{
+		p:= filepath.Join(dir,name)
+		if err:= os.WriteFile(p,[]byte(content),0o600);err!=nil{
+			t.Fatal(err)
+		}
+		return p
+	}
+	key:= newEncryptionKey()
+	opts,err:= LoadConfig(write("node.json",`{
+		"listen_addr": ":3000",
+		"storage_root": "`+filepath.Join(dir,"root")+`",
+		"bootstrap_nodes": ["127.0.0.1:4000"],
+		"enc_key": "`+base64.StdEncoding.EncodeToString(key)+`",
+		"replication_factor": 2,
+		"storage_weight": 4,
+		"max_bytes": 1048576
+	}`))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opts.EncKey,key) || opts.ReplicationFactor!=2 || opts.StorageWeight!=4 || opts.MaxBytes!=1<<20 || len(opts.BootstrapNodes)!=1{
+		t.Errorf("want the options of the file, have %+v",opts)
+	}
+	if tr,ok:= opts.Transport.(*p2p.TCPTransport);!ok || tr.Addr()!=":3000"{
+		t.Errorf("want a TCP transport on :3000, have %v",opts.Transport)
+	}
+	opts,err = LoadConfig(write("nat.json",`{
+		"listen_addr": ":3000",
+		"advertise_addr": "nat.example.com:4000",
+		"storage_root": "root",
+		"passphrase": "p"
+	}`))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if tr:= opts.Transport.(*p2p.TCPTransport);tr.Addr()!="nat.example.com:4000" || tr.ListenAddr!=":3000"{
+		t.Errorf("want :3000 advertised as nat.example.com:4000, have %s and %s",tr.ListenAddr,tr.Addr())
+	}
+
+	for _,tc:= range []struct{
+		config 	string
+		want 		string
+	}{
+		{`{"storage_root": "root","passphrase": "p"}`,"listen_addr is required"},
+		{`{"listen_addr": "3000","storage_root": "root","passphrase": "p"}`,"listen_addr"},
+		{`{"listen_addr": ":3000","passphrase": "p"}`,"storage_root is required"},
+		{`{"listen_addr": ":3000","storage_root": "root"}`,"enc_key or passphrase is required"},
+		{`{"listen_addr": ":3000","storage_root": "root","enc_key": "c2hvcnQ="}`,"enc_key"},
+		{`{"listen_addr": ":3000","storage_root": "root","passphrase": "p","replication_factor": -1}`,"replication_factor"},
+		{`{"listen_addr": ":3000","storage_root": "root","passphrase": "p","storage_weight": -1}`,"storage_weight"},
+		{`{"listen_addr": ":3000","storage_root": "root","passphrase": "p","bootstrap_nodes": ["nowhere"]}`,"bootstrap_nodes"},
+		{`{"listen_addr": ":3000","advertise_addr": "nat.example.com","storage_root": "root","passphrase": "p"}`,"advertise_addr"},
+		{`{"listen_addr": ":3000","storage_root": "root","passphrase": "p","replication": 2}`,"unknown field"},
+	}{
+		_,err:= LoadConfig(write("bad.json",tc.config))
+		if err==nil || !strings.Contains(err.Error(),tc.want){
+			t.Errorf("%s: want an error about %s, have %v",tc.config,tc.want,err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ErrNotConfirmed is returned by StoreAndConfirm when fewer peers than
+//asked for confirmed their copy. The file is stored locally all the same.
+var ErrNotConfirmed = errors.New("not enough peers confirmed the file")
+
+//StoreAndConfirm is like Store but only returns once minReplicas peers
+//confirmed they hold a complete copy, so the local file can be deleted
+//safely. The peers that took the stream report the sha256 of their copy,
+//which has to be that of the copy streamed to them. A peer that already
+//held the copy (see MessageStoreFile.Content) confirms with its ack.
+func (s *FileServer) StoreAndConfirm(key string,r io.Reader,minReplicas int) error{
+	return s.StoreAndConfirmContext(context.Background(),key,r,minReplicas)
+}
+
+func (s *FileServer) StoreAndConfirmContext(ctx context.Context,key string,r io.Reader,minReplicas int) error{
+	rep,err:= s.storeFile(ctx,key,r,0)
+	var replErr *ReplicationError
+	if err!=nil && !errors.As(err,&replErr){
+		return err
+	}
+	confirmed:= len(rep.held)
+	if len(rep.streamed)>0{
+		//A peer handles the stream before the messages that follow it, so
+		//when it answers the file is written.
+		holders,err:= s.whoHas(ctx,key,rep.streamed,rep.sum)
+		if err!=nil{
+			return err
+		}
+		confirmed+=len(holders)
+	}
+	if confirmed<minReplicas{
+		return fmt.Errorf("[%s] %w: %s confirmed by %d of %d peers",s.Transport.Addr(),ErrNotConfirmed,key,confirmed,minReplicas)
+	}
+	s.Logger.With("key",key).Infof("confirmed by %d peers",confirmed)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+//StoreContent stores r under the hex sha256 of its content and returns
+//that key. Storing bytes that are already stored is a no-op.
+func (s *FileServer) StoreContent(r io.Reader) (string,error){
+	return s.StoreContentContext(context.Background(),r)
+}
+
+//StoreContentContext is like StoreContent but stops once ctx is done.
+func (s *FileServer) StoreContentContext(ctx context.Context,r io.Reader) (string,error){
+	return s.storeContent(ctx,r,hex.EncodeToString)
+}
+
+//storeContent stores r under the key keyOf makes of its sha256 digest.
+func (s *FileServer) storeContent(ctx context.Context,r io.Reader,keyOf func([]byte) string) (string,error){
+	//The key has to be known before the file can be stored, so the content
+	//is spooled to a temporary file while it is hashed.
+	tmp,err:= os.CreateTemp("","cas-content-*")
+	if err!=nil{
+		return "",err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h:= sha256.New()
+	if _,err:= io.Copy(io.MultiWriter(tmp,h),ctxReader{ctx,r});err!=nil{
+		return "",err
+	}
+	key:= keyOf(h.Sum(nil))
+	if s.store.Has(s.ID,key) && !s.store.Expired(s.ID,key){
+		s.Logger.With("key",key).Infof("content already stored")
+		return key,s.store.addRef(s.ID,key,true)
+	}
+
+	if _,err:= tmp.Seek(0,io.SeekStart);err!=nil{
+		return "",err
+	}
+	if err:= s.StoreContext(ctx,key,tmp);err!=nil{
+		return "",err
+	}
+	return key,nil
+}
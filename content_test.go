@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreContent(t *testing.T){
+	s:= newTestFileServer()
+	data:= "the same bytes twice"
+	sum:= sha256.Sum256([]byte(data))
+	want:= hex.EncodeToString(sum[:])
+
+	key,err:= s.StoreContent(strings.NewReader(data))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if key!=want{
+		t.Fatalf("want key %s, have %s",want,key)
+	}
+
+	paths,err:= s.store.Backend.List()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	again,err:= s.StoreContent(strings.NewReader(data))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if again!=key{
+		t.Errorf("want the existing key %s, have %s",key,again)
+	}
+	pathsAgain,err:= s.store.Backend.List()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(pathsAgain)!=len(paths){
+		t.Errorf("storing the same content again changed the store: %v -> %v",paths,pathsAgain)
+	}
+
+	r,err:= s.Get(key)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if string(b)!=data{
+		t.Errorf("want %q, have %q",data,b)
+	}
+}
+
+func TestGetInfo(t *testing.T){
+	for _,c:= range []Compression{CompressionNone,CompressionGzip}{
+		s:= newTestFileServer()
+		s.Compression = c
+		data:= strings.Repeat("compressible ",100)
+		if err:= s.Store("info",strings.NewReader(data));err!=nil{
+			t.Fatal(err)
+		}
+		r,info,err:= s.GetInfo("info")
+		if err!=nil{
+			t.Fatal(err)
+		}
+		b,err:= io.ReadAll(r)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if string(b)!=data{
+			t.Errorf("%s: want the stored content back",c)
+		}
+		want:= FileInfo{Size: int64(len(data)),Key: "info"}
+		if info!=want{
+			t.Errorf("%s: want %+v, have %+v",c,want,info)
+		}
+	}
+}
+
+func TestStoreEphemeral(t *testing.T){
+	s:= newTestFileServer()
+	data:= "shared for a while"
+	long,err:= s.StoreEphemeral(strings.NewReader(data),time.Hour)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	short,err:= s.StoreEphemeral(strings.NewReader(data),time.Minute)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if long==short || len(long)!=16{
+		t.Fatalf("want two distinct short tokens, have %q and %q",long,short)
+	}
+	sum:= sha256.Sum256([]byte(data))
+	key:= hex.EncodeToString(sum[:])
+	if refs,err:= s.store.Refs(s.ID,key);err!=nil || refs!=2{
+		t.Fatalf("want the content stored once with 2 references, have %d (%v)",refs,err)
+	}
+
+	//The index outlives a restart.
+	s.tokens = nil
+	r,err:= s.GetByToken(short)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if b,_:= io.ReadAll(r);string(b)!=data{
+		t.Errorf("want %q, have %q",data,b)
+	}
+
+	if n,err:= s.sweepTokens(time.Now().Add(2*time.Minute));err!=nil || n!=1{
+		t.Fatalf("want 1 token swept, have %d (%v)",n,err)
+	}
+	if _,err:= s.GetByToken(short);!errors.Is(err,ErrUnknownToken){
+		t.Errorf("want %v for the expired token, have %v",ErrUnknownToken,err)
+	}
+	if _,err:= s.GetByToken(long);err!=nil{
+		t.Errorf("want the other token to still read the content, have %v",err)
+	}
+	if _,err:= s.sweepTokens(time.Now().Add(2*time.Hour));err!=nil{
+		t.Fatal(err)
+	}
+	if s.store.Has(s.ID,key){
+		t.Error("want the content deleted with its last token")
+	}
+}
@@ -1,14 +1,55 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 )
 
+//Encrypted files start with cipherMagic and a version byte. Files from
+//before the header are AES-CTR with just the IV in front, they are still
+//read during the migration. An IV that happens to start with the header
+//(one in 2^32) is misread and fails the tag check instead.
+var cipherMagic = []byte("CAS")
+
+const(
+	//cipherVersionGCM is AES-GCM from before key IDs, it is read with the
+	//key of files without a key ID.
+	cipherVersionGCM byte = 2
+	//cipherVersionKeyID is AES-GCM with the fingerprint of the key ID
+	//after the version byte.
+	cipherVersionKeyID byte = 3
+
+	//IVSize is the size of the IV in front of a legacy AES-CTR file.
+	IVSize = aes.BlockSize
+	//NonceSize is the size of the base nonce in the header of an AES-GCM
+	//file, every segment uses it with its index.
+	NonceSize = 12
+	//gcmSegmentSize is how much plain text each authenticated segment of
+	//an AES-GCM file holds.
+	gcmSegmentSize = 64<<10
+	gcmTagSize = 16
+	cipherHeaderSize = 4+keyIDSize+NonceSize
+)
+
+//encryptedSize is the number of bytes copyEncrypt produces for plainSize
+//bytes of input: the header, the input and a tag for every segment. The
+//last segment is never full so a file can't be cut at a segment
+//boundary. Sender and receiver both rely on it to frame the encrypted
+//stream.
+func encryptedSize(plainSize int64) int64{
+	return cipherHeaderSize+plainSize+gcmTagSize*(plainSize/gcmSegmentSize+1)
+}
+
 func generateID() string{
 	buf := make([]byte,32)
 	io.ReadFull(rand.Reader,buf)
@@ -20,6 +61,47 @@ func hashKey(key string) string{
 	return hex.EncodeToString(hash[:])
 }
 
+//contentHashFunc returns the hash the key was derived with and the digest
+//it names when the key looks like a content hash: hex encoded sha1 or
+//sha256, or a CID (see parseCID).
+func contentHashFunc(key string) (func() hash.Hash,[]byte,bool){
+	if c,err:= parseCID(key);err==nil{
+		return c.newHash,c.digest,true
+	}
+	digest,err:= hex.DecodeString(key)
+	if err!=nil{
+		return nil,nil,false
+	}
+	switch len(digest){
+	case sha1.Size:
+		return sha1.New,digest,true
+	case sha256.Size:
+		return sha256.New,digest,true
+	}
+	return nil,nil,false
+}
+
+//verifyContentHash checks that the content read from r hashes to key.
+//Keys that are not content hashes can't be verified and always pass.
+//errContentHash is returned for a file that doesn't hash to its content
+//key.
+var errContentHash = fmt.Errorf("%w: content hash mismatch",ErrIntegrity)
+
+func verifyContentHash(key string,r io.Reader) error{
+	newHash,want,ok:= contentHashFunc(key)
+	if !ok{
+		return nil
+	}
+	h:= newHash()
+	if _,err:= io.Copy(h,r);err!=nil{
+		return err
+	}
+	if sum:= h.Sum(nil);!bytes.Equal(sum,want){
+		return fmt.Errorf("%w: want %s, have %s",errContentHash,hex.EncodeToString(want),hex.EncodeToString(sum))
+	}
+	return nil
+}
+
 func newEncryptionKey() []byte{
 	keyBuf:= make([]byte, 32)
 	io.ReadFull(rand.Reader,keyBuf)
@@ -51,39 +133,221 @@ func copyStream(stream cipher.Stream,blockSize int,src io.Reader,dst io.Writer)(
 	return nw,nil
 }
 
-func copyDecrypt(key []byte,src io.Reader,dst io.Writer) (int,error){
-	block,err:= aes.NewCipher(key)
+//copyDecrypt decrypts an encrypted file from src to dst with the key its
+//header names and returns the bytes it read. A segment that fails its
+//tag check stops it with an error before any of it is written.
+func copyDecrypt(keys *keyring,src io.Reader,dst io.Writer) (int,error){
+	dst = fullWriter{dst}
+	header:= make([]byte,4,cipherHeaderSize)
+	if _,err:= io.ReadFull(src,header);err!=nil{
+		return 0,err
+	}
+	if !bytes.Equal(header[:3],cipherMagic) || (header[3]!=cipherVersionGCM && header[3]!=cipherVersionKeyID){
+		//A legacy CTR file, what we read is the start of its IV.
+		block,err:= legacyCipher(keys)
+		if err!=nil{
+			return 0,err
+		}
+		iv:= make([]byte,IVSize)
+		copy(iv,header)
+		if _,err := io.ReadFull(src,iv[4:]);err!=nil{
+			return 0,err
+		}
+		stream := cipher.NewCTR(block,iv)
+		return copyStream(stream,IVSize,src,dst)
+	}
+
+	var block cipher.Block
+	if header[3]==cipherVersionGCM{
+		//Written before key IDs.
+		b,err:= legacyCipher(keys)
+		if err!=nil{
+			return 0,err
+		}
+		block = b
+	}else{
+		header = header[:4+keyIDSize]
+		if _,err:= io.ReadFull(src,header[4:]);err!=nil{
+			return 0,err
+		}
+		key,ok:= keys.lookup(header[4:])
+		if !ok{
+			return 0,fmt.Errorf("no key for key ID %x in the keyring",header[4:])
+		}
+		b,err:= aes.NewCipher(key)
+		if err!=nil{
+			return 0,err
+		}
+		block = b
+	}
+	nonce:= make([]byte,NonceSize)
+	if _,err:= io.ReadFull(src,nonce);err!=nil{
+		return 0,err
+	}
+	aead,err:= cipher.NewGCM(block)
 	if err!=nil{
 		return 0,err
 	}
 
-	//Read the IV from the given io.Reader which, in our case should be
-	//the block.BlockSize() bytes we read.
-	iv := make([]byte,block.BlockSize())
-	if _,err := src.Read(iv);err!=nil{
+	var(
+		buf = make([]byte,gcmSegmentSize+gcmTagSize)
+		nr = len(header)+NonceSize
+	)
+	for i:=uint64(0);;i++{
+		n,err:= io.ReadFull(src,buf)
+		last:= err==io.EOF || err==io.ErrUnexpectedEOF
+		if err!=nil && !last{
+			return 0,err
+		}
+		nr+=n
+		plain,err:= aead.Open(buf[:0],segmentNonce(nonce,i),buf[:n],segmentAD(last))
+		if err!=nil{
+			return 0,fmt.Errorf("segment %d failed authentication: %w: %w",i,ErrIntegrity,err)
+		}
+		if _,err:= dst.Write(plain);err!=nil{
+			return 0,err
+		}
+		if last{
+			return nr,nil
+		}
+	}
+}
+
+//legacyCipher is the cipher of files without a key ID.
+func legacyCipher(keys *keyring) (cipher.Block,error){
+	key,ok:= keys.lookup(nil)
+	if !ok{
+		return nil,fmt.Errorf("no key for files without a key ID in the keyring")
+	}
+	return aes.NewCipher(key)
+}
+
+//copyEncrypt encrypts src with key, its header names keyID.
+func copyEncrypt(keyID string,key []byte, src io.Reader,dst io.Writer)(int,error){
+	nonce:= make([]byte,NonceSize)
+	if _,err:= io.ReadFull(rand.Reader,nonce);err!=nil{
 		return 0,err
 	}
-	
-	stream := cipher.NewCTR(block,iv)
-	return copyStream(stream,block.BlockSize(),src,dst)
+	return copyEncryptNonce(keyID,key,nonce,src,dst)
 }
 
-func copyEncrypt(key []byte, src io.Reader,dst io.Writer)(int,error){
+//copyEncryptNonce is copyEncrypt with a given nonce, encrypting the same
+//input with the same nonce again produces the same bytes. The nonce must
+//never be used for a different input.
+func copyEncryptNonce(keyID string,key []byte,nonce []byte,src io.Reader,dst io.Writer)(int,error){
+	//dst is often a stream to peers, a write that is cut short must fail.
+	dst = fullWriter{dst}
 	block,err:= aes.NewCipher(key)
 	if err!=nil{
 		return 0,err
 	}
-
-	iv:= make([]byte,block.BlockSize()) //16
-	if _,err:= io.ReadFull(rand.Reader,iv);err!=nil{
+	aead,err:= cipher.NewGCM(block)
+	if err!=nil{
 		return 0,err
 	}
 
-	//prepend IV to the file
-	if _,err:= dst.Write(iv);err!=nil{
+	header:= append(append([]byte{},cipherMagic...),cipherVersionKeyID)
+	header = append(append(header,keyFingerprint(keyID)...),nonce...)
+	if _,err:= dst.Write(header);err!=nil{
 		return 0,err
 	}
 
-	stream := cipher.NewCTR(block,iv)
-	return copyStream(stream,block.BlockSize(),src,dst)
-}
\ No newline at end of file
+	var(
+		buf = make([]byte,gcmSegmentSize,gcmSegmentSize+gcmTagSize)
+		nw = len(header)
+	)
+	for i:=uint64(0);;i++{
+		n,err:= io.ReadFull(src,buf)
+		last:= err==io.EOF || err==io.ErrUnexpectedEOF
+		if err!=nil && !last{
+			return 0,err
+		}
+		sealed:= aead.Seal(buf[:0],segmentNonce(nonce,i),buf[:n],segmentAD(last))
+		nn,err:= dst.Write(sealed)
+		if err!=nil{
+			return 0,err
+		}
+		nw+=nn
+		if last{
+			return nw,nil
+		}
+		buf = buf[:gcmSegmentSize]
+	}
+}
+
+//segmentNonce is the nonce of segment i, the base nonce with the index
+//mixed into its last bytes.
+func segmentNonce(nonce []byte,i uint64) []byte{
+	n:= append([]byte{},nonce...)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:],i)
+	for j,b:= range ctr{
+		n[NonceSize-8+j]^=b
+	}
+	return n
+}
+
+//segmentAD marks the last segment, so dropping the end of a file
+//fails the tag check.
+func segmentAD(last bool) []byte{
+	if last{
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+//segmentCount is the number of segments of an AES-GCM file of size
+//bytes, and plainSize the plain text they hold.
+func segmentCount(size int64) int64{
+	return (size-cipherHeaderSize+gcmSegmentSize+gcmTagSize-1)/(gcmSegmentSize+gcmTagSize)
+}
+
+func plainSize(size int64) int64{
+	return size-cipherHeaderSize-gcmTagSize*segmentCount(size)
+}
+
+//segmentSpan returns where segment i of an AES-GCM file of size bytes
+//starts and how long it is with its tag.
+func segmentSpan(i int64,size int64) (int64,int64){
+	off:= cipherHeaderSize+i*(gcmSegmentSize+gcmTagSize)
+	return off,min(gcmSegmentSize+gcmTagSize,size-off)
+}
+
+//segmentOpener opens single segments of an AES-GCM file with a key ID,
+//so a part of the file can be decrypted without reading what is before.
+type segmentOpener struct{
+	aead 	cipher.AEAD
+	nonce []byte
+	//last is the index of the last segment.
+	last 	int64
+}
+
+//newSegmentOpener reads the header of a file of size bytes and returns
+//its opener. Files without a key ID can only be read by copyDecrypt.
+func newSegmentOpener(keys *keyring,header []byte,size int64) (*segmentOpener,error){
+	if size<cipherHeaderSize+gcmTagSize || len(header)!=cipherHeaderSize || !bytes.Equal(header[:3],cipherMagic) || header[3]!=cipherVersionKeyID{
+		return nil,fmt.Errorf("not an AES-GCM file with a key ID")
+	}
+	key,ok:= keys.lookup(header[4:4+keyIDSize])
+	if !ok{
+		return nil,fmt.Errorf("no key for key ID %x in the keyring",header[4:4+keyIDSize])
+	}
+	block,err:= aes.NewCipher(key)
+	if err!=nil{
+		return nil,err
+	}
+	aead,err:= cipher.NewGCM(block)
+	if err!=nil{
+		return nil,err
+	}
+	return &segmentOpener{aead: aead,nonce: header[4+keyIDSize:],last: segmentCount(size)-1},nil
+}
+
+//open authenticates and decrypts segment i.
+func (o *segmentOpener) open(i int64,sealed []byte) ([]byte,error){
+	plain,err:= o.aead.Open(nil,segmentNonce(o.nonce,uint64(i)),sealed,segmentAD(i==o.last))
+	if err!=nil{
+		return nil,fmt.Errorf("segment %d failed authentication: %w",i,err)
+	}
+	return plain,nil
+}
@@ -2,6 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -10,22 +17,130 @@ func TestCopyEncryptDecrypt(t *testing.T){
 	src := bytes.NewReader([]byte(payload))
 	dst := new(bytes.Buffer)
 	key := newEncryptionKey()
-	_,err := copyEncrypt(key,src,dst)
+	_,err := copyEncrypt("",key,src,dst)
 	if err!=nil{
 		t.Error(err)
 	}
 
 	out := new(bytes.Buffer)
-	nw,err:= copyDecrypt(key,dst,out)
+	nw,err:= copyDecrypt(newKeyring(map[string][]byte{"": key},""),dst,out)
 	if err!=nil{
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload){
+	if int64(nw) != encryptedSize(int64(len(payload))){
 		t.Fail()
 	}
 
 	if out.String()!=payload{
 		t.Errorf("decryption failed!!!")
 	}
-}
\ No newline at end of file
+}
+
+func TestVerifyContentHash(t *testing.T){
+	data := []byte("some jpg bytes")
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+
+	if err:= verifyContentHash(key,bytes.NewReader(data));err!=nil{
+		t.Error(err)
+	}
+
+	if err:= verifyContentHash(key,bytes.NewReader([]byte("tampered bytes")));!errors.Is(err,ErrIntegrity){
+		t.Errorf("expected content hash mismatch, have %v",err)
+	}
+
+	//named keys are not content hashes and can't be verified
+	if err:= verifyContentHash("coolPicture.jpg",bytes.NewReader(data));err!=nil{
+		t.Error(err)
+	}
+}
+func TestCopyDecryptAuthenticates(t *testing.T){
+	key := newEncryptionKey()
+	for _,size := range []int{0,10,gcmSegmentSize,3*gcmSegmentSize+5}{
+		data := make([]byte,size)
+		rand.Read(data)
+		encrypted := new(bytes.Buffer)
+		if _,err := copyEncrypt("",key,bytes.NewReader(data),encrypted);err!=nil{
+			t.Fatal(err)
+		}
+
+		b := encrypted.Bytes()
+		tampered := append([]byte{},b...)
+		tampered[len(tampered)-1]^=1
+		if _,err := copyDecrypt(newKeyring(map[string][]byte{"": key},""),bytes.NewReader(tampered),io.Discard);!errors.Is(err,ErrIntegrity){
+			t.Errorf("size %d: expected a flipped bit to fail the tag check, have %v",size,err)
+		}
+		//Cutting the file at a segment boundary drops the last segment.
+		cut := b[:len(b)-gcmTagSize-size%gcmSegmentSize]
+		if _,err := copyDecrypt(newKeyring(map[string][]byte{"": key},""),bytes.NewReader(cut),io.Discard);err==nil{
+			t.Errorf("size %d: expected a truncated file to fail the tag check",size)
+		}
+	}
+}
+
+func TestCopyDecryptLegacyCTR(t *testing.T){
+	key := newEncryptionKey()
+	payload := []byte("encrypted before the header")
+	iv := make([]byte,IVSize)
+	rand.Read(iv)
+	block,err := aes.NewCipher(key)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	encrypted := bytes.NewBuffer(append([]byte{},iv...))
+	if _,err := copyStream(cipher.NewCTR(block,iv),IVSize,bytes.NewReader(payload),encrypted);err!=nil{
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	nr,err := copyDecrypt(newKeyring(map[string][]byte{"": key},""),encrypted,out)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if nr!=IVSize+len(payload) || !bytes.Equal(out.Bytes(),payload){
+		t.Errorf("legacy CTR file not decrypted: %q",out.Bytes())
+	}
+}
+
+func TestCopyDecryptKeyring(t *testing.T){
+	oldKey,newKey := newEncryptionKey(),newEncryptionKey()
+	keys := newKeyring(map[string][]byte{"old": oldKey},"old")
+
+	encrypted := new(bytes.Buffer)
+	if _,err := copyEncrypt("old",oldKey,bytes.NewReader([]byte("before the rotation")),encrypted);err!=nil{
+		t.Fatal(err)
+	}
+	keys.rotate("new",newKey)
+	if id,_,_ := keys.activeKey();id!="new"{
+		t.Errorf("want the rotated key active, have %q",id)
+	}
+
+	out := new(bytes.Buffer)
+	if _,err := copyDecrypt(keys,bytes.NewReader(encrypted.Bytes()),out);err!=nil{
+		t.Fatal(err)
+	}
+	if out.String()!="before the rotation"{
+		t.Errorf("decryption with the old key failed: %q",out.String())
+	}
+
+	if _,err := copyDecrypt(newKeyring(map[string][]byte{"new": newKey},"new"),bytes.NewReader(encrypted.Bytes()),io.Discard);err==nil{
+		t.Errorf("expected an error for a key missing from the keyring")
+	}
+}
+
+func BenchmarkCopyEncrypt(b *testing.B){
+	key:= newEncryptionKey()
+	for _,bs:= range benchSizes{
+		b.Run(bs.name,func(b *testing.B){
+			data:= randomBytes(b,bs.size)
+			b.SetBytes(int64(bs.size))
+			b.ResetTimer()
+			for i:=0;i<b.N;i++{
+				if _,err:= copyEncrypt("",key,bytes.NewReader(data),io.Discard);err!=nil{
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//StoreDir stores the directory at dirPath as one file under key, a tar
+//archive of its directories and regular files with their relative paths
+//and modes. The archive is streamed into Store as it is written. Other
+//files (symlinks, devices) fail the Store.
+func (s *FileServer) StoreDir(key string,dirPath string) error{
+	return s.StoreDirContext(context.Background(),key,dirPath)
+}
+
+func (s *FileServer) StoreDirContext(ctx context.Context,key string,dirPath string) error{
+	info,err:= os.Stat(dirPath)
+	if err!=nil{
+		return err
+	}
+	if !info.IsDir(){
+		return fmt.Errorf("%s is not a directory",dirPath)
+	}
+	pr,pw:= io.Pipe()
+	go func(){
+		pw.CloseWithError(writeTar(pw,dirPath))
+	}()
+	err = s.StoreContext(ctx,key,pr)
+	//Stops writeTar if the Store gave up early.
+	pr.CloseWithError(errors.New("store of the directory ended"))
+	return err
+}
+
+//GetDir fetches the directory StoreDir stored under key, like Get, and
+//extracts it into destPath. An entry that is absolute or leads out of
+//destPath fails the extract, the entries before it stay extracted.
+func (s *FileServer) GetDir(key string,destPath string) error{
+	return s.GetDirContext(context.Background(),key,destPath)
+}
+
+func (s *FileServer) GetDirContext(ctx context.Context,key string,destPath string) error{
+	r,err:= s.GetContext(ctx,key)
+	if err!=nil{
+		return err
+	}
+	if rc,ok:= r.(io.ReadCloser);ok{
+		defer rc.Close()
+	}
+	return extractTar(r,destPath)
+}
+
+//writeTar writes the directory at root to w as a tar archive.
+func writeTar(w io.Writer,root string) error{
+	tw:= tar.NewWriter(w)
+	err:= filepath.WalkDir(root,func(p string,d fs.DirEntry,err error) error{
+		if err!=nil{
+			return err
+		}
+		rel,err:= filepath.Rel(root,p)
+		if err!=nil || rel=="."{
+			return err
+		}
+		info,err:= d.Info()
+		if err!=nil{
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular(){
+			return fmt.Errorf("%s: only directories and regular files can be stored",p)
+		}
+		hdr,err:= tar.FileInfoHeader(info,"")
+		if err!=nil{
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir(){
+			hdr.Name+="/"
+		}
+		if err:= tw.WriteHeader(hdr);err!=nil{
+			return err
+		}
+		if info.IsDir(){
+			return nil
+		}
+		f,err:= os.Open(p)
+		if err!=nil{
+			return err
+		}
+		defer f.Close()
+		_,err = io.Copy(tw,f)
+		return err
+	})
+	if err!=nil{
+		return err
+	}
+	return tw.Close()
+}
+
+//extractTar extracts the tar archive r into dest, creating it if need be.
+func extractTar(r io.Reader,dest string) error{
+	if err:= os.MkdirAll(dest,os.ModePerm);err!=nil{
+		return err
+	}
+	//The modes of the directories are set last, a read only one would
+	//fail extracting its files.
+	var dirs []*tar.Header
+	tr:= tar.NewReader(r)
+	for{
+		hdr,err:= tr.Next()
+		if err==io.EOF{
+			for i:= len(dirs)-1;i>=0;i--{
+				p:= filepath.Join(dest,filepath.FromSlash(dirs[i].Name))
+				if err:= os.Chmod(p,fs.FileMode(dirs[i].Mode).Perm());err!=nil{
+					return err
+				}
+			}
+			return nil
+		}
+		if err!=nil{
+			return err
+		}
+		name:= filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name){
+			return fmt.Errorf("unsafe path %q in the archive",hdr.Name)
+		}
+		p:= filepath.Join(dest,name)
+		mode:= fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag{
+		case tar.TypeDir:
+			if err:= os.MkdirAll(p,os.ModePerm);err!=nil{
+				return err
+			}
+			dirs = append(dirs,hdr)
+		case tar.TypeReg:
+			if err:= os.MkdirAll(filepath.Dir(p),os.ModePerm);err!=nil{
+				return err
+			}
+			if err:= extractFile(tr,p,mode);err!=nil{
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported entry type %q in the archive",hdr.Name,hdr.Typeflag)
+		}
+	}
+}
+
+func extractFile(r io.Reader,p string,mode fs.FileMode) error{
+	f,err:= os.OpenFile(p,os.O_WRONLY|os.O_CREATE|os.O_TRUNC,mode)
+	if err!=nil{
+		return err
+	}
+	_,err = io.Copy(f,r)
+	if cerr:= f.Close();err==nil{
+		err = cerr
+	}
+	if err!=nil{
+		return err
+	}
+	//OpenFile leaves an existing file's mode alone, and the umask applies.
+	return os.Chmod(p,mode)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreDir(t *testing.T){
+	s:= newTestFileServer()
+	src:= t.TempDir()
+	files:= map[string]os.FileMode{"a.txt": 0644,"sub/b.sh": 0755,"sub/deeper/c": 0600}
+	for name,mode:= range files{
+		p:= filepath.Join(src,filepath.FromSlash(name))
+		if err:= os.MkdirAll(filepath.Dir(p),0755);err!=nil{
+			t.Fatal(err)
+		}
+		if err:= os.WriteFile(p,[]byte(name),mode);err!=nil{
+			t.Fatal(err)
+		}
+		//WriteFile is subject to the umask.
+		if err:= os.Chmod(p,mode);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if err:= os.Mkdir(filepath.Join(src,"empty"),0700);err!=nil{
+		t.Fatal(err)
+	}
+	if err:= s.StoreDir("dir",src);err!=nil{
+		t.Fatal(err)
+	}
+
+	dest:= filepath.Join(t.TempDir(),"out")
+	if err:= s.GetDir("dir",dest);err!=nil{
+		t.Fatal(err)
+	}
+	for name,mode:= range files{
+		p:= filepath.Join(dest,filepath.FromSlash(name))
+		b,err:= os.ReadFile(p)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if string(b)!=name{
+			t.Errorf("%s: want its name as content, have %q",name,b)
+		}
+		if info,_:= os.Stat(p);info.Mode().Perm()!=mode{
+			t.Errorf("%s: want mode %s, have %s",name,mode,info.Mode().Perm())
+		}
+	}
+	if info,err:= os.Stat(filepath.Join(dest,"empty"));err!=nil || !info.IsDir(){
+		t.Errorf("want the empty directory extracted, have %v",err)
+	}
+
+	if err:= s.StoreDir("file",filepath.Join(src,"a.txt"));err==nil{
+		t.Error("want an error storing a file as a directory")
+	}
+}
+
+func TestExtractTarRejectsUnsafePaths(t *testing.T){
+	for _,name:= range []string{"../escape","/etc/escape","sub/../../escape"}{
+		var buf bytes.Buffer
+		tw:= tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name,Mode: 0644,Size: 1,Typeflag: tar.TypeReg})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		dest:= filepath.Join(t.TempDir(),"out")
+		if err:= extractTar(&buf,dest);err==nil{
+			t.Errorf("%s: want an error for an entry outside the destination",name)
+		}
+		if _,err:= os.Stat(filepath.Join(filepath.Dir(dest),"escape"));err==nil{
+			t.Errorf("%s: want nothing written outside the destination",name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//drainPollInterval is how often Drain checks whether the transfers in
+//flight are done.
+const drainPollInterval = 10*time.Millisecond
+
+//Drain prepares the node to be stopped without losing files: it declines
+//the files peers want to store on it from now on, streams each of our
+//files that fewer peers hold than ReplicationFactor (at least one) to
+//them again until one confirmed its copy and waits for the transfers in
+//flight. The copies we hold for peers are left to their owners. The node
+//keeps serving Gets, Stop it once Drain returned.
+func (s *FileServer) Drain(ctx context.Context) error{
+	s.stopLock.Lock()
+	s.draining = true
+	s.stopLock.Unlock()
+	s.Logger.Infof("draining, no longer taking on files")
+
+	if err:= s.replicateUnique(ctx);err!=nil{
+		return err
+	}
+	ticker:= time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for{
+		s.stopLock.Lock()
+		inflight:= s.inflight
+		s.stopLock.Unlock()
+		if inflight==0{
+			return nil
+		}
+		select{
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *FileServer) isDraining() bool{
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	return s.draining
+}
+
+//replicateUnique replicates our files that are held by too few peers,
+//see Drain. Only the files with a key ID are known by their key.
+func (s *FileServer) replicateUnique(ctx context.Context) error{
+	keys,err:= s.ownKeys()
+	if err!=nil{
+		return err
+	}
+	var errs []error
+	for _,key:= range keys{
+		want:= 1
+		if s.ReplicationFactor>0{
+			want = min(s.ReplicationFactor,len(s.peerList()))
+		}
+		if _,err:= s.replicateMissing(ctx,key,want);err!=nil{
+			if ctx.Err()!=nil{
+				return ctx.Err()
+			}
+			errs = append(errs,err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,1692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//newTestCluster starts n FileServers on free loopback ports, every one
+//dialing the ones started before it, and waits until they are all
+//connected. configure can change the options of node i before it starts.
+func newTestCluster(t testing.TB,n int,configure func(i int,opts *FileServerOpts)) []*FileServer{
+	t.Helper()
+	var(
+		nodes []*FileServer
+		addrs []string
+	)
+	for i:=0;i<n;i++{
+		addr:= freeAddr(t)
+		tr:= p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	p2p.NOPHandshakeFunc,
+			Decoder: 				p2p.Defaultdecoder{},
+		})
+		opts:= FileServerOpts{
+			EncKey: 						newEncryptionKey(),
+			PathTransformFunc: 	CASpathTransformFunc,
+			Backend: 						NewMemoryBackend(),
+			Transport: 					tr,
+			BootstrapNodes: 		append([]string(nil),addrs...),
+			AckTimeout: 				500*time.Millisecond,
+			GossipInterval: 		-1,
+		}
+		if configure!=nil{
+			configure(i,&opts)
+		}
+		s:= NewFileServer(opts)
+		tr.HandshakeFunc = s.Handshake
+		tr.OnPeer = s.OnPeer
+		tr.OnPeerDisconnect = s.OnPeerDisconnect
+		started:= make(chan error,1)
+		go func(){
+			started <- s.Start()
+		}()
+		t.Cleanup(s.Stop)
+		nodes = append(nodes,s)
+		addrs = append(addrs,addr)
+
+		deadline:= time.Now().Add(5*time.Second)
+		for len(s.Peers())<i{
+			select{
+			case err:= <-started:
+				t.Fatalf("node %d: %v",i,err)
+			default:
+			}
+			if time.Now().After(deadline){
+				t.Fatalf("node %d: connected to %d of %d nodes",i,len(s.Peers()),i)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+	return nodes
+}
+
+//freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t testing.TB) string{
+	t.Helper()
+	l,err:= net.Listen("tcp","127.0.0.1:0")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+//storeReplicated stores data on s and waits until its n peers hold it.
+func storeReplicated(t testing.TB,s *FileServer,key string,data []byte,n int){
+	t.Helper()
+	if err:= s.Store(key,bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	deadline:= time.Now().Add(5*time.Second)
+	for{
+		holders,err:= s.WhoHas(key)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if len(holders)==n{
+			return
+		}
+		if time.Now().After(deadline){
+			t.Fatalf("%s: held by %v, want %d peers",key,holders,n)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+//requireContent reads r and fails unless it hashes to the hash of want.
+func requireContent(t *testing.T,r io.Reader,want []byte){
+	t.Helper()
+	if rc,ok:= r.(io.ReadCloser);ok{
+		defer rc.Close()
+	}
+	h:= sha256.New()
+	n,err:= io.Copy(h,r)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if sum:= sha256.Sum256(want);n!=int64(len(want)) || !bytes.Equal(h.Sum(nil),sum[:]){
+		t.Fatalf("want the %d bytes stored, have %d bytes with another hash",len(want),n)
+	}
+}
+
+func randomBytes(t testing.TB,n int) []byte{
+	t.Helper()
+	b:= make([]byte,n)
+	if _,err:= rand.Read(b);err!=nil{
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestClusterStoreAndFetch(t *testing.T){
+	nodes:= newTestCluster(t,3,nil)
+	a:= nodes[0]
+
+	for name,size:= range map[string]int{"small": 100,"large": 6<<20}{
+		t.Run(name,func(t *testing.T){
+			data:= randomBytes(t,size)
+			storeReplicated(t,a,name,data,2)
+			if err:= a.store.Delete(a.ID,name);err!=nil{
+				t.Fatal(err)
+			}
+			if a.store.Has(a.ID,name){
+				t.Fatal("want the local copy deleted")
+			}
+			r,err:= a.Get(name)
+			if err!=nil{
+				t.Fatal(err)
+			}
+			requireContent(t,r,data)
+			if !a.store.Has(a.ID,name){
+				t.Error("want the fetched file stored locally again")
+			}
+		})
+	}
+
+	t.Run("missing key",func(t *testing.T){
+		if _,err:= a.Get("never stored");!errors.Is(err,ErrNotFound){
+			t.Errorf("want %v for a key no node holds, have %v",ErrNotFound,err)
+		}
+	})
+}
+
+func TestClusterConcurrentStores(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a:= nodes[0]
+
+	//The streams of the Stores share the connection to the one peer.
+	files:= make([][]byte,4)
+	errs:= make([]error,len(files))
+	var wg sync.WaitGroup
+	for i:= range files{
+		files[i] = randomBytes(t,1<<20+i)
+		wg.Add(1)
+		go func(i int){
+			defer wg.Done()
+			errs[i] = a.Store(strings.Repeat("k",i+1),bytes.NewReader(files[i]))
+		}(i)
+	}
+	wg.Wait()
+	for i,data:= range files{
+		key:= strings.Repeat("k",i+1)
+		if errs[i]!=nil{
+			t.Fatal(errs[i])
+		}
+		deadline:= time.Now().Add(5*time.Second)
+		for holders,_:= a.WhoHas(key);len(holders)!=1;holders,_ = a.WhoHas(key){
+			if time.Now().After(deadline){
+				t.Fatalf("%s: held by %v, want the peer",key,holders)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+		if err:= a.store.Delete(a.ID,key);err!=nil{
+			t.Fatal(err)
+		}
+		r,err:= a.Get(key)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		requireContent(t,r,data)
+	}
+}
+
+func TestClusterPeerDisconnectsMidTransfer(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.ChunkSize = 256<<10
+		if i==0{
+			//Slow enough for the fetch to still run when b goes away.
+			opts.MaxDownloadBytesPerSec = 2<<20
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	data:= randomBytes(t,4<<20)
+	storeReplicated(t,a,"large",data,2)
+	if err:= a.store.Delete(a.ID,"large");err!=nil{
+		t.Fatal(err)
+	}
+
+	go func(){
+		time.Sleep(300*time.Millisecond)
+		for _,peer:= range b.peerList(){
+			peer.Close()
+		}
+	}()
+	r,err:= a.Get("large")
+	//The chunks b didn't send come from c, or else a resume fetches them.
+	var transferErr *TransferError
+	if errors.As(err,&transferErr){
+		r,err = a.ResumeGet(context.Background(),transferErr.Token)
+	}
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+}
+
+func TestClusterReadAt(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		if i==1{
+			opts.Compression = CompressionGzip
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	data:= randomBytes(t,5*gcmSegmentSize+100)
+	storeReplicated(t,a,"plain",data,2)
+	storeReplicated(t,b,"compressed",data,2)
+	for _,s:= range []*FileServer{a,b}{
+		for _,key:= range []string{"plain","compressed"}{
+			if err:= s.store.Delete(s.ID,key);err!=nil{
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _,tc:= range []struct{
+		off,length int64
+	}{
+		{0,10},
+		{2*gcmSegmentSize-5,10},
+		{gcmSegmentSize,3*gcmSegmentSize},
+		{int64(len(data))-3,10},
+	}{
+		r,err:= a.ReadAt("plain",tc.off,tc.length)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		end:= min(tc.off+tc.length,int64(len(data)))
+		if b,_:= io.ReadAll(r);!bytes.Equal(b,data[tc.off:end]){
+			t.Errorf("want %d bytes at %d, have %d other bytes",end-tc.off,tc.off,len(b))
+		}
+	}
+	if a.store.Has(a.ID,"plain"){
+		t.Error("want a ranged read to leave the file on the peers")
+	}
+	if _,err:= a.ReadAt("plain",int64(len(data)),1);err==nil{
+		t.Error("want an error for an offset beyond the end")
+	}
+
+	//A compressed copy is fetched whole.
+	r,err:= b.ReadAt("compressed",gcmSegmentSize,10)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if got,_:= io.ReadAll(r);!bytes.Equal(got,data[gcmSegmentSize:gcmSegmentSize+10]){
+		t.Errorf("want the 10 bytes at %d, have %x",gcmSegmentSize,got)
+	}
+	if !b.store.Has(b.ID,"compressed"){
+		t.Error("want the compressed file fetched and stored")
+	}
+}
+
+func TestClusterStoreDedup(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	data:= randomBytes(t,1000)
+	sum:= sha256.Sum256(data)
+	key:= hex.EncodeToString(sum[:])
+	storeReplicated(t,a,key,data,1)
+	storeReplicated(t,a,"named",data,1)
+
+	events:= b.Events()
+	for _,k:= range []string{key,"named"}{
+		if err:= a.store.Delete(a.ID,k);err!=nil{
+			t.Fatal(err)
+		}
+		storeReplicated(t,a,k,data,1)
+	}
+	//Only the file whose key doesn't name its content was streamed again.
+	var stored []string
+	for len(events)>0{
+		if ev:= <-events;ev.Type==EventFileStored{
+			stored = append(stored,ev.Key)
+		}
+	}
+	if len(stored)!=1 || stored[0]!=hashKey("named"){
+		t.Errorf("want only %s stored again, have %v",hashKey("named"),stored)
+	}
+	if err:= a.store.Delete(a.ID,key);err!=nil{
+		t.Fatal(err)
+	}
+	r,err:= a.Get(key)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+}
+
+//corruptingBackend appends a byte to the files it writes for origin.
+type corruptingBackend struct{
+	StorageBackend
+	origin string
+}
+
+func (b corruptingBackend) Write(p string,r io.Reader) (int64,error){
+	if strings.Contains(p,b.origin) && !isSidecar(p){
+		r = io.MultiReader(r,strings.NewReader("x"))
+	}
+	return b.StorageBackend.Write(p,r)
+}
+
+func TestClusterStoreAndConfirm(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		//The large file is streamed resumably.
+		opts.ChunkSize = 64<<10
+		switch i{
+		case 0:
+			opts.ID = "origin"
+		case 2:
+			opts.Backend = corruptingBackend{NewMemoryBackend(),"origin"}
+		}
+	})
+	a:= nodes[0]
+	if err:= a.StoreAndConfirm("large",bytes.NewReader(randomBytes(t,200<<10)),1);err!=nil{
+		t.Fatal(err)
+	}
+	data:= randomBytes(t,1000)
+	if err:= a.StoreAndConfirm("key",bytes.NewReader(data),1);err!=nil{
+		t.Fatal(err)
+	}
+	//The corrupt copy doesn't count.
+	err:= a.StoreAndConfirm("other",bytes.NewReader(data),2)
+	if !errors.Is(err,ErrNotConfirmed){
+		t.Errorf("want %v, have %v",ErrNotConfirmed,err)
+	}
+	if holders,_:= a.WhoHas("other");len(holders)!=2{
+		t.Errorf("want both peers holding a copy, have %v",holders)
+	}
+}
+
+func TestClusterMaxFileSize(t *testing.T){
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==1{
+			opts.MaxFileSize = 1000
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	storeReplicated(t,a,"small",randomBytes(t,500),1)
+
+	events:= b.Events()
+	a.Store("large",bytes.NewReader(randomBytes(t,5000)))
+	timeout:= time.After(5*time.Second)
+	for dropped:= false;!dropped;{
+		select{
+		case ev:= <-events:
+			dropped = ev.Type==EventPeerDisconnected
+		case <-timeout:
+			t.Fatal("want the peer announcing the large file dropped")
+		}
+	}
+	if b.store.Has(a.ID,hashKey("large")){
+		t.Error("want the file larger than MaxFileSize turned down")
+	}
+}
+
+func TestClusterPeerSelector(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.PeerSelector = RandomSelector{N: 1}
+	})
+	a:= nodes[0]
+	data:= randomBytes(t,1000)
+	storeReplicated(t,a,"key",data,1)
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	//The Get asks one random peer, the holder or the other.
+	for i:=0;;i++{
+		r,err:= a.Get("key")
+		if errors.Is(err,ErrNotFound) && i<50{
+			continue
+		}
+		if err!=nil{
+			t.Fatal(err)
+		}
+		requireContent(t,r,data)
+		return
+	}
+}
+
+func TestClusterStoreDiskFull(t *testing.T){
+	backend:= &failingBackend{StorageBackend: NewMemoryBackend(),err: syscall.ENOSPC}
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==0{
+			opts.ID = "full"
+			opts.Backend = backend
+		}
+	})
+	a:= nodes[0]
+	//Fails the file, then only its expiry which removes the file again.
+	for _,suffix:= range []string{"",expirySuffix}{
+		backend.fail = func(p string) bool{
+			return strings.Contains(p,a.ID) && strings.HasSuffix(p,suffix)
+		}
+		err:= a.StoreWithTTL("key",bytes.NewReader([]byte("some content")),time.Hour)
+		if !errors.Is(err,ErrDiskFull){
+			t.Fatalf("want %v, have %v",ErrDiskFull,err)
+		}
+		if a.store.Has(a.ID,"key"){
+			t.Error("want nothing stored locally")
+		}
+		if holders,err:= a.WhoHas("key");err!=nil || len(holders)>0{
+			t.Errorf("want the file never replicated, have %v (%v)",holders,err)
+		}
+	}
+}
+
+func TestClusterStatus(t *testing.T){
+	nodes:= newTestCluster(t,3,nil)
+	a:= nodes[0]
+	storeReplicated(t,a,"key",[]byte("some content"),2)
+
+	peers:= a.Peers()
+	report,err:= a.PeerStatus(peers[0])
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if report.Version!=Version || report.Files!=1 || report.Bytes==0 || report.Peers!=2 || report.Uptime<=0{
+		t.Errorf("want a peer with one file and two peers, have %+v",report)
+	}
+	if _,err:= a.PeerStatus("127.0.0.1:1");!errors.Is(err,ErrPeerNotFound){
+		t.Errorf("want %v for a peer that isn't connected, have %v",ErrPeerNotFound,err)
+	}
+
+	srv:= httptest.NewServer(NewGateway(a))
+	defer srv.Close()
+	_,body:= doRequest(t,http.MethodGet,srv.URL+"/status?network=true","")
+	var reports []StatusReport
+	if err:= json.Unmarshal([]byte(body),&reports);err!=nil{
+		t.Fatal(err)
+	}
+	if len(reports)!=3 || reports[0].Addr!=a.Transport.Addr(){
+		t.Errorf("want the reports of all 3 nodes starting with a, have %+v",reports)
+	}
+}
+
+func TestClusterGetRetries(t *testing.T){
+	//late is a restarted a: same ID and key, nothing stored.
+	id,key:= generateID(),newEncryptionKey()
+	sameNode:= func(i int,opts *FileServerOpts){
+		opts.ID,opts.EncKey = id,key
+	}
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==0{
+			sameNode(i,opts)
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	data:= []byte("held by b")
+	storeReplicated(t,a,"key",data,1)
+
+	late:= newTestCluster(t,1,sameNode)[0]
+	if _,err:= late.Get("key");!errors.Is(err,ErrNotFound) || !errors.Is(err,ErrNoPeers){
+		t.Fatalf("want %v and %v without peers, have %v",ErrNotFound,ErrNoPeers,err)
+	}
+	//The Get asks until late is connected to b.
+	late.GetRetries = 40
+	late.GetRetryInterval = 50*time.Millisecond
+	go func(){
+		time.Sleep(200*time.Millisecond)
+		late.Transport.Dial(b.Transport.Addr())
+	}()
+	r,err:= late.Get("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+}
+
+//BenchmarkNetworkTransfer measures a Get of a file held by a peer over
+//loopback TCP: the request, the stream, decrypting and storing it.
+func BenchmarkNetworkTransfer(b *testing.B){
+	nodes:= newTestCluster(b,2,nil)
+	a:= nodes[0]
+	for _,bs:= range benchSizes{
+		b.Run(bs.name,func(b *testing.B){
+			storeReplicated(b,a,bs.name,randomBytes(b,bs.size),1)
+			b.SetBytes(int64(bs.size))
+			b.ResetTimer()
+			for i:=0;i<b.N;i++{
+				b.StopTimer()
+				if err:= a.store.Delete(a.ID,bs.name);err!=nil{
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				r,err:= a.Get(bs.name)
+				if err!=nil{
+					b.Fatal(err)
+				}
+				if _,err:= io.Copy(io.Discard,r);err!=nil{
+					b.Fatal(err)
+				}
+				r.(io.ReadCloser).Close()
+			}
+		})
+	}
+}
+
+func BenchmarkTransferBufferSize(b *testing.B){
+	const size = 16<<20
+	data:= randomBytes(b,size)
+	for _,bs:= range []struct{
+		name string
+		size int
+	}{{"32KB",32<<10},{"1MB",1<<20}}{
+		b.Run(bs.name,func(b *testing.B){
+			nodes:= newTestCluster(b,2,func(i int,opts *FileServerOpts){
+				opts.TransferBufferSize = bs.size
+				opts.ChunkSize = -1
+			})
+			a:= nodes[0]
+			storeReplicated(b,a,"buffered",data,1)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i:=0;i<b.N;i++{
+				b.StopTimer()
+				if err:= a.store.Delete(a.ID,"buffered");err!=nil{
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				r,err:= a.Get("buffered")
+				if err!=nil{
+					b.Fatal(err)
+				}
+				if _,err:= io.Copy(io.Discard,r);err!=nil{
+					b.Fatal(err)
+				}
+				r.(io.ReadCloser).Close()
+			}
+		})
+	}
+}
+
+//tapProxy forwards the connections to addr it accepts and records what
+//addr sends back.
+type tapProxy struct{
+	mu 		sync.Mutex
+	seen 	bytes.Buffer
+}
+
+func (p *tapProxy) Write(b []byte) (int,error){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen.Write(b)
+}
+
+func (p *tapProxy) contains(b []byte) bool{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return bytes.Contains(p.seen.Bytes(),b)
+}
+
+func startTapProxy(t testing.TB,addr string) (*tapProxy,string){
+	l,err:= net.Listen("tcp","127.0.0.1:0")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	t.Cleanup(func(){ l.Close() })
+	p:= &tapProxy{}
+	go func(){
+		for{
+			conn,err:= l.Accept()
+			if err!=nil{
+				return
+			}
+			remote,err:= net.Dial("tcp",addr)
+			if err!=nil{
+				conn.Close()
+				continue
+			}
+			go func(){
+				io.Copy(remote,conn)
+				remote.Close()
+			}()
+			go func(){
+				io.Copy(io.MultiWriter(conn,p),remote)
+				conn.Close()
+			}()
+		}
+	}()
+	return p,l.Addr().String()
+}
+
+func TestClusterNeverSendsPlaintext(t *testing.T){
+	var tap *tapProxy
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==1{
+			//b reaches a through the tap only.
+			var addr string
+			tap,addr = startTapProxy(t,opts.BootstrapNodes[0])
+			opts.BootstrapNodes = []string{addr}
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	ours:= randomBytes(t,100<<10)
+	theirs:= randomBytes(t,100<<10)
+	if err:= a.Store("ours",bytes.NewReader(ours));err!=nil{
+		t.Fatal(err)
+	}
+	storeReplicated(t,b,"theirs",theirs,1)
+	if err:= b.store.Delete(b.ID,"theirs");err!=nil{
+		t.Fatal(err)
+	}
+
+	//a serves b the copy b encrypted, as it is on disk.
+	r,err:= b.Get("theirs")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,theirs)
+	//A peer asking for a's own file by its plain key gets nothing.
+	for _,payload:= range []any{
+		MessageGetFile{ID: a.ID,Key: "ours"},
+		MessageGetRange{RequestID: "ours",ID: a.ID,Key: "ours",Offset: 1,Length: 10},
+	}{
+		if err:= b.send(b.peerList()[0],&Message{Payload: payload});err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if holders,err:= b.whoHas(context.Background(),"ours",b.peerList(),nil);err!=nil || len(holders)>0{
+		t.Errorf("want a to deny holding its own file, have %v (%v)",holders,err)
+	}
+
+	for name,data:= range map[string][]byte{"ours": ours,"theirs": theirs}{
+		if tap.contains(data[:1<<10]) || tap.contains(data[len(data)-1<<10:]){
+			t.Errorf("a sent the plain bytes of %s",name)
+		}
+	}
+}
+
+func TestClusterBootstrapTimeout(t *testing.T){
+	//A node that can reach its bootstrap node starts as before.
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.BootstrapTimeout = 2*time.Second
+	})
+	if len(nodes[1].Peers())!=1{
+		t.Fatalf("want 1 peer, have %d",len(nodes[1].Peers()))
+	}
+
+	dead:= freeAddr(t)
+	tr:= p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: 		freeAddr(t),
+		HandshakeFunc: 	p2p.NOPHandshakeFunc,
+		Decoder: 				p2p.Defaultdecoder{},
+	})
+	s:= NewFileServer(FileServerOpts{
+		EncKey: 							newEncryptionKey(),
+		PathTransformFunc: 		CASpathTransformFunc,
+		Backend: 							NewMemoryBackend(),
+		Transport: 						tr,
+		BootstrapNodes: 			[]string{dead},
+		BootstrapTimeout: 		time.Second,
+		ReconnectBaseDelay: 	10*time.Millisecond,
+		MaxReconnectAttempts: 2,
+		GossipInterval: 			-1,
+	})
+	tr.OnPeer = s.OnPeer
+	t.Cleanup(s.Stop)
+	started:= make(chan error,1)
+	go func(){
+		started <- s.Start()
+	}()
+	select{
+	case err:= <-started:
+		var bootErr *BootstrapError
+		if !errors.As(err,&bootErr){
+			t.Fatalf("want a BootstrapError, have %v",err)
+		}
+		if bootErr.Results[dead]==nil{
+			t.Errorf("want the dial error of %s, have %v",dead,bootErr.Results)
+		}
+	case <-time.After(5*time.Second):
+		t.Fatal("Start didn't return")
+	}
+}
+
+func TestClusterOnFileStored(t *testing.T){
+	type stored struct{
+		key 				string
+		size 				int64
+		fromNetwork bool
+	}
+	calls:= make(chan stored,8)
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.OnFileStored = func(key string,size int64,fromNetwork bool){
+			if i==0{
+				panic("hook failed")
+			}
+			calls <- stored{key,size,fromNetwork}
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	next:= func() stored{
+		t.Helper()
+		select{
+		case c:= <-calls:
+			return c
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for the hook")
+		}
+		return stored{}
+	}
+
+	//A panicking hook doesn't get in the way of the store.
+	data:= randomBytes(t,1000)
+	storeReplicated(t,a,"theirs",data,1)
+	if c:= next();c.key!=hashKey("theirs") || !c.fromNetwork || c.size==0{
+		t.Errorf("want the copy of a stored from the network, have %+v",c)
+	}
+
+	if err:= b.Store("mine",bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	if c:= next();c.key!="mine" || c.fromNetwork{
+		t.Errorf("want the local store, have %+v",c)
+	}
+	if err:= b.store.Delete(b.ID,"mine");err!=nil{
+		t.Fatal(err)
+	}
+	r,err:= b.Get("mine")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+	if c:= next();c.key!="mine" || !c.fromNetwork{
+		t.Errorf("want the fetched file, have %+v",c)
+	}
+}
+
+func TestClusterSavedPeers(t *testing.T){
+	backend:= NewMemoryBackend()
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==1{
+			opts.Backend = backend
+		}
+	})
+	a,b:= nodes[0],nodes[1]
+	saved:= func() map[string]int{
+		t.Helper()
+		peers:= make(map[string]int)
+		_,r,err:= backend.Read(peersFile)
+		if err!=nil{
+			return peers
+		}
+		defer r.Close()
+		if err:= json.NewDecoder(r).Decode(&peers);err!=nil{
+			t.Fatal(err)
+		}
+		return peers
+	}
+	waitFor:= func(what string,done func() bool){
+		t.Helper()
+		deadline:= time.Now().Add(5*time.Second)
+		for !done(){
+			if time.Now().After(deadline){
+				t.Fatalf("timed out waiting for %s",what)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+	waitFor("a to be saved",func() bool{
+		_,ok:= saved()[a.Transport.Addr()]
+		return ok
+	})
+	b.Stop()
+
+	//A restarted node dials its saved peers without bootstrap nodes, one
+	//that keeps failing is forgotten.
+	dead:= freeAddr(t)
+	peers:= saved()
+	peers[dead] = 1
+	buf,_:= json.Marshal(peers)
+	if _,err:= backend.Write(peersFile,bytes.NewReader(buf));err!=nil{
+		t.Fatal(err)
+	}
+	restarted:= newTestCluster(t,1,func(i int,opts *FileServerOpts){
+		opts.Backend = backend
+		opts.MaxReconnectAttempts = 1
+		opts.MaxPeerFailures = 2
+	})[0]
+	waitFor("a to be dialed",func() bool{
+		return len(restarted.Peers())==1
+	})
+	waitFor("the dead peer to be forgotten",func() bool{
+		_,ok:= saved()[dead]
+		return !ok
+	})
+	if _,ok:= saved()[a.Transport.Addr()];!ok{
+		t.Errorf("want a still saved, have %v",saved())
+	}
+}
+
+func TestClusterRemoteHash(t *testing.T){
+	nodes:= newTestCluster(t,3,nil)
+	a:= nodes[0]
+	storeReplicated(t,a,"key",randomBytes(t,100<<10),2)
+
+	//Both peers hold the copy a streamed them.
+	size,r,err:= nodes[1].store.readStream(a.ID,hashKey("key"))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	r.Close()
+	var sums []string
+	for _,addr:= range a.Peers(){
+		sum,n,err:= a.RemoteHash("key",addr)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if n!=size || len(sum)!=64{
+			t.Errorf("want the hash of the %d byte copy, have %q of %d bytes",size,sum,n)
+		}
+		sums = append(sums,sum)
+	}
+	if sums[0]!=sums[1]{
+		t.Errorf("want the copies to hash the same, have %v",sums)
+	}
+	if _,_,err:= a.RemoteHash("missing",a.Peers()[0]);!errors.Is(err,ErrNotFound){
+		t.Errorf("want %v, have %v",ErrNotFound,err)
+	}
+}
+
+func TestClusterDrain(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	data:= randomBytes(t,1000)
+	storeReplicated(t,a,"unique",data,1)
+	storeReplicated(t,a,"replicated",data,1)
+	//b lost its copy of one of them, a is the only one holding it.
+	if err:= b.store.Delete(a.ID,hashKey("unique"));err!=nil{
+		t.Fatal(err)
+	}
+
+	ctx,cancel:= context.WithTimeout(context.Background(),5*time.Second)
+	defer cancel()
+	if err:= a.Drain(ctx);err!=nil{
+		t.Fatal(err)
+	}
+	if !b.store.Has(a.ID,hashKey("unique")){
+		t.Error("want the file only a held replicated by the drain")
+	}
+
+	//A draining node doesn't take on files anymore.
+	if err:= b.Drain(ctx);err!=nil{
+		t.Fatal(err)
+	}
+	if err:= a.Store("new",bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	if b.store.Has(a.ID,hashKey("new")){
+		t.Error("want the draining node to decline the file")
+	}
+}
+
+func TestClusterMeta(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	//waitMeta waits until b's copy has the metadata want.
+	waitMeta:= func(want map[string]string){
+		t.Helper()
+		deadline:= time.Now().Add(5*time.Second)
+		for{
+			meta,err:= b.store.Meta(a.ID,hashKey("key"))
+			if err!=nil{
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(meta,want){
+				return
+			}
+			if time.Now().After(deadline){
+				t.Fatalf("want the peer's metadata %v, have %v",want,meta)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+
+	meta:= map[string]string{MetaContentType: "text/plain","name": "notes.txt"}
+	if err:= a.StoreWithMeta("key",bytes.NewReader(randomBytes(t,1000)),meta);err!=nil{
+		t.Fatal(err)
+	}
+	if have,err:= a.Meta("key");err!=nil || !reflect.DeepEqual(have,meta){
+		t.Errorf("want %v, have %v %v",meta,have,err)
+	}
+	waitMeta(meta)
+
+	//The metadata can change, the file can't.
+	meta = map[string]string{MetaContentType: "text/markdown"}
+	if err:= a.SetMeta("key",meta);err!=nil{
+		t.Fatal(err)
+	}
+	waitMeta(meta)
+	if err:= a.SetMeta("key",nil);err!=nil{
+		t.Fatal(err)
+	}
+	waitMeta(map[string]string{})
+
+	if _,err:= a.Meta("missing");!errors.Is(err,ErrNotFound){
+		t.Errorf("want %v, have %v",ErrNotFound,err)
+	}
+	large:= map[string]string{"large": strings.Repeat("x",maxMetaBytes)}
+	if err:= a.SetMeta("key",large);!errors.Is(err,ErrMetaTooLarge){
+		t.Errorf("want %v, have %v",ErrMetaTooLarge,err)
+	}
+}
+
+func TestClusterSelfTest(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	report:= a.RunSelfTest(context.Background())
+	if err:= report.Err();err!=nil{
+		t.Fatalf("%s\n%s",err,report)
+	}
+	if len(report.Stages)!=4 || report.Stages[2].Skipped{
+		t.Errorf("want the peer round-trip to run, have\n%s",report)
+	}
+	//The test file is gone everywhere.
+	deadline:= time.Now().Add(5*time.Second)
+	for a.store.Has(a.ID,report.Key) || b.store.Has(a.ID,hashKey(report.Key)){
+		if time.Now().After(deadline){
+			t.Fatal("want the test file deleted")
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+
+	//Alone the peer round-trip is skipped, that is no failure.
+	alone:= newTestFileServer()
+	report = alone.RunSelfTest(context.Background())
+	if err:= report.Err();err!=nil || !report.Stages[2].Skipped{
+		t.Errorf("want only the peer round-trip skipped, have %v\n%s",err,report)
+	}
+}
+
+func TestClusterReplicate(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.ReplicationFactor = 2
+	})
+	a:= nodes[0]
+	storeReplicated(t,a,"key",randomBytes(t,1000),2)
+	//Both peers lost their copies.
+	for _,peer:= range nodes[1:]{
+		if err:= peer.store.Delete(a.ID,hashKey("key"));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if placed,err:= a.Replicate("key");err!=nil || placed!=2{
+		t.Fatalf("want 2 copies placed, have %d %v",placed,err)
+	}
+	if placed,err:= a.Replicate("key");err!=nil || placed!=0{
+		t.Errorf("want nothing to place, have %d %v",placed,err)
+	}
+	if _,err:= a.Replicate("missing");!errors.Is(err,ErrNotFound){
+		t.Errorf("want %v, have %v",ErrNotFound,err)
+	}
+
+	//The background Replicate heals a lost copy on its own.
+	nodes = newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.ReplicateInterval = 20*time.Millisecond
+	})
+	a,b:= nodes[0],nodes[1]
+	storeReplicated(t,a,"key",randomBytes(t,1000),1)
+	if err:= b.store.Delete(a.ID,hashKey("key"));err!=nil{
+		t.Fatal(err)
+	}
+	deadline:= time.Now().Add(5*time.Second)
+	for !b.store.Has(a.ID,hashKey("key")){
+		if time.Now().After(deadline){
+			t.Fatal("want the lost copy replicated again")
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterSequentialStores(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	//Each file takes more frames than a stream holds back, the read loop
+	//of b only gets to the second one if the first stream was closed.
+	first,second:= randomBytes(t,3<<20),randomBytes(t,3<<20)
+	done:= make(chan error,1)
+	go func(){
+		if err:= a.StoreAndConfirm("first",bytes.NewReader(first),1);err!=nil{
+			done <- err
+			return
+		}
+		done <- a.StoreAndConfirm("second",bytes.NewReader(second),1)
+	}()
+	select{
+	case err:= <-done:
+		if err!=nil{
+			t.Fatal(err)
+		}
+	case <-time.After(10*time.Second):
+		t.Fatal("timed out, the second Store is stuck behind the first")
+	}
+	for key,want:= range map[string][]byte{"first": first,"second": second}{
+		if err:= a.store.Delete(a.ID,key);err!=nil{
+			t.Fatal(err)
+		}
+		r,err:= a.Get(key)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		requireContent(t,r,want)
+	}
+	if !b.store.Has(a.ID,hashKey("second")){
+		t.Error("want the peer to hold the second file")
+	}
+}
+
+func TestClusterEncryptionLayers(t *testing.T){
+	for _,test:= range []struct{
+		name 				string
+		atRest 			bool
+		inTransit 	bool
+	}{
+		{"in transit only",false,true},
+		{"at rest and in transit",true,true},
+		{"at rest only",true,false},
+		{"none",false,false},
+	}{
+		t.Run(test.name,func(t *testing.T){
+			nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+				opts.EncKey = nil
+				if test.inTransit{
+					opts.InTransitKey = newEncryptionKey()
+				}
+				if test.atRest{
+					opts.AtRestKey = newEncryptionKey()
+				}
+			})
+			a,b:= nodes[0],nodes[1]
+			data:= bytes.Repeat([]byte("layered plain text "),1000)
+			holders:= 0
+			if test.inTransit{
+				holders = 1
+			}
+			storeReplicated(t,a,"key",data,holders)
+
+			//Neither copy shows the plain text unless nothing encrypts it.
+			raw:= func(s *FileServer,key string) []byte{
+				t.Helper()
+				_,r,err:= s.store.Backend.Read(s.store.backendPath(a.ID,key))
+				if err!=nil{
+					t.Fatal(err)
+				}
+				defer r.Close()
+				b,_:= io.ReadAll(r)
+				return b
+			}
+			if plain:= bytes.Contains(raw(a,"key"),data[:64]);plain==test.atRest{
+				t.Errorf("want our copy encrypted %v, have the plain text %v",test.atRest,plain)
+			}
+			r,err:= a.Get("key")
+			if err!=nil{
+				t.Fatal(err)
+			}
+			requireContent(t,r,data)
+
+			if !test.inTransit{
+				if b.store.Has(a.ID,hashKey("key")){
+					t.Error("want no copy sent without an in-transit key")
+				}
+				return
+			}
+			if bytes.Contains(raw(b,hashKey("key")),data[:64]){
+				t.Error("want the peer's copy encrypted")
+			}
+			//Without our copy the file comes back from the peer.
+			if err:= a.store.Delete(a.ID,"key");err!=nil{
+				t.Fatal(err)
+			}
+			r,err = a.Get("key")
+			if err!=nil{
+				t.Fatal(err)
+			}
+			requireContent(t,r,data)
+		})
+	}
+}
+
+func TestClusterGetStream(t *testing.T){
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.SendTimeout = 200*time.Millisecond
+	})
+	a:= nodes[0]
+	data:= randomBytes(t,3<<20)
+	storeReplicated(t,a,"key",data,1)
+	waitStored:= func(){
+		t.Helper()
+		deadline:= time.Now().Add(5*time.Second)
+		for !a.store.Has(a.ID,"key"){
+			if time.Now().After(deadline){
+				t.Fatal("want the streamed file stored")
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	r,info,err:= a.GetStream("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if info.Size!=-1 || !info.FromNetwork{
+		t.Errorf("want an unknown size from the network, have %+v",info)
+	}
+	requireContent(t,r,data)
+	waitStored()
+	//Now the copy is local, its size is known.
+	r,info,err = a.GetStream("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if info.Size!=int64(len(data)) || info.FromNetwork{
+		t.Errorf("want the local %d bytes, have %+v",len(data),info)
+	}
+	requireContent(t,r,data)
+
+	//A reader closed early still leaves the file stored.
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	r,_,err = a.GetStream("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if _,err:= io.ReadFull(r,make([]byte,10));err!=nil{
+		t.Fatal(err)
+	}
+	r.Close()
+	waitStored()
+	got,err:= a.Get("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,got,data)
+
+	//A HEAD of the gateway finds the file without fetching it.
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	srv:= httptest.NewServer(NewGateway(a))
+	defer srv.Close()
+	if resp,_:= doRequest(t,http.MethodHead,srv.URL+"/file/key","");resp.StatusCode!=http.StatusOK{
+		t.Errorf("want HEAD to find the file on the peer, have %s",resp.Status)
+	}
+	if resp,_:= doRequest(t,http.MethodHead,srv.URL+"/file/missing","");resp.StatusCode!=http.StatusNotFound{
+		t.Errorf("want HEAD of a missing file not found, have %s",resp.Status)
+	}
+	time.Sleep(100*time.Millisecond)
+	if a.store.Has(a.ID,"key"){
+		t.Error("want HEAD not to fetch the file")
+	}
+
+	//A reader nobody reads fails once it fell behind, the file is stored
+	//all the same.
+	r,_,err = a.GetStream("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	defer r.Close()
+	waitStored()
+	if _,err:= io.ReadAll(r);!errors.Is(err,errReaderStalled){
+		t.Errorf("want %v, have %v",errReaderStalled,err)
+	}
+}
+
+func TestClusterAdvertiseAddr(t *testing.T){
+	//Peers reach a only at its advertised address, like through a port
+	//mapping, b passes that one on after a dialed it.
+	advertised:= freeAddr(t)
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		if i==1{
+			opts.Transport.(*p2p.TCPTransport).AdvertiseAddr = advertised
+		}
+		opts.GossipInterval = 0
+	})
+	b,a:= nodes[0],nodes[1]
+	if a.Transport.Addr()!=advertised{
+		t.Fatalf("want %s, have %s",advertised,a.Transport.Addr())
+	}
+	deadline:= time.Now().Add(5*time.Second)
+	for !reflect.DeepEqual(b.peerListMessage().Addrs,[]string{advertised}){
+		if time.Now().After(deadline){
+			t.Fatalf("want a gossiped at %s, have %v",advertised,b.peerListMessage().Addrs)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterImport(t *testing.T){
+	nodes:= newTestCluster(t,2,nil)
+	a,b:= nodes[0],nodes[1]
+	dir:= t.TempDir()
+	files:= map[string][]byte{
+		"a.txt": 				randomBytes(t,1000),
+		"sub/b.txt": 		randomBytes(t,2000),
+		"sub/deep/c": 	randomBytes(t,10),
+		"same.txt": 		nil,
+	}
+	files["same.txt"] = files["a.txt"]
+	for rel,data:= range files{
+		p:= filepath.Join(dir,filepath.FromSlash(rel))
+		if err:= os.MkdirAll(filepath.Dir(p),0o755);err!=nil{
+			t.Fatal(err)
+		}
+		if err:= os.WriteFile(p,data,0o644);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	manifestPath:= filepath.Join(dir,"manifest.json")
+	opts:= ImportOpts{Concurrency: 2,ManifestPath: manifestPath,SkipExisting: true}
+	manifest,err:= a.Import(dir,opts)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(manifest)!=len(files){
+		t.Fatalf("want %d files in the manifest, have %v",len(files),manifest)
+	}
+	for rel,data:= range files{
+		sum:= sha256.Sum256(data)
+		key:= hex.EncodeToString(sum[:])
+		if manifest[rel]!=key{
+			t.Errorf("%s: want key %s, have %s",rel,key,manifest[rel])
+		}
+		//The peer stores its copy after the Store returned.
+		deadline:= time.Now().Add(5*time.Second)
+		for !b.store.Has(a.ID,hashKey(key)){
+			if time.Now().After(deadline){
+				t.Fatalf("%s: want a copy on the peer",rel)
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+	written,err:= readManifest(manifestPath)
+	if err!=nil || !reflect.DeepEqual(written,manifest){
+		t.Errorf("want the manifest written, have %v %v",written,err)
+	}
+
+	//Resuming stores only what is missing, the manifest itself isn't.
+	lost:= manifest["sub/b.txt"]
+	if err:= a.store.Delete(a.ID,lost);err!=nil{
+		t.Fatal(err)
+	}
+	again,err:= a.Import(dir,opts)
+	if err!=nil || !reflect.DeepEqual(again,manifest){
+		t.Fatalf("want the same manifest, have %v %v",again,err)
+	}
+	if !a.store.Has(a.ID,lost){
+		t.Error("want the lost file imported again")
+	}
+
+	if _,err:= a.Import(filepath.Join(dir,"a.txt"),ImportOpts{});err==nil{
+		t.Error("want an error importing a file")
+	}
+}
+
+func TestClusterMaxInflightStores(t *testing.T){
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.MaxInflightStores = 1
+		opts.MaxInflightBytes = 1<<20
+	})
+	a:= nodes[0]
+	//The first Store holds the only slot while its reader blocks.
+	pr,pw:= io.Pipe()
+	first:= make(chan error,1)
+	go func(){
+		first <- a.Store("first",pr)
+	}()
+	if _,err:= pw.Write(randomBytes(t,100));err!=nil{
+		t.Fatal(err)
+	}
+	ctx,cancel:= context.WithTimeout(context.Background(),100*time.Millisecond)
+	defer cancel()
+	if err:= a.StoreContext(ctx,"second",bytes.NewReader(randomBytes(t,100)));!errors.Is(err,context.DeadlineExceeded){
+		t.Fatalf("want the second Store to wait for the slot, have %v",err)
+	}
+	if a.store.Has(a.ID,"second"){
+		t.Error("want nothing of the second Store written")
+	}
+	pw.Close()
+	if err:= <-first;err!=nil{
+		t.Fatal(err)
+	}
+	//A file over MaxInflightBytes is still replicated, alone.
+	storeReplicated(t,a,"second",randomBytes(t,2<<20),1)
+}
+
+func TestClusterGetFragments(t *testing.T){
+	nodes:= newTestCluster(t,3,nil)
+	a,b,c:= nodes[0],nodes[1],nodes[2]
+	data:= randomBytes(t,100<<10)
+	storeReplicated(t,a,"key",data,2)
+	_,r,err:= b.store.Read(a.ID,hashKey("key"))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	copyBytes,err:= io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	size,half:= int64(len(copyBytes)),int64(len(copyBytes)/2)
+
+	//b got the first half of the copy before its Store failed, c the rest.
+	partial:= func(s *FileServer,ranges ...ByteRange){
+		t.Helper()
+		if err:= s.store.Delete(a.ID,hashKey("key"));err!=nil{
+			t.Fatal(err)
+		}
+		path:= s.spoolPath(a.ID,hashKey("key"))
+		t.Cleanup(func(){
+			os.Remove(path)
+			os.Remove(s.partialPath(a.ID,hashKey("key")))
+		})
+		if err:= os.WriteFile(path,copyBytes,0o600);err!=nil{
+			t.Fatal(err)
+		}
+		s.setPartial(a.ID,hashKey("key"),partialCopy{Size: size,Ranges: ranges})
+	}
+	partial(b,ByteRange{Offset: 0,Length: half})
+	partial(c,ByteRange{Offset: half,Length: size-half})
+
+	holders,err:= a.WhoHasRanges("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(holders)!=2 || holders[0].Complete() || holders[1].Complete(){
+		t.Fatalf("want two partial holders, have %+v",holders)
+	}
+	if holders,err:= a.WhoHas("key");err!=nil || len(holders)!=0{
+		t.Errorf("want no peer holding all of it, have %v %v",holders,err)
+	}
+
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	r2,err:= a.Get("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r2,data)
+
+	//With a byte missing between the parts the file can't be assembled.
+	if err:= a.store.Delete(a.ID,"key");err!=nil{
+		t.Fatal(err)
+	}
+	c.setPartial(a.ID,hashKey("key"),partialCopy{Size: size,Ranges: []ByteRange{{Offset: half+1,Length: size-half-1}}})
+	if _,err:= a.Get("key");!errors.Is(err,ErrNotFound){
+		t.Errorf("want %v, have %v",ErrNotFound,err)
+	}
+}
+
+func TestClusterBan(t *testing.T){
+	nodes:= newTestCluster(t,2,func(i int,opts *FileServerOpts){
+		opts.ReconnectBaseDelay = 20*time.Millisecond
+		opts.BanDuration = 300*time.Millisecond
+	})
+	a,b:= nodes[0],nodes[1]
+	addr:= a.Transport.Addr()
+	waitPeers:= func(s *FileServer,n int){
+		t.Helper()
+		deadline:= time.Now().Add(5*time.Second)
+		for len(s.Peers())!=n{
+			if time.Now().After(deadline){
+				t.Fatalf("want %d peers, have %v",n,s.Peers())
+			}
+			time.Sleep(10*time.Millisecond)
+		}
+	}
+
+	//A banned peer is dropped and not dialed again until it is unbanned.
+	b.Ban(addr,0)
+	waitPeers(b,0)
+	time.Sleep(200*time.Millisecond)
+	if peers:= b.Peers();len(peers)!=0{
+		t.Fatalf("banned peer reconnected: %v",peers)
+	}
+	if err:= b.Transport.Dial(addr);err!=nil{
+		t.Fatal(err)
+	}
+	time.Sleep(100*time.Millisecond)
+	if peers:= b.Peers();len(peers)!=0{
+		t.Fatalf("banned peer accepted: %v",peers)
+	}
+	b.Unban(addr)
+	if err:= b.Transport.Dial(addr);err!=nil{
+		t.Fatal(err)
+	}
+	waitPeers(b,1)
+
+	//BanThreshold strikes ban the peer for BanDuration.
+	for i:=0;i<defaultBanThreshold-1;i++{
+		b.misbehaved(addr,errChunkCorrupt)
+	}
+	if b.Banned(addr){
+		t.Fatal("banned before the threshold")
+	}
+	b.misbehaved(addr,errChunkCorrupt)
+	if !b.Banned(addr){
+		t.Fatal("want the peer banned at the threshold")
+	}
+	waitPeers(b,0)
+	time.Sleep(400*time.Millisecond)
+	if b.Banned(addr){
+		t.Fatal("want the ban over after BanDuration")
+	}
+}
+
+func TestClusterStorageWeight(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.ReplicationFactor = 1
+		if i==2{
+			opts.StorageWeight = 8
+		}
+	})
+	a,big:= nodes[0],nodes[2]
+	var addr string
+	for _,p:= range a.Peers(){
+		if report,err:= a.PeerStatus(p);err==nil && report.StorageWeight==8{
+			addr = p
+		}
+	}
+	if addr==""{
+		t.Fatal("want the status of a peer of weight 8")
+	}
+	deadline:= time.Now().Add(5*time.Second)
+	for a.peerWeights()[addr]!=8{
+		if time.Now().After(deadline){
+			t.Fatalf("want weight 8 announced by %s, have %v",addr,a.peerWeights())
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+
+	//The heavy node owns most of the keys a stores.
+	const keys = 40
+	for i:=0;i<keys;i++{
+		if err:= a.Store(fmt.Sprintf("key-%d",i),bytes.NewReader([]byte("weighted")));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	deadline = time.Now().Add(5*time.Second)
+	for{
+		_,files:= big.store.Usage()
+		if files>=keys/2{
+			break
+		}
+		if time.Now().After(deadline){
+			t.Fatalf("want the heavy node to hold most of the %d files, has %d",keys,files)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterCompressionNegotiation(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		switch i{
+		case 0:
+			opts.Compression = CompressionZstd
+			opts.CompressionLevel = 19
+		case 1:
+			opts.Compressions = []Compression{CompressionGzip}
+		}
+	})
+	a:= nodes[0]
+	var gzipOnly string
+	a.peerLock.Lock()
+	for addr,cs:= range a.compressions{
+		if len(cs)==1{
+			gzipOnly = addr
+		}
+	}
+	announced:= len(a.compressions)
+	a.peerLock.Unlock()
+	if announced!=2 || gzipOnly==""{
+		t.Fatalf("want the Compressions of 2 peers from the handshake, have %d",announced)
+	}
+
+	//One peer doesn't read zstd, the file is stored with gzip they all read.
+	data:= bytes.Repeat([]byte("negotiated\n"),1<<12)
+	storeReplicated(t,a,"key",data,2)
+	if c,err:= a.storedCompression("key");err!=nil || c!=CompressionGzip{
+		t.Fatalf("want the file stored with gzip, have %s (%v)",c,err)
+	}
+	r,err:= a.Get("key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+
+	//A peer doesn't take a copy in a Compression it doesn't read, even
+	//when the storer believes it does.
+	a.peerLock.Lock()
+	a.compressions[gzipOnly] = supportedCompressions
+	a.peerLock.Unlock()
+	storeReplicated(t,a,"zstd",data,1)
+	if c,err:= a.storedCompression("zstd");err!=nil || c!=CompressionZstd{
+		t.Fatalf("want the file stored with zstd, have %s (%v)",c,err)
+	}
+	if nodes[1].store.Has(a.ID,hashKey("zstd")){
+		t.Fatal("want the copy declined by the peer without zstd")
+	}
+
+	//Healing it renegotiates: the copy is stored again with gzip for the
+	//peer that only reads gzip.
+	a.peerLock.Lock()
+	a.compressions[gzipOnly] = []Compression{CompressionGzip}
+	a.peerLock.Unlock()
+	if n,err:= a.Replicate("zstd");err!=nil || n!=1{
+		t.Fatalf("want 1 new copy, have %d (%v)",n,err)
+	}
+	if c,err:= a.storedCompression("zstd");err!=nil || c!=CompressionGzip{
+		t.Fatalf("want the file stored again with gzip, have %s (%v)",c,err)
+	}
+	if !nodes[1].store.Has(a.ID,hashKey("zstd")){
+		t.Error("want a copy on the peer that only reads gzip")
+	}
+	r,err = a.Get("zstd")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	requireContent(t,r,data)
+}
+
+func TestClusterOwnership(t *testing.T){
+	nodes:= newTestCluster(t,3,nil)
+	a,b,c:= nodes[0],nodes[1],nodes[2]
+	storeReplicated(t,a,"key",[]byte("owned by a"),2)
+
+	//b names a's ID, and its own for a, to delete the files: our own, a's
+	//copies and a's plain file are all kept.
+	for _,p:= range b.peerList(){
+		for _,msg:= range []any{
+			MessageDeleteFile{ID: a.ID,Key: hashKey("key")},
+			MessageDeleteFile{ID: a.ID,Key: "key"},
+			MessageFileMeta{ID: a.ID,Key: hashKey("key"),Meta: map[string]string{"owner": "b"}},
+		}{
+			if err:= b.send(p,&Message{Payload: msg});err!=nil{
+				t.Fatal(err)
+			}
+		}
+	}
+	//The status replies come after the messages sent before them.
+	for _,addr:= range b.Peers(){
+		if _,err:= b.PeerStatus(addr);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if !a.store.Has(a.ID,"key") || !c.store.Has(a.ID,hashKey("key")){
+		t.Fatal("want the files kept when another peer deletes them")
+	}
+	if meta,err:= c.store.Meta(a.ID,hashKey("key"));err!=nil || meta["owner"]!=""{
+		t.Errorf("want the metadata kept, have %v (%v)",meta,err)
+	}
+
+	//Their owner deletes them.
+	if err:= a.Delete("key");err!=nil{
+		t.Fatal(err)
+	}
+	deadline:= time.Now().Add(5*time.Second)
+	for c.store.Has(a.ID,hashKey("key")){
+		if time.Now().After(deadline){
+			t.Fatal("want the copy deleted by its owner")
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}
+
+func TestClusterServesInBackground(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.ChunkSize = -1
+	})
+	a,b,c:= nodes[0],nodes[1],nodes[2]
+	data:= randomBytes(t,16<<20)
+	storeReplicated(t,a,"big",data,2)
+	//Only b serves the file, to a Get that doesn't read it.
+	if err:= a.store.Delete(a.ID,"big");err!=nil{
+		t.Fatal(err)
+	}
+	if err:= c.store.Delete(a.ID,hashKey("big"));err!=nil{
+		t.Fatal(err)
+	}
+	r,_,err:= a.GetStream("big")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.Sleep(100*time.Millisecond)
+
+	//b goes on with the messages of its other peers meanwhile.
+	if _,err:= c.PeerStatus(b.Transport.Addr());err!=nil{
+		t.Fatalf("want b to answer while it serves the file: %s",err)
+	}
+}
+
+func TestClusterThrottledServe(t *testing.T){
+	nodes:= newTestCluster(t,3,func(i int,opts *FileServerOpts){
+		opts.ChunkSize = -1
+		if i==1{
+			opts.MaxUploadBytesPerSec = 128<<10
+		}
+	})
+	a,b,c:= nodes[0],nodes[1],nodes[2]
+	data:= randomBytes(t,384<<10)
+	storeReplicated(t,a,"slow",data,2)
+	if err:= a.store.Delete(a.ID,"slow");err!=nil{
+		t.Fatal(err)
+	}
+	if err:= c.store.Delete(a.ID,hashKey("slow"));err!=nil{
+		t.Fatal(err)
+	}
+	got:= make(chan []byte,1)
+	go func(){
+		r,err:= a.Get("slow")
+		if err!=nil{
+			t.Error(err)
+			got <- nil
+			return
+		}
+		b,_:= io.ReadAll(r)
+		got <- b
+	}()
+	time.Sleep(200*time.Millisecond)
+
+	//The throttled upload takes seconds, b answers its other peers
+	//meanwhile.
+	start:= time.Now()
+	if _,err:= c.PeerStatus(b.Transport.Addr());err!=nil{
+		t.Fatalf("want b to answer while its upload is throttled: %s",err)
+	}
+	select{
+	case <-got:
+		t.Fatal("want the upload still throttled")
+	default:
+	}
+	if elapsed:= time.Since(start);elapsed>250*time.Millisecond{
+		t.Errorf("want the status answered at once, took %s",elapsed)
+	}
+	if !bytes.Equal(<-got,data){
+		t.Error("want the throttled file intact")
+	}
+}
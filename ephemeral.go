@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+//tokensFile is where a Store keeps the tokens of StoreEphemeral, with the
+//content key each stands for and when it expires.
+const tokensFile = ".tokens"
+
+//tokenSize is how many random bytes a token is made of.
+const tokenSize = 12
+
+//ErrUnknownToken is returned by GetByToken for a token that was never
+//handed out here or has expired.
+var ErrUnknownToken = errors.New("unknown or expired token")
+
+//ephemeralToken is what a token of StoreEphemeral stands for.
+type ephemeralToken struct{
+	Key 		string
+	Expires time.Time
+}
+
+//StoreEphemeral stores r like StoreContent and returns a random token
+//that reads it with GetByToken until ttl elapsed. Every token holds a
+//reference to the content: the same content shared twice is stored once,
+//and it is deleted once the last of its tokens (and names) is gone. The
+//tokens are only known to this node.
+func (s *FileServer) StoreEphemeral(r io.Reader,ttl time.Duration) (string,error){
+	if ttl<=0{
+		return "",fmt.Errorf("invalid ttl %s",ttl)
+	}
+	b:= make([]byte,tokenSize)
+	if _,err:= io.ReadFull(rand.Reader,b);err!=nil{
+		return "",err
+	}
+	token:= base64.RawURLEncoding.EncodeToString(b)
+	key,err:= s.StoreContent(r)
+	if err!=nil{
+		return "",err
+	}
+
+	s.tokenLock.Lock()
+	defer s.tokenLock.Unlock()
+	if err:= s.loadTokens();err!=nil{
+		return "",err
+	}
+	s.tokens[token] = ephemeralToken{Key: key,Expires: time.Now().Add(ttl)}
+	if err:= s.saveTokens();err!=nil{
+		delete(s.tokens,token)
+		return "",err
+	}
+	return token,nil
+}
+
+//GetByToken returns the content a token of StoreEphemeral stands for,
+//fetched from the network like Get if it isn't stored here anymore.
+func (s *FileServer) GetByToken(token string) (io.Reader,error){
+	s.tokenLock.Lock()
+	err:= s.loadTokens()
+	t,ok:= s.tokens[token]
+	s.tokenLock.Unlock()
+	if err!=nil{
+		return nil,err
+	}
+	if !ok || !time.Now().Before(t.Expires){
+		return nil,ErrUnknownToken
+	}
+	return s.Get(t.Key)
+}
+
+//sweepTokens forgets the tokens expired by now and releases the content
+//they hold, it returns how many it removed.
+func (s *FileServer) sweepTokens(now time.Time) (int,error){
+	s.tokenLock.Lock()
+	if err:= s.loadTokens();err!=nil{
+		s.tokenLock.Unlock()
+		return 0,err
+	}
+	var expired []string
+	for token,t:= range s.tokens{
+		if !now.Before(t.Expires){
+			expired = append(expired,t.Key)
+			delete(s.tokens,token)
+		}
+	}
+	var err error
+	if len(expired)>0{
+		err = s.saveTokens()
+	}
+	s.tokenLock.Unlock()
+	if err!=nil{
+		return 0,err
+	}
+
+	var errs []error
+	for _,key:= range expired{
+		if err:= s.Delete(key);err!=nil{
+			errs = append(errs,fmt.Errorf("release %s: %w",key,err))
+		}
+	}
+	return len(expired),errors.Join(errs...)
+}
+
+//loadTokens reads the tokens file into tokens the first time.
+func (s *FileServer) loadTokens() error{
+	if s.tokens!=nil{
+		return nil
+	}
+	tokens:= make(map[string]ephemeralToken)
+	_,r,err:= s.store.Backend.Read(tokensFile)
+	if err==nil{
+		defer r.Close()
+		err = json.NewDecoder(r).Decode(&tokens)
+	}
+	if err!=nil && !errors.Is(err,fs.ErrNotExist){
+		return err
+	}
+	s.tokens = tokens
+	return nil
+}
+
+func (s *FileServer) saveTokens() error{
+	b,err:= json.Marshal(s.tokens)
+	if err!=nil{
+		return err
+	}
+	_,err = s.store.Backend.Write(tokensFile,bytes.NewReader(b))
+	return err
+}
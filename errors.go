@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//The errors below are returned wrapped with the details, match them with
+//errors.Is like ErrNotFound, ErrQuotaExceeded and the others declared
+//next to where they are returned.
+var(
+	//ErrPeerNotFound is returned for an address that isn't a connected
+	//peer (see Peers), and by the handlers of messages from a peer that
+	//is gone.
+	ErrPeerNotFound = errors.New("peer not found")
+	//ErrNoPeers is returned when a transfer needs peers and none is
+	//connected or left to it. A Get without peers fails with ErrNotFound
+	//as well.
+	ErrNoPeers = errors.New("no peers")
+	//ErrIntegrity is returned for a file, chunk or message that doesn't
+	//match its content hash, sha256, checksum or authentication tag. It is
+	//p2p.ErrIntegrity, so it matches the errors of the transport too.
+	ErrIntegrity = p2p.ErrIntegrity
+	//ErrKeyExists is returned for a key that is taken: a key ID RotateKey
+	//is given for another key, or a path Migrate would move a file to.
+	ErrKeyExists = errors.New("key exists")
+	//ErrNotOwner is returned to a peer storing, deleting or changing the
+	//copies of a node ID other than the one it named in the Handshake, or
+	//our own files.
+	ErrNotOwner = errors.New("peer doesn't own the file")
+)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//EventType is what an Event reports.
+type EventType int
+
+const(
+	//EventPeerConnected and EventPeerDisconnected report a peer joining
+	//and leaving the peer list.
+	EventPeerConnected EventType = iota
+	EventPeerDisconnected
+	//EventFileStored reports a file written to the local store, either
+	//by Store (Peer is empty) or streamed to us by Peer.
+	EventFileStored
+	//EventFileServed reports a file we streamed to Peer for its Get.
+	EventFileServed
+	//EventFileFetched reports a file a Get fetched from the network.
+	EventFileFetched
+)
+
+func (t EventType) String() string{
+	switch t{
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventFileStored:
+		return "file stored"
+	case EventFileServed:
+		return "file served"
+	case EventFileFetched:
+		return "file fetched"
+	}
+	return fmt.Sprintf("event(%d)",int(t))
+}
+
+//Event is sent to the channels returned by Events. Key and Size (the bytes
+//written or sent) are set for the file events, the key of a file held for
+//a peer is the hashed key that peer sent.
+type Event struct{
+	Type 	EventType
+	Time 	time.Time
+	Peer 	string
+	Key 	string
+	Size 	int64
+}
+
+//eventBuffer is how many events a subscriber can fall behind by before
+//it misses events.
+const eventBuffer = 64
+
+//Events returns a channel that receives every event from now on. Events
+//are never waited for: the ones a slow subscriber has no room for are
+//dropped. The channel is closed when the server stops.
+func (s *FileServer) Events() <-chan Event{
+	ch:= make(chan Event,eventBuffer)
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+	if s.eventsClosed{
+		close(ch)
+		return ch
+	}
+	s.subscribers = append(s.subscribers,ch)
+	return ch
+}
+
+func (s *FileServer) emit(e Event){
+	e.Time = time.Now()
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+	for _,ch:= range s.subscribers{
+		select{
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *FileServer) closeEvents(){
+	s.eventLock.Lock()
+	defer s.eventLock.Unlock()
+	for _,ch:= range s.subscribers{
+		close(ch)
+	}
+	s.subscribers = nil
+	s.eventsClosed = true
+}
+
+//fileStored runs the OnFileStored hook, if any, without holding up the
+//transfer that stored the file.
+func (s *FileServer) fileStored(key string,size int64,fromNetwork bool){
+	if s.OnFileStored==nil{
+		return
+	}
+	go func(){
+		defer func(){
+			if r:= recover();r!=nil{
+				s.Logger.With("key",key).Errorf("OnFileStored hook panicked: %v",r)
+			}
+		}()
+		s.OnFileStored(key,size,fromNetwork)
+	}()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//streamBuffer is how many writes of a stream a peer can fall behind the
+//fastest one by before the stream waits for it, at most SendTimeout.
+const streamBuffer = 16
+
+//ReplicationError is returned by a Store (or a Pin, a key rotation) when
+//some of the peers that accepted the file failed to receive it. The file
+//is stored locally and on Peers, Failed holds the error by peer address.
+type ReplicationError struct{
+	Key 		string
+	Peers 	[]string
+	Failed 	map[string]error
+}
+
+func (e *ReplicationError) Error() string{
+	addrs:= make([]string,0,len(e.Failed))
+	for addr:= range e.Failed{
+		addrs = append(addrs,addr)
+	}
+	sort.Strings(addrs)
+	for i,addr:= range addrs{
+		addrs[i] = fmt.Sprintf("%s (%s)",addr,e.Failed[addr])
+	}
+	return fmt.Sprintf("replicated %s to %d of %d peers, failed: %s",e.Key,len(e.Peers),len(e.Peers)+len(e.Failed),strings.Join(addrs,", "))
+}
+
+//streamWriter writes a stream to several peers at once, each has a
+//goroutine sending it the writes it buffered. A peer whose write fails,
+//or that falls behind by streamBuffer writes for SendTimeout, is dropped
+//while the others keep receiving the stream.
+type streamWriter struct{
+	s 			*FileServer
+	key 		string
+	peers 	[]*peerStream
+	failed 	map[string]error
+	closed 	bool
+}
+
+type peerStream struct{
+	peer 	p2p.Peer
+	id 		uint32
+	ch 		chan []byte
+	done 	chan struct{}
+	//err is set before done is closed.
+	err 	error
+}
+
+func (s *FileServer) newStreamWriter(key string,id uint32,peers []p2p.Peer) *streamWriter{
+	w:= &streamWriter{s: s,key: key,failed: make(map[string]error)}
+	for _,peer:= range peers{
+		ps:= &peerStream{peer: peer,id: id,ch: make(chan []byte,streamBuffer),done: make(chan struct{})}
+		w.peers = append(w.peers,ps)
+		go s.streamTo(ps)
+	}
+	return w
+}
+
+//streamTo opens the stream of ps and sends it the writes of ps until its
+//channel is closed, which ends the stream, or a write fails.
+func (s *FileServer) streamTo(ps *peerStream){
+	defer close(ps.done)
+	var sw io.WriteCloser
+	ps.err = s.writePeer(ps.peer,func() (err error){
+		sw,err = p2p.OpenStream(ps.peer,ps.id)
+		return err
+	})
+	if ps.err!=nil{
+		return
+	}
+	for b:= range ps.ch{
+		ps.err = s.writePeer(ps.peer,func() error{
+			_,err:= sw.Write(b)
+			return err
+		})
+		if ps.err!=nil{
+			return
+		}
+	}
+	ps.err = s.writePeer(ps.peer,sw.Close)
+}
+
+func (w *streamWriter) Write(b []byte) (int,error){
+	//The caller may reuse b once Write returns.
+	buf:= append([]byte(nil),b...)
+	live:= w.peers[:0]
+	for _,ps:= range w.peers{
+		select{
+		case <-ps.done:
+			w.fail(ps,ps.err)
+			continue
+		case ps.ch<-buf:
+			live = append(live,ps)
+			continue
+		default:
+		}
+		timer:= time.NewTimer(w.s.SendTimeout)
+		select{
+		case ps.ch<-buf:
+			live = append(live,ps)
+		case <-ps.done:
+			w.fail(ps,ps.err)
+		case <-timer.C:
+			w.fail(ps,fmt.Errorf("fell behind the stream for %s",w.s.SendTimeout))
+		}
+		timer.Stop()
+	}
+	w.peers = live
+	if len(w.peers)==0{
+		return 0,fmt.Errorf("%w left to stream to",ErrNoPeers)
+	}
+	return len(b),nil
+}
+
+//Close waits until the peers received what was written, at most
+//SendTimeout. Calling it again does nothing.
+func (w *streamWriter) Close() error{
+	if w.closed{
+		return nil
+	}
+	w.closed = true
+	for _,ps:= range w.peers{
+		close(ps.ch)
+	}
+	timer:= time.NewTimer(w.s.SendTimeout)
+	defer timer.Stop()
+	live:= w.peers[:0]
+	for _,ps:= range w.peers{
+		select{
+		case <-ps.done:
+			if ps.err!=nil{
+				w.fail(ps,ps.err)
+				continue
+			}
+			live = append(live,ps)
+		case <-timer.C:
+			w.fail(ps,fmt.Errorf("stream not received within %s",w.s.SendTimeout))
+		}
+	}
+	w.peers = live
+	return nil
+}
+
+//abort drops the peers a stream that is cut short was sent to.
+func (w *streamWriter) abort(err error){
+	for _,ps:= range w.peers{
+		w.s.dropPeer(ps.peer,err)
+		if !w.closed{
+			close(ps.ch)
+		}
+	}
+	w.peers = nil
+	w.closed = true
+}
+
+func (w *streamWriter) fail(ps *peerStream,err error){
+	w.s.dropPeer(ps.peer,err)
+	w.failed[ps.peer.RemoteAddr().String()] = err
+}
+
+//received returns the peers that are receiving, or after Close received,
+//the whole stream.
+func (w *streamWriter) received() []p2p.Peer{
+	peers:= make([]p2p.Peer,len(w.peers))
+	for i,ps:= range w.peers{
+		peers[i] = ps.peer
+	}
+	return peers
+}
+
+//err returns a ReplicationError if a peer failed to receive the stream.
+func (w *streamWriter) err() error{
+	if len(w.failed)==0{
+		return nil
+	}
+	e:= &ReplicationError{Key: w.key,Failed: w.failed}
+	for _,peer:= range w.received(){
+		e.Peers = append(e.Peers,peer.RemoteAddr().String())
+	}
+	sort.Strings(e.Peers)
+	return e
+}
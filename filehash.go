@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+//MessageFileHash asks a peer for the sha256 and size of its copy of the
+//file for Key stored by the node with ID.
+type MessageFileHash struct{
+	RequestID string
+	ID 				string
+	Key 			string
+}
+
+//MessageFileHashReply is the reply to MessageFileHash, Has is false when
+//the peer doesn't hold the file.
+type MessageFileHashReply struct{
+	RequestID string
+	Has 			bool
+	Sum 			[]byte
+	Size 			int64
+}
+
+//RemoteHash returns the hex sha256 and the size of the copy of the file
+//for key held by the connected peer with the remote address addr, without
+//fetching it. The peer hashes its copy as it is stored, encrypted, so the
+//hashes of the copies of one Store match (see StoreAndConfirm). It fails
+//with ErrNotFound if the peer doesn't hold the file.
+func (s *FileServer) RemoteHash(key string,addr string) (string,int64,error){
+	return s.RemoteHashContext(context.Background(),key,addr)
+}
+
+func (s *FileServer) RemoteHashContext(ctx context.Context,key string,addr string) (string,int64,error){
+	peer,ok:= s.peer(addr)
+	if !ok{
+		return "",0,fmt.Errorf("%w: %s",ErrPeerNotFound,addr)
+	}
+	id,replies:= s.addRequest(1)
+	defer s.removeRequest(id)
+
+	if err:= s.send(peer,&Message{Payload: MessageFileHash{RequestID: id,ID: s.ID,Key: hashKey(key)}});err!=nil{
+		return "",0,err
+	}
+	//The peer reads its whole copy, that takes longer than an ack.
+	select{
+	case reply:= <-replies:
+		r:= reply.Payload.(MessageFileHashReply)
+		if !r.Has{
+			return "",0,fmt.Errorf("[%s] %w: peer %s doesn't hold (%s)",s.Transport.Addr(),ErrNotFound,addr,key)
+		}
+		return hex.EncodeToString(r.Sum),r.Size,nil
+	case <-time.After(s.SendTimeout):
+		return "",0,fmt.Errorf("timed out waiting for the hash of %s from %s",key,addr)
+	case <-ctx.Done():
+		return "",0,ctx.Err()
+	}
+}
+
+//handleMessageFileHash hashes our copy in the background, so the
+//messages after it aren't held up by a large file.
+func (s *FileServer) handleMessageFileHash(from string,msg MessageFileHash) error{
+	peer,ok:= s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+	reply:= MessageFileHashReply{RequestID: msg.RequestID}
+	if !s.servesCopy(msg.ID,msg.Key) || !s.beginTransfer(){
+		return s.send(peer,&Message{Payload: reply})
+	}
+	go func(){
+		defer s.endTransfer()
+		sum,size,err:= s.copySum(msg.ID,msg.Key)
+		if err!=nil{
+			s.Logger.With("key",msg.Key,"peer",from).Errorf("hashing copy error: %s",err)
+		}
+		reply.Has,reply.Sum,reply.Size = err==nil,sum,size
+		if err:= s.send(peer,&Message{Payload: reply});err!=nil{
+			s.Logger.With("peer",from).Errorf("file hash reply error: %s",err)
+		}
+	}()
+	return nil
+}
+
+func (s *FileServer) handleMessageFileHashReply(from string,msg MessageFileHashReply) error{
+	s.deliverReply(msg.RequestID,from,msg)
+	return nil
+}
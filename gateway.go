@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Gateway exposes a FileServer over HTTP for clients that don't speak
+//the peer protocol:
+//
+//	PUT    /file/{key}  stores the request body under key
+//	PUT    /file        stores the body under its sha256 content hash
+//	GET    /file/{key}  returns the file, Range requests are supported
+//	DELETE /file/{key}  deletes the file
+//	GET    /files       lists the keys stored on the node, one per line,
+//	                    ?network=true includes the peers' keys and
+//	                    ?prefix= lists only the keys starting with it
+//	GET    /peers       lists the addresses of the connected peers
+//	GET    /status      returns the node's StatusReport as JSON,
+//	                    ?network=true returns a list of it and the
+//	                    reports of the peers that answered
+//	POST   /selftest    runs RunSelfTest and returns its report as text,
+//	                    a failed stage answers 500
+//
+//A PUT with a Content-Type keeps it as the MetaContentType of the file,
+//a GET serves the file with it.
+//
+//The gateway lives next to the FileServer in package main, FileServer
+//can't be imported from a package of its own.
+type Gateway struct{
+	fs *FileServer
+}
+
+func NewGateway(fs *FileServer) http.Handler{
+	g:= &Gateway{fs: fs}
+	mux:= http.NewServeMux()
+	mux.HandleFunc("/file",g.handleFile)
+	mux.HandleFunc("/file/",g.handleFile)
+	mux.HandleFunc("/files",g.handleFiles)
+	mux.HandleFunc("/peers",g.handlePeers)
+	mux.HandleFunc("/status",g.handleStatus)
+	mux.HandleFunc("/selftest",g.handleSelfTest)
+	return mux
+}
+
+func (g *Gateway) handleFile(w http.ResponseWriter,r *http.Request){
+	key:= strings.TrimPrefix(strings.TrimPrefix(r.URL.Path,"/file"),"/")
+
+	switch r.Method{
+	case http.MethodPut:
+		g.handlePut(w,r,key)
+	case http.MethodGet,http.MethodHead:
+		if len(key)==0{
+			http.Error(w,"missing key",http.StatusBadRequest)
+			return
+		}
+		g.handleGet(w,r,key)
+	case http.MethodDelete:
+		if len(key)==0{
+			http.Error(w,"missing key",http.StatusBadRequest)
+			return
+		}
+		if err:= g.fs.Delete(key);err!=nil{
+			http.Error(w,err.Error(),http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow","GET, HEAD, PUT, DELETE")
+		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) handlePut(w http.ResponseWriter,r *http.Request,key string){
+	var meta map[string]string
+	if ct:= r.Header.Get("Content-Type");ct!=""{
+		meta = map[string]string{MetaContentType: ct}
+	}
+	var err error
+	if len(key)==0{
+		//The content may be stored already, its metadata is replaced.
+		if key,err = g.fs.StoreContentContext(r.Context(),r.Body);err==nil && meta!=nil{
+			err = g.fs.SetMetaContext(r.Context(),key,meta)
+		}
+	}else{
+		err = g.fs.StoreWithMetaContext(r.Context(),key,r.Body,meta)
+	}
+	if errors.Is(err,ErrQuotaExceeded){
+		http.Error(w,err.Error(),http.StatusInsufficientStorage)
+		return
+	}
+	if err!=nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location","/file/"+key)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w,key)
+}
+
+func (g *Gateway) handleGet(w http.ResponseWriter,r *http.Request,key string){
+	//A HEAD only asks the peers whether they hold a file we don't, the
+	//file isn't fetched.
+	if r.Method==http.MethodHead{
+		info,err:= g.fs.statFile(r.Context(),key)
+		if err!=nil{
+			http.Error(w,err.Error(),http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Accept-Ranges","bytes")
+		w.Header().Set("Content-Type",g.contentType(key))
+		if info.Size>=0{
+			w.Header().Set("Content-Length",strconv.FormatInt(info.Size,10))
+		}
+		return
+	}
+
+	//A file that isn't stored on the node is streamed while it is fetched,
+	//and stored even if the client leaves early. A Range needs all of it.
+	var(
+		f 		io.Reader
+		info 	FileInfo
+		err 	error
+	)
+	if len(r.Header.Get("Range"))>0{
+		f,info,err = g.fs.GetInfoContext(r.Context(),key)
+	}else{
+		f,info,err = g.fs.GetStreamContext(context.WithoutCancel(r.Context()),key)
+	}
+	if errors.Is(err,ErrIntegrity){
+		http.Error(w,err.Error(),http.StatusBadGateway)
+		return
+	}
+	if err!=nil{
+		http.Error(w,err.Error(),http.StatusNotFound)
+		return
+	}
+	if rc,ok:= f.(io.ReadCloser);ok{
+		defer rc.Close()
+	}
+
+	contentType:= g.contentType(key)
+	w.Header().Set("Accept-Ranges","bytes")
+	if len(r.Header.Get("Range"))==0{
+		w.Header().Set("Content-Type",contentType)
+		if info.Size>=0{
+			w.Header().Set("Content-Length",strconv.FormatInt(info.Size,10))
+		}
+		io.Copy(w,f)
+		return
+	}
+
+	//The stored file is compressed and can't be seeked, so for a range
+	//request it is spooled to a temporary file that ServeContent can seek.
+	tmp,err:= os.CreateTemp("","cas-gateway-*")
+	if err!=nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _,err:= io.Copy(tmp,f);err!=nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type",contentType)
+	http.ServeContent(w,r,key,time.Time{},tmp)
+}
+
+//contentType is the MetaContentType of the file, octet-stream without.
+func (g *Gateway) contentType(key string) string{
+	if meta,err:= g.fs.Meta(key);err==nil && meta[MetaContentType]!=""{
+		return meta[MetaContentType]
+	}
+	return "application/octet-stream"
+}
+
+func (g *Gateway) handleFiles(w http.ResponseWriter,r *http.Request){
+	if r.Method!=http.MethodGet{
+		w.Header().Set("Allow","GET")
+		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+		return
+	}
+	var(
+		keys []string
+		err error
+	)
+	prefix:= r.URL.Query().Get("prefix")
+	if network,_:= strconv.ParseBool(r.URL.Query().Get("network"));network{
+		keys,err = g.fs.ListNetworkPrefix(r.Context(),prefix)
+	}else{
+		keys,err = g.fs.ListPrefix(prefix)
+	}
+	if err!=nil{
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	writeLines(w,keys)
+}
+
+func (g *Gateway) handlePeers(w http.ResponseWriter,r *http.Request){
+	if r.Method!=http.MethodGet{
+		w.Header().Set("Allow","GET")
+		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+		return
+	}
+	writeLines(w,g.fs.Peers())
+}
+
+func (g *Gateway) handleStatus(w http.ResponseWriter,r *http.Request){
+	if r.Method!=http.MethodGet{
+		w.Header().Set("Allow","GET")
+		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+		return
+	}
+	status:= g.fs.Status()
+	var v any = status
+	if network,_:= strconv.ParseBool(r.URL.Query().Get("network"));network{
+		reports:= []StatusReport{status}
+		for _,addr:= range g.fs.Peers(){
+			report,err:= g.fs.PeerStatusContext(r.Context(),addr)
+			if err!=nil{
+				g.fs.Logger.With("peer",addr).Errorf("status: %s",err)
+				continue
+			}
+			reports = append(reports,report)
+		}
+		v = reports
+	}
+	w.Header().Set("Content-Type","application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (g *Gateway) handleSelfTest(w http.ResponseWriter,r *http.Request){
+	if r.Method!=http.MethodPost{
+		w.Header().Set("Allow","POST")
+		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+		return
+	}
+	report:= g.fs.RunSelfTest(r.Context())
+	w.Header().Set("Content-Type","text/plain; charset=utf-8")
+	if report.Err()!=nil{
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	io.WriteString(w,report.String())
+}
+
+func writeLines(w http.ResponseWriter,lines []string){
+	w.Header().Set("Content-Type","text/plain; charset=utf-8")
+	for _,line:= range lines{
+		fmt.Fprintln(w,line)
+	}
+}
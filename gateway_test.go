@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//newTestFileServer returns a FileServer without peers that keeps its
+//files in memory, its transport is never started.
+func newTestFileServer() *FileServer{
+	return NewFileServer(FileServerOpts{
+		EncKey: 						newEncryptionKey(),
+		PathTransformFunc: 	CASpathTransformFunc,
+		Backend: 						NewMemoryBackend(),
+		Transport: 					p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3401"}),
+		//The test peers don't read what isn't asked for.
+		GossipInterval: 		-1,
+	})
+}
+
+func newGatewayServer() *httptest.Server{
+	return httptest.NewServer(NewGateway(newTestFileServer()))
+}
+
+func doRequest(t *testing.T,method string,url string,body string,header ...string) (*http.Response,string){
+	req,err:= http.NewRequest(method,url,strings.NewReader(body))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	for i:=0;i+1<len(header);i+=2{
+		req.Header.Set(header[i],header[i+1])
+	}
+	resp,err:= http.DefaultClient.Do(req)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b,err:= io.ReadAll(resp.Body)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	return resp,string(b)
+}
+
+func TestGateway(t *testing.T){
+	srv:= newGatewayServer()
+	defer srv.Close()
+
+	data:= "some bytes served over http"
+	if resp,_:= doRequest(t,http.MethodPut,srv.URL+"/file/greeting",data);resp.StatusCode!=http.StatusCreated{
+		t.Fatalf("PUT: want %d, have %d",http.StatusCreated,resp.StatusCode)
+	}
+
+	if resp,b:= doRequest(t,http.MethodGet,srv.URL+"/file/greeting","");resp.StatusCode!=http.StatusOK || b!=data{
+		t.Errorf("GET: want %d %q, have %d %q",http.StatusOK,data,resp.StatusCode,b)
+	}else if resp.ContentLength!=int64(len(data)){
+		t.Errorf("GET: want Content-Length %d, have %d",len(data),resp.ContentLength)
+	}
+
+	resp,b:= doRequest(t,http.MethodGet,srv.URL+"/file/greeting","","Range","bytes=5-9")
+	if resp.StatusCode!=http.StatusPartialContent || b!=data[5:10]{
+		t.Errorf("GET range: want %d %q, have %d %q",http.StatusPartialContent,data[5:10],resp.StatusCode,b)
+	}
+
+	if resp,_:= doRequest(t,http.MethodDelete,srv.URL+"/file/greeting","");resp.StatusCode!=http.StatusNoContent{
+		t.Errorf("DELETE: want %d, have %d",http.StatusNoContent,resp.StatusCode)
+	}
+	if resp,_:= doRequest(t,http.MethodGet,srv.URL+"/file/greeting","");resp.StatusCode!=http.StatusNotFound{
+		t.Errorf("GET after DELETE: want %d, have %d",http.StatusNotFound,resp.StatusCode)
+	}
+}
+
+func TestGatewayContentKey(t *testing.T){
+	srv:= newGatewayServer()
+	defer srv.Close()
+
+	data:= "content addressed bytes"
+	sum:= sha256.Sum256([]byte(data))
+	want:= hex.EncodeToString(sum[:])
+
+	resp,b:= doRequest(t,http.MethodPut,srv.URL+"/file",data)
+	if resp.StatusCode!=http.StatusCreated{
+		t.Fatalf("PUT: want %d, have %d",http.StatusCreated,resp.StatusCode)
+	}
+	if key:= strings.TrimSpace(b);key!=want{
+		t.Fatalf("want key %s, have %s",want,key)
+	}
+	if resp,b:= doRequest(t,http.MethodGet,srv.URL+"/file/"+want,"");b!=data{
+		t.Errorf("GET: want %q, have %d %q",data,resp.StatusCode,b)
+	}
+}
+
+func TestGatewayContentType(t *testing.T){
+	srv:= newGatewayServer()
+	defer srv.Close()
+
+	doRequest(t,http.MethodPut,srv.URL+"/file/page","<p>hello</p>","Content-Type","text/html")
+	doRequest(t,http.MethodPut,srv.URL+"/file/plain","bytes")
+	for key,want:= range map[string]string{"page": "text/html","plain": "application/octet-stream"}{
+		if resp,_:= doRequest(t,http.MethodGet,srv.URL+"/file/"+key,"");resp.Header.Get("Content-Type")!=want{
+			t.Errorf("GET %s: want Content-Type %q, have %q",key,want,resp.Header.Get("Content-Type"))
+		}
+	}
+	if resp,_:= doRequest(t,http.MethodGet,srv.URL+"/file/page","","Range","bytes=0-2");resp.Header.Get("Content-Type")!="text/html"{
+		t.Errorf("GET range: want Content-Type text/html, have %q",resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestGatewayListing(t *testing.T){
+	srv:= newGatewayServer()
+	defer srv.Close()
+
+	if resp,_:= doRequest(t,http.MethodPut,srv.URL+"/file","listed bytes");resp.StatusCode!=http.StatusCreated{
+		t.Fatalf("PUT: want %d, have %d",http.StatusCreated,resp.StatusCode)
+	}
+	//CASpathTransformFunc can't be reversed, the listing holds the file name.
+	if resp,b:= doRequest(t,http.MethodGet,srv.URL+"/files","");resp.StatusCode!=http.StatusOK || strings.Count(b,"\n")!=1{
+		t.Errorf("GET /files: want one key, have %d %q",resp.StatusCode,b)
+	}
+	if resp,b:= doRequest(t,http.MethodGet,srv.URL+"/peers","");resp.StatusCode!=http.StatusOK || b!=""{
+		t.Errorf("GET /peers: want no peers, have %d %q",resp.StatusCode,b)
+	}
+}
+
+func TestGatewaySelfTest(t *testing.T){
+	srv:= newGatewayServer()
+	defer srv.Close()
+
+	if resp,b:= doRequest(t,http.MethodPost,srv.URL+"/selftest","");resp.StatusCode!=http.StatusOK || !strings.HasSuffix(b,"PASS\n"){
+		t.Errorf("POST: want %d and a passed report, have %d %q",http.StatusOK,resp.StatusCode,b)
+	}
+	if resp,_:= doRequest(t,http.MethodGet,srv.URL+"/selftest","");resp.StatusCode!=http.StatusMethodNotAllowed{
+		t.Errorf("GET: want %d, have %d",http.StatusMethodNotAllowed,resp.StatusCode)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//GetStream is like GetInfo but doesn't wait for a file that isn't stored
+//locally to be fetched: the reader streams its content as it arrives from
+//the peer serving it, while it is stored for the next Get, and the Size
+//is -1. Each segment is authenticated before it is read, a file that is
+//cut short or doesn't hash to its content key fails the last Read instead
+//of GetStream. Closing the reader early doesn't keep the file from being
+//stored, neither does a reader left unread: once it didn't take the next
+//bytes for SendTimeout it fails and the file is stored without it. The
+//fetch is neither chunked (see ChunkSize) nor retried.
+func (s *FileServer) GetStream(key string) (io.ReadCloser,FileInfo,error){
+	return s.GetStreamContext(context.Background(),key)
+}
+
+//GetStreamContext is like GetStream but the fetch stops once ctx is done,
+//the reader then fails.
+func (s *FileServer) GetStreamContext(ctx context.Context,key string) (io.ReadCloser,FileInfo,error){
+	f,first:= s.startFetch(key)
+	if !first{
+		//Another Get is fetching the file already, it is read once stored.
+		r,info,err:= s.GetInfoContext(ctx,key)
+		if err!=nil{
+			return nil,FileInfo{},err
+		}
+		return asReadCloser(r),info,nil
+	}
+	r,ok,err:= s.getLocal(key)
+	if ok || err!=nil{
+		s.endFetch(key,f,nil)
+		if err!=nil{
+			return nil,FileInfo{},err
+		}
+		rc:= asReadCloser(r)
+		size,err:= s.localSize(key)
+		if err!=nil{
+			rc.Close()
+			return nil,FileInfo{},err
+		}
+		s.audit(AuditEntry{Op: AuditGet,ID: s.ID,Key: key,Size: size})
+		return rc,FileInfo{Size: size,Key: key},nil
+	}
+	rc,err:= s.streamFetch(ctx,key,f)
+	if err!=nil{
+		return nil,FileInfo{},err
+	}
+	return rc,FileInfo{Size: -1,Key: key,FromNetwork: true},nil
+}
+
+//statFile returns the FileInfo of the file for key without fetching it:
+//that of our copy, or with a Size of -1 when only peers hold it. It is
+//ErrNotFound when none of the peers a Get asks holds it.
+func (s *FileServer) statFile(ctx context.Context,key string) (FileInfo,error){
+	if s.store.Has(s.ID,key) && !s.store.Expired(s.ID,key){
+		size,err:= s.localSize(key)
+		if err!=nil{
+			return FileInfo{},err
+		}
+		return FileInfo{Size: size,Key: key},nil
+	}
+	holders,_,err:= s.probeFile(ctx,key,s.selectPeers(key))
+	if err!=nil{
+		return FileInfo{},err
+	}
+	if len(holders)==0{
+		return FileInfo{},fmt.Errorf("[%s] no peer holds file (%s): %w",s.Transport.Addr(),key,ErrNotFound)
+	}
+	return FileInfo{Size: -1,Key: key,FromNetwork: true},nil
+}
+
+//asReadCloser returns r, with a no-op Close unless it has one.
+func asReadCloser(r io.Reader) io.ReadCloser{
+	if rc,ok:= r.(io.ReadCloser);ok{
+		return rc
+	}
+	return io.NopCloser(r)
+}
+
+//streamFetch fetches the file for key from the first peer that serves it
+//and returns its content as it is stored, it ends the fetch f once it is.
+func (s *FileServer) streamFetch(ctx context.Context,key string,f *fetchCall) (io.ReadCloser,error){
+	s.Logger.With("key",key).Infof("don't have the file locally, streaming from network...")
+	start:= time.Now()
+	if !s.beginTransfer(){
+		err:= fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+		s.endFetch(key,f,err)
+		return nil,err
+	}
+	peer,err:= s.requestFromOwners(ctx,key,s.selectPeers(key))
+	var fileSize int64
+	if err==nil{
+		if err = binary.Read(peer,binary.LittleEndian,&fileSize);err==nil{
+			err = s.checkFileSize(fileSize)
+		}
+		if err!=nil{
+			peer.CloseStream()
+			s.dropPeer(peer,err)
+		}
+	}
+	if err!=nil{
+		s.endTransfer()
+		s.endFetch(key,f,err)
+		return nil,err
+	}
+
+	pr,pw:= io.Pipe()
+	tee:= &teeWriter{w: pw,timeout: s.SendTimeout}
+	go func(){
+		defer s.endTransfer()
+		lr:= &exactReader{r: peer,n: fileSize}
+		//The plain bytes go to the reader on their way to the backend, after
+		//the content hash of the ones before them.
+		n,err:= s.store.writeDecrypt(s.keys,s.ID,key,ctxReader{ctx,throttle(lr,s.downloads,ctx.Done())},func(key string,r io.Reader) io.ReadCloser{
+			v:= verifyingReader(key,r)
+			return readCloser{io.TeeReader(v,tee),v}
+		})
+		peer.CloseStream()
+		if errors.Is(err,ErrIntegrity){
+			s.misbehaved(peer.RemoteAddr().String(),err)
+		}
+		if err==nil{
+			s.Logger.With("key",key,"peer",peer.RemoteAddr().String()).Infof("streamed (%d) bytes over the network",n)
+			s.recordFetch(key,n,start)
+			s.audit(AuditEntry{Op: AuditGet,ID: s.ID,Key: key,Size: n,Fetched: true})
+		}
+		s.endFetch(key,f,err)
+		pw.CloseWithError(err)
+	}()
+
+	dr,err:= decompressReader(pr)
+	if err!=nil{
+		pr.Close()
+		return nil,err
+	}
+	return dr,nil
+}
+
+//teeWriter writes to w until a write fails and discards the rest, the
+//reader of a GetStream may stop before the file is stored. A write the
+//reader doesn't take within timeout fails it, so an abandoned reader
+//doesn't hold up the transfer (and Stop).
+type teeWriter struct{
+	w 			*io.PipeWriter
+	timeout time.Duration
+	err 		error
+}
+
+//errReaderStalled fails the reader of a GetStream that fell behind.
+var errReaderStalled = errors.New("reader didn't keep up with the stream")
+
+func (t *teeWriter) Write(b []byte) (int,error){
+	if t.err==nil{
+		timer:= time.AfterFunc(t.timeout,func(){ t.w.CloseWithError(errReaderStalled) })
+		_,t.err = t.w.Write(b)
+		timer.Stop()
+	}
+	return len(b),nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+const defaultGossipInterval = 30*time.Second
+
+//MessagePeerList is sent to every peer on connect and every
+//GossipInterval. Listen is the address the sender listens on, Addrs are
+//the addresses the peers it is connected to can be dialed at.
+type MessagePeerList struct{
+	Listen 	string
+	Addrs 	[]string
+}
+
+//gossipLoop sends our peer list to every peer each GossipInterval, so
+//peers that joined meanwhile are passed on.
+func (s *FileServer) gossipLoop(){
+	ticker:= time.NewTicker(s.GossipInterval)
+	defer ticker.Stop()
+	for{
+		select{
+		case <-ticker.C:
+			if _,err:= s.multicast(context.Background(),&Message{Payload: s.peerListMessage()},s.peerList());err!=nil{
+				s.Logger.Errorf("gossip error: %s",err)
+			}
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+//gossip sends our peer list to a peer that just connected.
+func (s *FileServer) gossip(p p2p.Peer){
+	if s.GossipInterval<0{
+		return
+	}
+	if err:= s.send(p,&Message{Payload: s.peerListMessage()});err!=nil{
+		s.Logger.With("peer",p.RemoteAddr().String()).Errorf("gossip error: %s",err)
+	}
+}
+
+//peerListMessage lists the addresses our peers can be dialed at: the one
+//we dialed, or for a peer that dialed us the one it listens on.
+func (s *FileServer) peerListMessage() MessagePeerList{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	addrs:= make([]string,0,len(s.peers))
+	for addr,p:= range s.peers{
+		if !p.Outbound(){
+			var ok bool
+			if addr,ok = s.listenAddrs[addr];!ok{
+				continue
+			}
+		}
+		addrs = append(addrs,addr)
+	}
+	sort.Strings(addrs)
+	return MessagePeerList{Listen: s.Transport.Addr(),Addrs: addrs}
+}
+
+//handleMessagePeerList records where the sender listens and dials the
+//addresses it knows that we are not connected to yet.
+func (s *FileServer) handleMessagePeerList(from string,msg MessagePeerList) error{
+	s.peerLock.Lock()
+	peer,ok:= s.peers[from]
+	if ok && msg.Listen!=""{
+		s.listenAddrs[from] = dialAddr(msg.Listen,from)
+	}
+	s.peerLock.Unlock()
+	if !ok{
+		return nil
+	}
+
+	//Two nodes that learn of each other at the same time would dial each
+	//other, only the one with the smaller address does. Our address is
+	//the one our listen port has on the connection to the sender.
+	self:= dialAddr(s.Transport.Addr(),peer.LocalAddr().String())
+	for _,addr:= range msg.Addrs{
+		s.dialDiscovered(addr,self,"dialing gossiped peer")
+	}
+	return nil
+}
+
+//dialDiscovered dials addr in the background unless it is us, a peer we
+//are connected to or dialing already, or not larger than self (our own
+//address as the peer at addr sees it).
+func (s *FileServer) dialDiscovered(addr string,self string,msg string){
+	if self>=addr || s.isSelf(addr) || s.bans.banned(addr) || !s.startDial(addr){
+		return
+	}
+	go func(){
+		defer s.endDial(addr)
+		if s.peersFull(){
+			return
+		}
+		s.Logger.With("peer",addr).Infof(msg)
+		if err:= s.Transport.Dial(addr);err!=nil{
+			s.Logger.With("peer",addr).Errorf("dial error: %s",err)
+		}
+	}()
+}
+
+//startDial reports whether addr is unknown, neither connected nor being
+//dialed, and marks it as being dialed.
+func (s *FileServer) startDial(addr string) bool{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if _,ok:= s.peers[addr];ok || s.dialing[addr]{
+		return false
+	}
+	for _,listen:= range s.listenAddrs{
+		if listen==addr{
+			return false
+		}
+	}
+	s.dialing[addr] = true
+	return true
+}
+
+func (s *FileServer) endDial(addr string){
+	s.peerLock.Lock()
+	delete(s.dialing,addr)
+	s.peerLock.Unlock()
+}
+
+//dialAddr completes a listen address without a host, like ":3000",
+//with the host of the remote address the peer connected from.
+func dialAddr(listen string,remote string) string{
+	host,port,err:= net.SplitHostPort(listen)
+	if err!=nil || (host!="" && !net.ParseIP(host).IsUnspecified()){
+		return listen
+	}
+	if remoteHost,_,err:= net.SplitHostPort(remote);err==nil{
+		return net.JoinHostPort(remoteHost,port)
+	}
+	return listen
+}
+
+//isSelf tells whether addr is one we listen on.
+func (s *FileServer) isSelf(addr string) bool{
+	host,port,err:= net.SplitHostPort(addr)
+	if err!=nil{
+		return false
+	}
+	ownHost,ownPort,err:= net.SplitHostPort(s.Transport.Addr())
+	if err!=nil || port!=ownPort{
+		return false
+	}
+	if ownHost!="" && !net.ParseIP(ownHost).IsUnspecified(){
+		return host==ownHost
+	}
+	//We listen on every interface.
+	ip:= net.ParseIP(host)
+	if ip==nil{
+		return host=="localhost"
+	}
+	if ip.IsLoopback() || ip.IsUnspecified(){
+		return true
+	}
+	ifaces,err:= net.InterfaceAddrs()
+	if err!=nil{
+		return false
+	}
+	for _,a:= range ifaces{
+		if ipNet,ok:= a.(*net.IPNet);ok && ipNet.IP.Equal(ip){
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultImportConcurrency = 4
+
+//ImportOpts configures an Import.
+type ImportOpts struct{
+	//Concurrency is how many files are stored at once, default 4.
+	Concurrency 	int
+	//ManifestPath is optional, the manifest is written there as JSON once
+	//the Import ends, even when some files failed.
+	ManifestPath 	string
+	//SkipExisting skips the files that are stored locally already, and
+	//those the manifest at ManifestPath lists with a key that is stored
+	//without reading them again, so an Import that failed can be resumed.
+	SkipExisting 	bool
+}
+
+//Import stores every regular file under dir by the hex sha256 of its
+//content, like StoreContent, and returns the manifest: the slash path of
+//each file relative to dir to its key. Other files (symlinks, devices)
+//are skipped. A file that fails doesn't stop the others, the manifest
+//lists those stored and the error those that failed.
+func (s *FileServer) Import(dir string,opts ImportOpts) (map[string]string,error){
+	return s.ImportContext(context.Background(),dir,opts)
+}
+
+//ImportContext is like Import but stops once ctx is done, the manifest is
+//still written with the files stored until then.
+func (s *FileServer) ImportContext(ctx context.Context,dir string,opts ImportOpts) (map[string]string,error){
+	if opts.Concurrency<=0{
+		opts.Concurrency = defaultImportConcurrency
+	}
+	info,err:= os.Stat(dir)
+	if err!=nil{
+		return nil,err
+	}
+	if !info.IsDir(){
+		return nil,fmt.Errorf("%s is not a directory",dir)
+	}
+	manifest:= map[string]string{}
+	if opts.SkipExisting && len(opts.ManifestPath)>0{
+		if manifest,err = readManifest(opts.ManifestPath);err!=nil{
+			return nil,err
+		}
+	}
+	//The manifest isn't imported when it is written into dir.
+	manifestPath,_:= filepath.Abs(opts.ManifestPath)
+
+	var(
+		mu 		sync.Mutex
+		errs 	[]error
+		wg 		sync.WaitGroup
+	)
+	fail:= func(err error){
+		mu.Lock()
+		errs = append(errs,err)
+		mu.Unlock()
+	}
+	paths:= make(chan string)
+	imp:= &importer{s: s,skipExisting: opts.SkipExisting,calls: make(map[string]*importCall)}
+	for i:=0;i<opts.Concurrency;i++{
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for rel:= range paths{
+				key,err:= imp.importFile(ctx,filepath.Join(dir,filepath.FromSlash(rel)))
+				if err!=nil{
+					fail(fmt.Errorf("import %s: %w",rel,err))
+					continue
+				}
+				mu.Lock()
+				manifest[rel] = key
+				mu.Unlock()
+			}
+		}()
+	}
+
+	walkErr:= filepath.WalkDir(dir,func(p string,d fs.DirEntry,err error) error{
+		if err!=nil{
+			fail(err)
+			return nil
+		}
+		if err:= ctx.Err();err!=nil{
+			return err
+		}
+		if !d.Type().IsRegular(){
+			if !d.IsDir(){
+				s.Logger.With("path",p).Infof("import skips a file that isn't regular")
+			}
+			return nil
+		}
+		if abs,_:= filepath.Abs(p);len(opts.ManifestPath)>0 && abs==manifestPath{
+			return nil
+		}
+		rel,err:= filepath.Rel(dir,p)
+		if err!=nil{
+			fail(err)
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		mu.Lock()
+		key,ok:= manifest[rel]
+		mu.Unlock()
+		if ok && opts.SkipExisting && s.store.Has(s.ID,key){
+			return nil
+		}
+		paths <- rel
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+	if walkErr!=nil{
+		errs = append(errs,walkErr)
+	}
+	s.Logger.With("dir",dir).Infof("import done, %d files in the manifest and %d errors",len(manifest),len(errs))
+
+	if len(opts.ManifestPath)>0{
+		if err:= writeManifest(opts.ManifestPath,manifest);err!=nil{
+			errs = append(errs,err)
+		}
+	}
+	return manifest,errors.Join(errs...)
+}
+
+//importer stores the files of one Import. Files with the same content
+//are stored once, the transfers of a Store are tracked by key.
+type importer struct{
+	s 						*FileServer
+	skipExisting 	bool
+
+	mu 		sync.Mutex
+	calls map[string]*importCall
+}
+
+//importCall is the Store of one content key, done is closed once err is
+//set.
+type importCall struct{
+	done 	chan struct{}
+	err 	error
+}
+
+//importFile stores the file at p under the hash of its content, which is
+//read once to hash and once to store. With skipExisting a file stored
+//already isn't stored again.
+func (imp *importer) importFile(ctx context.Context,p string) (string,error){
+	s:= imp.s
+	f,err:= os.Open(p)
+	if err!=nil{
+		return "",err
+	}
+	defer f.Close()
+	h:= sha256.New()
+	if _,err:= io.Copy(h,ctxReader{ctx,f});err!=nil{
+		return "",err
+	}
+	key:= hex.EncodeToString(h.Sum(nil))
+
+	imp.mu.Lock()
+	c,ok:= imp.calls[key]
+	if ok{
+		imp.mu.Unlock()
+		select{
+		case <-c.done:
+			return key,c.err
+		case <-ctx.Done():
+			return "",ctx.Err()
+		}
+	}
+	c = &importCall{done: make(chan struct{})}
+	imp.calls[key] = c
+	imp.mu.Unlock()
+	defer close(c.done)
+
+	if imp.skipExisting && s.store.Has(s.ID,key) && !s.store.Expired(s.ID,key){
+		return key,nil
+	}
+	if _,c.err = f.Seek(0,io.SeekStart);c.err!=nil{
+		return "",c.err
+	}
+	c.err = s.StoreContext(ctx,key,f)
+	return key,c.err
+}
+
+//readManifest reads the manifest an Import wrote to p, empty if there is
+//none yet.
+func readManifest(p string) (map[string]string,error){
+	manifest:= map[string]string{}
+	b,err:= os.ReadFile(p)
+	if errors.Is(err,fs.ErrNotExist){
+		return manifest,nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	if err:= json.Unmarshal(b,&manifest);err!=nil{
+		return nil,fmt.Errorf("manifest %s: %w",p,err)
+	}
+	return manifest,nil
+}
+
+//writeManifest replaces the manifest at p, it is written to a temporary
+//file first so a crash doesn't leave half of it.
+func writeManifest(p string,manifest map[string]string) error{
+	b,err:= json.MarshalIndent(manifest,"","  ")
+	if err!=nil{
+		return err
+	}
+	f,err:= os.CreateTemp(filepath.Dir(p),"."+filepath.Base(p)+tempSuffix)
+	if err!=nil{
+		return err
+	}
+	_,err = f.Write(append(b,'\n'))
+	if cerr:= f.Close();err==nil{
+		err = cerr
+	}
+	if err==nil{
+		err = os.Rename(f.Name(),p)
+	}
+	if err!=nil{
+		os.Remove(f.Name())
+	}
+	return err
+}
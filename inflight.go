@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+//storeLimiter caps the Stores in flight and the bytes they replicate, see
+//MaxInflightStores. A nil storeLimiter doesn't limit.
+type storeLimiter struct{
+	mu 				sync.Mutex
+	maxStores int
+	maxBytes 	int64
+	stores 		int
+	bytes 		int64
+	//wake is closed and replaced whenever a slot is released.
+	wake 			chan struct{}
+}
+
+//newStoreLimiter returns nil when neither maxStores nor maxBytes is set.
+func newStoreLimiter(maxStores int,maxBytes int64) *storeLimiter{
+	if maxStores<=0 && maxBytes<=0{
+		return nil
+	}
+	return &storeLimiter{maxStores: maxStores,maxBytes: maxBytes,wake: make(chan struct{})}
+}
+
+//acquire blocks until stores more Stores and n more bytes fit, or ctx or
+//quit is done. A file larger than maxBytes waits until no other bytes are
+//in flight, so it doesn't wait forever.
+func (l *storeLimiter) acquire(ctx context.Context,quit <-chan struct{},stores int,n int64) error{
+	if l==nil{
+		return nil
+	}
+	for{
+		l.mu.Lock()
+		fitStores:= l.maxStores<=0 || l.stores+stores<=l.maxStores
+		fitBytes:= l.maxBytes<=0 || l.bytes==0 || l.bytes+n<=l.maxBytes
+		if fitStores && fitBytes{
+			l.stores+=stores
+			l.bytes+=n
+			l.mu.Unlock()
+			return nil
+		}
+		wake:= l.wake
+		l.mu.Unlock()
+		select{
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return errStopped
+		}
+	}
+}
+
+//release gives back what acquire took.
+func (l *storeLimiter) release(stores int,n int64){
+	if l==nil{
+		return
+	}
+	l.mu.Lock()
+	l.stores-=stores
+	l.bytes-=n
+	close(l.wake)
+	l.wake = make(chan struct{})
+	l.mu.Unlock()
+}
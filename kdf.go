@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"golang.org/x/crypto/argon2"
+)
+
+//saltFile is where a Store keeps the salt the key of a Passphrase is
+//derived with, it belongs to the files encrypted with that key.
+const(
+	saltFile = ".salt"
+	saltSize = 16
+)
+
+//KDFParams are the Argon2id parameters a key is derived from a passphrase
+//with. Doubling Time or Memory (in KiB) doubles the work of guessing the
+//passphrase of a stolen copy, and the time NewFileServer takes to derive
+//the key. Threads spreads that work over as many cores. The same
+//passphrase with other parameters is another key.
+type KDFParams struct{
+	Time 		uint32
+	Memory 	uint32
+	Threads uint8
+}
+
+//DefaultKDFParams are the second recommendation of RFC 9106: 3 passes over
+//64MiB, a few tenths of a second on current hardware.
+var DefaultKDFParams = KDFParams{Time: 3,Memory: 64<<10,Threads: 4}
+
+//DeriveKey derives a 32 byte EncKey from passphrase and salt with
+//DefaultKDFParams.
+func DeriveKey(passphrase string,salt []byte) []byte{
+	return DefaultKDFParams.DeriveKey(passphrase,salt)
+}
+
+func (p KDFParams) DeriveKey(passphrase string,salt []byte) []byte{
+	return argon2.IDKey([]byte(passphrase),salt,p.Time,p.Memory,p.Threads,32)
+}
+
+//salt returns the salt saved in the backend, it is created the first time.
+func (s *Store) salt() ([]byte,error){
+	_,r,err:= s.Backend.Read(saltFile)
+	if errors.Is(err,fs.ErrNotExist){
+		salt:= make([]byte,saltSize)
+		if _,err:= io.ReadFull(rand.Reader,salt);err!=nil{
+			return nil,err
+		}
+		if _,err:= s.Backend.Write(saltFile,bytes.NewReader(salt));err!=nil{
+			return nil,err
+		}
+		return salt,nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+func TestDeriveKey(t *testing.T){
+	salt:= []byte("0123456789abcdef")
+	key:= DeriveKey("correct horse",salt)
+	if len(key)!=32 || !bytes.Equal(key,DeriveKey("correct horse",salt)){
+		t.Fatalf("want the same 32 byte key for the same passphrase, have %x",key)
+	}
+	fast:= KDFParams{Time: 1,Memory: 1<<10,Threads: 1}
+	for name,other:= range map[string][]byte{
+		"passphrase": DeriveKey("wrong horse",salt),
+		"salt": DeriveKey("correct horse",[]byte("fedcba9876543210")),
+		"params": fast.DeriveKey("correct horse",salt),
+	}{
+		if bytes.Equal(key,other){
+			t.Errorf("want another key for another %s",name)
+		}
+	}
+}
+
+func TestPassphraseKey(t *testing.T){
+	newServer:= func(root string) *FileServer{
+		return NewFileServer(FileServerOpts{
+			StorageRoot: 				root,
+			PathTransformFunc: 	CASpathTransformFunc,
+			Transport: 					p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":3401"}),
+			Passphrase: 				"correct horse",
+			KDF: 								KDFParams{Time: 1,Memory: 1<<10,Threads: 1},
+		})
+	}
+	root:= t.TempDir()
+	a,b:= newServer(root),newServer(root)
+	if a.EncKey==nil || !bytes.Equal(a.EncKey,b.EncKey){
+		t.Fatal("want the key derived with the salt in the storage root")
+	}
+	if c:= newServer(t.TempDir());bytes.Equal(a.EncKey,c.EncKey){
+		t.Error("want another salt, and key, for another storage root")
+	}
+	if !a.store.Backend.Has(saltFile){
+		t.Error("want the salt saved")
+	}
+}
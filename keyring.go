@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+)
+
+//keyIDSuffix marks the sidecar file recording which key the peers' copies
+//of one of our files are encrypted with, so ReencryptAll knows what to
+//migrate. It holds the key ID and the file's key on separate lines.
+const keyIDSuffix = ".keyid"
+
+//keyIDSize is the size of the key fingerprint in the header of an
+//encrypted file.
+const keyIDSize = 8
+
+//keyFingerprint identifies a key ID in the header of an encrypted file
+//without revealing it.
+func keyFingerprint(id string) []byte{
+	sum:= sha256.Sum256([]byte(id))
+	return sum[:keyIDSize]
+}
+
+//keyring holds the keys files can be encrypted with by ID. New files are
+//encrypted with the active key, files are decrypted with the key their
+//header names.
+type keyring struct{
+	lock 		sync.RWMutex
+	keys 		map[string][]byte
+	active 	string
+}
+
+func newKeyring(keys map[string][]byte,active string) *keyring{
+	k:= &keyring{keys: make(map[string][]byte,len(keys)),active: active}
+	for id,key:= range keys{
+		k.keys[id] = key
+	}
+	return k
+}
+
+//activeKey returns the key new files are encrypted with.
+func (k *keyring) activeKey() (string,[]byte,error){
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key,ok:= k.keys[k.active]
+	if !ok{
+		return "",nil,fmt.Errorf("no key for the active key ID %q",k.active)
+	}
+	return k.active,key,nil
+}
+
+func (k *keyring) empty() bool{
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return len(k.keys)==0
+}
+
+func (k *keyring) key(id string) ([]byte,bool){
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key,ok:= k.keys[id]
+	return key,ok
+}
+
+//lookup returns the key for the fingerprint of an encrypted file's header.
+//Files without one predate key IDs, they use the key with the empty ID
+//(EncKey) or else the active key.
+func (k *keyring) lookup(fingerprint []byte) ([]byte,bool){
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if fingerprint==nil{
+		if key,ok:= k.keys[""];ok{
+			return key,true
+		}
+		key,ok:= k.keys[k.active]
+		return key,ok
+	}
+	for id,key:= range k.keys{
+		if bytes.Equal(keyFingerprint(id),fingerprint){
+			return key,true
+		}
+	}
+	return nil,false
+}
+
+func (k *keyring) rotate(id string,key []byte){
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[id] = key
+	k.active = id
+}
+
+//RotateKey adds a key to the keyring and makes it the active key. Files
+//stored from now on are encrypted with it, the older keys stay in the
+//keyring to read what was encrypted with them. Call ReencryptAll to move
+//the peers' copies of our files over to it.
+func (s *FileServer) RotateKey(newID string,newKey []byte) error{
+	if _,err:= aes.NewCipher(newKey);err!=nil{
+		return err
+	}
+	if key,ok:= s.keys.key(newID);ok && !bytes.Equal(key,newKey){
+		return fmt.Errorf("%w: key ID %q is already used for another key",ErrKeyExists,newID)
+	}
+	s.keys.rotate(newID,newKey)
+	s.Logger.With("key_id",newID).Infof("rotated encryption key")
+	return nil
+}
+
+//ReencryptAll replicates our files whose peer copies are encrypted with an
+//older key again with the active key. It runs in the background one file
+//at a time and stops with the server.
+func (s *FileServer) ReencryptAll(){
+	if !s.beginTransfer(){
+		return
+	}
+	go func(){
+		defer s.endTransfer()
+		ctx,cancel:= context.WithCancel(context.Background())
+		defer cancel()
+		go func(){
+			select{
+			case <-s.quitCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		n,err:= s.reencryptAll(ctx)
+		if err!=nil{
+			s.Logger.Errorf("reencrypt error after %d files: %s",n,err)
+			return
+		}
+		s.Logger.Infof("reencrypted %d files",n)
+	}()
+}
+
+func (s *FileServer) reencryptAll(ctx context.Context) (int,error){
+	active,_,err:= s.keys.activeKey()
+	if err!=nil{
+		return 0,err
+	}
+	keys,err:= s.store.keyIDs(s.ID)
+	if err!=nil{
+		return 0,err
+	}
+	n:= 0
+	for key,keyID:= range keys{
+		if keyID==active || !s.store.Has(s.ID,key){
+			continue
+		}
+		if err:= ctx.Err();err!=nil{
+			return n,err
+		}
+		size,f,err:= s.store.Read(s.ID,key)
+		if err!=nil{
+			return n,err
+		}
+		if rc,ok:= f.(io.ReadCloser);ok{
+			rc.Close()
+		}
+		expires,_,err:= s.store.Expiry(s.ID,key)
+		if err!=nil{
+			return n,err
+		}
+		//A peer that missed the new copy keeps serving the old one, its key
+		//is still in the keyring.
+		var replErr *ReplicationError
+		if _,err:= s.replicate(ctx,key,size,expires,nil);errors.As(err,&replErr){
+			s.Logger.With("key",key).Errorf("re-encrypt: %s",err)
+		}else if err!=nil{
+			return n,err
+		}
+		n++
+	}
+	return n,nil
+}
+
+func (s *Store) keyIDPath(id string,key string) string{
+	return s.backendPath(id,key)+keyIDSuffix
+}
+
+//SetKeyID records the ID of the key the peers' copies of the file for key
+//are (or will be) encrypted with, and the key itself.
+func (s *Store) SetKeyID(id string,key string,keyID string) error{
+	_,err:= s.Backend.Write(s.keyIDPath(id,key),strings.NewReader(keyID+"\n"+key))
+	return err
+}
+
+//KeyID returns the ID recorded with SetKeyID, ok is false when there is
+//none.
+func (s *Store) KeyID(id string,key string) (string,bool,error){
+	keyID,_,ok,err:= s.readKeyID(s.keyIDPath(id,key))
+	return keyID,ok,err
+}
+
+func (s *Store) readKeyID(p string) (string,string,bool,error){
+	_,r,err:= s.Backend.Read(p)
+	if errors.Is(err,fs.ErrNotExist){
+		return "","",false,nil
+	}
+	if err!=nil{
+		return "","",false,err
+	}
+	defer r.Close()
+
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return "","",false,err
+	}
+	keyID,key,ok:= strings.Cut(string(b),"\n")
+	if !ok{
+		return "","",false,fmt.Errorf("invalid key ID file %s",p)
+	}
+	return keyID,key,true,nil
+}
+
+//keyIDs returns the recorded key ID of every file stored under id by key.
+func (s *Store) keyIDs(id string) (map[string]string,error){
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return nil,err
+	}
+	keys:= make(map[string]string)
+	for _,p:= range paths{
+		if !strings.HasSuffix(p,keyIDSuffix) || !strings.HasPrefix(p,id+"/"){
+			continue
+		}
+		keyID,key,_,err:= s.readKeyID(p)
+		if err!=nil{
+			return nil,err
+		}
+		keys[key] = keyID
+	}
+	return keys,nil
+}
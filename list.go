@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//MessageListFiles asks a peer for the keys it holds, only the ones that
+//start with Prefix when it is set.
+type MessageListFiles struct{
+	RequestID string
+	Prefix 		string
+}
+
+//MessageFileList is the reply to MessageListFiles.
+type MessageFileList struct{
+	RequestID string
+	Keys 			[]string
+}
+
+//List returns the keys of all files stored on this node.
+func (s *FileServer) List() ([]string,error){
+	return s.store.List()
+}
+
+//ListPrefix returns the keys stored on this node that start with prefix,
+//see Store.ListPrefix.
+func (s *FileServer) ListPrefix(prefix string) ([]string,error){
+	return s.store.ListPrefix(prefix)
+}
+
+//ListNetwork asks every connected peer for its catalog and merges it with
+//the local one. Peers that don't answer within AckTimeout are left out.
+func (s *FileServer) ListNetwork(ctx context.Context) ([]string,error){
+	return s.ListNetworkPrefix(ctx,"")
+}
+
+//ListNetworkPrefix is ListNetwork for the keys that start with prefix.
+func (s *FileServer) ListNetworkPrefix(ctx context.Context,prefix string) ([]string,error){
+	keys,err:= s.ListPrefix(prefix)
+	if err!=nil{
+		return nil,err
+	}
+
+	peers:= s.peerList()
+	id,replies:= s.addRequest(len(peers))
+	defer s.removeRequest(id)
+
+	peers,_ = s.multicast(ctx,&Message{Payload: MessageListFiles{RequestID: id,Prefix: prefix}},peers)
+	if err:= ctx.Err();err!=nil{
+		return nil,err
+	}
+
+	seen:= make(map[string]bool,len(keys))
+	for _,key:= range keys{
+		seen[key] = true
+	}
+	timeout:= time.After(s.AckTimeout)
+	for i:=0;i<len(peers);i++{
+		select{
+		case reply:= <-replies:
+			for _,key:= range reply.Payload.(MessageFileList).Keys{
+				//A peer from before prefixes sends all of its keys.
+				if !seen[key] && strings.HasPrefix(key,prefix){
+					seen[key] = true
+					keys = append(keys,key)
+				}
+			}
+		case <-timeout:
+			s.Logger.Errorf("timed out waiting for file lists")
+			i = len(peers)
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+	sort.Strings(keys)
+	return keys,nil
+}
+
+func (s *FileServer) handleMessageListFiles(from string,msg MessageListFiles) error{
+	peer,ok:= s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+	keys:= []string{}
+	if !s.ReadOnly{
+		var err error
+		if keys,err = s.ListPrefix(msg.Prefix);err!=nil{
+			return err
+		}
+	}
+	return s.send(peer,&Message{Payload: MessageFileList{RequestID: msg.RequestID,Keys: keys}})
+}
+
+func (s *FileServer) handleMessageFileList(from string,msg MessageFileList) error{
+	s.deliverReply(msg.RequestID,from,msg)
+	return nil
+}
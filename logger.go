@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+//Logger is what the FileServer logs through. With returns a Logger that
+//adds the given key/value pairs (like the file key) to every entry.
+type Logger interface{
+	Debugf(format string,args ...any)
+	Infof(format string,args ...any)
+	Errorf(format string,args ...any)
+	With(args ...any) Logger
+}
+
+//slogLogger adapts a *slog.Logger, use a slog.JSONHandler to ship the
+//logs as JSON.
+type slogLogger struct{
+	l *slog.Logger
+}
+
+func NewSlogLogger(l *slog.Logger) Logger{
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Debugf(format string,args ...any){
+	s.l.Debug(fmt.Sprintf(format,args...))
+}
+
+func (s slogLogger) Infof(format string,args ...any){
+	s.l.Info(fmt.Sprintf(format,args...))
+}
+
+func (s slogLogger) Errorf(format string,args ...any){
+	s.l.Error(fmt.Sprintf(format,args...))
+}
+
+func (s slogLogger) With(args ...any) Logger{
+	return slogLogger{l: s.l.With(args...)}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"time"
 	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
 )
@@ -26,12 +28,43 @@ func makeServer(listenAddr string,nodes ...string) *FileServer{
 	}
 
 	s:=NewFileServer(fileServerOpts)
+	tcpTransport.HandshakeFunc = s.Handshake
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	tcpTransport.OnHandshakeError = s.OnHandshakeError
 
 	return s
 }
 
+//runConfig runs the node of the config file until it fails, with the
+//gateway on gateway if set.
+func runConfig(path string,gateway string){
+	opts,err:= LoadConfig(path)
+	if err!=nil{
+		log.Fatal(err)
+	}
+	s:= NewFileServer(opts)
+	tr:= opts.Transport.(*p2p.TCPTransport)
+	tr.HandshakeFunc = s.Handshake
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+	tr.OnHandshakeError = s.OnHandshakeError
+	if len(gateway)>0{
+		go func(){ log.Fatal(http.ListenAndServe(gateway,NewGateway(s)))}()
+	}
+	log.Fatal(s.Start())
+}
+
 func main() {
+	gateway:= flag.String("gateway","","serve the HTTP gateway of the last node on this address after the demo, for cmd/cas")
+	config:= flag.String("config","","run a single node configured by this JSON file instead of the demo, see Config")
+	flag.Parse()
+
+	if len(*config)>0{
+		runConfig(*config,*gateway)
+		return
+	}
+
 	s1 := makeServer(":3000","")
 	s2 := makeServer(":4000","")
 	s3 := makeServer(":5000",":3000",":4000")
@@ -65,5 +98,10 @@ func main() {
 		fmt.Println(string(b))
 	}
 
+	if len(*gateway)>0{
+		log.Printf("serving the gateway on %s",*gateway)
+		log.Fatal(http.ListenAndServe(*gateway,NewGateway(s3)))
+	}
+
 	
 }
\ No newline at end of file
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DiscoverLAN (see FileServerOpts) advertises the node over mDNS as an
+//instance of mdnsService named by its ID, and dials the instances other
+//nodes advertise, at the address the announcement came from and the port
+//of its SRV record.
+const(
+	mdnsService 	= "_cas._tcp.local."
+	mdnsInterval 	= 10*time.Second
+	mdnsTTL 			= 120
+
+	dnsTypePTR 	= 12
+	dnsTypeSRV 	= 33
+	dnsTypeANY 	= 255
+	dnsClassIN 	= 1
+	//dnsCacheFlush tells mDNS caches the record replaces the ones they hold.
+	dnsCacheFlush = 0x8000
+	dnsResponse 	= 0x8400
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224,0,0,251),Port: 5353}
+
+//discoverLAN runs the mDNS responder and browser until the server stops.
+//Without multicast (or a free mDNS port) it logs why and leaves finding
+//peers to the bootstrap nodes.
+func (s *FileServer) discoverLAN(){
+	_,portStr,err:= net.SplitHostPort(s.Transport.Addr())
+	if err!=nil{
+		s.Logger.Errorf("LAN discovery unavailable: %s",err)
+		return
+	}
+	port,err:= strconv.Atoi(portStr)
+	if err!=nil{
+		s.Logger.Errorf("LAN discovery unavailable: %s",err)
+		return
+	}
+	conn,err:= net.ListenMulticastUDP("udp4",nil,mdnsGroup)
+	if err!=nil{
+		s.Logger.Errorf("LAN discovery unavailable: %s",err)
+		return
+	}
+	go func(){
+		<-s.quitCh
+		conn.Close()
+	}()
+
+	instance:= s.ID+"."+mdnsService
+	announcement:= mdnsAnnouncement(instance,uint16(port))
+	go func(){
+		ticker:= time.NewTicker(mdnsInterval)
+		defer ticker.Stop()
+		query:= mdnsQuery()
+		for{
+			//Announcing ourselves lets the nodes already up dial us right away.
+			conn.WriteToUDP(announcement,mdnsGroup)
+			conn.WriteToUDP(query,mdnsGroup)
+			select{
+			case <-ticker.C:
+			case <-s.quitCh:
+				return
+			}
+		}
+	}()
+
+	buf:= make([]byte,9000)
+	for{
+		n,from,err:= conn.ReadFromUDP(buf)
+		if err!=nil{
+			select{
+			case <-s.quitCh:
+			default:
+				s.Logger.Errorf("LAN discovery stopped: %s",err)
+			}
+			return
+		}
+		msg,err:= parseMDNS(buf[:n])
+		if err!=nil{
+			//Not every mDNS packet on a LAN is one we can make sense of.
+			continue
+		}
+		if msg.query{
+			if msg.asks(mdnsService){
+				conn.WriteToUDP(announcement,mdnsGroup)
+			}
+			continue
+		}
+		for name,port:= range msg.instances(mdnsService){
+			if strings.EqualFold(name,instance){
+				continue
+			}
+			addr:= net.JoinHostPort(from.IP.String(),strconv.Itoa(int(port)))
+			s.dialDiscovered(addr,localAddrFor(addr,s.Transport.Addr()),"dialing peer found on the LAN")
+		}
+	}
+}
+
+//localAddrFor returns our listen address as the node at remote sees it,
+//the host is the one of the interface that routes to remote.
+func localAddrFor(remote string,listen string) string{
+	c,err:= net.Dial("udp",remote)
+	if err!=nil{
+		return listen
+	}
+	defer c.Close()
+	return dialAddr(listen,c.LocalAddr().String())
+}
+
+func mdnsQuery() []byte{
+	b:= dnsHeader(0,1,0,0)
+	b = appendDNSName(b,mdnsService)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(b,dnsTypePTR),dnsClassIN)
+}
+
+//mdnsAnnouncement answers a query for mdnsService with the PTR record of
+//instance and its SRV record.
+func mdnsAnnouncement(instance string,port uint16) []byte{
+	b:= dnsHeader(dnsResponse,0,1,1)
+	b = appendDNSRecord(b,mdnsService,dnsTypePTR,dnsClassIN,appendDNSName(nil,instance))
+	srv:= binary.BigEndian.AppendUint16(make([]byte,4),port)
+	srv = appendDNSName(srv,strings.TrimSuffix(instance,mdnsService)+"local.")
+	return appendDNSRecord(b,instance,dnsTypeSRV,dnsClassIN|dnsCacheFlush,srv)
+}
+
+func dnsHeader(flags uint16,questions uint16,answers uint16,additional uint16) []byte{
+	b:= make([]byte,12)
+	binary.BigEndian.PutUint16(b[2:],flags)
+	binary.BigEndian.PutUint16(b[4:],questions)
+	binary.BigEndian.PutUint16(b[6:],answers)
+	binary.BigEndian.PutUint16(b[10:],additional)
+	return b
+}
+
+func appendDNSName(b []byte,name string) []byte{
+	for _,label:= range strings.Split(strings.TrimSuffix(name,"."),"."){
+		b = append(b,byte(len(label)))
+		b = append(b,label...)
+	}
+	return append(b,0)
+}
+
+func appendDNSRecord(b []byte,name string,typ uint16,class uint16,data []byte) []byte{
+	b = appendDNSName(b,name)
+	b = binary.BigEndian.AppendUint16(b,typ)
+	b = binary.BigEndian.AppendUint16(b,class)
+	b = binary.BigEndian.AppendUint32(b,mdnsTTL)
+	b = binary.BigEndian.AppendUint16(b,uint16(len(data)))
+	return append(b,data...)
+}
+
+//mdnsMessage is what we read off an mDNS packet: the questions of a query,
+//the PTR and SRV records of a response.
+type mdnsMessage struct{
+	query 		bool
+	questions map[string]uint16
+	ptrs 			map[string][]string
+	ports 		map[string]uint16
+}
+
+var errDNSFormat = errors.New("malformed DNS message")
+
+func parseMDNS(b []byte) (*mdnsMessage,error){
+	if len(b)<12{
+		return nil,errDNSFormat
+	}
+	msg:= &mdnsMessage{
+		query: 			binary.BigEndian.Uint16(b[2:])&0x8000==0,
+		questions: 	make(map[string]uint16),
+		ptrs: 			make(map[string][]string),
+		ports: 			make(map[string]uint16),
+	}
+	counts:= [4]int{}
+	for i:= range counts{
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+
+	off:= 12
+	for i:=0;i<counts[0];i++{
+		name,next,err:= readDNSName(b,off)
+		if err!=nil || next+4>len(b){
+			return nil,errDNSFormat
+		}
+		msg.questions[strings.ToLower(name)] = binary.BigEndian.Uint16(b[next:])
+		off = next+4
+	}
+	for i:=0;i<counts[1]+counts[2]+counts[3];i++{
+		name,next,err:= readDNSName(b,off)
+		if err!=nil || next+10>len(b){
+			return nil,errDNSFormat
+		}
+		typ:= binary.BigEndian.Uint16(b[next:])
+		length:= int(binary.BigEndian.Uint16(b[next+8:]))
+		data:= next+10
+		if data+length>len(b){
+			return nil,errDNSFormat
+		}
+		name = strings.ToLower(name)
+		switch typ{
+		case dnsTypePTR:
+			target,_,err:= readDNSName(b,data)
+			if err!=nil{
+				return nil,errDNSFormat
+			}
+			msg.ptrs[name] = append(msg.ptrs[name],strings.ToLower(target))
+		case dnsTypeSRV:
+			if length<6{
+				return nil,errDNSFormat
+			}
+			msg.ports[name] = binary.BigEndian.Uint16(b[data+4:])
+		}
+		off = data+length
+	}
+	return msg,nil
+}
+
+//asks tells whether the query asks for the instances of service.
+func (m *mdnsMessage) asks(service string) bool{
+	typ,ok:= m.questions[strings.ToLower(service)]
+	return ok && (typ==dnsTypePTR || typ==dnsTypeANY)
+}
+
+//instances returns the port of every instance of service the message
+//holds an SRV record for.
+func (m *mdnsMessage) instances(service string) map[string]uint16{
+	found:= make(map[string]uint16)
+	for _,name:= range m.ptrs[strings.ToLower(service)]{
+		if port,ok:= m.ports[name];ok{
+			found[name] = port
+		}
+	}
+	return found
+}
+
+//readDNSName reads the name at off, following compression pointers, and
+//returns it with the offset right after it.
+func readDNSName(b []byte,off int) (string,int,error){
+	var(
+		labels 	[]string
+		next 		= -1
+	)
+	for jumps:=0;;{
+		if off>=len(b){
+			return "",0,errDNSFormat
+		}
+		n:= int(b[off])
+		switch{
+		case n==0:
+			if next<0{
+				next = off+1
+			}
+			return strings.Join(labels,".")+".",next,nil
+		case n&0xc0==0xc0:
+			if off+1>=len(b) || jumps>=16{
+				return "",0,errDNSFormat
+			}
+			if next<0{
+				next = off+2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:])&0x3fff)
+			jumps++
+		default:
+			if off+1+n>len(b){
+				return "",0,errDNSFormat
+			}
+			labels = append(labels,string(b[off+1:off+1+n]))
+			off+=1+n
+		}
+	}
+}
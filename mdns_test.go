@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestMDNSMessages(t *testing.T){
+	query,err:= parseMDNS(mdnsQuery())
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if !query.query || !query.asks(mdnsService){
+		t.Errorf("want a query for %s, have %+v",mdnsService,query)
+	}
+
+	instance:= "node1."+mdnsService
+	answer,err:= parseMDNS(mdnsAnnouncement(instance,3000))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if answer.query{
+		t.Error("want a response")
+	}
+	if found:= answer.instances(mdnsService);len(found)!=1 || found[instance]!=3000{
+		t.Errorf("want %s at port 3000, have %v",instance,found)
+	}
+
+	//Other responders compress names, the PTR target points back into the
+	//name of the record.
+	b:= dnsHeader(dnsResponse,0,1,1)
+	b = appendDNSName(b,mdnsService)
+	b = binary.BigEndian.AppendUint16(b,dnsTypePTR)
+	b = binary.BigEndian.AppendUint16(b,dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b,mdnsTTL)
+	b = binary.BigEndian.AppendUint16(b,8)
+	b = append(b,5,'n','o','d','e','2',0xc0,12)
+	srv:= binary.BigEndian.AppendUint16(make([]byte,4),3001)
+	srv = append(srv,0xc0,12)
+	b = append(b,0xc0,byte(len(b)-8))
+	b = binary.BigEndian.AppendUint16(b,dnsTypeSRV)
+	b = binary.BigEndian.AppendUint16(b,dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b,mdnsTTL)
+	b = binary.BigEndian.AppendUint16(b,uint16(len(srv)))
+	b = append(b,srv...)
+	compressed,err:= parseMDNS(b)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if found:= compressed.instances(mdnsService);found["node2."+mdnsService]!=3001{
+		t.Errorf("want node2 at port 3001, have %v",found)
+	}
+
+	if _,err:= parseMDNS(b[:len(b)-3]);err==nil{
+		t.Error("want a truncated message to fail")
+	}
+}
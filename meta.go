@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+const(
+	//metaSuffix marks the sidecar file holding the metadata of a file.
+	metaSuffix 		= ".meta"
+	//maxMetaBytes is the largest metadata, JSON encoded, a file can have.
+	maxMetaBytes 	= 4096
+)
+
+//MetaContentType is the metadata the gateway serves a file with as its
+//Content-Type.
+const MetaContentType = "content-type"
+
+//ErrMetaTooLarge is returned for metadata over maxMetaBytes.
+var ErrMetaTooLarge = errors.New("metadata too large")
+
+//MessageFileMeta replaces the metadata of the file for Key stored by the
+//node with ID, see SetMeta.
+type MessageFileMeta struct{
+	ID 		string
+	Key 	string
+	Meta 	map[string]string
+}
+
+//StoreWithMeta is like Store but also keeps meta (a content type, the
+//original file name, tags) with the file, here and on the peers it is
+//replicated to. The file itself can't be changed, its metadata can with
+//SetMeta. The metadata is sent and kept in the clear, unlike the file.
+func (s *FileServer) StoreWithMeta(key string,r io.Reader,meta map[string]string) error{
+	return s.StoreWithMetaContext(context.Background(),key,r,meta)
+}
+
+func (s *FileServer) StoreWithMetaContext(ctx context.Context,key string,r io.Reader,meta map[string]string) error{
+	if err:= checkMeta(meta);err!=nil{
+		return err
+	}
+	_,err:= s.storeFileMeta(ctx,key,r,0,meta)
+	return err
+}
+
+//Meta returns the metadata of our copy of the file for key, empty if it
+//was stored without. It fails with ErrNotFound if the file isn't stored
+//locally.
+func (s *FileServer) Meta(key string) (map[string]string,error){
+	if !s.store.Has(s.ID,key){
+		return nil,fmt.Errorf("[%s] %w: (%s)",s.Transport.Addr(),ErrNotFound,key)
+	}
+	return s.store.Meta(s.ID,key)
+}
+
+//SetMeta replaces the metadata of the file for key, which has to be
+//stored locally, and sends it to the peers. Those holding a copy replace
+//theirs, an empty meta removes it.
+func (s *FileServer) SetMeta(key string,meta map[string]string) error{
+	return s.SetMetaContext(context.Background(),key,meta)
+}
+
+func (s *FileServer) SetMetaContext(ctx context.Context,key string,meta map[string]string) error{
+	if err:= checkMeta(meta);err!=nil{
+		return err
+	}
+	if !s.store.Has(s.ID,key){
+		return fmt.Errorf("[%s] %w: (%s)",s.Transport.Addr(),ErrNotFound,key)
+	}
+	if err:= s.store.SetMeta(s.ID,key,meta);err!=nil{
+		return err
+	}
+	if s.ReadOnly{
+		return nil
+	}
+	return s.broadcastContext(ctx,&Message{
+		Payload: MessageFileMeta{
+			ID: s.ID,
+			Key: hashKey(key),
+			Meta: meta,
+		},
+	})
+}
+
+func (s *FileServer) handleMessageFileMeta(from string,msg MessageFileMeta) error{
+	if err:= checkMeta(msg.Meta);err!=nil{
+		return err
+	}
+	if err:= s.ownedBy(msg.ID,from);err!=nil{
+		return err
+	}
+	//The peers that never received the file have nothing to update.
+	if !s.store.Has(msg.ID,msg.Key){
+		return nil
+	}
+	if err:= s.store.SetMeta(msg.ID,msg.Key,msg.Meta);err!=nil{
+		return err
+	}
+	s.Logger.With("key",msg.Key,"peer",from).Infof("updated metadata")
+	return nil
+}
+
+//storeFileMeta is storeFile keeping meta with the file before it is
+//replicated, a nil meta keeps the metadata the file has.
+func (s *FileServer) storeFileMeta(ctx context.Context,key string,r io.Reader,ttl time.Duration,meta map[string]string) (replication,error){
+	if meta==nil{
+		return s.storeFile(ctx,key,r,ttl)
+	}
+	existed:= s.store.Has(s.ID,key)
+	old,err:= s.store.Meta(s.ID,key)
+	if err!=nil{
+		return replication{},err
+	}
+	if err:= s.store.SetMeta(s.ID,key,meta);err!=nil{
+		return replication{},err
+	}
+	rep,err:= s.storeFile(ctx,key,r,ttl)
+	var replErr *ReplicationError
+	if err!=nil && !errors.As(err,&replErr){
+		//The file wasn't stored, the metadata is put back.
+		if !existed{
+			old = nil
+		}
+		s.store.SetMeta(s.ID,key,old)
+	}
+	return rep,err
+}
+
+func checkMeta(meta map[string]string) error{
+	b,err:= json.Marshal(meta)
+	if err!=nil{
+		return err
+	}
+	if len(b)>maxMetaBytes{
+		return fmt.Errorf("%w: %d bytes, at most %d",ErrMetaTooLarge,len(b),maxMetaBytes)
+	}
+	return nil
+}
+
+func (s *Store) metaPath(id string,key string) string{
+	return s.backendPath(id,key)+metaSuffix
+}
+
+//SetMeta records the metadata of the file for key, an empty meta removes
+//it.
+func (s *Store) SetMeta(id string,key string,meta map[string]string) error{
+	if len(meta)==0{
+		return s.Backend.Delete(s.metaPath(id,key))
+	}
+	b,err:= json.Marshal(meta)
+	if err!=nil{
+		return err
+	}
+	_,err = s.Backend.Write(s.metaPath(id,key),bytes.NewReader(b))
+	return diskError(err)
+}
+
+//Meta returns the metadata recorded with SetMeta, empty for files without.
+func (s *Store) Meta(id string,key string) (map[string]string,error){
+	meta:= map[string]string{}
+	_,r,err:= s.Backend.Read(s.metaPath(id,key))
+	if errors.Is(err,fs.ErrNotExist){
+		return meta,nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	defer r.Close()
+	if err:= json.NewDecoder(r).Decode(&meta);err!=nil{
+		return nil,err
+	}
+	return meta,nil
+}
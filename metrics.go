@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//Metrics holds the prometheus collectors of a FileServer. All methods
+//are safe on a nil *Metrics, so a node without metrics records nothing.
+type Metrics struct{
+	registry 			*prometheus.Registry
+	bytesStored 	prometheus.Counter
+	bytesServed 	prometheus.Counter
+	filesFetched 	*prometheus.CounterVec
+	peers 				prometheus.Gauge
+	rejectedPeers prometheus.Counter
+	fetchLatency 	prometheus.Histogram
+}
+
+func NewMetrics() *Metrics{
+	m:= &Metrics{
+		registry: prometheus.NewRegistry(),
+		bytesStored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cas_bytes_stored_total",
+			Help: "Bytes written to the local store.",
+		}),
+		bytesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cas_bytes_served_total",
+			Help: "Bytes served to peers over the network.",
+		}),
+		filesFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cas_files_fetched_total",
+			Help: "Files returned by Get, by source (local or network).",
+		},[]string{"source"}),
+		peers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cas_peers",
+			Help: "Currently connected peers.",
+		}),
+		rejectedPeers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cas_peers_rejected_total",
+			Help: "Connections closed because MaxPeers peers were connected.",
+		}),
+		fetchLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "cas_fetch_latency_seconds",
+			Help: "Time it took to fetch a file from the network.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	m.registry.MustRegister(m.bytesStored,m.bytesServed,m.filesFetched,m.peers,m.rejectedPeers,m.fetchLatency)
+	return m
+}
+
+func (m *Metrics) addBytesStored(n int64){
+	if m!=nil{
+		m.bytesStored.Add(float64(n))
+	}
+}
+
+func (m *Metrics) addBytesServed(n int64){
+	if m!=nil{
+		m.bytesServed.Add(float64(n))
+	}
+}
+
+func (m *Metrics) fetchedLocal(){
+	if m!=nil{
+		m.filesFetched.WithLabelValues("local").Inc()
+	}
+}
+
+func (m *Metrics) fetchedNetwork(start time.Time){
+	if m!=nil{
+		m.filesFetched.WithLabelValues("network").Inc()
+		m.fetchLatency.Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) setPeers(n int){
+	if m!=nil{
+		m.peers.Set(float64(n))
+	}
+}
+
+func (m *Metrics) rejectedPeer(){
+	if m!=nil{
+		m.rejectedPeers.Inc()
+	}
+}
+
+//MetricsHandler serves the metrics in the prometheus text format, mount it
+//under /metrics. Without Metrics configured it responds 404.
+func (s *FileServer) MetricsHandler() http.Handler{
+	if s.Metrics==nil{
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(s.Metrics.registry,promhttp.HandlerOpts{})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+//migrateJournal is where Migrate lists the moves it is making, a
+//migration that was interrupted is finished from it. The journal ends
+//with journalEnd, one without it was cut short before any move was made.
+const(
+	migrateJournal 	= ".migrate"
+	journalEnd 			= "end"
+)
+
+//Migrate moves every file of the Store, with its sidecars, to the path
+//newTransform gives its key and makes newTransform the PathTransformFunc.
+//The store must not be in use meanwhile.
+//
+//A hashing transform like CASpathTransformFunc can't be reversed, so the
+//keys Migrate can't recover otherwise (from a reversible transform or
+//the record ReencryptAll keeps) have to be passed in keys. Nothing is
+//moved unless the key of every file is known.
+//
+//The moves are journaled before the first one is made. If Migrate is
+//interrupted, calling it again with the same transform finishes them.
+func (s *Store) Migrate(newTransform PathTransformFunc,keys ...string) error{
+	if err:= s.checkTransform();err!=nil{
+		return err
+	}
+	want:= transformFingerprint(newTransform)
+
+	moves,fingerprint,ok,err:= s.readJournal()
+	if err!=nil{
+		return err
+	}
+	if ok && fingerprint!=want{
+		return fmt.Errorf("an interrupted migration to another path transform (%s) has to be finished first",fingerprint)
+	}
+	if !ok{
+		if moves,err = s.planMigration(newTransform,keys);err!=nil{
+			return err
+		}
+		if err:= s.writeJournal(want,moves);err!=nil{
+			return err
+		}
+	}
+
+	for _,m:= range moves{
+		if err:= s.move(m[0],m[1]);err!=nil{
+			return fmt.Errorf("migrate %s: %w",m[0],err)
+		}
+	}
+	if _,err:= s.Backend.Write(transformMarker,strings.NewReader(want));err!=nil{
+		return err
+	}
+	s.PathTransformFunc = newTransform
+	return s.Backend.Delete(migrateJournal)
+}
+
+//planMigration returns the moves (from, to) that put every file and its
+//sidecars at the path of newTransform.
+func (s *Store) planMigration(newTransform PathTransformFunc,keys []string) ([][2]string,error){
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return nil,err
+	}
+	known,err:= s.knownKeys(paths,keys)
+	if err!=nil{
+		return nil,err
+	}
+
+	var(
+		moves 			[][2]string
+		unknown 		[]string
+		existing 		= make(map[string]bool,len(paths))
+	)
+	for _,p:= range paths{
+		existing[p] = true
+	}
+	for _,p:= range paths{
+		//The first element is the id the file is stored under.
+		id,fullPath,ok:= strings.Cut(p,"/")
+		if !ok || isSidecar(p){
+			continue
+		}
+		key,ok:= known[fullPath]
+		if !ok{
+			key,ok = s.recoverKey(fullPath)
+		}
+		if !ok{
+			unknown = append(unknown,p)
+			continue
+		}
+		to:= id+"/"+newTransform(key).FullPath()
+		if to==p{
+			continue
+		}
+		for _,m:= range append([][2]string{{p,to}},sidecarMoves(p,to,existing)...){
+			if existing[m[1]]{
+				return nil,fmt.Errorf("%w: can't move %s to %s, it is taken",ErrKeyExists,m[0],m[1])
+			}
+			moves = append(moves,m)
+		}
+	}
+	if len(unknown)>0{
+		return nil,fmt.Errorf("the keys of %d files are unknown (like %s), pass them to Migrate",len(unknown),unknown[0])
+	}
+	return moves,nil
+}
+
+//knownKeys maps the full paths (below the id) of the files to their key,
+//for the files in paths ReencryptAll keeps a record of and for keys.
+func (s *Store) knownKeys(paths []string,keys []string) (map[string]string,error){
+	known:= make(map[string]string)
+	for _,key:= range keys{
+		known[s.PathTransformFunc(key).FullPath()] = key
+	}
+	for _,p:= range paths{
+		if !strings.HasSuffix(p,keyIDSuffix){
+			continue
+		}
+		_,key,_,err:= s.readKeyID(p)
+		if err!=nil{
+			return nil,err
+		}
+		if _,fullPath,ok:= strings.Cut(strings.TrimSuffix(p,keyIDSuffix),"/");ok{
+			known[fullPath] = key
+		}
+	}
+	return known,nil
+}
+
+//recoverKey returns the key PathTransformFunc turned into fullPath, if
+//the transform can be reversed.
+func (s *Store) recoverKey(fullPath string) (string,bool){
+	if key:= s.reverseKey(fullPath);s.PathTransformFunc(key).FullPath()==fullPath{
+		return key,true
+	}
+	return "",false
+}
+
+func sidecarMoves(from string,to string,existing map[string]bool) [][2]string{
+	var moves [][2]string
+	for _,suffix:= range sidecarSuffixes{
+		if existing[from+suffix]{
+			moves = append(moves,[2]string{from+suffix,to+suffix})
+		}
+	}
+	return moves
+}
+
+//move copies from to to and then deletes from. Both may exist after a
+//crash, moving again overwrites to.
+func (s *Store) move(from string,to string) error{
+	_,r,err:= s.Backend.Read(from)
+	if errors.Is(err,fs.ErrNotExist){
+		//Moved before the migration was interrupted.
+		return nil
+	}
+	if err!=nil{
+		return err
+	}
+	_,err = s.Backend.Write(to,r)
+	r.Close()
+	if err!=nil{
+		return err
+	}
+	return s.Backend.Delete(from)
+}
+
+//writeJournal records the fingerprint of the new transform and the moves,
+//one per line.
+func (s *Store) writeJournal(fingerprint string,moves [][2]string) error{
+	var b strings.Builder
+	b.WriteString(fingerprint+"\n")
+	for _,m:= range moves{
+		b.WriteString(m[0]+"\t"+m[1]+"\n")
+	}
+	b.WriteString(journalEnd+"\n")
+	_,err:= s.Backend.Write(migrateJournal,strings.NewReader(b.String()))
+	return err
+}
+
+func (s *Store) readJournal() ([][2]string,string,bool,error){
+	_,r,err:= s.Backend.Read(migrateJournal)
+	if errors.Is(err,fs.ErrNotExist){
+		return nil,"",false,nil
+	}
+	if err!=nil{
+		return nil,"",false,err
+	}
+	defer r.Close()
+
+	sc:= bufio.NewScanner(r)
+	if !sc.Scan(){
+		return nil,"",false,sc.Err()
+	}
+	fingerprint:= sc.Text()
+	var moves [][2]string
+	for sc.Scan(){
+		if sc.Text()==journalEnd{
+			return moves,fingerprint,true,nil
+		}
+		from,to,ok:= strings.Cut(sc.Text(),"\t")
+		if !ok{
+			return nil,"",false,fmt.Errorf("invalid migration journal line %q",sc.Text())
+		}
+		moves = append(moves,[2]string{from,to})
+	}
+	if err:= sc.Err();err!=nil{
+		return nil,"",false,err
+	}
+	return nil,"",false,nil
+}
@@ -1,10 +1,32 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 )
 
+//ErrIntegrity is matched by the errors of data that doesn't match its
+//checksum or hash, like ErrChecksum.
+var ErrIntegrity = errors.New("integrity check failed")
+
+//ErrChecksum is returned by Defaultdecoder for a message that doesn't match
+//its checksum. The whole frame was read, the next one can be decoded. It
+//matches ErrIntegrity.
+var ErrChecksum = fmt.Errorf("%w: message checksum mismatch",ErrIntegrity)
+
+//ErrMessageTooLarge is returned by Defaultdecoder for a message longer
+//than its MaxMessageSize. Nothing of it was read, the connection is out
+//of frame.
+var ErrMessageTooLarge = errors.New("message too large")
+
+//DefaultMaxMessageSize is the MaxMessageSize of a Defaultdecoder that has
+//none set.
+const DefaultMaxMessageSize = 16<<20
+
 type Decoder interface {
 	Decode(io.Reader,*RPC) error
 }
@@ -15,7 +37,11 @@ func (dec GOBdecoder) Decode(r io.Reader, msg *RPC) error{
 	return gob.NewDecoder(r).Decode(msg)
 }
 
-type Defaultdecoder struct{}
+type Defaultdecoder struct{
+	//MaxMessageSize is the longest message that is read, so a peer can't
+	//have us allocate whatever length it puts in front of a message.
+	MaxMessageSize uint32
+}
 
 func (dec Defaultdecoder) Decode(r io.Reader,msg *RPC) error{
 	peekBuf:= make([]byte,1)
@@ -27,16 +53,74 @@ func (dec Defaultdecoder) Decode(r io.Reader,msg *RPC) error{
 	stream:= peekBuf[0] ==IncomingStream
 	if stream{
 		msg.Stream = true
+		return binary.Read(r,binary.LittleEndian,&msg.StreamID)
+	}
+	if peekBuf[0]==MessagePing || peekBuf[0]==MessagePong{
+		msg.Control = peekBuf[0]
 		return nil
 	}
+	if peekBuf[0]==StreamData{
+		return decodeStreamData(r,msg)
+	}
 	
-	buf := make([]byte, 1024)
-	n,err:= r.Read(buf)
-	if err!=nil{
+	//Messages are length prefixed (see EncodeMessage) so a message is never
+	//cut short or merged with whatever the peer sends right after it. The
+	//CRC32 of the length and payload follows the length, a corrupt message
+	//is dropped before anyone tries to decode it.
+	header:= make([]byte,8)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return err
+	}
+	n:= binary.LittleEndian.Uint32(header[0:4])
+	limit:= dec.MaxMessageSize
+	if limit==0{
+		limit = DefaultMaxMessageSize
+	}
+	if n>limit{
+		return fmt.Errorf("%w: %d bytes exceed %d",ErrMessageTooLarge,n,limit)
+	}
+	buf := make([]byte,n)
+	if _,err:= io.ReadFull(r,buf);err!=nil{
 		return err
 	}
+	if checksum(header[0:4],buf)!=binary.LittleEndian.Uint32(header[4:8]){
+		return ErrChecksum
+	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 
 	return nil
-}
\ No newline at end of file
+}
+
+//decodeStreamData reads a StreamData frame after its type byte.
+func decodeStreamData(r io.Reader,msg *RPC) error{
+	header:= make([]byte,8)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return err
+	}
+	n:= binary.LittleEndian.Uint32(header[4:8])
+	if n>streamFrameSize{
+		return fmt.Errorf("stream frame of %d bytes exceeds %d",n,streamFrameSize)
+	}
+	msg.Control = StreamData
+	msg.StreamID = binary.LittleEndian.Uint32(header[0:4])
+	msg.Payload = make([]byte,n)
+	_,err:= io.ReadFull(r,msg.Payload)
+	return err
+}
+
+//EncodeMessage frames payload the way Defaultdecoder expects it: the
+//IncomingMessage byte, the payload length, the checksum and the payload
+//itself.
+func EncodeMessage(payload []byte) []byte{
+	buf:= make([]byte,9+len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:5],uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[5:9],checksum(buf[1:5],payload))
+	copy(buf[9:],payload)
+	return buf
+}
+
+func checksum(length []byte,payload []byte) uint32{
+	return crc32.Update(crc32.ChecksumIEEE(length),crc32.IEEETable,payload)
+}
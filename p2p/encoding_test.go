@@ -0,0 +1,35 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultdecoderChecksum(t *testing.T){
+	corrupt:= EncodeMessage([]byte("corrupt message"))
+	corrupt[len(corrupt)-1] ^= 0x1
+	r:= bytes.NewReader(append(corrupt,EncodeMessage([]byte("next message"))...))
+
+	rpc:= RPC{}
+	err:= Defaultdecoder{}.Decode(r,&rpc)
+	assert.ErrorIs(t,err,ErrChecksum)
+	assert.ErrorIs(t,err,ErrIntegrity)
+	assert.Nil(t,rpc.Payload)
+
+	//The corrupt frame was consumed, the next one decodes.
+	assert.Nil(t,Defaultdecoder{}.Decode(r,&rpc))
+	assert.Equal(t,[]byte("next message"),rpc.Payload)
+}
+
+func TestDefaultdecoderMaxMessageSize(t *testing.T){
+	msg:= EncodeMessage(make([]byte,100))
+	rpc:= RPC{}
+	assert.ErrorIs(t,Defaultdecoder{MaxMessageSize: 99}.Decode(bytes.NewReader(msg),&rpc),ErrMessageTooLarge)
+	assert.Nil(t,Defaultdecoder{MaxMessageSize: 100}.Decode(bytes.NewReader(msg),&rpc))
+
+	//The length alone is enough to turn down a message, its bytes never arrive.
+	huge:= EncodeMessage(nil)
+	huge[1],huge[2],huge[3],huge[4] = 0xff,0xff,0xff,0xff
+	assert.ErrorIs(t,Defaultdecoder{}.Decode(bytes.NewReader(huge),&rpc),ErrMessageTooLarge)
+}
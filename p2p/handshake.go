@@ -1,6 +1,73 @@
 package p2p
 
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
 //HandshakeFunc....
 type HandshakeFunc func (Peer) error
 
-func NOPHandshakeFunc(Peer) error {return nil}
\ No newline at end of file
+func NOPHandshakeFunc(Peer) error {return nil}
+
+//ErrAuthFailed is returned when a remote doesn't prove it knows the
+//ClusterSecret.
+var ErrAuthFailed = errors.New("p2p: cluster secret mismatch")
+
+const(
+	authNonceSize = 32
+	authTimeout 	= 10*time.Second
+)
+
+//authenticate proves to the remote that we know secret and checks it
+//does too. Both sides send a random nonce and answer the remote's with
+//its HMAC, keyed by the secret and bound to the side answering so a
+//remote can't just reflect our own answer back. It has to be done within
+//authTimeout, or by deadline if that comes first.
+func authenticate(conn net.Conn,secret []byte,outbound bool,deadline time.Time) error{
+	if limit:= time.Now().Add(authTimeout);deadline.IsZero() || limit.Before(deadline){
+		deadline = limit
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	nonce:= make([]byte,authNonceSize)
+	if _,err:= io.ReadFull(rand.Reader,nonce);err!=nil{
+		return err
+	}
+	if _,err:= conn.Write(nonce);err!=nil{
+		return err
+	}
+	remoteNonce:= make([]byte,authNonceSize)
+	if _,err:= io.ReadFull(conn,remoteNonce);err!=nil{
+		return err
+	}
+
+	if _,err:= conn.Write(authMAC(secret,outbound,remoteNonce));err!=nil{
+		return err
+	}
+	mac:= make([]byte,sha256.Size)
+	if _,err:= io.ReadFull(conn,mac);err!=nil{
+		return err
+	}
+	if !hmac.Equal(mac,authMAC(secret,!outbound,nonce)){
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func authMAC(secret []byte,dialer bool,nonce []byte) []byte{
+	h:= hmac.New(sha256.New,secret)
+	if dialer{
+		h.Write([]byte("dialer"))
+	}else{
+		h.Write([]byte("listener"))
+	}
+	h.Write(nonce)
+	return h.Sum(nil)
+}
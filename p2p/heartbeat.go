@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//pongQuiet is how long a connection has to go without writes before a
+//ping is answered when no HeartbeatInterval is set. Anything we wrote
+//more recently tells the remote we are alive as well as a pong would.
+const pongQuiet = time.Second
+
+//activityConn records when a connection last read and wrote, so the
+//heartbeat knows when it is idle. Pings and pongs are only written on a
+//connection that wrote nothing for a while, and never inside a frame: a
+//Send is one write.
+type activityConn struct{
+	net.Conn
+	lastRead 	atomic.Int64
+	lastWrite atomic.Int64
+	//writeLock keeps a control frame from slipping in between the check
+	//that the connection is idle and the write of the frame.
+	writeLock sync.Mutex
+	//pinged is when the unanswered ping was sent, rtt how long the last
+	//one took to be answered, both in nanoseconds.
+	pinged 		atomic.Int64
+	rtt 			atomic.Int64
+}
+
+func newActivityConn(conn net.Conn) *activityConn{
+	c:= &activityConn{Conn: conn}
+	now:= time.Now().UnixNano()
+	c.lastRead.Store(now)
+	c.lastWrite.Store(now)
+	return c
+}
+
+func (c *activityConn) Read(b []byte) (int,error){
+	n,err:= c.Conn.Read(b)
+	if n>0{
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n,err
+}
+
+func (c *activityConn) Write(b []byte) (int,error){
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	defer c.lastWrite.Store(time.Now().UnixNano())
+	return c.Conn.Write(b)
+}
+
+//writeControl writes the control frame b unless the connection wrote in
+//the last quiet, ok reports whether it did. Control frames don't count as
+//writes, so two ends pinging each other at once still answer (and time)
+//each other's pings.
+func (c *activityConn) writeControl(b byte,quiet time.Duration) (bool,error){
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if time.Since(time.Unix(0,c.lastWrite.Load()))<quiet{
+		return false,nil
+	}
+	_,err:= c.Conn.Write([]byte{b})
+	return err==nil,err
+}
+
+//ponged records the round trip of the ping a pong answers.
+func (c *activityConn) ponged(){
+	if sent:= c.pinged.Swap(0);sent!=0{
+		c.rtt.Store(time.Now().UnixNano()-sent)
+	}
+}
+
+func (c *activityConn) readSince(t time.Time) bool{
+	return c.lastRead.Load()>t.UnixNano()
+}
+
+func (c *activityConn) readIdle(d time.Duration) bool{
+	return time.Since(time.Unix(0,c.lastRead.Load()))>=d
+}
+
+//heartbeat pings the remote once nothing was read from it for
+//HeartbeatInterval and closes the connection when the ping goes
+//unanswered for HeartbeatTimeout. It returns once done is closed.
+func (t *TCPTransport) heartbeat(conn *activityConn,done <-chan struct{}){
+	ticker:= time.NewTicker(t.HeartbeatInterval/2)
+	defer ticker.Stop()
+
+	var pinged time.Time
+	for{
+		select{
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		if !pinged.IsZero(){
+			if conn.readSince(pinged){
+				pinged = time.Time{}
+			}else if time.Since(pinged)>=t.HeartbeatTimeout{
+				conn.Close()
+				return
+			}
+			continue
+		}
+		if !conn.readIdle(t.HeartbeatInterval){
+			continue
+		}
+		ok,err:= conn.writeControl(MessagePing,t.HeartbeatInterval/2)
+		if err!=nil{
+			return
+		}
+		if ok{
+			pinged = time.Now()
+			conn.pinged.Store(pinged.UnixNano())
+		}
+	}
+}
+
+//pong answers a ping unless we wrote to the remote just now.
+func (t *TCPTransport) pong(conn *activityConn) error{
+	quiet:= pongQuiet
+	if t.HeartbeatInterval>0{
+		quiet = t.HeartbeatInterval/2
+	}
+	_,err:= conn.writeControl(MessagePong,quiet)
+	return err
+}
+
+//setKeepAlive applies the KeepAlive option to an accepted connection.
+func (t *TCPTransport) setKeepAlive(conn net.Conn){
+	if t.KeepAlive==0{
+		return
+	}
+	if tlsConn,ok:= conn.(*tls.Conn);ok{
+		conn = tlsConn.NetConn()
+	}
+	tcpConn,ok:= conn.(*net.TCPConn)
+	if !ok{
+		return
+	}
+	if t.KeepAlive<0{
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(t.KeepAlive)
+}
@@ -2,7 +2,16 @@ package p2p
 
 const(
 	IncomingMessage = 0x1
+	//IncomingStream opens the stream whose ID follows, its bytes follow in
+	//StreamData frames. See OpenStream.
 	IncomingStream = 0x2
+	//MessagePing and MessagePong are the heartbeat of TCPTransport, see
+	//HeartbeatInterval. The transport answers them itself.
+	MessagePing = 0x3
+	MessagePong = 0x4
+	//StreamData carries the next bytes of a stream: its ID, their length
+	//and the bytes. A length of 0 ends the stream.
+	StreamData = 0x5
 )
 
 //RPC holds any arbitrary data that is being sent over
@@ -11,4 +20,14 @@ type RPC struct{
 	From		string
 	Payload	[]byte 
 	Stream 	bool
-}
\ No newline at end of file
+	//StreamID is the stream an IncomingStream or StreamData frame is of.
+	StreamID uint32
+	//Peer is set for a Stream, reading it reads the stream and its
+	//CloseStream discards what is left of it. The messages sent after the
+	//stream are held back until it is closed.
+	Peer 		Peer
+	//Control is set to MessagePing or MessagePong for a heartbeat frame
+	//and to StreamData for the bytes of a stream, those never reach
+	//Consume.
+	Control byte
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const(
+	//streamFrameSize is the most bytes a StreamData frame carries, so the
+	//frames of concurrent streams and the messages take turns on the
+	//connection.
+	streamFrameSize = 64<<10
+	//streamBacklog is how many frames of a stream the transport holds for
+	//a consumer that is slow to read them before the connection waits.
+	streamBacklog = 16
+)
+
+var errStreamClosed = errors.New("stream is closed")
+
+//OpenStream opens the stream id to peer and returns the writer of its
+//bytes, Close ends the stream. The bytes go out in StreamData frames, so
+//several streams and the messages share the connection and the receiver
+//tells them apart by id. An id can be reused once its stream ended. A
+//message sent after Close reaches the receiver once it closed the stream.
+func OpenStream(peer Peer,id uint32) (io.WriteCloser,error){
+	open:= make([]byte,5)
+	open[0] = IncomingStream
+	binary.LittleEndian.PutUint32(open[1:],id)
+	if err:= peer.Send(open);err!=nil{
+		return nil,err
+	}
+	return &streamWriter{peer: peer,id: id},nil
+}
+
+type streamWriter struct{
+	peer 		Peer
+	id 			uint32
+	buf 		[]byte
+	closed 	bool
+}
+
+func (w *streamWriter) Write(b []byte) (int,error){
+	if w.closed{
+		return 0,errStreamClosed
+	}
+	var n int
+	for len(b)>0{
+		chunk:= b[:min(len(b),streamFrameSize)]
+		if err:= w.peer.Send(w.frame(chunk));err!=nil{
+			return n,err
+		}
+		n+=len(chunk)
+		b = b[len(chunk):]
+	}
+	return n,nil
+}
+
+//frame returns the StreamData frame of b, each is sent with one Send.
+func (w *streamWriter) frame(b []byte) []byte{
+	w.buf = append(w.buf[:0],StreamData,0,0,0,0,0,0,0,0)
+	binary.LittleEndian.PutUint32(w.buf[1:5],w.id)
+	binary.LittleEndian.PutUint32(w.buf[5:9],uint32(len(b)))
+	return append(w.buf,b...)
+}
+
+func (w *streamWriter) Close() error{
+	if w.closed{
+		return nil
+	}
+	w.closed = true
+	return w.peer.Send(w.frame(nil))
+}
+
+//stream is an incoming stream, the read loop hands it the frames and
+//the consumer reads them through a streamPeer.
+type stream struct{
+	frames 	chan []byte
+	//done is closed by CloseStream, later frames are dropped.
+	done 		chan struct{}
+	once 		sync.Once
+	//err is what reads return once frames is closed, it is set before.
+	err 		error
+}
+
+func newStream() *stream{
+	return &stream{frames: make(chan []byte,streamBacklog),done: make(chan struct{})}
+}
+
+//push hands the stream a frame, unless the consumer closed it.
+func (st *stream) push(b []byte){
+	select{
+	case st.frames <- b:
+	case <-st.done:
+	}
+}
+
+func (st *stream) end(err error){
+	st.err = err
+	close(st.frames)
+}
+
+//streamPeer is the Peer of a stream's RPC: reads are of the stream, the
+//connection is used as usual otherwise.
+type streamPeer struct{
+	Peer
+	st 	*stream
+	buf []byte
+}
+
+func (p *streamPeer) Read(b []byte) (int,error){
+	for len(p.buf)==0{
+		frame,ok:= <-p.st.frames
+		if !ok{
+			return 0,p.st.err
+		}
+		p.buf = frame
+	}
+	n:= copy(b,p.buf)
+	p.buf = p.buf[n:]
+	return n,nil
+}
+
+func (p *streamPeer) CloseStream(){
+	p.st.once.Do(func(){
+		close(p.st.done)
+	})
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPTransportStreams(t *testing.T) {
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *TCPTransport{
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	NOPHandshakeFunc,
+			Decoder:				Defaultdecoder{},
+			OnPeer: 				func(p Peer) error{
+				if p.Outbound(){
+					connected <- p
+				}
+				return nil
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3231")
+	tr2:= newTransport("127.0.0.1:3232")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	assert.Nil(t, tr2.Dial("127.0.0.1:3231"))
+	var peer Peer
+	select{
+	case peer = <-connected:
+	case <-time.After(2*time.Second):
+		t.Fatal("timed out waiting for the peer")
+	}
+
+	//Two streams and a message interleaved on the one connection.
+	s1,err:= OpenStream(peer,1)
+	assert.Nil(t, err)
+	s2,err:= OpenStream(peer,2)
+	assert.Nil(t, err)
+	big:= make([]byte,3*streamFrameSize)
+	for i:= range big{
+		big[i] = byte(i)
+	}
+	_,err = s1.Write([]byte("first "))
+	assert.Nil(t, err)
+	_,err = s2.Write(big)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.Send(EncodeMessage([]byte("between"))))
+	_,err = s1.Write([]byte("stream"))
+	assert.Nil(t, err)
+	assert.Nil(t, s2.Close())
+	assert.Nil(t, s1.Close())
+	assert.Nil(t, peer.Send(EncodeMessage([]byte("after"))))
+
+	//Each stream is read on its own, the read loop keeps going meanwhile.
+	type result struct{
+		id 	uint32
+		b 	[]byte
+	}
+	results:= make(chan result,2)
+	streams:= make(map[uint32][]byte)
+	var(
+		messages 	[]string
+		closed 		atomic.Int32
+	)
+	for len(streams)<2 || len(messages)<2{
+		var rpc RPC
+		select{
+		case rpc = <-tr1.Consume():
+		case r:= <-results:
+			streams[r.id] = r.b
+			continue
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for the streams")
+		}
+		if !rpc.Stream{
+			//The message after the streams waits until they are closed.
+			if string(rpc.Payload)=="after"{
+				assert.Equal(t, int32(2), closed.Load())
+			}
+			messages = append(messages,string(rpc.Payload))
+			continue
+		}
+		go func(rpc RPC){
+			b,err:= io.ReadAll(rpc.Peer)
+			assert.Nil(t, err)
+			closed.Add(1)
+			rpc.Peer.CloseStream()
+			results <- result{rpc.StreamID,b}
+		}(rpc)
+	}
+	assert.Equal(t, []string{"between","after"}, messages)
+	assert.Equal(t, "first stream", string(streams[1]))
+	assert.Equal(t, big, streams[2])
+
+	//The open frame goes through Send like the data, a stream can't be
+	//opened once the connection is gone.
+	assert.Nil(t, peer.Close())
+	_,err = OpenStream(peer,3)
+	assert.NotNil(t, err)
+}
@@ -1,11 +1,14 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 //TCPpeer represents the remote node over a TCP established connection.
@@ -18,49 +21,185 @@ type TCPpeer struct{
 	//if we accept and retreive a connection => outbound == false
 	outbound bool
 
-	wg *sync.WaitGroup
+	//sends queues the frames of concurrent Sends (those of several
+	//streams and the messages) for writeLoop, which writes them whole one
+	//at a time in the order they were queued.
+	sends 		chan sendRequest
+	closed 		chan struct{}
+	closeOnce sync.Once
+	//activity is set for the peers of a TCPTransport, see RTT.
+	activity *activityConn
+}
+
+//sendRequest is a frame queued for writeLoop, done gets the error of its
+//write.
+type sendRequest struct{
+	b 		[]byte
+	done 	chan error
 }
 
 func NewTCPpeer(conn net.Conn, outbound bool) *TCPpeer{
-	return &TCPpeer{
+	p:= &TCPpeer{
 		Conn: conn,
 		outbound: outbound,
-		wg: &sync.WaitGroup{},
+		sends: make(chan sendRequest),
+		closed: make(chan struct{}),
 	}
+	go p.writeLoop()
+	return p
+}
+
+func (p *TCPpeer) Outbound() bool{
+	return p.outbound
 }
 
-func (p *TCPpeer) CloseStream(){
-	p.wg.Done()
+//RTT returns how long the last heartbeat ping took to be answered, 0
+//until one was. Only a transport with a HeartbeatInterval pings.
+func (p *TCPpeer) RTT() time.Duration{
+	if p.activity==nil{
+		return 0
+	}
+	return time.Duration(p.activity.rtt.Load())
 }
 
+//CloseStream does nothing, a stream is read and closed through the Peer
+//of its RPC.
+func (p *TCPpeer) CloseStream(){}
+
+//Send queues b to be written after the frames queued before it and waits
+//until all of it was written. A short write is an error as the rest of
+//the connection would be out of frame.
 func(p *TCPpeer) Send(b []byte) error{
-	_,err:= p.Conn.Write(b)
-	return err
+	req:= sendRequest{b: b,done: make(chan error,1)}
+	select{
+	case p.sends <- req:
+	case <-p.closed:
+		return net.ErrClosed
+	}
+	return <-req.done
+}
+
+//writeLoop writes the frames of Send until the peer is closed. Once a
+//write failed the connection is out of frame, the later ones fail with
+//the same error. A transient failure that wrote nothing (see IsTransient)
+//only fails its own frame.
+func (p *TCPpeer) writeLoop(){
+	var err error
+	for{
+		select{
+		case req:= <-p.sends:
+			if err!=nil{
+				req.done <- err
+				continue
+			}
+			n,werr:= p.Conn.Write(req.b)
+			if werr==nil && n<len(req.b){
+				werr = io.ErrShortWrite
+			}
+			if werr!=nil && (n>0 || !IsTransient(werr)){
+				err = werr
+			}
+			req.done <- werr
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+//Close closes the connection and ends writeLoop, the Sends still queued
+//fail.
+func (p *TCPpeer) Close() error{
+	p.closeOnce.Do(func(){
+		close(p.closed)
+	})
+	return p.Conn.Close()
 }
 
 type TCPTransportOpts struct{
 	ListenAddr		string
+	//AdvertiseAddr is optional, it is the address the peers are told to
+	//dial when it isn't ListenAddr, like behind NAT or a container port
+	//mapping. Addr returns it instead of ListenAddr.
+	AdvertiseAddr string
 	HandshakeFunc	HandshakeFunc
 	Decoder				Decoder
 	OnPeer				func(Peer) error
+	//OnPeerDisconnect is called once the connection of a peer that was
+	//accepted by OnPeer is gone.
+	OnPeerDisconnect	func(Peer)
+	//OnHandshakeError is optional, it is called with the remote address of
+	//a connection dropped because the TLS handshake, the ClusterSecret or
+	//HandshakeFunc failed, before it got to OnPeer.
+	OnHandshakeError 	func(addr net.Addr,outbound bool,err error)
+	//TLSConfig is optional, when set both accepted and dialed connections
+	//are wrapped in TLS. For mutual TLS set Certificates and RootCAs plus
+	//ClientCAs with ClientAuth: tls.RequireAndVerifyClientCert.
+	TLSConfig			*tls.Config
+	//ClusterSecret is optional, when set a remote has to prove it knows
+	//the same secret before HandshakeFunc and OnPeer see it.
+	ClusterSecret []byte
+	//KeepAlive is the TCP keepalive period of the connections, 0 keeps
+	//the default of the net package and a negative value disables it.
+	KeepAlive 		time.Duration
+	//With HeartbeatInterval set, a peer nothing was read from for that
+	//long is sent a MessagePing, and dropped when nothing arrives within
+	//HeartbeatTimeout (default 2*HeartbeatInterval). The heartbeat needs
+	//the framing of Defaultdecoder.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout 	time.Duration
+	//MaxConcurrentHandshakes caps the accepted connections that haven't
+	//been handed to OnPeer yet, further ones wait in the listen backlog.
+	//0 is unlimited. With a limit a remote gets HandshakeTimeout (default
+	//10s) to get through the TLS handshake, the ClusterSecret and
+	//HandshakeFunc, so connects that never finish don't hold the slots.
+	MaxConcurrentHandshakes int
+	HandshakeTimeout 				time.Duration
 }
 
+const(
+	defaultHandshakeTimeout = 10*time.Second
+	//An accept that failed, like with EMFILE when we ran out of file
+	//descriptors, is retried after a backoff doubling from acceptMinDelay
+	//up to acceptMaxDelay.
+	acceptMinDelay 	= 5*time.Millisecond
+	acceptMaxDelay 	= time.Second
+)
+
 type TCPTransport struct {
 	TCPTransportOpts
 	listener      net.Listener
 	rpcch					chan RPC
+	//wrapConn lets transports built on top of this one (UDPTransport)
+	//wrap every connection before it is used.
+	wrapConn 			func(net.Conn) net.Conn
+	//handshakes holds a slot for every accepted connection that is still
+	//handshaking, see MaxConcurrentHandshakes.
+	handshakes 		chan struct{}
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport{
-	return &TCPTransport{
+	if opts.HeartbeatInterval>0 && opts.HeartbeatTimeout<=0{
+		opts.HeartbeatTimeout = 2*opts.HeartbeatInterval
+	}
+	t:= &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch: 						make(chan RPC,1024),	
 	}
+	if opts.MaxConcurrentHandshakes>0{
+		if opts.HandshakeTimeout<=0{
+			t.HandshakeTimeout = defaultHandshakeTimeout
+		}
+		t.handshakes = make(chan struct{},opts.MaxConcurrentHandshakes)
+	}
+	return t
 }
 
 //Addr implements the Transport interface return the address
-//the transportis accepting connections.
+//the transportis accepting connections, the AdvertiseAddr if set.
 func (t *TCPTransport) Addr() string{
+	if len(t.AdvertiseAddr)>0{
+		return t.AdvertiseAddr
+	}
 	return t.ListenAddr
 }
 
@@ -77,7 +216,16 @@ func (t *TCPTransport) Close() error{
 
 //Dial implements Transport interface
 func (t *TCPTransport) Dial(addr string) error{
-	conn,err:= net.Dial("tcp",addr)
+	var(
+		conn net.Conn
+		err error
+	)
+	dialer:= &net.Dialer{KeepAlive: t.KeepAlive}
+	if t.TLSConfig!=nil{
+		conn,err = tls.DialWithDialer(dialer,"tcp",addr,t.TLSConfig)
+	}else{
+		conn,err = dialer.Dial("tcp",addr)
+	}
 	if err!=nil{
 		return err
 	}
@@ -92,6 +240,9 @@ func(t *TCPTransport)ListenAndAccept() error{
 	if err !=nil{
 		return err
 	}
+	if t.TLSConfig!=nil{
+		t.listener = tls.NewListener(t.listener,t.TLSConfig)
+	}
 
 	go t.startAcceptLoop()
 	log.Printf("TCP transport listening on port %s\n",t.ListenAddr)
@@ -99,18 +250,33 @@ func(t *TCPTransport)ListenAndAccept() error{
 }
 
 func (t *TCPTransport)startAcceptLoop(){
+	var delay time.Duration
 	for{
 		conn,err := t.listener.Accept()
 		if errors.Is(err,net.ErrClosed){
 			return 
 		}
 		if err!=nil{
-			fmt.Printf("TCP accept error: %s\n", err)
+			delay = min(max(2*delay,acceptMinDelay),acceptMaxDelay)
+			fmt.Printf("TCP accept error: %s, retrying in %s\n", err,delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		t.setKeepAlive(conn)
+		if t.handshakes!=nil{
+			t.handshakes <- struct{}{}
 		}
 		go t.handleConn(conn,false)
 	}
 }
 
+func (t *TCPTransport) handshakeFailed(conn net.Conn,outbound bool,err error){
+	if t.OnHandshakeError!=nil{
+		t.OnHandshakeError(conn.RemoteAddr(),outbound,err)
+	}
+}
+
 func (t *TCPTransport)handleConn(conn net.Conn,outbound bool){
 	var err error
 
@@ -119,9 +285,55 @@ func (t *TCPTransport)handleConn(conn net.Conn,outbound bool){
 		conn.Close()
 	}()
 
-	peer:= NewTCPpeer(conn,true)
+	//An accepted connection holds its handshake slot until OnPeer took it.
+	var(
+		handshaking = !outbound && t.handshakes!=nil
+		deadline 		time.Time
+		raw 				= conn
+	)
+	endHandshake:= func(){
+		if handshaking{
+			handshaking = false
+			raw.SetDeadline(time.Time{})
+			<-t.handshakes
+		}
+	}
+	defer endHandshake()
+	if handshaking{
+		deadline = time.Now().Add(t.HandshakeTimeout)
+		raw.SetDeadline(deadline)
+	}
+
+	//Do the TLS handshake up front so a peer with a bad certificate is
+	//dropped before it is handed to HandshakeFunc and OnPeer.
+	if tlsConn,ok:= conn.(*tls.Conn);ok{
+		if err = tlsConn.Handshake();err!=nil{
+			t.handshakeFailed(raw,outbound,err)
+			return
+		}
+	}
 
-	if err := t.HandshakeFunc(peer);err!=nil{
+	if len(t.ClusterSecret)>0{
+		if err = authenticate(conn,t.ClusterSecret,outbound,deadline);err!=nil{
+			t.handshakeFailed(raw,outbound,err)
+			return
+		}
+		//authenticate cleared the deadline of the handshake.
+		raw.SetDeadline(deadline)
+	}
+
+	activity:= newActivityConn(conn)
+	conn = activity
+	if t.wrapConn!=nil{
+		conn = t.wrapConn(conn)
+	}
+
+	peer:= NewTCPpeer(conn,outbound)
+	peer.activity = activity
+	defer peer.Close()
+
+	if err = t.HandshakeFunc(peer);err!=nil{
+		t.handshakeFailed(raw,outbound,err)
 		return	
 	}
 
@@ -130,21 +342,83 @@ func (t *TCPTransport)handleConn(conn net.Conn,outbound bool){
 			return
 		}
 	}
+	endHandshake()
+	if t.OnPeerDisconnect !=nil{
+		defer t.OnPeerDisconnect(peer)
+	}
+	if t.HeartbeatInterval>0{
+		done:= make(chan struct{})
+		defer close(done)
+		go t.heartbeat(activity,done)
+	}
+
+	//streams holds the open incoming streams by ID, those still open when
+	//the connection goes are cut short.
+	streams:= make(map[uint32]*stream)
+	//ended holds the streams that ended but were not closed by their
+	//consumer yet. A message waits for them, so it is handled after the
+	//streams sent before it.
+	var ended []*stream
+	defer func(){
+		for _,st:= range streams{
+			st.end(io.ErrUnexpectedEOF)
+		}
+	}()
 
 	//Read Loop
 	for{
 		rpc :=RPC{}
-		if err := t.Decoder.Decode(conn,&rpc);err!=nil{
+		if err = t.Decoder.Decode(conn,&rpc);errors.Is(err,ErrChecksum){
+			fmt.Printf("[%s] dropping corrupt message: %s\n",conn.RemoteAddr(),err)
+			continue
+		}
+		if errors.Is(err,ErrMessageTooLarge){
+			fmt.Printf("[%s] dropping peer: %s\n",conn.RemoteAddr(),err)
+		}
+		if err!=nil{
 			return
 		}
 
+		switch rpc.Control{
+		case MessagePing:
+			if err = t.pong(activity);err!=nil{
+				return
+			}
+			continue
+		case MessagePong:
+			activity.ponged()
+			continue
+		case StreamData:
+			st,ok:= streams[rpc.StreamID]
+			if !ok{
+				continue
+			}
+			if len(rpc.Payload)==0{
+				st.end(io.EOF)
+				delete(streams,rpc.StreamID)
+				ended = append(ended,st)
+				continue
+			}
+			//A consumer that is slow to read holds up the connection.
+			st.push(rpc.Payload)
+			continue
+		}
+
 		rpc.From = conn.RemoteAddr().String()
 		if rpc.Stream{
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n",conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n",conn.RemoteAddr())
-			continue
+			//The stream is handed to the consumer which reads it through
+			//rpc.Peer while we route its frames there.
+			if st,ok:= streams[rpc.StreamID];ok{
+				st.end(io.ErrUnexpectedEOF)
+			}
+			st:= newStream()
+			streams[rpc.StreamID] = st
+			rpc.Peer = &streamPeer{Peer: peer,st: st}
+		}else{
+			for _,st:= range ended{
+				<-st.done
+			}
+			ended = ended[:0]
 		}
 		t.rpcch <- rpc
 	}
@@ -1,7 +1,18 @@
 package p2p
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,4 +28,274 @@ func TestTCPTransport(t *testing.T) {
 	assert.Equal(t , tr.ListenAddr,listenAddr)
 
 	assert.Nil(t, tr.ListenAndAccept())
-}
\ No newline at end of file
+}
+
+func TestTCPTransportTLS(t *testing.T) {
+	cert,pool:= newTestCertificate(t)
+	tlsConfig:= &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs: 			pool,
+		ClientCAs: 		pool,
+		ClientAuth: 	tls.RequireAndVerifyClientCert,
+	}
+
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *TCPTransport{
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	NOPHandshakeFunc,
+			Decoder:				Defaultdecoder{},
+			TLSConfig: 			tlsConfig,
+			OnPeer: 				func(p Peer) error{
+				connected <- p
+				return nil
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3201")
+	tr2:= newTransport("127.0.0.1:3202")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	assert.Nil(t, tr2.Dial("127.0.0.1:3201"))
+	for i:=0;i<2;i++{
+		select{
+		case <-connected:
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for TLS peers")
+		}
+	}
+
+	//A client without a certificate is rejected by the mutual TLS handshake.
+	conn,err:= tls.Dial("tcp","127.0.0.1:3201",&tls.Config{RootCAs: pool})
+	if err==nil{
+		_,err = conn.Read(make([]byte,1))
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate,*x509.CertPool){
+	key,err:= ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	template:= &x509.Certificate{
+		SerialNumber: 					big.NewInt(1),
+		Subject: 								pkix.Name{CommonName: "cas test"},
+		NotBefore: 							time.Now().Add(-time.Hour),
+		NotAfter: 							time.Now().Add(time.Hour),
+		IPAddresses: 						[]net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage: 							x509.KeyUsageDigitalSignature|x509.KeyUsageCertSign,
+		ExtKeyUsage: 						[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,x509.ExtKeyUsageClientAuth},
+		IsCA: 									true,
+		BasicConstraintsValid: 	true,
+	}
+	der,err:= x509.CreateCertificate(rand.Reader,template,template,&key.PublicKey,key)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	leaf,err:= x509.ParseCertificate(der)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	pool:= x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der},PrivateKey: key,Leaf: leaf},pool
+}
+
+func TestTCPTransportClusterSecret(t *testing.T) {
+	connected:= make(chan Peer,2)
+	rejected:= make(chan bool,2)
+	newTransport:= func(addr string,secret string) *TCPTransport{
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	NOPHandshakeFunc,
+			Decoder:				Defaultdecoder{},
+			ClusterSecret: 	[]byte(secret),
+			OnPeer: 				func(p Peer) error{
+				connected <- p
+				return nil
+			},
+			OnHandshakeError: func(addr net.Addr,outbound bool,err error){
+				rejected <- outbound
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3211","cluster secret")
+	tr2:= newTransport("127.0.0.1:3212","cluster secret")
+	tr3:= newTransport("127.0.0.1:3213","another secret")
+	for _,tr:= range []*TCPTransport{tr1,tr2,tr3}{
+		assert.Nil(t, tr.ListenAndAccept())
+		defer tr.Close()
+	}
+
+	assert.Nil(t, tr2.Dial("127.0.0.1:3211"))
+	for i:=0;i<2;i++{
+		select{
+		case <-connected:
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for authenticated peers")
+		}
+	}
+
+	//A node with another secret never makes it to OnPeer on either side.
+	assert.Nil(t, tr3.Dial("127.0.0.1:3211"))
+	select{
+	case p:= <-connected:
+		t.Fatalf("peer %s joined with the wrong secret",p.RemoteAddr())
+	case <-time.After(500*time.Millisecond):
+	}
+	//Both sides report the failed handshake.
+	for i:=0;i<2;i++{
+		select{
+		case <-rejected:
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for OnHandshakeError")
+		}
+	}
+}
+
+func TestTCPTransportHandshakeLimit(t *testing.T) {
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *TCPTransport{
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr: 							addr,
+			HandshakeFunc: 						NOPHandshakeFunc,
+			Decoder:									Defaultdecoder{},
+			ClusterSecret: 						[]byte("cluster secret"),
+			MaxConcurrentHandshakes: 	1,
+			HandshakeTimeout: 				300*time.Millisecond,
+			OnPeer: 									func(p Peer) error{
+				if !p.Outbound(){
+					connected <- p
+				}
+				return nil
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3241")
+	tr2:= newTransport("127.0.0.1:3242")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	//A remote that never authenticates holds the only slot until its
+	//handshake times out, the node dialing after it waits for that.
+	silent,err:= net.Dial("tcp","127.0.0.1:3241")
+	assert.Nil(t, err)
+	defer silent.Close()
+	time.Sleep(50*time.Millisecond)
+	start:= time.Now()
+	assert.Nil(t, tr2.Dial("127.0.0.1:3241"))
+	select{
+	case <-connected:
+		if elapsed:= time.Since(start);elapsed<200*time.Millisecond{
+			t.Errorf("want the peer to wait for the slot, connected after %s",elapsed)
+		}
+	case <-time.After(2*time.Second):
+		t.Fatal("timed out waiting for the peer")
+	}
+}
+
+func TestTCPpeerSendOrder(t *testing.T) {
+	conn,other:= net.Pipe()
+	peer:= NewTCPpeer(conn,false)
+
+	//The frames of concurrent Sends are written whole, those of one
+	//goroutine in the order it sent them.
+	const(
+		senders = 4
+		frames 	= 50
+		size 		= 1000
+	)
+	errs:= make(chan error,senders)
+	for i:=0;i<senders;i++{
+		go func(i int){
+			for j:=0;j<frames;j++{
+				frame:= bytes.Repeat([]byte{byte(i*frames+j)},size)
+				if err:= peer.Send(frame);err!=nil{
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	next:= make([]int,senders)
+	buf:= make([]byte,size)
+	for n:=0;n<senders*frames;n++{
+		_,err:= io.ReadFull(other,buf)
+		assert.Nil(t, err)
+		if !bytes.Equal(buf,bytes.Repeat(buf[:1],size)){
+			t.Fatalf("frame %d was interleaved with another",n)
+		}
+		i,j:= int(buf[0])/frames,int(buf[0])%frames
+		assert.Equal(t, next[i], j)
+		next[i] = j+1
+	}
+	for i:=0;i<senders;i++{
+		assert.Nil(t, <-errs)
+	}
+
+	//After a failed write, or once closed, nothing more is sent.
+	other.Close()
+	assert.NotNil(t, peer.Send([]byte("lost")))
+	assert.NotNil(t, peer.Send([]byte("lost too")))
+	peer.Close()
+	assert.ErrorIs(t, peer.Send([]byte("closed")), net.ErrClosed)
+}
+
+func TestTCPTransportHeartbeat(t *testing.T) {
+	disconnected:= make(chan Peer,2)
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *TCPTransport{
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr: 				addr,
+			HandshakeFunc: 			NOPHandshakeFunc,
+			Decoder:						Defaultdecoder{},
+			HeartbeatInterval: 	50*time.Millisecond,
+			OnPeer: 						func(p Peer) error{
+				connected <- p
+				return nil
+			},
+			OnPeerDisconnect: 	func(p Peer){
+				disconnected <- p
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3221")
+	tr2:= newTransport("127.0.0.1:3222")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	//Idle peers that answer the pings stay connected.
+	assert.Nil(t, tr2.Dial("127.0.0.1:3221"))
+	select{
+	case p:= <-disconnected:
+		t.Fatalf("live peer %s was dropped",p.RemoteAddr())
+	case <-time.After(500*time.Millisecond):
+	}
+	//Both ends pinged at once and still answered each other.
+	for i:=0;i<2;i++{
+		if rtt:= (<-connected).(*TCPpeer).RTT();rtt<=0{
+			t.Errorf("want the round trip of the pings measured, have %s",rtt)
+		}
+	}
+
+	//A remote that went silent is dropped once a ping goes unanswered.
+	conn,err:= net.Dial("tcp","127.0.0.1:3221")
+	assert.Nil(t, err)
+	defer conn.Close()
+	select{
+	case p:= <-disconnected:
+		assert.Equal(t, conn.LocalAddr().String(), p.RemoteAddr().String())
+	case <-time.After(2*time.Second):
+		t.Fatal("timed out waiting for the silent peer to be dropped")
+	}
+}
@@ -1,19 +1,39 @@
 package p2p
 
-import "net"
+import (
+	"errors"
+	"net"
+	"syscall"
+)
 
 //Peer is an interface that represents a remote node
 type Peer interface{
 	net.Conn
 	Send([]byte) error
+	//CloseStream ends the consumer's part of a stream (see RPC.Peer):
+	//what is left of it is discarded and the messages sent after it are
+	//delivered. A stream has to be read to its end or closed, one that
+	//is neither holds up the connection once its backlog is full.
 	CloseStream()
+	//Outbound reports whether we dialed the peer (true) or accepted
+	//its connection (false).
+	Outbound() bool
 }
 
 
+//IsTransient tells whether a Send failed without writing anything and
+//without breaking the connection, so it can be sent again: the system
+//was short of buffers or the write would have blocked. A closed or reset
+//connection, a short write and a timeout are not transient.
+func IsTransient(err error) bool{
+	return errors.Is(err,syscall.ENOBUFS) || errors.Is(err,syscall.EAGAIN) || errors.Is(err,syscall.ENOMEM)
+}
+
 //Transport is anything that handles communication
 //between the nodes in the network. This can be of 
 //the form(TCP, UDP, WebSockets,...) 
 type Transport interface{
+	//Addr is the address the peers can dial us at, it is gossiped.
 	Addr() string
 	ListenAndAccept() error
 	Consume() <-chan RPC
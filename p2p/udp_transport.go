@@ -0,0 +1,602 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const(
+	//udpFragmentSize keeps a datagram below the usual MTU.
+	udpFragmentSize 	= 1200
+	//message id, fragment index, fragment count and the TCP sequence.
+	udpHeaderSize 		= 16
+	//udpMACSize is the truncated HMAC-SHA256 that ends every datagram.
+	udpMACSize 				= 16
+	udpNonceSize 			= 32
+	//udpReassemblyTimeout is how long fragments of an incomplete message
+	//are kept around before they are dropped.
+	udpReassemblyTimeout = 5*time.Second
+)
+
+//UDPpeer is a TCPpeer whose control messages travel as UDP datagrams,
+//streams keep using the TCP connection.
+type UDPpeer struct{
+	*TCPpeer
+	transport *UDPTransport
+	udpAddr 	*net.UDPAddr
+	conn 			*countingConn
+	//inbox delivers the messages of this peer in order, see deliverLoop.
+	inbox 		chan udpDelivery
+
+	//sendLock keeps the datagram count and the TCP sequence consistent
+	//with each other while sending.
+	sendLock 	sync.Mutex
+	sent 			uint64
+	//nextID numbers the messages sent to the peer, under sendLock.
+	nextID 		uint32
+
+	//sendKey and recvKey authenticate the datagrams to and from the peer,
+	//see udpKey. replay is only touched by readLoop.
+	sendKey 	[]byte
+	recvKey 	[]byte
+	replay 		replayWindow
+
+	deliverLock sync.Mutex
+	delivered 	*sync.Cond
+	received 		uint64
+}
+
+type udpDelivery struct{
+	seq uint64
+	msg []byte
+}
+
+//Send sends framed messages (see EncodeMessage) over UDP, everything else
+//(the frames of streams) goes over the TCP connection. The frame opening
+//a stream carries the number of datagrams sent before it, so the receiver
+//can hold the stream back until those messages were delivered.
+func (p *UDPpeer) Send(b []byte) error{
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	if len(b)>0 && b[0]==IncomingMessage{
+		//A message that failed is never delivered, a stream opened after
+		//it must not wait for it.
+		p.nextID++
+		err:= p.transport.sendDatagrams(p,p.nextID,p.conn.written.Load(),b)
+		if err==nil{
+			p.sent++
+		}
+		return err
+	}
+	if len(b)==5 && b[0]==IncomingStream{
+		buf:= make([]byte,13)
+		copy(buf,b)
+		binary.LittleEndian.PutUint64(buf[5:],p.sent)
+		return p.TCPpeer.Send(buf)
+	}
+	return p.TCPpeer.Send(b)
+}
+
+//markDelivered counts a message handed to the consumer.
+func (p *UDPpeer) markDelivered(){
+	p.deliverLock.Lock()
+	p.received++
+	p.delivered.Broadcast()
+	p.deliverLock.Unlock()
+}
+
+//waitDelivered blocks until n messages of the peer were delivered. Lost
+//datagrams never arrive, so after udpReassemblyTimeout we give up waiting.
+func (p *UDPpeer) waitDelivered(n uint64){
+	expired:= false
+	timer:= time.AfterFunc(udpReassemblyTimeout,func(){
+		p.deliverLock.Lock()
+		expired = true
+		p.delivered.Broadcast()
+		p.deliverLock.Unlock()
+	})
+	defer timer.Stop()
+
+	p.deliverLock.Lock()
+	defer p.deliverLock.Unlock()
+	for p.received<n && !expired{
+		p.delivered.Wait()
+	}
+}
+
+//udpDecoder reads the datagram count that UDPpeer.Send puts after the
+//frame opening a stream and waits for those datagrams before reporting
+//the stream.
+type udpDecoder struct{
+	Decoder
+	transport *UDPTransport
+}
+
+func (d udpDecoder) Decode(r io.Reader,msg *RPC) error{
+	if err:= d.Decoder.Decode(r,msg);err!=nil{
+		return err
+	}
+	if !msg.Stream{
+		return nil
+	}
+	var sent uint64
+	if err:= binary.Read(r,binary.LittleEndian,&sent);err!=nil{
+		return err
+	}
+	if peer:= d.transport.peerOfConn(r);peer!=nil{
+		peer.waitDelivered(sent)
+	}
+	return nil
+}
+
+//countingConn counts the bytes that went over the TCP connection. Every
+//datagram carries the number of TCP bytes its sender wrote before it, and
+//the receiver holds the message back until it read that many. That way a
+//message never overtakes a stream that was sent before it.
+type countingConn struct{
+	net.Conn
+	written atomic.Uint64
+
+	mu 		sync.Mutex
+	cond 	*sync.Cond
+	read 	uint64
+	closed bool
+}
+
+func newCountingConn(conn net.Conn) *countingConn{
+	c:= &countingConn{Conn: conn}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *countingConn) Write(b []byte) (int,error){
+	n,err:= c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n,err
+}
+
+func (c *countingConn) Read(b []byte) (int,error){
+	n,err:= c.Conn.Read(b)
+	c.mu.Lock()
+	c.read+=uint64(n)
+	if err!=nil{
+		c.closed = true
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return n,err
+}
+
+//waitRead blocks until seq bytes were read or the connection failed.
+func (c *countingConn) waitRead(seq uint64) bool{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.read<seq && !c.closed{
+		c.cond.Wait()
+	}
+	return c.read>=seq
+}
+
+type UDPTransportOpts struct{
+	//ListenAddr is used for both the TCP listener and the UDP socket.
+	ListenAddr		string
+	//AdvertiseAddr is the address peers dial, see TCPTransportOpts. The
+	//UDP port a peer sends to is the one of the socket on ListenAddr.
+	AdvertiseAddr string
+	HandshakeFunc	HandshakeFunc
+	Decoder				Decoder
+	OnPeer				func(Peer) error
+	OnPeerDisconnect	func(Peer)
+	//OnHandshakeError is called like that of the TCP transport.
+	OnHandshakeError 	func(addr net.Addr,outbound bool,err error)
+	//ClusterSecret and the handshake limits are passed on to the TCP
+	//transport. The datagrams are authenticated with keys derived from
+	//the secret and the handshake, see udpKey.
+	ClusterSecret 					[]byte
+	MaxConcurrentHandshakes int
+	HandshakeTimeout 				time.Duration
+}
+
+//UDPTransport sends the small, latency sensitive control messages over
+//UDP and falls back to TCP for file streams. Larger messages are split
+//into fragments and reassembled on the receiving side.
+type UDPTransport struct{
+	UDPTransportOpts
+	tcp 		*TCPTransport
+	conn 		*net.UDPConn
+
+	mu 			sync.Mutex
+	//peers maps the UDP address of a remote to its peer, wrapped maps the
+	//underlying TCP peer to it.
+	peers 	map[string]*UDPpeer
+	wrapped map[*TCPpeer]*UDPpeer
+	partial map[string]*udpMessage
+}
+
+type udpMessage struct{
+	fragments [][]byte
+	received 	int
+	started 	time.Time
+}
+
+func NewUDPTransport(opts UDPTransportOpts) *UDPTransport{
+	t:= &UDPTransport{
+		UDPTransportOpts: opts,
+		peers: 		make(map[string]*UDPpeer),
+		wrapped: 	make(map[*TCPpeer]*UDPpeer),
+		partial: 	make(map[string]*udpMessage),
+	}
+	t.tcp = NewTCPTransport(TCPTransportOpts{
+		ListenAddr: 			opts.ListenAddr,
+		AdvertiseAddr: 		opts.AdvertiseAddr,
+		HandshakeFunc: 		t.handshake,
+		Decoder: 					udpDecoder{Decoder: opts.Decoder,transport: t},
+		OnPeer: 					t.onPeer,
+		OnPeerDisconnect: t.onPeerDisconnect,
+		OnHandshakeError: t.onHandshakeError,
+		ClusterSecret: 		opts.ClusterSecret,
+		MaxConcurrentHandshakes: opts.MaxConcurrentHandshakes,
+		HandshakeTimeout: 				opts.HandshakeTimeout,
+	})
+	t.tcp.wrapConn = func(conn net.Conn) net.Conn{
+		return newCountingConn(conn)
+	}
+	return t
+}
+
+//Addr implements the Transport interface
+func (t *UDPTransport) Addr() string{
+	return t.tcp.Addr()
+}
+
+//Consume implements the Transport interface, messages from both the UDP
+//socket and the TCP connections end up on the same channel.
+func (t *UDPTransport) Consume() <-chan RPC{
+	return t.tcp.Consume()
+}
+
+//Close implements the Transport interface
+func (t *UDPTransport) Close() error{
+	err:= t.tcp.Close()
+	if t.conn!=nil{
+		if uerr:= t.conn.Close();err==nil{
+			err = uerr
+		}
+	}
+	return err
+}
+
+//Dial implements the Transport interface
+func (t *UDPTransport) Dial(addr string) error{
+	return t.tcp.Dial(addr)
+}
+
+func (t *UDPTransport) ListenAndAccept() error{
+	addr,err:= net.ResolveUDPAddr("udp",t.ListenAddr)
+	if err!=nil{
+		return err
+	}
+	t.conn,err = net.ListenUDP("udp",addr)
+	if err!=nil{
+		return err
+	}
+	if err:= t.tcp.ListenAndAccept();err!=nil{
+		t.conn.Close()
+		return err
+	}
+
+	go t.readLoop()
+	log.Printf("UDP transport listening on port %s\n",t.ListenAddr)
+	return nil
+}
+
+//handshake tells the remote which UDP port to send its datagrams to and
+//a nonce for their keys, and learns the remote's, before running the
+//configured HandshakeFunc.
+func (t *UDPTransport) handshake(p Peer) error{
+	tcpPeer:= p.(*TCPpeer)
+	port:= uint16(t.conn.LocalAddr().(*net.UDPAddr).Port)
+	nonce:= make([]byte,udpNonceSize)
+	if _,err:= io.ReadFull(rand.Reader,nonce);err!=nil{
+		return err
+	}
+	if _,err:= tcpPeer.Conn.Write(append(binary.LittleEndian.AppendUint16(nil,port),nonce...));err!=nil{
+		return err
+	}
+	var remotePort uint16
+	if err:= binary.Read(tcpPeer.Conn,binary.LittleEndian,&remotePort);err!=nil{
+		return err
+	}
+	remoteNonce:= make([]byte,udpNonceSize)
+	if _,err:= io.ReadFull(tcpPeer.Conn,remoteNonce);err!=nil{
+		return err
+	}
+	dialerNonce,listenerNonce:= nonce,remoteNonce
+	if !tcpPeer.Outbound(){
+		dialerNonce,listenerNonce = remoteNonce,nonce
+	}
+
+	remoteIP:= tcpPeer.RemoteAddr().(*net.TCPAddr).IP
+	peer:= &UDPpeer{
+		TCPpeer: 		tcpPeer,
+		transport: 	t,
+		udpAddr: 		&net.UDPAddr{IP: remoteIP,Port: int(remotePort)},
+		conn: 			tcpPeer.Conn.(*countingConn),
+		inbox: 			make(chan udpDelivery,1024),
+		sendKey: 		udpKey(t.ClusterSecret,tcpPeer.Outbound(),dialerNonce,listenerNonce),
+		recvKey: 		udpKey(t.ClusterSecret,!tcpPeer.Outbound(),dialerNonce,listenerNonce),
+	}
+	peer.delivered = sync.NewCond(&peer.deliverLock)
+	t.mu.Lock()
+	t.wrapped[tcpPeer] = peer
+	t.mu.Unlock()
+
+	if t.HandshakeFunc!=nil{
+		return t.HandshakeFunc(peer)
+	}
+	return nil
+}
+
+func (t *UDPTransport) peerOf(p Peer) (*UDPpeer,error){
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peer,ok:= t.wrapped[p.(*TCPpeer)]
+	if !ok{
+		return nil,fmt.Errorf("peer %s did not complete the UDP handshake",p.RemoteAddr())
+	}
+	return peer,nil
+}
+
+func (t *UDPTransport) peerOfConn(r io.Reader) *UDPpeer{
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _,peer:= range t.wrapped{
+		if io.Reader(peer.conn)==r{
+			return peer
+		}
+	}
+	return nil
+}
+
+func (t *UDPTransport) onPeer(p Peer) error{
+	peer,err:= t.peerOf(p)
+	if err!=nil{
+		return err
+	}
+	t.mu.Lock()
+	t.peers[peer.udpAddr.String()] = peer
+	t.mu.Unlock()
+	go t.deliverLoop(peer)
+
+	if t.OnPeer!=nil{
+		if err:= t.OnPeer(peer);err!=nil{
+			//The connection is closed without a disconnect callback.
+			t.forget(peer)
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *UDPTransport) onPeerDisconnect(p Peer){
+	peer,err:= t.peerOf(p)
+	if err!=nil{
+		return
+	}
+	t.forget(peer)
+
+	if t.OnPeerDisconnect!=nil{
+		t.OnPeerDisconnect(peer)
+	}
+}
+
+func (t *UDPTransport) onHandshakeError(addr net.Addr,outbound bool,err error){
+	if t.OnHandshakeError!=nil{
+		t.OnHandshakeError(addr,outbound,err)
+	}
+}
+
+//forget removes a peer whose connection is gone and stops its delivery.
+func (t *UDPTransport) forget(peer *UDPpeer){
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.wrapped,peer.TCPpeer)
+	if t.peers[peer.udpAddr.String()]==peer{
+		delete(t.peers,peer.udpAddr.String())
+		close(peer.inbox)
+	}
+}
+
+//udpKey derives the key of the datagrams the dialer (or the listener)
+//sends from the nonces both sides sent in the handshake. The datagrams
+//of one connection can't be passed off as another's, and with a
+//ClusterSecret only a member of the cluster can derive the key.
+func udpKey(secret []byte,dialer bool,dialerNonce []byte,listenerNonce []byte) []byte{
+	h:= hmac.New(sha256.New,secret)
+	if dialer{
+		h.Write([]byte("udp dialer"))
+	}else{
+		h.Write([]byte("udp listener"))
+	}
+	h.Write(dialerNonce)
+	h.Write(listenerNonce)
+	return h.Sum(nil)
+}
+
+func datagramMAC(key []byte,datagram []byte) []byte{
+	h:= hmac.New(sha256.New,key)
+	h.Write(datagram)
+	return h.Sum(nil)[:udpMACSize]
+}
+
+//replayWindow holds which of the last 64 message ids up to top were
+//delivered, older ones all count as delivered.
+type replayWindow struct{
+	top 	uint32
+	seen 	uint64
+}
+
+func (w *replayWindow) fresh(id uint32) bool{
+	if id>w.top{
+		return true
+	}
+	d:= w.top-id
+	return d<64 && w.seen&(1<<d)==0
+}
+
+func (w *replayWindow) mark(id uint32){
+	if id<=w.top{
+		w.seen|= 1<<(w.top-id)
+		return
+	}
+	if shift:= id-w.top;shift<64{
+		w.seen = w.seen<<shift|1
+	}else{
+		w.seen = 1
+	}
+	w.top = id
+}
+
+//sendDatagrams splits b into fragments of at most udpFragmentSize bytes,
+//each prefixed with the message id, its index and the fragment count and
+//followed by its MAC.
+func (t *UDPTransport) sendDatagrams(peer *UDPpeer,id uint32,seq uint64,b []byte) error{
+	count:= (len(b)+udpFragmentSize-1)/udpFragmentSize
+	if count>0xffff{
+		return fmt.Errorf("%w: %d bytes for UDP",ErrMessageTooLarge,len(b))
+	}
+
+	datagram:= make([]byte,udpHeaderSize+udpFragmentSize,udpHeaderSize+udpFragmentSize+udpMACSize)
+	for i:=0;i<count;i++{
+		from,to:= i*udpFragmentSize,(i+1)*udpFragmentSize
+		if to>len(b){
+			to = len(b)
+		}
+		binary.LittleEndian.PutUint32(datagram[0:4],id)
+		binary.LittleEndian.PutUint16(datagram[4:6],uint16(i))
+		binary.LittleEndian.PutUint16(datagram[6:8],uint16(count))
+		binary.LittleEndian.PutUint64(datagram[8:16],seq)
+		n:= copy(datagram[udpHeaderSize:],b[from:to])
+		signed:= append(datagram[:udpHeaderSize+n],datagramMAC(peer.sendKey,datagram[:udpHeaderSize+n])...)
+		if _,err:= t.conn.WriteToUDP(signed,peer.udpAddr);err!=nil{
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *UDPTransport) readLoop(){
+	buf:= make([]byte,udpHeaderSize+udpFragmentSize+udpMACSize)
+	for{
+		n,addr,err:= t.conn.ReadFromUDP(buf)
+		if errors.Is(err,net.ErrClosed){
+			return
+		}
+		if err!=nil{
+			fmt.Printf("UDP read error: %s\n",err)
+			continue
+		}
+		if n<udpHeaderSize+udpMACSize{
+			continue
+		}
+
+		t.mu.Lock()
+		peer,ok:= t.peers[addr.String()]
+		t.mu.Unlock()
+		if !ok{
+			//Only peers that completed the handshake may send messages.
+			continue
+		}
+		//A datagram that isn't the peer's, forged or replayed, is dropped.
+		datagram:= buf[:n-udpMACSize]
+		if !hmac.Equal(buf[n-udpMACSize:n],datagramMAC(peer.recvKey,datagram)){
+			continue
+		}
+		id:= binary.LittleEndian.Uint32(datagram[0:4])
+		if !peer.replay.fresh(id){
+			continue
+		}
+
+		msg,ok:= t.reassemble(addr.String(),datagram)
+		if !ok{
+			continue
+		}
+		peer.replay.mark(id)
+		select{
+		case peer.inbox <- udpDelivery{seq: binary.LittleEndian.Uint64(buf[8:16]),msg: msg}:
+		default:
+			fmt.Printf("UDP inbox of %s is full, dropping message\n",peer.RemoteAddr())
+		}
+	}
+}
+
+//deliverLoop hands the messages of peer to the consumer once everything
+//the peer sent over TCP before them has been read.
+func (t *UDPTransport) deliverLoop(peer *UDPpeer){
+	for d:= range peer.inbox{
+		if !peer.conn.waitRead(d.seq){
+			return
+		}
+		rpc:= RPC{}
+		if err:= t.Decoder.Decode(bytes.NewReader(d.msg),&rpc);err!=nil{
+			fmt.Printf("UDP decode error: %s\n",err)
+			continue
+		}
+		rpc.From = peer.RemoteAddr().String()
+		t.tcp.rpcch <- rpc
+		peer.markDelivered()
+	}
+}
+
+//reassemble collects the fragment in datagram and returns the whole
+//message once all of its fragments arrived.
+func (t *UDPTransport) reassemble(from string,datagram []byte) ([]byte,bool){
+	id:= binary.LittleEndian.Uint32(datagram[0:4])
+	index:= int(binary.LittleEndian.Uint16(datagram[4:6]))
+	count:= int(binary.LittleEndian.Uint16(datagram[6:8]))
+	payload:= append([]byte(nil),datagram[udpHeaderSize:]...)
+	if count==1 && index==0{
+		return payload,true
+	}
+	if index>=count{
+		return nil,false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key,m:= range t.partial{
+		if time.Since(m.started)>udpReassemblyTimeout{
+			delete(t.partial,key)
+		}
+	}
+
+	key:= fmt.Sprintf("%s/%d",from,id)
+	m,ok:= t.partial[key]
+	if !ok{
+		m = &udpMessage{fragments: make([][]byte,count),started: time.Now()}
+		t.partial[key] = m
+	}
+	if len(m.fragments)!=count || m.fragments[index]!=nil{
+		return nil,false
+	}
+	m.fragments[index] = payload
+	m.received++
+	if m.received<count{
+		return nil,false
+	}
+	delete(t.partial,key)
+	return bytes.Join(m.fragments,nil),true
+}
@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPTransport(t *testing.T) {
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *UDPTransport{
+		return NewUDPTransport(UDPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	NOPHandshakeFunc,
+			Decoder:				Defaultdecoder{},
+			OnPeer: 				func(p Peer) error{
+				connected <- p
+				return nil
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3301")
+	tr2:= newTransport("127.0.0.1:3302")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	assert.Nil(t, tr2.Dial("127.0.0.1:3301"))
+	var dialed Peer
+	for i:=0;i<2;i++{
+		select{
+		case p:= <-connected:
+			if p.Outbound(){
+				dialed = p
+			}
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for UDP peers")
+		}
+	}
+
+	//Large enough to be split into several datagrams.
+	payload:= bytes.Repeat([]byte("some jpg bytes "),500)
+	assert.Nil(t, dialed.Send(EncodeMessage(payload)))
+
+	select{
+	case rpc:= <-tr1.Consume():
+		assert.Equal(t, payload, rpc.Payload)
+		assert.False(t, rpc.Stream)
+	case <-time.After(2*time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+}
+
+func TestUDPTransportAuthenticatesDatagrams(t *testing.T) {
+	connected:= make(chan Peer,2)
+	newTransport:= func(addr string) *UDPTransport{
+		return NewUDPTransport(UDPTransportOpts{
+			ListenAddr: 		addr,
+			HandshakeFunc: 	NOPHandshakeFunc,
+			Decoder:				Defaultdecoder{},
+			ClusterSecret: 	[]byte("cluster secret"),
+			OnPeer: 				func(p Peer) error{
+				connected <- p
+				return nil
+			},
+		})
+	}
+	tr1:= newTransport("127.0.0.1:3303")
+	tr2:= newTransport("127.0.0.1:3304")
+	assert.Nil(t, tr1.ListenAndAccept())
+	assert.Nil(t, tr2.ListenAndAccept())
+	defer tr1.Close()
+	defer tr2.Close()
+
+	assert.Nil(t, tr2.Dial("127.0.0.1:3303"))
+	var dialed *UDPpeer
+	for i:=0;i<2;i++{
+		select{
+		case p:= <-connected:
+			if p.Outbound(){
+				dialed = p.(*UDPpeer)
+			}
+		case <-time.After(2*time.Second):
+			t.Fatal("timed out waiting for UDP peers")
+		}
+	}
+
+	//A message of one datagram sent from the peer's address, as a node
+	//spoofing it would.
+	to:= tr1.conn.LocalAddr().(*net.UDPAddr)
+	msg:= EncodeMessage([]byte("delete everything"))
+	datagram:= make([]byte,udpHeaderSize,udpHeaderSize+len(msg)+udpMACSize)
+	binary.LittleEndian.PutUint32(datagram[0:4],1000)
+	binary.LittleEndian.PutUint16(datagram[6:8],1)
+	datagram = append(datagram,msg...)
+
+	forged:= append(bytes.Clone(datagram),make([]byte,udpMACSize)...)
+	_,err:= tr2.conn.WriteToUDP(forged,to)
+	assert.Nil(t, err)
+	wrongKey:= append(bytes.Clone(datagram),datagramMAC([]byte("cluster secret"),datagram)...)
+	_,err = tr2.conn.WriteToUDP(wrongKey,to)
+	assert.Nil(t, err)
+	select{
+	case rpc:= <-tr1.Consume():
+		t.Fatalf("delivered an unauthenticated datagram: %q",rpc.Payload)
+	case <-time.After(200*time.Millisecond):
+	}
+
+	//A valid datagram is delivered once however often it is replayed.
+	valid:= append(bytes.Clone(datagram),datagramMAC(dialed.sendKey,datagram)...)
+	for i:=0;i<3;i++{
+		_,err = tr2.conn.WriteToUDP(valid,to)
+		assert.Nil(t, err)
+	}
+	select{
+	case rpc:= <-tr1.Consume():
+		assert.Equal(t, []byte("delete everything"), rpc.Payload)
+	case <-time.After(2*time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	select{
+	case rpc:= <-tr1.Consume():
+		t.Fatalf("delivered a replayed datagram: %q",rpc.Payload)
+	case <-time.After(200*time.Millisecond):
+	}
+}
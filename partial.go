@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//ByteRange is Length bytes at Offset of a copy.
+type ByteRange struct{
+	Offset int64
+	Length int64
+}
+
+func (r ByteRange) end() int64{
+	return r.Offset+r.Length
+}
+
+//FileHolder is a peer holding the whole copy of a file, or only the Ranges
+//of it that reached the peer before its Store failed. Size is that of the
+//whole (encrypted) copy.
+type FileHolder struct{
+	Addr 		string
+	Size 		int64
+	Ranges 	[]ByteRange
+}
+
+//Complete tells whether the peer holds all of the copy.
+func (h FileHolder) Complete() bool{
+	return len(h.Ranges)==1 && h.Ranges[0]==ByteRange{Offset: 0,Length: h.Size}
+}
+
+//WhoHasRanges is like WhoHas but also returns the peers holding parts of
+//the file, with the ranges they hold. A Get assembles a file no peer
+//holds all of from those parts.
+func (s *FileServer) WhoHasRanges(key string) ([]FileHolder,error){
+	return s.WhoHasRangesContext(context.Background(),key)
+}
+
+func (s *FileServer) WhoHasRangesContext(ctx context.Context,key string) ([]FileHolder,error){
+	return s.whoHasRanges(ctx,key,s.peerList())
+}
+
+func (s *FileServer) whoHasRanges(ctx context.Context,key string,peers []p2p.Peer) ([]FileHolder,error){
+	replies,err:= s.hasFileReplies(ctx,key,peers,false)
+	if err!=nil{
+		return nil,err
+	}
+	holders:= []FileHolder{}
+	for addr,r:= range replies{
+		if len(r.Ranges)>0{
+			holders = append(holders,FileHolder{Addr: addr,Size: r.Size,Ranges: r.Ranges})
+		}
+	}
+	sort.Slice(holders,func(i,j int) bool{ return holders[i].Addr<holders[j].Addr })
+	return holders,nil
+}
+
+//partialCopy is what we hold of a copy a peer was streaming to us when
+//the stream broke, its bytes are in the spool (see receiveSpooled).
+type partialCopy struct{
+	Size 		int64
+	Ranges 	[]ByteRange
+}
+
+//holds tells whether the length bytes at off are all in one range.
+func (p partialCopy) holds(off int64,length int64) bool{
+	for _,r:= range p.Ranges{
+		if r.Offset<=off && off+length<=r.end(){
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FileServer) partialPath(id string,key string) string{
+	return s.spoolPath(id,key)+".ranges"
+}
+
+//partialOf returns the partial copy we hold of the file of the node with
+//id, ok is false when there is none.
+func (s *FileServer) partialOf(id string,key string) (partialCopy,bool){
+	var p partialCopy
+	b,err:= os.ReadFile(s.partialPath(id,key))
+	if err!=nil || json.Unmarshal(b,&p)!=nil || len(p.Ranges)==0{
+		return partialCopy{},false
+	}
+	return p,true
+}
+
+//setPartial records the ranges of the spool of a copy, none removes it.
+func (s *FileServer) setPartial(id string,key string,p partialCopy){
+	path:= s.partialPath(id,key)
+	if len(p.Ranges)==0{
+		os.Remove(path)
+		return
+	}
+	b,_:= json.Marshal(p)
+	if err:= os.WriteFile(path,b,0o600);err!=nil{
+		s.Logger.With("key",key).Errorf("recording partial copy error: %s",err)
+	}
+}
+
+//servePartial serves the chunk msg asks for out of our partial copy.
+func (s *FileServer) servePartial(peer p2p.Peer,from string,msg MessageGetFile,decline func() error) error{
+	if !s.beginTransfer(){
+		return decline()
+	}
+	s.serveInBackground(from,msg.Key,func() error{
+		return s.serveSpooled(peer,from,msg,decline)
+	})
+	return nil
+}
+
+//serveSpooled streams the chunk out of the spool, see servePartial.
+func (s *FileServer) serveSpooled(peer p2p.Peer,from string,msg MessageGetFile,decline func() error) error{
+	f,err:= os.Open(s.spoolPath(msg.ID,msg.Key))
+	if err!=nil{
+		decline()
+		return err
+	}
+	defer f.Close()
+	s.Logger.With("key",msg.Key,"peer",from).Infof("serving %d bytes at %d of a partial copy over the network",msg.Length,msg.Offset)
+	var(
+		r io.Reader = io.NewSectionReader(f,msg.Offset,msg.Length)
+		size 				= msg.Length
+	)
+	if msg.Sum{
+		h:= sha256.New()
+		if _,err:= io.Copy(h,io.NewSectionReader(f,msg.Offset,msg.Length));err!=nil{
+			decline()
+			return err
+		}
+		r,size = io.MultiReader(bytes.NewReader(h.Sum(nil)),r),size+sha256.Size
+	}
+	return s.serveFile(peer,from,msg,r,size)
+}
+
+//fragment is a chunk of a copy and the holder it is fetched from.
+type fragment struct{
+	holder 	int
+	chunk 	fileChunk
+}
+
+//planFragments covers the size bytes of a copy with the ranges of the
+//holders, the one reaching furthest first, in chunks of at most
+//chunkSize. ok is false when the ranges leave a gap.
+func planFragments(size int64,holders []FileHolder,chunkSize int64) (plan []fragment,ok bool){
+	for pos:= int64(0);pos<size;{
+		best,end:= -1,pos
+		for i,h:= range holders{
+			for _,r:= range h.Ranges{
+				if r.Offset<=pos && r.end()>end{
+					best,end = i,r.end()
+				}
+			}
+		}
+		if best<0{
+			return nil,false
+		}
+		for end = min(end,size);pos<end;{
+			n:= min(chunkSize,end-pos)
+			plan = append(plan,fragment{holder: best,chunk: fileChunk{index: int64(len(plan)),offset: pos,length: n}})
+			pos+=n
+		}
+	}
+	return plan,true
+}
+
+//fetchFragments assembles the file for key from the parts of it the
+//peers hold when none of them serves all of it. It fails with ErrNotFound
+//when the parts leave a gap. The file is checked against its content
+//hash and the tags of its segments like any other fetch.
+func (s *FileServer) fetchFragments(ctx context.Context,key string,peers []p2p.Peer,start time.Time) (io.Reader,error){
+	found,err:= s.whoHasRanges(ctx,key,peers)
+	if err!=nil{
+		return nil,err
+	}
+	//Every copy is the same encrypted file, one that differs is left out.
+	var holders []FileHolder
+	for _,h:= range found{
+		if len(holders)==0 || h.Size==holders[0].Size{
+			holders = append(holders,h)
+		}
+	}
+	if len(holders)==0{
+		return nil,fmt.Errorf("[%s] no peer holds any of file (%s): %w",s.Transport.Addr(),key,ErrNotFound)
+	}
+	size:= holders[0].Size
+	if err:= s.checkFileSize(size);err!=nil{
+		return nil,err
+	}
+	chunkSize:= s.ChunkSize
+	if chunkSize<=0{
+		chunkSize = defaultChunkSize
+	}
+	plan,ok:= planFragments(size,holders,chunkSize)
+	if !ok{
+		return nil,fmt.Errorf("[%s] the parts of file (%s) the peers hold leave gaps: %w",s.Transport.Addr(),key,ErrNotFound)
+	}
+
+	var(
+		chunks 	= make(map[p2p.Peer][]fileChunk)
+		sources []p2p.Peer
+	)
+	for _,frag:= range plan{
+		peer,ok:= s.peer(holders[frag.holder].Addr)
+		if !ok{
+			return nil,fmt.Errorf("[%s] %w: %s holding a part of file (%s)",s.Transport.Addr(),ErrPeerNotFound,holders[frag.holder].Addr,key)
+		}
+		if _,ok:= chunks[peer];!ok{
+			sources = append(sources,peer)
+		}
+		chunks[peer] = append(chunks[peer],frag.chunk)
+	}
+	s.Logger.With("key",key).Infof("no peer holds the whole file, assembling it from %d parts held by %d peers",len(plan),len(sources))
+
+	spool,err:= os.CreateTemp("","cas-fragments-*")
+	if err!=nil{
+		return nil,err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	t:= s.addStreamTransfer(hashKey(key),kindGet,len(plan)+len(sources),len(sources))
+	defer s.removeTransfer(hashKey(key),kindGet)
+	routes,stopRoutes:= s.routeChunks(t,sources)
+	var(
+		wg 		sync.WaitGroup
+		errs 	= make(chan error,len(sources))
+	)
+	for peer,cs:= range chunks{
+		wg.Add(1)
+		go func(peer p2p.Peer,cs []fileChunk){
+			defer wg.Done()
+			for _,c:= range cs{
+				if _,err:= s.fetchChunk(ctx,key,peer,routes[peer.RemoteAddr().String()],spool,c);err!=nil{
+					errs <- fmt.Errorf("%d bytes at %d from %s: %w",c.length,c.offset,peer.RemoteAddr(),err)
+					return
+				}
+			}
+		}(peer,cs)
+	}
+	wg.Wait()
+	stopRoutes()
+	close(errs)
+	var failures []error
+	for err:= range errs{
+		failures = append(failures,err)
+	}
+	if len(failures)>0{
+		return nil,errors.Join(failures...)
+	}
+
+	if _,err:= spool.Seek(0,io.SeekStart);err!=nil{
+		return nil,err
+	}
+	written,err:= s.store.writeDecrypt(s.keys,s.ID,key,ctxReader{ctx,io.LimitReader(spool,size)},verifyingReader)
+	if err!=nil{
+		return nil,err
+	}
+	s.Logger.With("key",key).Infof("received (%d) bytes in %d parts over the network",written,len(plan))
+	return s.completeFetch(key,written,start)
+}
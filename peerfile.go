@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"sort"
+)
+
+//peersFile is where a Store keeps the addresses of the peers we dialed,
+//with the number of times in a row the dials to them gave up.
+const peersFile = ".peers"
+
+const defaultMaxPeerFailures = 3
+
+//savedPeers returns the addresses in the peers file, in order.
+func (s *FileServer) savedPeers() []string{
+	s.knownLock.Lock()
+	defer s.knownLock.Unlock()
+	if err:= s.loadPeers();err!=nil{
+		s.Logger.Errorf("reading saved peers: %s",err)
+	}
+	addrs:= make([]string,0,len(s.knownPeers))
+	for addr:= range s.knownPeers{
+		addrs = append(addrs,addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//loadPeers reads the peers file into knownPeers the first time.
+func (s *FileServer) loadPeers() error{
+	if s.knownPeers!=nil{
+		return nil
+	}
+	s.knownPeers = make(map[string]int)
+	_,r,err:= s.store.Backend.Read(peersFile)
+	if errors.Is(err,fs.ErrNotExist){
+		return nil
+	}
+	if err!=nil{
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(&s.knownPeers)
+}
+
+//rememberPeer saves the address of a peer we dialed, its failures are
+//forgotten.
+func (s *FileServer) rememberPeer(addr string){
+	if s.MaxPeerFailures<0{
+		return
+	}
+	s.knownLock.Lock()
+	defer s.knownLock.Unlock()
+	s.loadPeers()
+	if fails,ok:= s.knownPeers[addr];ok && fails==0{
+		return
+	}
+	s.knownPeers[addr] = 0
+	s.savePeers()
+}
+
+//peerFailed counts a round of dials that gave up on addr, a saved peer
+//is forgotten after MaxPeerFailures of them.
+func (s *FileServer) peerFailed(addr string){
+	if s.MaxPeerFailures<0{
+		return
+	}
+	s.knownLock.Lock()
+	defer s.knownLock.Unlock()
+	s.loadPeers()
+	fails,ok:= s.knownPeers[addr]
+	if !ok{
+		return
+	}
+	if fails+1>=s.MaxPeerFailures{
+		s.Logger.With("peer",addr).Infof("forgetting saved peer after %d failed reconnects",fails+1)
+		delete(s.knownPeers,addr)
+	}else{
+		s.knownPeers[addr] = fails+1
+	}
+	s.savePeers()
+}
+
+func (s *FileServer) savePeers(){
+	b,err:= json.Marshal(s.knownPeers)
+	if err==nil{
+		_,err = s.store.Backend.Write(peersFile,bytes.NewReader(b))
+	}
+	if err!=nil{
+		s.Logger.Errorf("saving peers: %s",err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//pinsSuffix marks the sidecar file listing the peers a file was pinned to.
+const pinsSuffix = ".pins"
+
+//Pin streams the file for key to the peers with the given addresses only,
+//whatever ReplicationFactor would pick, and waits until each of them
+//confirms it holds the file. A file that isn't stored locally is fetched
+//from the network first. The peers that confirmed are listed by Pins.
+func (s *FileServer) Pin(key string,peerAddrs []string) error{
+	return s.PinContext(context.Background(),key,peerAddrs)
+}
+
+//PinContext is like Pin but stops once ctx is done.
+func (s *FileServer) PinContext(ctx context.Context,key string,peerAddrs []string) error{
+	if s.ReadOnly{
+		return fmt.Errorf("[%s] a read only server can't pin files",s.Transport.Addr())
+	}
+	targets:= make([]p2p.Peer,0,len(peerAddrs))
+	for _,addr:= range peerAddrs{
+		peer,ok:= s.peer(addr)
+		if !ok{
+			return fmt.Errorf("[%s] %w: %s",s.Transport.Addr(),ErrPeerNotFound,addr)
+		}
+		targets = append(targets,peer)
+	}
+
+	r,err:= s.GetContext(ctx,key)
+	if err!=nil{
+		return fmt.Errorf("pin %s: %w",key,err)
+	}
+	if rc,ok:= r.(io.ReadCloser);ok{
+		rc.Close()
+	}
+
+	if !s.beginTransfer(){
+		return fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+	size,f,err:= s.store.Read(s.ID,key)
+	if err!=nil{
+		return err
+	}
+	if rc,ok:= f.(io.ReadCloser);ok{
+		rc.Close()
+	}
+	expires,_,err:= s.store.Expiry(s.ID,key)
+	if err!=nil{
+		return err
+	}
+	//The peers that failed to receive the file are reported as missing.
+	rep,err:= s.replicateTo(ctx,key,size,expires,nil,targets)
+	var replErr *ReplicationError
+	if err!=nil && !errors.As(err,&replErr){
+		return err
+	}
+
+	//A peer handles the stream before the messages that follow it, so
+	//when it answers the file is written.
+	holders,err:= s.whoHas(ctx,key,rep.peers(),nil)
+	if err!=nil{
+		return err
+	}
+	if err:= s.store.addPins(s.ID,key,holders);err!=nil{
+		return err
+	}
+	held:= make(map[string]bool,len(holders))
+	for _,addr:= range holders{
+		held[addr] = true
+	}
+	var missing []string
+	for _,addr:= range peerAddrs{
+		if !held[addr]{
+			missing = append(missing,addr)
+		}
+	}
+	if len(missing)>0{
+		return fmt.Errorf("[%s] pin %s: not confirmed by %s",s.Transport.Addr(),key,strings.Join(missing,", "))
+	}
+	s.Logger.With("key",key).Infof("pinned to %d peers",len(holders))
+	return nil
+}
+
+//Pins returns the addresses of the peers the file for key was pinned to,
+//sorted. They are the peers that confirmed a Pin, whether they still
+//hold the file can be checked with WhoHas.
+func (s *FileServer) Pins(key string) []string{
+	pins,err:= s.store.Pins(s.ID,key)
+	if err!=nil{
+		s.Logger.With("key",key).Errorf("read pins error: %s",err)
+	}
+	return pins
+}
+
+func (s *Store) pinsPath(id string,key string) string{
+	return s.backendPath(id,key)+pinsSuffix
+}
+
+//Pins returns the peers recorded with addPins, sorted.
+func (s *Store) Pins(id string,key string) ([]string,error){
+	_,r,err:= s.Backend.Read(s.pinsPath(id,key))
+	if errors.Is(err,fs.ErrNotExist){
+		return []string{},nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	defer r.Close()
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return nil,err
+	}
+	return strings.Fields(string(b)),nil
+}
+
+//addPins adds addrs to the peers the file for key is pinned to.
+func (s *Store) addPins(id string,key string,addrs []string) error{
+	pins,err:= s.Pins(id,key)
+	if err!=nil{
+		return err
+	}
+	seen:= make(map[string]bool,len(pins))
+	for _,addr:= range pins{
+		seen[addr] = true
+	}
+	for _,addr:= range addrs{
+		if !seen[addr]{
+			seen[addr] = true
+			pins = append(pins,addr)
+		}
+	}
+	sort.Strings(pins)
+	_,err = s.Backend.Write(s.pinsPath(id,key),strings.NewReader(strings.Join(pins,"\n")))
+	return err
+}
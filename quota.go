@@ -0,0 +1,420 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrQuotaExceeded is returned by a write that doesn't fit in MaxBytes.
+var ErrQuotaExceeded = errors.New("store quota exceeded")
+
+//EvictionPolicy decides what a Store with MaxBytes does with a write
+//that doesn't fit.
+type EvictionPolicy int
+
+const(
+	//EvictReject fails the write with ErrQuotaExceeded.
+	EvictReject EvictionPolicy = iota
+	//EvictLRU removes the least recently read files until it fits.
+	EvictLRU
+)
+
+//accessLog is where the access times of the files are saved, see
+//quotaBackend.flush. It holds a line of the time in Unix nanoseconds and
+//the path per file.
+const accessLog = ".access"
+
+//isBookkeeping tells whether p is one of the Store's own files at the
+//root of the backend, they are never counted or evicted.
+func isBookkeeping(p string) bool{
+	return p==transformMarker || p==migrateJournal || p==accessLog || p==saltFile || p==peersFile || p==tokensFile
+}
+
+//quotaBackend keeps the files of a backend within maxBytes, 0 is
+//unlimited. It tracks the size of every path as it is written and
+//deleted and when every file was last used, the backend is only listed
+//once it is needed. The access times are kept in memory and saved by
+//flush, so reads don't write to the backend.
+type quotaBackend struct{
+	StorageBackend
+	maxBytes 	int64
+	policy 		EvictionPolicy
+
+	mu 			sync.Mutex
+	loaded 	bool
+	usage 	int64
+	sizes 	map[string]int64
+	//lru holds the *lruEntry of the files (not sidecars), most recently
+	//used in front. A file being written is not in it until it is complete.
+	lru 		*list.List
+	files 	map[string]*list.Element
+	//dirty is set when an access time changed since the last flush.
+	dirty 	bool
+}
+
+type lruEntry struct{
+	p 		string
+	atime time.Time
+}
+
+func newQuotaBackend(b StorageBackend,maxBytes int64,policy EvictionPolicy) *quotaBackend{
+	return &quotaBackend{
+		StorageBackend: b,
+		maxBytes: 			maxBytes,
+		policy: 				policy,
+		sizes: 					make(map[string]int64),
+		lru: 						list.New(),
+		files: 					make(map[string]*list.Element),
+	}
+}
+
+//load sizes up what the backend already holds, the files are ordered by
+//their saved access times. The ones written or read since we started are
+//the most recent, the ones without an access time the least.
+func (q *quotaBackend) load() error{
+	if q.loaded{
+		return nil
+	}
+	paths,err:= q.StorageBackend.List()
+	if err!=nil{
+		return err
+	}
+	saved,err:= q.readAccessLog()
+	if err!=nil{
+		return err
+	}
+	for _,p:= range paths{
+		if _,ok:= q.sizes[p];ok || isBookkeeping(p){
+			continue
+		}
+		n,r,err:= q.StorageBackend.Read(p)
+		if err!=nil{
+			return err
+		}
+		r.Close()
+		q.usage+=n
+		q.sizes[p] = n
+		if _,ok:= q.files[p];!ok && !isSidecar(p){
+			q.files[p] = q.lru.PushBack(&lruEntry{p: p,atime: saved[p]})
+		}
+	}
+
+	entries:= make([]*lruEntry,0,q.lru.Len())
+	for e:= q.lru.Front();e!=nil;e = e.Next(){
+		entries = append(entries,e.Value.(*lruEntry))
+	}
+	sort.SliceStable(entries,func(i,j int) bool{
+		return entries[i].atime.After(entries[j].atime)
+	})
+	q.lru.Init()
+	for _,entry:= range entries{
+		q.files[entry.p] = q.lru.PushBack(entry)
+	}
+	q.loaded = true
+	return nil
+}
+
+func (q *quotaBackend) readAccessLog() (map[string]time.Time,error){
+	saved:= make(map[string]time.Time)
+	if !q.StorageBackend.Has(accessLog){
+		return saved,nil
+	}
+	_,r,err:= q.StorageBackend.Read(accessLog)
+	if err!=nil{
+		return nil,err
+	}
+	defer r.Close()
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return nil,err
+	}
+	for _,line:= range strings.Split(string(b),"\n"){
+		nanos,p,ok:= strings.Cut(line," ")
+		if !ok{
+			continue
+		}
+		if n,err:= strconv.ParseInt(nanos,10,64);err==nil{
+			saved[p] = time.Unix(0,n)
+		}
+	}
+	return saved,nil
+}
+
+//flush saves the access times if one changed. The backend is loaded
+//first so the times saved before aren't lost.
+func (q *quotaBackend) flush() error{
+	q.mu.Lock()
+	if !q.dirty{
+		q.mu.Unlock()
+		return nil
+	}
+	if err:= q.load();err!=nil{
+		q.mu.Unlock()
+		return err
+	}
+	var b strings.Builder
+	for e:= q.lru.Front();e!=nil;e = e.Next(){
+		if entry:= e.Value.(*lruEntry);!entry.atime.IsZero(){
+			fmt.Fprintf(&b,"%d %s\n",entry.atime.UnixNano(),entry.p)
+		}
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	if _,err:= q.StorageBackend.Write(accessLog,strings.NewReader(b.String()));err!=nil{
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (q *quotaBackend) track(p string,n int64){
+	q.usage+=n-q.sizes[p]
+	q.sizes[p] = n
+	if !isSidecar(p){
+		q.touch(p)
+	}
+}
+
+//touch makes the file at p the most recently used.
+func (q *quotaBackend) touch(p string){
+	q.dirty = true
+	if e,ok:= q.files[p];ok{
+		e.Value.(*lruEntry).atime = time.Now()
+		q.lru.MoveToFront(e)
+		return
+	}
+	q.files[p] = q.lru.PushFront(&lruEntry{p: p,atime: time.Now()})
+}
+
+func (q *quotaBackend) forget(p string){
+	q.usage-=q.sizes[p]
+	delete(q.sizes,p)
+	if e,ok:= q.files[p];ok{
+		q.lru.Remove(e)
+		delete(q.files,p)
+		q.dirty = true
+	}
+}
+
+//reserve makes room for n more bytes of path p.
+func (q *quotaBackend) reserve(p string,n int64) error{
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes>0 && q.sizes[p]+n>q.maxBytes{
+		//It won't fit however much is evicted.
+		return ErrQuotaExceeded
+	}
+	for q.maxBytes>0 && q.usage+n>q.maxBytes{
+		if q.policy!=EvictLRU{
+			return ErrQuotaExceeded
+		}
+		if ok,err:= q.evictOne();!ok || err!=nil{
+			return ErrQuotaExceeded
+		}
+	}
+	q.usage+=n
+	q.sizes[p]+=n
+	return nil
+}
+
+//evictOne removes the least recently used file along with its sidecars,
+//it returns false if there is none.
+func (q *quotaBackend) evictOne() (bool,error){
+	e:= q.lru.Back()
+	if e==nil{
+		return false,nil
+	}
+	p:= e.Value.(*lruEntry).p
+	for _,del:= range append([]string{p},sidecarPaths(p)...){
+		if err:= q.StorageBackend.Delete(del);err!=nil{
+			return false,err
+		}
+		q.forget(del)
+	}
+	return true,nil
+}
+
+//evict removes the least recently used files until the backend holds at
+//most target bytes, and returns how many it removed.
+func (q *quotaBackend) evict(target int64) (int,error){
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err:= q.load();err!=nil{
+		return 0,err
+	}
+	n:= 0
+	for q.usage>target{
+		ok,err:= q.evictOne()
+		if err!=nil{
+			return n,err
+		}
+		if !ok{
+			break
+		}
+		n++
+	}
+	return n,nil
+}
+
+func (q *quotaBackend) Write(p string,r io.Reader) (int64,error){
+	if isBookkeeping(p){
+		//The Store's own bookkeeping doesn't count.
+		return q.StorageBackend.Write(p,r)
+	}
+	q.mu.Lock()
+	//Without a quota there is no need to know the usage yet.
+	if q.maxBytes>0{
+		if err:= q.load();err!=nil{
+			q.mu.Unlock()
+			return 0,err
+		}
+	}
+	//The old content is replaced, the new one is reserved as it streams in.
+	q.forget(p)
+	q.mu.Unlock()
+
+	n,err:= q.StorageBackend.Write(p,&quotaReader{q: q,p: p,r: r})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.forget(p)
+	if err!=nil{
+		//The backend kept what p held before the failed write, it still counts.
+		if size,r,rerr:= q.StorageBackend.Read(p);rerr==nil{
+			r.Close()
+			q.track(p,size)
+		}
+		return n,err
+	}
+	q.track(p,n)
+	return n,nil
+}
+
+//Close saves the access times and closes the wrapped backend if it is an
+//io.Closer.
+func (q *quotaBackend) Close() error{
+	err:= q.flush()
+	if c,ok:= q.StorageBackend.(io.Closer);ok{
+		return errors.Join(err,c.Close())
+	}
+	return err
+}
+
+func (q *quotaBackend) Read(p string) (int64,io.ReadCloser,error){
+	n,r,err:= q.StorageBackend.Read(p)
+	if err==nil && !isSidecar(p) && !isBookkeeping(p){
+		q.mu.Lock()
+		q.touch(p)
+		q.mu.Unlock()
+	}
+	return n,r,err
+}
+
+func (q *quotaBackend) Delete(p string) error{
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes>0{
+		if err:= q.load();err!=nil{
+			return err
+		}
+	}
+	if err:= q.StorageBackend.Delete(p);err!=nil{
+		return err
+	}
+	below:= func(f string) bool{
+		return f==p || strings.HasPrefix(f,p+"/")
+	}
+	var gone []string
+	for f:= range q.sizes{
+		if below(f){
+			gone = append(gone,f)
+		}
+	}
+	//A file that was only read has an access time but no size yet.
+	for f:= range q.files{
+		if below(f){
+			gone = append(gone,f)
+		}
+	}
+	for _,f:= range gone{
+		q.forget(f)
+	}
+	return nil
+}
+
+func (q *quotaBackend) Clear() error{
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err:= q.StorageBackend.Clear();err!=nil{
+		return err
+	}
+	q.usage = 0
+	q.sizes = make(map[string]int64)
+	q.lru.Init()
+	q.files = make(map[string]*list.Element)
+	q.loaded = true
+	q.dirty = false
+	return nil
+}
+
+//Usage returns the bytes the backend holds and the number of files.
+func (q *quotaBackend) Usage() (int64,int,error){
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err:= q.load();err!=nil{
+		return 0,0,err
+	}
+	return q.usage,q.lru.Len(),nil
+}
+
+//quotaReader reserves the bytes of a write as the backend reads them.
+type quotaReader struct{
+	q 	*quotaBackend
+	p 	string
+	r 	io.Reader
+}
+
+func (r *quotaReader) Read(b []byte) (int,error){
+	n,err:= r.r.Read(b)
+	if n>0{
+		if qerr:= r.q.reserve(r.p,int64(n));qerr!=nil{
+			return 0,qerr
+		}
+	}
+	return n,err
+}
+
+//Usage returns the bytes the Store holds in its backend, sidecars
+//included, and the number of files. The backend is listed the first time,
+//if that fails the error is logged and nothing is counted.
+func (s *Store) Usage() (int64,int){
+	n,count,err:= s.quota.Usage()
+	if err!=nil{
+		log.Printf("usage: %s",err)
+	}
+	return n,count
+}
+
+//EvictLRU removes the least recently read or written files along with
+//their sidecars until the Store holds at most targetBytes, and returns how
+//many it removed.
+func (s *Store) EvictLRU(targetBytes int64) (int,error){
+	return s.quota.evict(targetBytes)
+}
+
+//FlushAccessTimes saves the access times EvictLRU goes by, so they
+//outlive a restart. Close saves them as well.
+func (s *Store) FlushAccessTimes() error{
+	return s.quota.flush()
+}
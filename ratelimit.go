@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//errStopped is returned by a throttled transfer the server stops during.
+var errStopped = errors.New("server is stopping")
+
+//throttleChunk is the most a throttled read takes at once, so the
+//limiter is fed evenly rather than with whole copy buffers.
+const throttleChunk = 16<<10
+
+//rateLimiter is a token bucket of bytes shared by all the transfers in one
+//direction. A nil rateLimiter doesn't limit.
+type rateLimiter struct{
+	mu 			sync.Mutex
+	rate 		float64
+	burst 	float64
+	tokens 	float64
+	last 		time.Time
+}
+
+//newRateLimiter allows bytesPerSec with bursts of a second's worth, it
+//returns nil for a rate of 0 or less.
+func newRateLimiter(bytesPerSec int64) *rateLimiter{
+	if bytesPerSec<=0{
+		return nil
+	}
+	rate:= float64(bytesPerSec)
+	return &rateLimiter{rate: rate,burst: rate,tokens: rate,last: time.Now()}
+}
+
+//reserve takes n tokens and returns how long to wait before using them.
+//The bucket may go into debt, the next callers then wait it off in turn.
+func (l *rateLimiter) reserve(n int) time.Duration{
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now:= time.Now()
+	l.tokens = min(l.burst,l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens-=float64(n)
+	if l.tokens>=0{
+		return 0
+	}
+	return time.Duration(-l.tokens/l.rate*float64(time.Second))
+}
+
+//wait blocks until n bytes may be transferred or done is closed.
+func (l *rateLimiter) wait(done <-chan struct{},n int) error{
+	if l==nil || n<=0{
+		return nil
+	}
+	d:= l.reserve(n)
+	if d<=0{
+		return nil
+	}
+	t:= time.NewTimer(d)
+	defer t.Stop()
+	select{
+	case <-t.C:
+		return nil
+	case <-done:
+		return errStopped
+	}
+}
+
+//throttledReader reads from r no faster than its limiter allows.
+type throttledReader struct{
+	r 		io.Reader
+	l 		*rateLimiter
+	done 	<-chan struct{}
+}
+
+func throttle(r io.Reader,l *rateLimiter,done <-chan struct{}) io.Reader{
+	if l==nil{
+		return r
+	}
+	return &throttledReader{r: r,l: l,done: done}
+}
+
+func (t *throttledReader) Read(b []byte) (int,error){
+	if len(b)>throttleChunk{
+		b = b[:throttleChunk]
+	}
+	n,err:= t.r.Read(b)
+	if werr:= t.l.wait(t.done,n);werr!=nil{
+		return n,werr
+	}
+	return n,err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterShared(t *testing.T){
+	const rate = 200<<10
+	l:= newRateLimiter(rate)
+	start:= time.Now()
+
+	//Two transfers of a second's worth each share the bucket: the burst
+	//covers one of them, the other has to wait about a second.
+	var wg sync.WaitGroup
+	for i:=0;i<2;i++{
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			n,err:= io.Copy(io.Discard,throttle(bytes.NewReader(make([]byte,rate)),l,nil))
+			if err!=nil || n!=rate{
+				t.Errorf("want %d bytes, have %d (%v)",rate,n,err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d:= time.Since(start);d<900*time.Millisecond || d>3*time.Second{
+		t.Errorf("want about a second for two seconds' worth, took %s",d)
+	}
+}
+
+func TestRateLimiterStop(t *testing.T){
+	l:= newRateLimiter(1<<10)
+	done:= make(chan struct{})
+	close(done)
+	_,err:= io.Copy(io.Discard,throttle(bytes.NewReader(make([]byte,64<<10)),l,done))
+	if !errors.Is(err,errStopped){
+		t.Errorf("want %v, have %v",errStopped,err)
+	}
+	if newRateLimiter(0)!=nil{
+		t.Error("want no limiter for a rate of 0")
+	}
+}
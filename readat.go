@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//MessageGetRange asks for the Length plain bytes starting at Offset of the
+//peer's (encrypted) copy of a file. The peer streams the header and only
+//the segments holding them, plus the first one which holds the
+//compression byte. The ack carries RequestID.
+type MessageGetRange struct{
+	RequestID string
+	ID 				string
+	Key 			string
+	Offset 		int64
+	Length 		int64
+}
+
+//errRangeUnsupported is returned for a copy whose range can't be read on
+//its own: it is compressed, or was encrypted before key IDs.
+var errRangeUnsupported = errors.New("range can't be read from the copy")
+
+//ReadAt returns length bytes of the content of the file starting at off,
+//fewer if the file ends first. An uncompressed file is read from off on
+//a backend that can seek, a compressed one is decompressed up to off.
+func (s *Store) ReadAt(id string,key string,off int64,length int64) (io.Reader,error){
+	if off<0 || length<0{
+		return nil,fmt.Errorf("invalid range of %d bytes at %d",length,off)
+	}
+	size,r,err:= s.readStream(id,key)
+	if err!=nil{
+		return nil,err
+	}
+	header:= make([]byte,1)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		r.Close()
+		return nil,err
+	}
+	if Compression(header[0])==CompressionNone{
+		if off>=size-1 && length>0{
+			r.Close()
+			return nil,fmt.Errorf("offset %d beyond the end of the %d byte file",off,size-1)
+		}
+		if sk,ok:= r.(io.Seeker);ok{
+			_,err = sk.Seek(1+off,io.SeekStart)
+		}else{
+			_,err = io.CopyN(io.Discard,r,off)
+		}
+		if err!=nil{
+			r.Close()
+			return nil,err
+		}
+		return readCloser{io.LimitReader(r,length),r},nil
+	}
+
+	dr,err:= decompressReader(readCloser{io.MultiReader(bytes.NewReader(header),r),r})
+	if err!=nil{
+		r.Close()
+		return nil,err
+	}
+	//Reading the byte at off tells whether the file ends before it.
+	next:= make([]byte,1)
+	_,err = io.CopyN(io.Discard,dr,off)
+	if err==nil && length>0{
+		_,err = io.ReadFull(dr,next)
+	}
+	if err!=nil{
+		dr.Close()
+		if err==io.EOF{
+			return nil,fmt.Errorf("offset %d beyond the end of the file",off)
+		}
+		return nil,err
+	}
+	if length==0{
+		return readCloser{bytes.NewReader(nil),dr},nil
+	}
+	return readCloser{io.MultiReader(bytes.NewReader(next),io.LimitReader(dr,length-1)),dr},nil
+}
+
+//ReadAt returns length bytes of the file starting at off without fetching
+//all of it. A file we don't hold is read from a peer's copy, only the
+//segments holding the range are sent and each is checked against its tag
+//instead of the whole file against its hash. The range is read into
+//memory. A copy that is compressed is fetched whole and stored, like Get.
+func (s *FileServer) ReadAt(key string,off int64,length int64) (io.Reader,error){
+	return s.ReadAtContext(context.Background(),key,off,length)
+}
+
+func (s *FileServer) ReadAtContext(ctx context.Context,key string,off int64,length int64) (io.Reader,error){
+	if s.store.Has(s.ID,key) && !s.store.Expired(s.ID,key){
+		return s.store.ReadAt(s.ID,key,off,length)
+	}
+	if off<0 || length<0{
+		return nil,fmt.Errorf("invalid range of %d bytes at %d",length,off)
+	}
+	if length==0{
+		return bytes.NewReader(nil),nil
+	}
+
+	if !s.beginTransfer(){
+		return nil,fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	b,err:= s.fetchRange(ctx,key,off,length)
+	s.endTransfer()
+	if err==nil{
+		return bytes.NewReader(b),nil
+	}
+	if !errors.Is(err,errRangeUnsupported){
+		return nil,err
+	}
+	s.Logger.With("key",key).Infof("range can't be read from the peer's copy, fetching the file")
+	r,_,err:= s.get(ctx,key)
+	if err!=nil{
+		return nil,err
+	}
+	if rc,ok:= r.(io.ReadCloser);ok{
+		rc.Close()
+	}
+	return s.store.ReadAt(s.ID,key,off,length)
+}
+
+//fetchRange asks the peers for the range and reads it from the first
+//that streams it.
+func (s *FileServer) fetchRange(ctx context.Context,key string,off int64,length int64) ([]byte,error){
+	peers:= s.selectPeers(key)
+	msg:= MessageGetRange{
+		RequestID: generateID(),
+		ID: s.ID,
+		Key: hashKey(key),
+		//The plain bytes of a copy start with the compression byte.
+		Offset: 1+off,
+		Length: length,
+	}
+	t:= s.addTransfer(msg.RequestID,kindRange,len(peers))
+	defer s.removeTransfer(msg.RequestID,kindRange)
+
+	reached,_:= s.multicast(ctx,&Message{Payload: msg},peers)
+	if err:= ctx.Err();err!=nil{
+		return nil,err
+	}
+
+	//Every peer acks, the ones that have the file stream the range right
+	//after with the size of their copy in the ack.
+	var(
+		declined 	int
+		sizes 		= make(map[string]int64)
+		timeout 	= time.After(s.AckTimeout)
+	)
+	for{
+		if declined==len(reached){
+			return nil,fmt.Errorf("[%s] no peer served %d bytes at %d of file (%s): %w",s.Transport.Addr(),length,off,key,ErrNotFound)
+		}
+		select{
+		case peer:= <-t.streams:
+			//Its ack was queued before the stream was handed to us.
+			for len(t.acks)>0{
+				ack:= <-t.acks
+				sizes[ack.From] = ack.Size
+			}
+			return s.receiveRange(ctx,peer,msg,sizes[peer.RemoteAddr().String()])
+		case ack:= <-t.acks:
+			if !ack.Ready{
+				declined++
+				continue
+			}
+			sizes[ack.From] = ack.Size
+		case <-timeout:
+			return nil,fmt.Errorf("[%s] no peer served %d bytes at %d of file (%s): %w",s.Transport.Addr(),length,off,key,ErrNotFound)
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+}
+
+//rangeSegments returns the segments of a copy of size bytes a peer serves
+//for msg, in the order they are sent.
+func rangeSegments(msg MessageGetRange,size int64) []int64{
+	first:= msg.Offset/gcmSegmentSize
+	last:= (min(msg.Offset+msg.Length,plainSize(size))-1)/gcmSegmentSize
+	var segments []int64
+	if first>0{
+		segments = append(segments,0)
+	}
+	for i:= first;i<=last;i++{
+		segments = append(segments,i)
+	}
+	return segments
+}
+
+//receiveRange reads the segments a peer is streaming for msg and returns
+//the plain bytes of the range.
+func (s *FileServer) receiveRange(ctx context.Context,peer p2p.Peer,msg MessageGetRange,size int64) ([]byte,error){
+	var streamSize int64
+	if err:= binary.Read(peer,binary.LittleEndian,&streamSize);err!=nil{
+		peer.CloseStream()
+		s.dropPeer(peer,err)
+		return nil,err
+	}
+	lr:= &exactReader{r: peer,n: streamSize}
+	var(
+		segments 	[]int64
+		want 			= int64(-1)
+	)
+	if size>=cipherHeaderSize+gcmTagSize && msg.Offset<plainSize(size){
+		segments = rangeSegments(msg,size)
+		want = cipherHeaderSize
+		for _,i:= range segments{
+			_,n:= segmentSpan(i,size)
+			want+=n
+		}
+	}
+	if streamSize!=want{
+		peer.CloseStream()
+		return nil,fmt.Errorf("peer %s served %d bytes of a %d byte range",peer.RemoteAddr(),streamSize,want)
+	}
+	b:= make([]byte,streamSize)
+	_,err:= io.ReadFull(ctxReader{ctx,throttle(lr,s.downloads,ctx.Done())},b)
+	if err!=nil{
+		peer.CloseStream()
+		if ctx.Err()!=nil{
+			return nil,ctx.Err()
+		}
+		return nil,err
+	}
+	peer.CloseStream()
+
+	o,err:= newSegmentOpener(s.keys,b[:cipherHeaderSize],size)
+	if err!=nil{
+		return nil,fmt.Errorf("%w: %s",errRangeUnsupported,err)
+	}
+	var(
+		plain []byte
+		first = msg.Offset/gcmSegmentSize
+	)
+	b = b[cipherHeaderSize:]
+	for j,i:= range segments{
+		_,n:= segmentSpan(i,size)
+		p,err:= o.open(i,b[:n])
+		if err!=nil{
+			return nil,err
+		}
+		b = b[n:]
+		if j==0 && (len(p)==0 || Compression(p[0])!=CompressionNone){
+			return nil,errRangeUnsupported
+		}
+		//The first segment may only be there for the compression byte.
+		if i>=first{
+			plain = append(plain,p...)
+		}
+	}
+	start:= msg.Offset-first*gcmSegmentSize
+	return plain[start:min(start+msg.Length,int64(len(plain)))],nil
+}
+
+//handleMessageGetRange serves the segments of our copy of a file that
+//hold the range, see MessageGetRange.
+func (s *FileServer) handleMessageGetRange(from string,msg MessageGetRange) error{
+	peer,ok:= s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+
+	decline:= func() error{
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false,Get: true,RequestID: msg.RequestID}})
+	}
+	if msg.Offset<0 || msg.Length<=0 || !s.servesCopy(msg.ID,msg.Key){
+		return decline()
+	}
+	if !s.beginTransfer(){
+		return decline()
+	}
+	s.serveInBackground(from,msg.Key,func() error{
+		return s.serveRange(peer,from,msg,decline)
+	})
+	return nil
+}
+
+//serveRange streams the segments msg asks for, see handleMessageGetRange.
+func (s *FileServer) serveRange(peer p2p.Peer,from string,msg MessageGetRange,decline func() error) error{
+	size,r,err:= s.store.readStream(msg.ID,msg.Key)
+	if err!=nil{
+		decline()
+		return err
+	}
+	defer r.Close()
+	if size<cipherHeaderSize+gcmTagSize || msg.Offset>=plainSize(size){
+		return decline()
+	}
+
+	spans:= [][2]int64{{0,cipherHeaderSize}}
+	streamSize:= int64(cipherHeaderSize)
+	for _,i:= range rangeSegments(msg,size){
+		off,n:= segmentSpan(i,size)
+		spans = append(spans,[2]int64{off,n})
+		streamSize+=n
+	}
+	s.Logger.With("key",msg.Key,"peer",from).Infof("serving %d bytes at %d of file over the network",msg.Length,msg.Offset)
+
+	id:= s.nextStreamID()
+	if err:= s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: true,Get: true,Size: size,RequestID: msg.RequestID,StreamID: id}});err!=nil{
+		return err
+	}
+	w,err:= s.beginStream(peer,id,streamSize)
+	if err!=nil{
+		return err
+	}
+	var pos,written int64
+	for _,span:= range spans{
+		if sk,ok:= r.(io.Seeker);ok{
+			_,err = sk.Seek(span[0],io.SeekStart)
+		}else{
+			_,err = io.CopyN(io.Discard,r,span[0]-pos)
+		}
+		if err==nil{
+			var n int64
+			n,err = s.copyBufferN(w,throttle(r,s.uploads,s.quitCh),span[1])
+			written+=n
+		}
+		if err!=nil{
+			s.dropPeer(peer,err)
+			return err
+		}
+		pos = span[0]+span[1]
+	}
+	if err:= w.Close();err!=nil{
+		s.dropPeer(peer,err)
+		return err
+	}
+	s.Metrics.addBytesServed(written)
+	s.emit(Event{Type: EventFileServed,Peer: from,Key: msg.Key,Size: written})
+	s.audit(AuditEntry{Op: AuditGet,ID: msg.ID,Key: msg.Key,Size: written,Peer: from})
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+const(
+	defaultReconnectBaseDelay 	= 500*time.Millisecond
+	defaultReconnectMaxDelay 		= 30*time.Second
+	defaultMaxReconnectAttempts = 5
+)
+
+//reconnectDelay is the exponential backoff before the given (zero based)
+//retry, capped at ReconnectMaxDelay.
+func (s *FileServer) reconnectDelay(attempt int) time.Duration{
+	delay:= s.ReconnectBaseDelay
+	for i:=0;i<attempt;i++{
+		delay*=2
+		if delay>=s.ReconnectMaxDelay{
+			return s.ReconnectMaxDelay
+		}
+	}
+	return delay
+}
+
+//errStillDialing is reported in a BootstrapError for the nodes whose dial
+//had not ended when the BootstrapTimeout elapsed.
+var errStillDialing = errors.New("still dialing")
+
+//BootstrapError is returned by Start when no peer connected within the
+//BootstrapTimeout. Results holds the error of the dial by bootstrap node.
+type BootstrapError struct{
+	Results map[string]error
+}
+
+func (e *BootstrapError) Error() string{
+	addrs:= make([]string,0,len(e.Results))
+	for addr:= range e.Results{
+		addrs = append(addrs,addr)
+	}
+	sort.Strings(addrs)
+	for i,addr:= range addrs{
+		addrs[i] = fmt.Sprintf("%s (%s)",addr,e.Results[addr])
+	}
+	return fmt.Sprintf("no bootstrap node connected: %s",strings.Join(addrs,", "))
+}
+
+//bootstrapNetwork dials the BootstrapNodes and the saved peers in the
+//background. With a BootstrapTimeout it waits until a peer connected,
+//which may also be one that dialed us, and returns a BootstrapError when
+//none did in time or every dial gave up before.
+func (s *FileServer) bootstrapNetwork() error{
+	type result struct{
+		addr 	string
+		err 	error
+	}
+	addrs:= append([]string(nil),s.BootstrapNodes...)
+	if s.MaxPeerFailures>=0{
+		for _,addr:= range s.savedPeers(){
+			if !slices.Contains(addrs,addr){
+				addrs = append(addrs,addr)
+			}
+		}
+	}
+	var(
+		results = make(map[string]error)
+		done 		= make(chan result,len(addrs))
+	)
+	for _,addr := range addrs{
+		if len(addr)==0{continue}
+		results[addr] = errStillDialing
+		go func(addr string){
+			done <- result{addr,s.dialWithBackoff(addr)}
+		}(addr)
+	}
+	if s.BootstrapTimeout<=0 || len(results)==0{
+		return nil
+	}
+
+	timeout:= time.After(s.BootstrapTimeout)
+	pending:= len(results)
+	for{
+		select{
+		case <-s.joined:
+			return nil
+		case r:= <-done:
+			results[r.addr] = r.err
+			if r.err==nil{
+				//The handshake is still to come, the peer connects with it.
+				results[r.addr] = errors.New("handshake not completed")
+			}
+			pending--
+			if pending>0 || r.err==nil{
+				continue
+			}
+			//Every dial gave up, there is nothing left to wait for but a
+			//peer dialing us.
+			select{
+			case <-s.joined:
+				return nil
+			default:
+			}
+		case <-timeout:
+		}
+		return &BootstrapError{Results: results}
+	}
+}
+
+//dialWithBackoff dials addr until it succeeds, the server stops or
+//MaxReconnectAttempts dials failed (a negative value retries forever).
+//It returns the error of the last dial, nil once one succeeded.
+func (s *FileServer) dialWithBackoff(addr string) error{
+	logger:= s.Logger.With("peer",addr)
+	for attempt:=0;;attempt++{
+		if s.peersFull(){
+			logger.Infof("skipping dial, at the limit of %d peers",s.MaxPeers)
+			return fmt.Errorf("at the limit of %d peers",s.MaxPeers)
+		}
+		if s.bans.banned(addr){
+			logger.Infof("skipping dial of banned remote")
+			return ErrBanned
+		}
+		logger.Infof("attempting to connect with remote")
+		err:= s.Transport.Dial(addr)
+		if err==nil{
+			return nil
+		}
+		logger.Errorf("dial error: %s",err)
+
+		if s.MaxReconnectAttempts>=0 && attempt+1>=s.MaxReconnectAttempts{
+			logger.Errorf("giving up on remote after %d attempts",attempt+1)
+			s.peerFailed(addr)
+			return fmt.Errorf("gave up after %d attempts: %w",attempt+1,err)
+		}
+		select{
+		case <-time.After(s.reconnectDelay(attempt)):
+		case <-s.quitCh:
+			return err
+		}
+	}
+}
+
+//OnPeerDisconnect removes a dropped peer, a peer we dialed ourselves is
+//dialed again in the background.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer){
+	addr:= p.RemoteAddr().String()
+
+	s.removePeer(p)
+	s.Logger.With("peer",addr).Infof("disconnected from remote")
+
+	s.stopLock.Lock()
+	stopping:= s.stopping
+	s.stopLock.Unlock()
+	if p.Outbound() && !stopping{
+		go s.dialWithBackoff(addr)
+	}
+}
+
+//removePeer takes p off the peer list unless it was already replaced.
+func (s *FileServer) removePeer(p p2p.Peer){
+	addr:= p.RemoteAddr().String()
+	s.peerLock.Lock()
+	removed:= s.peers[addr]==p
+	if removed{
+		delete(s.peers,addr)
+		delete(s.listenAddrs,addr)
+		delete(s.weights,addr)
+		delete(s.compressions,addr)
+		delete(s.peerIDs,addr)
+	}
+	s.Metrics.setPeers(len(s.peers))
+	s.peerLock.Unlock()
+	if removed{
+		s.emit(Event{Type: EventPeerDisconnected,Peer: addr})
+	}
+}
+
+//dropPeer removes a peer whose connection failed and closes it. Its read
+//loop ends with that and OnPeerDisconnect redials it when we dialed it.
+func (s *FileServer) dropPeer(p p2p.Peer,err error){
+	addr:= p.RemoteAddr().String()
+
+	s.removePeer(p)
+	s.Logger.With("peer",addr).Errorf("dropping peer: %s",err)
+	p.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+//refsSuffix marks the sidecar file holding the reference count of a
+//content addressed file. Several names can store the same content, the
+//file is only removed once the last of them deleted it.
+const refsSuffix = ".refs"
+
+//sidecarSuffixes mark the metadata files stored next to a file.
+var sidecarSuffixes = []string{expirySuffix,refsSuffix,keyIDSuffix,pinsSuffix,metaSuffix}
+
+//sidecarPaths returns the paths of the sidecars of the file at p.
+func sidecarPaths(p string) []string{
+	paths:= make([]string,len(sidecarSuffixes))
+	for i,suffix:= range sidecarSuffixes{
+		paths[i] = p+suffix
+	}
+	return paths
+}
+
+//isSidecar tells whether p is one of the metadata files stored next to
+//a file instead of a file itself.
+func isSidecar(p string) bool{
+	for _,suffix:= range sidecarSuffixes{
+		if strings.HasSuffix(p,suffix){
+			return true
+		}
+	}
+	return false
+}
+
+func isContentKey(key string) bool{
+	_,_,ok:= contentHashFunc(key)
+	return ok
+}
+
+func (s *Store) refsPath(id string,key string) string{
+	return s.backendPath(id,key)+refsSuffix
+}
+
+//Refs returns the reference count of the file for key. Files that are
+//not content addressed, or were stored before counting, count once.
+func (s *Store) Refs(id string,key string) (int,error){
+	if !s.Has(id,key){
+		return 0,nil
+	}
+	n,ok,err:= s.readRefs(s.refsPath(id,key))
+	if err!=nil || !ok{
+		return 1,err
+	}
+	return n,nil
+}
+
+func (s *Store) readRefs(p string) (int,bool,error){
+	_,r,err:= s.Backend.Read(p)
+	if errors.Is(err,fs.ErrNotExist){
+		return 0,false,nil
+	}
+	if err!=nil{
+		return 0,false,err
+	}
+	defer r.Close()
+
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return 0,false,err
+	}
+	n,err:= strconv.Atoi(string(b))
+	if err!=nil{
+		return 0,false,err
+	}
+	return n,true,nil
+}
+
+func (s *Store) writeRefs(p string,n int) error{
+	_,err:= s.Backend.Write(p,bytes.NewReader([]byte(strconv.Itoa(n))))
+	return err
+}
+
+//addRef counts another reference to the content addressed file for key,
+//existed tells whether the file was there before it was written again.
+func (s *Store) addRef(id string,key string,existed bool) error{
+	if !isContentKey(key){
+		return nil
+	}
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+
+	n,ok,err:= s.readRefs(s.refsPath(id,key))
+	if err!=nil{
+		return err
+	}
+	if !ok && existed{
+		n = 1
+	}
+	return s.writeRefs(s.refsPath(id,key),n+1)
+}
+
+//release drops a reference to the file for key and returns how many are
+//left. The caller removes the file once none are left, the count is
+//written as 0 first so GC removes it should that fail.
+func (s *Store) release(id string,key string) (int,error){
+	if !isContentKey(key) || !s.Has(id,key){
+		return 0,nil
+	}
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+
+	n,ok,err:= s.readRefs(s.refsPath(id,key))
+	if err!=nil{
+		return 0,err
+	}
+	if !ok{
+		n = 1
+	}
+	n = max(n-1,0)
+	return n,s.writeRefs(s.refsPath(id,key),n)
+}
+
+//GC removes the files nothing references anymore, as well as reference
+//counts that outlived their file, and returns how many files it removed.
+func (s *Store) GC() (int,error){
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return 0,err
+	}
+	removed:= 0
+	for _,p:= range paths{
+		if !strings.HasSuffix(p,refsSuffix){
+			continue
+		}
+		file:= strings.TrimSuffix(p,refsSuffix)
+		if !s.Backend.Has(file){
+			if err:= s.Backend.Delete(p);err!=nil{
+				return removed,err
+			}
+			continue
+		}
+		n,_,err:= s.readRefs(p)
+		if err!=nil{
+			return removed,err
+		}
+		if n>0{
+			continue
+		}
+		for _,del:= range append([]string{file},sidecarPaths(file)...){
+			if err:= s.Backend.Delete(del);err!=nil{
+				return removed,err
+			}
+		}
+		removed++
+	}
+	return removed,nil
+}
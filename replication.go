@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//xorDistance is the XOR of the key hash and the peer address hash, the
+//smaller it is (compared big endian) the closer the peer is to the key.
+func xorDistance(key string,addr string) []byte{
+	k:= md5.Sum([]byte(key))
+	a:= md5.Sum([]byte(addr))
+	d:= make([]byte,len(k))
+	for i:= range k{
+		d[i] = k[i]^a[i]
+	}
+	return d
+}
+
+//closestPeers returns the n peers closest to key by XOR distance, so the
+//same peers are picked as owners every time the key is stored or fetched.
+//The distance is weighted by the StorageWeight of the peers (by remote
+//address, 1 when missing) like rendezvous hashing: a peer of weight 2 is
+//picked for about twice the keys of one of weight 1. With equal weights
+//the order is that of the XOR distance alone.
+func closestPeers(key string,peers []p2p.Peer,n int,weights map[string]int) []p2p.Peer{
+	sorted:= make([]p2p.Peer,len(peers))
+	copy(sorted,peers)
+	var(
+		dists 	= make(map[p2p.Peer][]byte,len(peers))
+		scores 	= make(map[p2p.Peer]float64,len(peers))
+	)
+	for _,p:= range sorted{
+		addr:= p.RemoteAddr().String()
+		d:= xorDistance(key,addr)
+		w,ok:= weights[addr]
+		if !ok || w<=0{
+			w = defaultStorageWeight
+		}
+		//The top 53 bits of the distance as a uniform u in (0,1), the
+		//score falls with it and grows with the weight.
+		u:= (float64(binary.BigEndian.Uint64(d)>>11)+0.5)/(1<<53)
+		dists[p],scores[p] = d,-float64(w)/math.Log1p(-u)
+	}
+	sort.Slice(sorted,func(i,j int) bool{
+		si,sj:= scores[sorted[i]],scores[sorted[j]]
+		if si!=sj{
+			return si>sj
+		}
+		return bytes.Compare(dists[sorted[i]],dists[sorted[j]])<0
+	})
+	if n<len(sorted){
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+//splitPeers separates the selected peers from the rest of peers.
+func splitPeers(peers []p2p.Peer,selected []p2p.Peer) ([]p2p.Peer,[]p2p.Peer){
+	in:= make(map[p2p.Peer]bool,len(selected))
+	for _,p:= range selected{
+		in[p] = true
+	}
+	var rest []p2p.Peer
+	for _,p:= range peers{
+		if !in[p]{
+			rest = append(rest,p)
+		}
+	}
+	return selected,rest
+}
+
+//Replicate heals the file for key: when fewer peers than ReplicationFactor
+//(all the peers PeerSelector picks when it is 0) hold a copy, it is
+//streamed to as many of the closest other peers as are missing. It
+//returns how many new peers confirmed a copy, ErrNotConfirmed when too
+//few did and ErrNotFound when the file isn't stored locally.
+func (s *FileServer) Replicate(key string) (int,error){
+	return s.ReplicateContext(context.Background(),key)
+}
+
+func (s *FileServer) ReplicateContext(ctx context.Context,key string) (int,error){
+	if s.ReadOnly{
+		return 0,fmt.Errorf("[%s] a read only server can't replicate files",s.Transport.Addr())
+	}
+	want:= len(s.selectPeers(key))
+	if s.ReplicationFactor>0{
+		want = min(s.ReplicationFactor,want)
+	}
+	return s.replicateMissing(ctx,key,want)
+}
+
+//replicateMissing streams the file for key to the peers it takes for want
+//of them to hold a copy and returns how many new ones confirmed theirs.
+func (s *FileServer) replicateMissing(ctx context.Context,key string,want int) (int,error){
+	if !s.store.Has(s.ID,key) || s.store.Expired(s.ID,key){
+		return 0,fmt.Errorf("[%s] %w: (%s)",s.Transport.Addr(),ErrNotFound,key)
+	}
+	holders,err:= s.whoHas(ctx,key,s.peerList(),nil)
+	if err!=nil{
+		return 0,err
+	}
+	need:= want-len(holders)
+	if need<=0{
+		return 0,nil
+	}
+	held:= make(map[string]bool,len(holders))
+	for _,addr:= range holders{
+		held[addr] = true
+	}
+	var candidates []p2p.Peer
+	for _,peer:= range s.selectPeers(key){
+		if !held[peer.RemoteAddr().String()]{
+			candidates = append(candidates,peer)
+		}
+	}
+	targets:= closestPeers(key,candidates,need,s.peerWeights())
+
+	if !s.beginTransfer(){
+		return 0,fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+	size,f,err:= s.store.Read(s.ID,key)
+	if err!=nil{
+		return 0,err
+	}
+	if rc,ok:= f.(io.ReadCloser);ok{
+		rc.Close()
+	}
+	expires,_,err:= s.store.Expiry(s.ID,key)
+	if err!=nil{
+		return 0,err
+	}
+	s.Logger.With("key",key).Infof("held by %d of %d peers, replicating to %d more",len(holders),want,len(targets))
+	rep,err:= s.replicateTo(ctx,key,size,expires,nil,targets)
+	var replErr *ReplicationError
+	if err!=nil && !errors.As(err,&replErr){
+		return 0,err
+	}
+	placed:= len(rep.held)
+	if len(rep.streamed)>0{
+		//Like StoreAndConfirm, the peers answer once the file is written.
+		confirmed,err:= s.whoHas(ctx,key,rep.streamed,rep.sum)
+		if err!=nil{
+			return placed,err
+		}
+		placed+=len(confirmed)
+	}
+	if placed<need{
+		return placed,fmt.Errorf("[%s] %w: %s held by %d of %d peers",s.Transport.Addr(),ErrNotConfirmed,key,len(holders)+placed,want)
+	}
+	return placed,nil
+}
+
+//replicateLoop Replicates all our files every ReplicateInterval until the
+//server stops.
+func (s *FileServer) replicateLoop(){
+	ctx,cancel:= context.WithCancel(context.Background())
+	defer cancel()
+	go func(){
+		<-s.quitCh
+		cancel()
+	}()
+	ticker:= time.NewTicker(s.ReplicateInterval)
+	defer ticker.Stop()
+	for{
+		select{
+		case <-ticker.C:
+			placed,err:= s.replicateAll(ctx)
+			if err!=nil{
+				s.Logger.Errorf("replicate error: %s",err)
+			}
+			if placed>0{
+				s.Logger.Infof("replicated %d copies",placed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//replicateAll Replicates each of our files known by its key (see
+//keyIDs) and returns how many copies it placed.
+func (s *FileServer) replicateAll(ctx context.Context) (int,error){
+	keys,err:= s.ownKeys()
+	if err!=nil{
+		return 0,err
+	}
+	var(
+		placed 	int
+		errs 		[]error
+	)
+	for _,key:= range keys{
+		n,err:= s.ReplicateContext(ctx,key)
+		placed+=n
+		if err!=nil{
+			if ctx.Err()!=nil{
+				return placed,ctx.Err()
+			}
+			errs = append(errs,err)
+		}
+	}
+	return placed,errors.Join(errs...)
+}
+
+//ownKeys returns the keys of the files we stored that are still there,
+//sorted.
+func (s *FileServer) ownKeys() ([]string,error){
+	keyIDs,err:= s.store.keyIDs(s.ID)
+	if err!=nil{
+		return nil,err
+	}
+	keys:= make([]string,0,len(keyIDs))
+	for key:= range keyIDs{
+		if s.store.Has(s.ID,key) && !s.store.Expired(s.ID,key){
+			keys = append(keys,key)
+		}
+	}
+	sort.Strings(keys)
+	return keys,nil
+}
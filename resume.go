@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//ResumeToken identifies a Store or Get of a large file that failed
+//partway. Passing it to ResumeStore or ResumeGet continues the transfer
+//from the chunks that made it instead of starting over.
+type ResumeToken string
+
+//TransferError is returned by a Store or Get that failed partway and can
+//be resumed with Token.
+type TransferError struct{
+	Err 	error
+	Token ResumeToken
+}
+
+func (e *TransferError) Error() string{
+	return fmt.Sprintf("%s (resumable)",e.Err)
+}
+
+func (e *TransferError) Unwrap() error{
+	return e.Err
+}
+
+//resumeState is the manifest of a chunked transfer, a ResumeToken is its
+//encoding.
+type resumeState struct{
+	Get 			bool
+	Key 			string
+	//Size is the size of the encrypted copy.
+	Size 			int64
+	ChunkSize int64
+	//Chunks holds the sha256 of every chunk that was transferred by index.
+	Chunks 		map[int64][]byte
+	//Spool is the file a Get collects the chunks in.
+	Spool 		string
+	//KeyID is the key the Store encrypts with, a rotation in between
+	//doesn't change it.
+	KeyID 		string
+	//Nonce keeps the encrypted stream of a Store the same across retries.
+	Nonce 		[]byte
+	//Sum is the sha256 of the stored file a Store encrypts with Nonce.
+	Sum 			[]byte
+}
+
+func (st *resumeState) token() ResumeToken{
+	b,_:= json.Marshal(st)
+	return ResumeToken(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func parseResumeToken(token ResumeToken) (*resumeState,error){
+	b,err:= base64.RawURLEncoding.DecodeString(string(token))
+	if err!=nil{
+		return nil,fmt.Errorf("invalid resume token: %w",err)
+	}
+	st:= &resumeState{}
+	if err:= json.Unmarshal(b,st);err!=nil{
+		return nil,fmt.Errorf("invalid resume token: %w",err)
+	}
+	if st.ChunkSize<=0 || st.Size<0{
+		return nil,fmt.Errorf("invalid resume token")
+	}
+	if st.Chunks==nil{
+		st.Chunks = make(map[int64][]byte)
+	}
+	return st,nil
+}
+
+//openSpool opens the spool file of a Get, creating it on the first try.
+func (st *resumeState) openSpool() (*os.File,error){
+	if len(st.Spool)==0{
+		f,err:= os.CreateTemp("","cas-spool-*")
+		if err!=nil{
+			return nil,err
+		}
+		st.Spool = f.Name()
+		return f,nil
+	}
+	return os.OpenFile(st.Spool,os.O_RDWR|os.O_CREATE,0o600)
+}
+
+//verifySpool forgets the chunks that are no longer intact in the spool.
+func (st *resumeState) verifySpool(){
+	f,err:= os.Open(st.Spool)
+	if err!=nil{
+		st.Chunks = make(map[int64][]byte)
+		return
+	}
+	defer f.Close()
+	for i,sum:= range st.Chunks{
+		c:= chunkOf(i,st.ChunkSize,st.Size)
+		h:= sha256.New()
+		if _,err:= io.Copy(h,io.NewSectionReader(f,c.offset,c.length));err!=nil || !bytes.Equal(h.Sum(nil),sum){
+			delete(st.Chunks,i)
+		}
+	}
+}
+
+//matchingChunks is how many leading chunks of a peer's partial copy
+//match the chunks we sent.
+func (st *resumeState) matchingChunks(have [][]byte) int64{
+	var n int64
+	for n<int64(len(have)) && bytes.Equal(st.Chunks[n],have[n]){
+		n++
+	}
+	return n
+}
+
+//ResumeGet continues a Get that failed with a TransferError.
+func (s *FileServer) ResumeGet(ctx context.Context,token ResumeToken) (io.Reader,error){
+	st,err:= parseResumeToken(token)
+	if err!=nil{
+		return nil,err
+	}
+	if !st.Get{
+		return nil,fmt.Errorf("resume token is not for a Get")
+	}
+	if !s.beginTransfer(){
+		return nil,fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+	start:= time.Now()
+
+	holders,size,err:= s.probeFile(ctx,st.Key,s.selectPeers(st.Key))
+	if err!=nil{
+		return nil,err
+	}
+	if len(holders)==0{
+		return nil,&TransferError{Err: fmt.Errorf("[%s] no peer served file (%s): %w",s.Transport.Addr(),st.Key,ErrNotFound),Token: token}
+	}
+	if size!=st.Size{
+		//The peers hold a different copy now, start over.
+		st.Size = size
+		st.Chunks = make(map[int64][]byte)
+	}
+	st.verifySpool()
+	return s.fetchChunks(ctx,st,holders,start)
+}
+
+//ResumeStore continues replicating a file whose Store failed with a
+//TransferError. Peers keep the chunks they received and only get the
+//rest.
+func (s *FileServer) ResumeStore(ctx context.Context,token ResumeToken) error{
+	st,err:= parseResumeToken(token)
+	if err!=nil{
+		return err
+	}
+	if st.Get{
+		return fmt.Errorf("resume token is not for a Store")
+	}
+	if !s.beginTransfer(){
+		return fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+
+	if !s.store.Has(s.ID,st.Key){
+		return fmt.Errorf("[%s] file (%s) is not stored locally",s.Transport.Addr(),st.Key)
+	}
+	expires,_,err:= s.store.Expiry(s.ID,st.Key)
+	if err!=nil{
+		return err
+	}
+	size,f,err:= s.store.Read(s.ID,st.Key)
+	if err!=nil{
+		return err
+	}
+	h:= sha256.New()
+	_,err = io.Copy(h,f)
+	if rc,ok:= f.(io.ReadCloser);ok{
+		rc.Close()
+	}
+	if err!=nil{
+		return err
+	}
+	if encryptedSize(size)!=st.Size || !bytes.Equal(h.Sum(nil),st.Sum){
+		return fmt.Errorf("[%s] file (%s) changed since the Store failed",s.Transport.Addr(),st.Key)
+	}
+	_,err = s.replicate(ctx,st.Key,size,expires,st)
+	return err
+}
+
+//newStoreResume starts the manifest of a chunked Store.
+func newStoreResume(key string,keyID string,size int64,chunkSize int64) (*resumeState,error){
+	nonce:= make([]byte,NonceSize)
+	if _,err:= io.ReadFull(rand.Reader,nonce);err!=nil{
+		return nil,err
+	}
+	return &resumeState{
+		Key: 				key,
+		KeyID: 			keyID,
+		Size: 			size,
+		ChunkSize: 	chunkSize,
+		Chunks: 		make(map[int64][]byte),
+		Nonce: 			nonce,
+	},nil
+}
+
+//chunkWriter hashes the encrypted stream of a Store chunk by chunk into
+//its manifest. The first skip bytes are already with the peers and are
+//only hashed.
+type chunkWriter struct{
+	st 		*resumeState
+	w 		io.Writer
+	skip 	int64
+	pos 	int64
+	h 		hash.Hash
+}
+
+func newChunkWriter(st *resumeState,w io.Writer,skip int64) *chunkWriter{
+	return &chunkWriter{st: st,w: w,skip: skip,h: sha256.New()}
+}
+
+func (cw *chunkWriter) Write(b []byte) (int,error){
+	written:= 0
+	for len(b)>0{
+		index:= cw.pos/cw.st.ChunkSize
+		c:= chunkOf(index,cw.st.ChunkSize,cw.st.Size)
+		n:= min(int64(len(b)),c.offset+c.length-cw.pos)
+		part:= b[:n]
+		if cw.pos+n>cw.skip{
+			from:= max(cw.skip-cw.pos,0)
+			if _,err:= (fullWriter{cw.w}).Write(part[from:]);err!=nil{
+				return written,err
+			}
+		}
+		cw.h.Write(part)
+		cw.pos+=n
+		written+=int(n)
+		b = b[n:]
+		if cw.pos==c.offset+c.length{
+			cw.st.Chunks[index] = cw.h.Sum(nil)
+			cw.h.Reset()
+		}
+	}
+	return written,nil
+}
+
+//spoolPath is where we collect a resumable file a peer is storing on us.
+func (s *FileServer) spoolPath(id string,key string) string{
+	return filepath.Join(os.TempDir(),"cas-spool-"+hashKey(s.ID+"/"+id+"/"+key))
+}
+
+//spooledChunks hashes the complete chunks of the partial copy we hold of
+//a resumable file, so the peer can skip them.
+func (s *FileServer) spooledChunks(msg MessageStoreFile) ([][]byte,error){
+	f,err:= os.Open(s.spoolPath(msg.ID,msg.Key))
+	if errors.Is(err,fs.ErrNotExist){
+		return nil,nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	defer f.Close()
+
+	chunks:= [][]byte{}
+	for{
+		h:= sha256.New()
+		if n,_:= io.CopyN(h,f,msg.ChunkSize);n<msg.ChunkSize{
+			//The last chunk of the file isn't chunk size, but when we have
+			//it the stream completed and the spool is gone.
+			return chunks,nil
+		}
+		chunks = append(chunks,h.Sum(nil))
+	}
+}
+
+//receiveSpooled writes a resumable stream into the spool, starting at the
+//offset the peer resumes from, and stores the file once it is complete.
+func (s *FileServer) receiveSpooled(peer p2p.Peer,msg MessageStoreFile) (int64,error){
+	var offset int64
+	if err:= binary.Read(peer,binary.LittleEndian,&offset);err!=nil{
+		return 0,err
+	}
+	if offset<0 || offset>msg.Size{
+		return 0,fmt.Errorf("invalid resume offset %d",offset)
+	}
+
+	path:= s.spoolPath(msg.ID,msg.Key)
+	f,err:= openSpoolAt(path,offset)
+	if err!=nil{
+		//Keep the connection in sync with the peer.
+		io.CopyN(io.Discard,peer,msg.Size-offset)
+		return 0,err
+	}
+	defer f.Close()
+	//What made it into the spool is served to Gets while the Store is
+	//failing, see fetchFragments.
+	partial:= func(n int64) partialCopy{
+		if n==0{
+			return partialCopy{}
+		}
+		return partialCopy{Size: msg.Size,Ranges: []ByteRange{{Offset: 0,Length: n}}}
+	}
+	s.setPartial(msg.ID,msg.Key,partial(offset))
+	n,err:= s.copyBuffer(f,io.LimitReader(peer,msg.Size-offset))
+	if err==nil && n!=msg.Size-offset{
+		err = io.ErrUnexpectedEOF
+	}
+	if err!=nil{
+		s.setPartial(msg.ID,msg.Key,partial(offset+n))
+		return 0,err
+	}
+
+	if _,err:= f.Seek(0,io.SeekStart);err!=nil{
+		return 0,err
+	}
+	written,err:= s.store.writeStream(msg.ID,msg.Key,f)
+	if err!=nil{
+		return 0,err
+	}
+	f.Close()
+	os.Remove(path)
+	s.setPartial(msg.ID,msg.Key,partialCopy{})
+	return written,nil
+}
+
+//openSpoolAt opens the spool at path positioned at offset, dropping
+//whatever it held after that.
+func openSpoolAt(path string,offset int64) (*os.File,error){
+	f,err:= os.OpenFile(path,os.O_RDWR|os.O_CREATE,0o600)
+	if err!=nil{
+		return nil,err
+	}
+	if err:= f.Truncate(offset);err!=nil{
+		f.Close()
+		return nil,err
+	}
+	if _,err:= f.Seek(offset,io.SeekStart);err!=nil{
+		f.Close()
+		return nil,err
+	}
+	return f,nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestResumeToken(t *testing.T){
+	st,err:= newStoreResume("big","",10<<10,1<<10)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	st.Chunks[3] = []byte("sum")
+
+	have,err:= parseResumeToken(st.token())
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if have.Key!=st.Key || have.Size!=st.Size || have.ChunkSize!=st.ChunkSize || !bytes.Equal(have.Nonce,st.Nonce) || !bytes.Equal(have.Chunks[3],st.Chunks[3]){
+		t.Errorf("token round trip changed the manifest: %+v",have)
+	}
+	if _,err:= parseResumeToken("not a token");err==nil{
+		t.Errorf("expected an error for an invalid token")
+	}
+}
+
+func TestChunkWriter(t *testing.T){
+	data:= make([]byte,10<<10+7)
+	if _,err:= rand.Read(data);err!=nil{
+		t.Fatal(err)
+	}
+	stream:= func(st *resumeState,skip int64) []byte{
+		buf:= new(bytes.Buffer)
+		cw:= newChunkWriter(st,buf,skip)
+		//Odd sized writes cross the chunk boundaries.
+		for b:= data;len(b)>0;{
+			n:= min(len(b),777)
+			if _,err:= cw.Write(b[:n]);err!=nil{
+				t.Fatal(err)
+			}
+			b = b[n:]
+		}
+		return buf.Bytes()
+	}
+
+	st:= &resumeState{Size: int64(len(data)),ChunkSize: 1<<10,Chunks: make(map[int64][]byte)}
+	if b:= stream(st,0);!bytes.Equal(b,data){
+		t.Fatalf("want the whole stream, have %d bytes",len(b))
+	}
+	if n:= int64(len(st.Chunks));n!=chunkCount(st.Size,st.ChunkSize){
+		t.Fatalf("want %d chunk sums, have %d",chunkCount(st.Size,st.ChunkSize),n)
+	}
+
+	resumed:= &resumeState{Size: st.Size,ChunkSize: st.ChunkSize,Chunks: make(map[int64][]byte)}
+	skip:= 4*st.ChunkSize
+	if b:= stream(resumed,skip);!bytes.Equal(b,data[skip:]){
+		t.Errorf("want the stream from %d, have %d bytes",skip,len(b))
+	}
+	have:= [][]byte{st.Chunks[0],st.Chunks[1],[]byte("other")}
+	if n:= resumed.matchingChunks(have);n!=2{
+		t.Errorf("want 2 matching chunks, have %d",n)
+	}
+}
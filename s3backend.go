@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+//S3API is the part of *s3.Client an S3Backend uses.
+type S3API interface{
+	PutObject(context.Context,*s3.PutObjectInput,...func(*s3.Options)) (*s3.PutObjectOutput,error)
+	GetObject(context.Context,*s3.GetObjectInput,...func(*s3.Options)) (*s3.GetObjectOutput,error)
+	HeadObject(context.Context,*s3.HeadObjectInput,...func(*s3.Options)) (*s3.HeadObjectOutput,error)
+	DeleteObject(context.Context,*s3.DeleteObjectInput,...func(*s3.Options)) (*s3.DeleteObjectOutput,error)
+	ListObjectsV2(context.Context,*s3.ListObjectsV2Input,...func(*s3.Options)) (*s3.ListObjectsV2Output,error)
+}
+
+//S3Backend stores files as the objects of Bucket in an S3 compatible
+//object store, a file at path is the object Prefix+path.
+type S3Backend struct{
+	Client S3API
+	Bucket string
+	Prefix string
+}
+
+func NewS3Backend(client S3API,bucket string,prefix string) *S3Backend{
+	return &S3Backend{Client: client,Bucket: bucket,Prefix: prefix}
+}
+
+func (b *S3Backend) objectKey(p string) *string{
+	return aws.String(b.Prefix+p)
+}
+
+//Write spools r to a temporary file first: an object is uploaded whole
+//with its length, and only once all of r could be read.
+func (b *S3Backend) Write(p string,r io.Reader) (int64,error){
+	tmp,err:= os.CreateTemp("","cas-s3-*")
+	if err!=nil{
+		return 0,err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n,err:= io.Copy(tmp,r)
+	if err!=nil{
+		return n,err
+	}
+	if _,err:= tmp.Seek(0,io.SeekStart);err!=nil{
+		return n,err
+	}
+	_,err = b.Client.PutObject(context.Background(),&s3.PutObjectInput{
+		Bucket: 				aws.String(b.Bucket),
+		Key: 						b.objectKey(p),
+		Body: 					tmp,
+		ContentLength: 	aws.Int64(n),
+	})
+	if err!=nil{
+		return n,err
+	}
+	return n,nil
+}
+
+//Read streams the body of the object.
+func (b *S3Backend) Read(p string) (int64,io.ReadCloser,error){
+	out,err:= b.Client.GetObject(context.Background(),&s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key: 		b.objectKey(p),
+	})
+	if err!=nil{
+		return 0,nil,s3PathError("open",p,err)
+	}
+	return aws.ToInt64(out.ContentLength),out.Body,nil
+}
+
+//Has tells whether the object exists or, like a directory on disk, p
+//holds other objects.
+func (b *S3Backend) Has(p string) bool{
+	_,err:= b.Client.HeadObject(context.Background(),&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key: 		b.objectKey(p),
+	})
+	if err==nil{
+		return true
+	}
+	out,err:= b.Client.ListObjectsV2(context.Background(),&s3.ListObjectsV2Input{
+		Bucket: 	aws.String(b.Bucket),
+		Prefix: 	b.objectKey(p+"/"),
+		MaxKeys: 	aws.Int32(1),
+	})
+	return err==nil && len(out.Contents)>0
+}
+
+//Delete removes the object at p and the ones below it.
+func (b *S3Backend) Delete(p string) error{
+	keys,err:= b.list(p+"/")
+	if err!=nil{
+		return err
+	}
+	for _,key:= range append(keys,b.Prefix+p){
+		_,err:= b.Client.DeleteObject(context.Background(),&s3.DeleteObjectInput{
+			Bucket: aws.String(b.Bucket),
+			Key: 		aws.String(key),
+		})
+		if err!=nil && !isS3NotFound(err){
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) List() ([]string,error){
+	keys,err:= b.list("")
+	if err!=nil{
+		return nil,err
+	}
+	paths:= make([]string,len(keys))
+	for i,key:= range keys{
+		paths[i] = strings.TrimPrefix(key,b.Prefix)
+	}
+	return paths,nil
+}
+
+//Clear removes every object below Prefix.
+func (b *S3Backend) Clear() error{
+	keys,err:= b.list("")
+	if err!=nil{
+		return err
+	}
+	for _,key:= range keys{
+		_,err:= b.Client.DeleteObject(context.Background(),&s3.DeleteObjectInput{
+			Bucket: aws.String(b.Bucket),
+			Key: 		aws.String(key),
+		})
+		if err!=nil && !isS3NotFound(err){
+			return err
+		}
+	}
+	return nil
+}
+
+//list returns the keys of the objects below Prefix+prefix.
+func (b *S3Backend) list(prefix string) ([]string,error){
+	keys:= []string{}
+	pages:= s3.NewListObjectsV2Paginator(b.Client,&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.Bucket),
+		Prefix: aws.String(b.Prefix+prefix),
+	})
+	for pages.HasMorePages(){
+		page,err:= pages.NextPage(context.Background())
+		if err!=nil{
+			return nil,err
+		}
+		for _,obj:= range page.Contents{
+			keys = append(keys,aws.ToString(obj.Key))
+		}
+	}
+	return keys,nil
+}
+
+//s3PathError makes a missing object an fs.ErrNotExist, like a missing file.
+func s3PathError(op string,p string,err error) error{
+	if isS3NotFound(err){
+		return &fs.PathError{Op: op,Path: p,Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func isS3NotFound(err error) bool{
+	var(
+		noSuchKey 	*types.NoSuchKey
+		notFound 		*types.NotFound
+		respErr 		*awshttp.ResponseError
+	)
+	if errors.As(err,&noSuchKey) || errors.As(err,&notFound){
+		return true
+	}
+	return errors.As(err,&respErr) && respErr.HTTPStatusCode()==404
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+//fakeS3 serves the objects of one bucket over the path style S3 API, as
+//much of it as S3Backend uses.
+type fakeS3 struct{
+	mu 			sync.Mutex
+	bucket 	string
+	objects map[string][]byte
+}
+
+type listBucketResult struct{
+	XMLName 	xml.Name `xml:"ListBucketResult"`
+	KeyCount 	int
+	Contents 	[]struct{
+		Key 	string
+		Size 	int
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter,r *http.Request){
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key,ok:= strings.CutPrefix(r.URL.Path,"/"+f.bucket)
+	if !ok{
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key = strings.TrimPrefix(key,"/")
+	if key=="" && r.Method==http.MethodGet{
+		var res listBucketResult
+		keys:= make([]string,0,len(f.objects))
+		for k:= range f.objects{
+			if strings.HasPrefix(k,r.URL.Query().Get("prefix")){
+				keys = append(keys,k)
+			}
+		}
+		sort.Strings(keys)
+		for _,k:= range keys{
+			res.Contents = append(res.Contents,struct{Key string;Size int}{k,len(f.objects[k])})
+		}
+		res.KeyCount = len(keys)
+		xml.NewEncoder(w).Encode(res)
+		return
+	}
+
+	switch r.Method{
+	case http.MethodPut:
+		b,_:= io.ReadAll(r.Body)
+		f.objects[key] = b
+	case http.MethodGet,http.MethodHead:
+		b,ok:= f.objects[key]
+		if !ok{
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method==http.MethodGet{
+				io.WriteString(w,"<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+		w.Header().Set("Content-Length",strconv.Itoa(len(b)))
+		if r.Method==http.MethodGet{
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(f.objects,key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Backend(t *testing.T){
+	fake:= &fakeS3{bucket: "cas",objects: make(map[string][]byte)}
+	srv:= httptest.NewServer(fake)
+	defer srv.Close()
+	client:= s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Region: 			"us-east-1",
+		Credentials: 	aws.AnonymousCredentials{},
+	})
+	b:= NewS3Backend(client,"cas","node1/")
+
+	if _,err:= b.Write("dir/file",strings.NewReader("some content"));err!=nil{
+		t.Fatal(err)
+	}
+	if _,ok:= fake.objects["node1/dir/file"];!ok{
+		t.Fatalf("want the object at node1/dir/file, have %v",fake.objects)
+	}
+	size,r,err:= b.Read("dir/file")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	content,_:= io.ReadAll(r)
+	r.Close()
+	if size!=12 || string(content)!="some content"{
+		t.Errorf("want 12 bytes of some content, have %d bytes of %q",size,content)
+	}
+	if _,_,err:= b.Read("missing");!errors.Is(err,fs.ErrNotExist){
+		t.Errorf("want fs.ErrNotExist, have %v",err)
+	}
+
+	//A failed write uploads nothing.
+	if _,err:= b.Write("dir/other",io.MultiReader(strings.NewReader("part"),iotest.ErrReader(io.ErrUnexpectedEOF)));err==nil{
+		t.Fatal("want the read error")
+	}
+	for p,want:= range map[string]bool{"dir/file": true,"dir": true,"dir/other": false,"di": false}{
+		if b.Has(p)!=want{
+			t.Errorf("%s: want has %t",p,want)
+		}
+	}
+
+	if _,err:= b.Write("top",bytes.NewReader(nil));err!=nil{
+		t.Fatal(err)
+	}
+	paths,err:= b.List()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if strings.Join(paths,",")!="dir/file,top"{
+		t.Errorf("want dir/file,top, have %v",paths)
+	}
+	if err:= b.Delete("dir");err!=nil{
+		t.Fatal(err)
+	}
+	if b.Has("dir/file"){
+		t.Error("want dir/file deleted with dir")
+	}
+	if err:= b.Clear();err!=nil{
+		t.Fatal(err)
+	}
+	if len(fake.objects)!=0{
+		t.Errorf("want every object cleared, have %v",fake.objects)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//PeerSelector picks the peers to use for a key out of the connected ones,
+//in order of preference: a Store streams the file to them and a Get asks
+//them for it. With a ReplicationFactor the closest to the key of the
+//peers it returns are used, see FileServerOpts.PeerSelector.
+type PeerSelector interface{
+	SelectPeers(key string,peers []p2p.Peer) []p2p.Peer
+}
+
+//BroadcastSelector uses every peer, like a FileServer without a
+//PeerSelector.
+type BroadcastSelector struct{}
+
+func (BroadcastSelector) SelectPeers(key string,peers []p2p.Peer) []p2p.Peer{
+	return peers
+}
+
+//RandomSelector uses N peers picked at random, all of them in random
+//order for an N of 0. A Get only finds the files the picked peers hold,
+//it suits clusters where most peers hold most files.
+type RandomSelector struct{
+	N int
+}
+
+func (r RandomSelector) SelectPeers(key string,peers []p2p.Peer) []p2p.Peer{
+	shuffled:= make([]p2p.Peer,len(peers))
+	copy(shuffled,peers)
+	rand.Shuffle(len(shuffled),func(i,j int){
+		shuffled[i],shuffled[j] = shuffled[j],shuffled[i]
+	})
+	if r.N>0 && r.N<len(shuffled){
+		shuffled = shuffled[:r.N]
+	}
+	return shuffled
+}
+
+//LatencySelector uses the N peers with the shortest round trip, all of
+//them fastest first for an N of 0. The round trips are measured by the
+//heartbeat of the transport (see p2p.TCPpeer.RTT), peers not measured yet
+//come last.
+type LatencySelector struct{
+	N int
+}
+
+//rttPeer is a peer that knows its round trip, like a p2p.TCPpeer.
+type rttPeer interface{
+	RTT() time.Duration
+}
+
+func (l LatencySelector) SelectPeers(key string,peers []p2p.Peer) []p2p.Peer{
+	rtts:= make(map[p2p.Peer]time.Duration,len(peers))
+	for _,peer:= range peers{
+		if rp,ok:= peer.(rttPeer);ok{
+			rtts[peer] = rp.RTT()
+		}
+	}
+	sorted:= make([]p2p.Peer,len(peers))
+	copy(sorted,peers)
+	sort.SliceStable(sorted,func(i,j int) bool{
+		ri,rj:= rtts[sorted[i]],rtts[sorted[j]]
+		if ri==0 || rj==0{
+			return rj==0 && ri!=0
+		}
+		return ri<rj
+	})
+	if l.N>0 && l.N<len(sorted){
+		sorted = sorted[:l.N]
+	}
+	return sorted
+}
+
+//selectPeers returns the connected peers the PeerSelector picks for key.
+func (s *FileServer) selectPeers(key string) []p2p.Peer{
+	peers:= s.peerList()
+	if s.PeerSelector==nil{
+		return peers
+	}
+	return s.PeerSelector.SelectPeers(key,peers)
+}
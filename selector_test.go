@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+type rttTestPeer struct{
+	p2p.Peer
+	rtt time.Duration
+}
+
+func (p *rttTestPeer) RTT() time.Duration{
+	return p.rtt
+}
+
+func TestLatencySelector(t *testing.T){
+	slow:= &rttTestPeer{rtt: 30*time.Millisecond}
+	fast:= &rttTestPeer{rtt: time.Millisecond}
+	unmeasured:= &rttTestPeer{}
+	peers:= []p2p.Peer{unmeasured,slow,fast}
+
+	want:= []p2p.Peer{fast,slow,unmeasured}
+	got:= LatencySelector{}.SelectPeers("key",peers)
+	for i:= range want{
+		if got[i]!=want[i]{
+			t.Fatalf("want the peers fastest first and unmeasured last, have %v",got)
+		}
+	}
+	if got:= (LatencySelector{N: 1}).SelectPeers("key",peers);len(got)!=1 || got[0]!=fast{
+		t.Errorf("want only the fastest peer, have %v",got)
+	}
+	if peers[0]!=unmeasured{
+		t.Error("want the peers passed in left alone")
+	}
+}
+
+func TestRandomSelector(t *testing.T){
+	peers:= []p2p.Peer{&rttTestPeer{},&rttTestPeer{},&rttTestPeer{}}
+	if got:= (RandomSelector{N: 2}).SelectPeers("key",peers);len(got)!=2 || got[0]==got[1]{
+		t.Errorf("want 2 distinct peers, have %v",got)
+	}
+	if got:= (RandomSelector{}).SelectPeers("key",peers);len(got)!=len(peers){
+		t.Errorf("want all %d peers, have %d",len(peers),len(got))
+	}
+}
+
+type addrTestPeer struct{
+	p2p.Peer
+	addr net.Addr
+}
+
+func (p *addrTestPeer) RemoteAddr() net.Addr{
+	return p.addr
+}
+
+func TestClosestPeersStorageWeight(t *testing.T){
+	var peers []p2p.Peer
+	for _,port:= range []int{3000,4000,5000}{
+		peers = append(peers,&addrTestPeer{addr: &net.TCPAddr{IP: net.IPv4(127,0,0,1),Port: port}})
+	}
+	big:= peers[2].RemoteAddr().String()
+
+	//Equal weights keep the order of the XOR distance.
+	for i:=0;i<100;i++{
+		key:= fmt.Sprintf("key-%d",i)
+		got:= closestPeers(key,peers,len(peers),map[string]int{big: 1})
+		for j:=1;j<len(got);j++{
+			if bytes.Compare(xorDistance(key,got[j-1].RemoteAddr().String()),xorDistance(key,got[j].RemoteAddr().String()))>0{
+				t.Fatalf("%s: want the peers by XOR distance, have %v",key,got)
+			}
+		}
+	}
+
+	//A peer of weight 8 next to two of weight 1 owns about 8/10 of the keys.
+	const keys = 2000
+	owned:= 0
+	for i:=0;i<keys;i++{
+		if closestPeers(fmt.Sprintf("key-%d",i),peers,1,map[string]int{big: 8})[0]==peers[2]{
+			owned++
+		}
+	}
+	if share:= float64(owned)/keys;share<0.7 || share>0.9{
+		t.Errorf("want the heavy peer to own about 0.8 of the keys, have %.2f",share)
+	}
+}
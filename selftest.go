@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//selfTestSize is the size of the random file SelfTest stores.
+const selfTestSize = 4<<10
+
+//errSkipped marks the stages of a SelfTest that couldn't run.
+var errSkipped = errors.New("skipped")
+
+//SelfTestStage is the outcome of one stage of a SelfTest, Err is nil when
+//it passed. A stage that couldn't run is Skipped, Err says why.
+type SelfTestStage struct{
+	Name 		string
+	Skipped bool
+	Err 		error
+}
+
+//SelfTestReport lists the stages of a SelfTest in the order they ran.
+type SelfTestReport struct{
+	Key 		string
+	Stages 	[]SelfTestStage
+}
+
+//Err returns the failures of the stages together, nil if all passed.
+//Skipped stages are not failures.
+func (r SelfTestReport) Err() error{
+	var errs []error
+	for _,stage:= range r.Stages{
+		if stage.Err!=nil && !stage.Skipped{
+			errs = append(errs,fmt.Errorf("%s: %w",stage.Name,stage.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//String returns one line per stage, "ok", "skipped" or "FAIL" with why.
+func (r SelfTestReport) String() string{
+	var b strings.Builder
+	for _,stage:= range r.Stages{
+		switch{
+		case stage.Skipped:
+			fmt.Fprintf(&b,"%-20s skipped: %s\n",stage.Name,stage.Err)
+		case stage.Err!=nil:
+			fmt.Fprintf(&b,"%-20s FAIL: %s\n",stage.Name,stage.Err)
+		default:
+			fmt.Fprintf(&b,"%-20s ok\n",stage.Name)
+		}
+	}
+	if r.Err()==nil{
+		b.WriteString("PASS\n")
+	}else{
+		b.WriteString("FAIL\n")
+	}
+	return b.String()
+}
+
+//SelfTest checks this node works, see RunSelfTest. It returns the stages
+//that failed.
+func (s *FileServer) SelfTest() error{
+	return s.RunSelfTest(context.Background()).Err()
+}
+
+//RunSelfTest stores a small random file under its content hash and reads
+//it back, encrypts and decrypts it like the copies of the peers, then
+//sends it to the peers, deletes our copy and fetches it back from them.
+//The file is deleted everywhere at the end. Without peers the peer
+//round-trip is skipped.
+func (s *FileServer) RunSelfTest(ctx context.Context) SelfTestReport{
+	var report SelfTestReport
+	run:= func(name string,stage func() error){
+		err:= stage()
+		report.Stages = append(report.Stages,SelfTestStage{Name: name,Skipped: errors.Is(err,errSkipped),Err: err})
+	}
+	if !s.beginTransfer(){
+		run("local write",func() error{
+			return fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+		})
+		return report
+	}
+	defer s.endTransfer()
+
+	data:= make([]byte,selfTestSize)
+	if _,err:= rand.Read(data);err!=nil{
+		run("local write",func() error{ return err })
+		return report
+	}
+	sum:= sha256.Sum256(data)
+	key:= hex.EncodeToString(sum[:])
+	report.Key = key
+
+	var size int64
+	run("local write",func() error{
+		cr:= compressReader(s.Compression,s.CompressionLevel,bytes.NewReader(data))
+		n,err:= s.store.Write(s.ID,key,cr)
+		cr.Close()
+		if err!=nil{
+			return err
+		}
+		size = n
+		r,err:= s.readLocal(key)
+		if err!=nil{
+			return err
+		}
+		if rc,ok:= r.(io.ReadCloser);ok{
+			defer rc.Close()
+		}
+		return checkSelfTest(r,data)
+	})
+	stored:= size>0
+
+	run("encrypt round-trip",func() error{
+		keyID,encKey,err:= s.keys.activeKey()
+		if err!=nil{
+			return err
+		}
+		var sealed,opened bytes.Buffer
+		if _,err:= copyEncrypt(keyID,encKey,bytes.NewReader(data),&sealed);err!=nil{
+			return err
+		}
+		if int64(sealed.Len())!=encryptedSize(int64(len(data))){
+			return fmt.Errorf("encrypted %d bytes into %d, want %d",len(data),sealed.Len(),encryptedSize(int64(len(data))))
+		}
+		if _,err:= copyDecrypt(s.keys,&sealed,&opened);err!=nil{
+			return err
+		}
+		return checkSelfTest(&opened,data)
+	})
+
+	run("peer round-trip",func() error{
+		switch{
+		case !stored:
+			return fmt.Errorf("%w: the local write failed",errSkipped)
+		case s.ReadOnly:
+			return fmt.Errorf("%w: the server is read only",errSkipped)
+		case len(s.peerList())==0:
+			return fmt.Errorf("%w: no peers connected",errSkipped)
+		}
+		rep,err:= s.replicate(ctx,key,size,time.Time{},nil)
+		var replErr *ReplicationError
+		if err!=nil && !errors.As(err,&replErr){
+			return err
+		}
+		holders,err:= s.whoHas(ctx,key,rep.streamed,rep.sum)
+		if err!=nil{
+			return err
+		}
+		if len(holders)==0{
+			return fmt.Errorf("no peer confirmed the copy")
+		}
+		//Without our copy the file can only come from the peers.
+		if err:= s.store.Delete(s.ID,key);err!=nil{
+			return err
+		}
+		r,err:= s.GetContext(ctx,key)
+		if err!=nil{
+			return err
+		}
+		if rc,ok:= r.(io.ReadCloser);ok{
+			defer rc.Close()
+		}
+		return checkSelfTest(r,data)
+	})
+
+	run("clean up",func() error{
+		return s.Delete(key)
+	})
+	return report
+}
+
+//checkSelfTest reads r and fails unless it is want.
+func checkSelfTest(r io.Reader,want []byte) error{
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return err
+	}
+	if !bytes.Equal(b,want){
+		return fmt.Errorf("read back %d bytes that differ from the %d written",len(b),len(want))
+	}
+	return nil
+}
@@ -2,47 +2,437 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
 )
 
 type FileServerOpts struct {
 	ID								string
+	//EncKey encrypts the copies of our files the peers hold. It is the key
+	//with the empty ID in the keyring, and the active key if Keys is empty.
 	EncKey						[]byte
+	//InTransitKey is EncKey by the name that tells it apart from
+	//AtRestKey, it is used when EncKey is nil. A node without any of
+	//them (or a Passphrase) keeps its files locally only, the copies are
+	//never sent in the clear.
+	InTransitKey 			[]byte
+	//AtRestKey encrypts the files in the StorageRoot, see StoreOpts. It
+	//is independent of EncKey, nil stores them as they are.
+	AtRestKey 				[]byte
+	//Keys is the keyring by key ID, new files are encrypted with the key
+	//ActiveKeyID names. See RotateKey.
+	Keys 							map[string][]byte
+	ActiveKeyID 			string
+	//Passphrase is used instead of EncKey when that is nil, the key is
+	//derived from it with KDF (DefaultKDFParams if zero) and a salt kept
+	//in the StorageRoot. Start fails if the salt can't be read.
+	Passphrase 				string
+	KDF 							KDFParams
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
+	//Backend is optional, it defaults to storing files on disk in StorageRoot.
+	Backend						StorageBackend
+	//MaxBytes, Eviction, ShardDepth, ShardWidth and SyncWrites are passed
+	//on to the Store, see StoreOpts.
+	MaxBytes 					int64
+	Eviction 					EvictionPolicy
+	ShardDepth 				int
+	ShardWidth 				int
+	SyncWrites 				bool
+	//TargetBytes has the sweeper evict the least recently used files (see
+	//Store.EvictLRU) once the store holds more, so writes rarely have to
+	//wait for evictions. 0 disables it.
+	TargetBytes 			int64
 	Transport         p2p.Transport
 	BootstrapNodes		[]string
+	//AckTimeout is how long Store and Get wait for peers to acknowledge
+	//a MessageStoreFile or MessageGetFile.
+	AckTimeout				time.Duration
+	//SendTimeout is how long a peer may take to accept a message or keep
+	//up with a stream before it is dropped, so a slow peer never holds up
+	//the others.
+	SendTimeout 			time.Duration
+	//A message sent to several peers (like a broadcast) that failed
+	//transiently is sent again up to SendRetries (default 3) times, apart
+	//by a backoff doubling from SendRetryDelay (default 50ms), before the
+	//peer is dropped. A negative value doesn't retry.
+	SendRetries 			int
+	SendRetryDelay 		time.Duration
+	//ReplicationFactor is the number of peers a stored file is streamed
+	//to. 0 streams it to every connected peer.
+	ReplicationFactor	int
+	//StorageWeight is the share of the files this node takes on relative
+	//to its peers (default 1), like its disk size in TB. It is announced
+	//to the peers on connect, with a ReplicationFactor those of a higher
+	//weight are picked as owners for proportionally more keys.
+	StorageWeight 		int
+	//MaxPeers caps the connected peers, 0 is unlimited. At the cap inbound
+	//connections are closed after their handshake and dials are skipped.
+	MaxPeers 					int
+	//Metrics is optional, when set the server records its transfers there.
+	Metrics						*Metrics
+	//Logger defaults to slog.Default() with the transport address attached.
+	Logger						Logger
+	//Failed bootstrap dials and dropped outbound peers are dialed again with
+	//an exponential backoff from ReconnectBaseDelay up to ReconnectMaxDelay,
+	//at most MaxReconnectAttempts times (negative retries forever).
+	ReconnectBaseDelay		time.Duration
+	ReconnectMaxDelay			time.Duration
+	MaxReconnectAttempts	int
+	//BootstrapTimeout makes Start wait up to that long for a peer to
+	//connect and fail with a BootstrapError when none did. At 0 Start
+	//doesn't wait for the BootstrapNodes.
+	BootstrapTimeout			time.Duration
+	//The peers we dialed are saved in the Store and dialed again by Start
+	//along with the BootstrapNodes. A saved peer is forgotten once the
+	//dials to it gave up MaxPeerFailures (default 3) times in a row, a
+	//negative value saves no peers.
+	MaxPeerFailures 			int
+	//SweepInterval is how often expired files (see StoreWithTTL) are
+	//deleted.
+	SweepInterval					time.Duration
+	//Files larger than ChunkSize are transferred in chunks of that size.
+	//A Get fetches them from all peers holding the file in parallel, each
+	//chunk checked against the sha256 its peer sends ahead of it so only
+	//a corrupt chunk is fetched again, and an interrupted Store or Get can
+	//be resumed with the ResumeToken of its TransferError. A negative
+	//value disables chunking.
+	ChunkSize	int64
+	//Compression is applied to new files before they are stored and
+	//encrypted, files keep the compression they were stored with. A file
+	//replicated to a peer that doesn't read it is stored with one they
+	//all read, see negotiateCompression.
+	Compression						Compression
+	//CompressionLevel is the level Compression writes at, 0 for its
+	//default: 1 (fastest) to 9 for gzip, -2 for Huffman only, 1 to 22 for
+	//zstd which maps them to its four speeds. Start fails on any other.
+	CompressionLevel 			int
+	//Compressions are the Compressions the node accepts copies in and
+	//tells its peers in the Handshake, default all of them.
+	//CompressionNone is always accepted.
+	Compressions 					[]Compression
+	//MaxUploadBytesPerSec and MaxDownloadBytesPerSec cap the rate files
+	//are streamed to and fetched from the peers, shared by all transfers
+	//so control messages still get through. The transfers wait for the
+	//limit in their own goroutines, never in the message loop. 0 is
+	//unlimited.
+	MaxUploadBytesPerSec		int64
+	MaxDownloadBytesPerSec	int64
+	//ReadOnly makes the node a cache: it fetches files from the network
+	//and keeps what it stores or fetches locally, but never replicates its
+	//files, takes on or serves the files of peers, or advertises any.
+	ReadOnly 								bool
+	//GossipInterval is how often the peer list is sent to the peers, which
+	//dial the addresses they are not connected to yet. It is also sent on
+	//connect. A negative value disables gossip.
+	GossipInterval 					time.Duration
+	//ReplicateInterval is how often all our files are Replicated, so the
+	//ones that lost copies when peers left are healed. 0 never does.
+	ReplicateInterval 			time.Duration
+	//DiscoverLAN advertises the node over mDNS and dials the nodes found
+	//on the local network. Without multicast the bootstrap nodes are
+	//still dialed.
+	DiscoverLAN 						bool
+	//AuditLog, if set, records every Store, Get and Delete, our own and
+	//those of the peers, see FileAuditLog.
+	AuditLog 								AuditLog
+	//Codec encodes the control messages we send, it defaults to GobCodec.
+	//Messages of peers using another built in codec are still decoded.
+	Codec 									Codec
+	//GetRetries is how many more times a Get asks the peers for a file
+	//none of them served, GetRetryInterval apart. It helps when the peer
+	//holding it is still connecting.
+	GetRetries 							int
+	GetRetryInterval 				time.Duration
+	//TransferBufferSize is the buffer files are copied to and from the
+	//peers through, 32KB by default. Larger buffers help fast links.
+	TransferBufferSize 			int
+	//PeerSelector picks the peers a Store streams to and a Get asks, by
+	//default every peer (see BroadcastSelector).
+	PeerSelector 						PeerSelector
+	//MaxFileSize is the largest file (in bytes after Compression) a peer
+	//may store on us or serve to us, 0 is unlimited. A peer announcing a
+	//larger one is dropped before anything of it is read.
+	MaxFileSize 						int64
+	//MaxInflightStores caps the Stores running at once and
+	//MaxInflightBytes the bytes (after Compression) they replicate at once,
+	//0 is unlimited. Further Stores block until one ends, or their context
+	//is done. Each Store streams its file from disk through streamBuffer
+	//writes of TransferBufferSize per peer, so with MaxInflightStores the
+	//memory Stores take is bounded. A file larger than MaxInflightBytes is
+	//replicated alone.
+	MaxInflightStores 			int
+	MaxInflightBytes 				int64
+	//Blacklist holds the addresses refused until Unban, hosts or host:port
+	//(see Ban). A peer that failed BanThreshold (default 3) integrity
+	//checks or handshakes within BanWindow (default 10m) is banned for
+	//BanDuration (default 1h), a negative BanThreshold never bans. The
+	//transport reports handshakes through OnHandshakeError.
+	Blacklist 							[]string
+	BanThreshold 						int
+	BanWindow 							time.Duration
+	BanDuration 						time.Duration
+	//OnFileStored, if set, is called in its own goroutine after a file was
+	//written to the local store: by Store (fromNetwork is false), streamed
+	//to us by a peer or fetched by a Get. The key is that of the matching
+	//Event, a panic of the hook is logged.
+	OnFileStored 						func(key string,size int64,fromNetwork bool)
 }
 
+//ErrNotFound is returned by a Get when no peer served the file.
+var ErrNotFound = errors.New("file not found")
+
+const(
+	defaultAckTimeout 	= 2*time.Second
+	defaultSendTimeout 	= 10*time.Second
+	defaultGetRetryInterval = time.Second
+	defaultSendRetries 	= 3
+	defaultSendRetryDelay = 50*time.Millisecond
+)
+
 type FileServer struct {
 	FileServerOpts
 	store 		*Store
+	keys 			*keyring
+	//uploads and downloads throttle the file streams, see
+	//MaxUploadBytesPerSec.
+	uploads 	*rateLimiter
+	downloads *rateLimiter
+	//buffers holds the TransferBufferSize buffers, see copyBuffer.
+	buffers 	*sync.Pool
+	//storeLimit holds the Stores in flight, see MaxInflightStores.
+	storeLimit *storeLimiter
+	//bans holds the banned addresses, see Blacklist.
+	bans 			*banList
 	quitCh 		chan struct{}
 	peers			map[string]p2p.Peer
 	peerLock 	sync.Mutex
+	//listenAddrs holds the address the peers that dialed us listen on by
+	//remote address, dialing the gossiped addresses being dialed. Both
+	//are guarded by peerLock.
+	listenAddrs map[string]string
+	dialing 		map[string]bool
+	//weights holds the StorageWeight the peers announced by remote address,
+	//also guarded by peerLock.
+	weights 		map[string]int
+	//compressions holds the Compressions the peers read by remote
+	//address, see Handshake, also guarded by peerLock.
+	compressions map[string][]Compression
+	//peerIDs holds the node ID the peers named in the Handshake by remote
+	//address, also guarded by peerLock.
+	peerIDs 		map[string]string
+
+	//pendingStreams holds the announced MessageStoreFile whose stream has
+	//not arrived yet by streamKey. Only touched from loop().
+	pendingStreams map[string]MessageStoreFile
+	//servedStreams holds the transfer (see transferID) a peer acked to
+	//serve a file to by the streamKey it streams the file on. Only touched
+	//from loop().
+	servedStreams	map[string]string
+	//streamIDs numbers the streams we open, see nextStreamID.
+	streamIDs 		atomic.Uint32
+
+	transferLock 	sync.Mutex
+	transfers 		map[string]*transfer
+	//fetches holds the Gets fetching from the network by key, see get.
+	fetchLock 		sync.Mutex
+	fetches 			map[string]*fetchCall
+
+	//subscribers are the channels handed out by Events.
+	eventLock 		sync.Mutex
+	subscribers 	[]chan Event
+	eventsClosed 	bool
+	//requests holds the reply channels of request/response messages
+	//(like MessageListFiles) by request id.
+	requests 			map[string]chan peerReply
+
+	//active tracks the Store/Get transfers in flight so Stop can wait
+	//for them, once stopping is set no new transfers are started.
+	stopLock 	sync.Mutex
+	stopping 	bool
+	active 		sync.WaitGroup
+	//inflight counts the transfers in active, draining is set by Drain.
+	inflight 	int
+	draining 	bool
+	stopOnce 	sync.Once
+	closeErr 	error
+	//created is when NewFileServer returned the server, see Status.
+	created 	time.Time
+	//keyErr is why no key could be derived from the Passphrase.
+	keyErr 		error
+	//optsErr is why the options are invalid, Start returns it.
+	optsErr 	error
+	//joined is closed once the first peer connected, see BootstrapTimeout.
+	joined 		chan struct{}
+	joinOnce 	sync.Once
+	//knownPeers are the saved peers by address with the times the dials
+	//to them gave up, loaded from peersFile on first use.
+	knownLock 	sync.Mutex
+	knownPeers 	map[string]int
+	//tokens are those of StoreEphemeral, loaded from tokensFile on first
+	//use.
+	tokenLock 	sync.Mutex
+	tokens 			map[string]ephemeralToken
+}
+
+//transfer collects the acks (and for Get the served stream) of the peers
+//while a Store or Get is waiting on them.
+type transfer struct{
+	acks 		chan peerAck
+	streams chan p2p.Peer
+}
+
+type peerAck struct{
+	From string
+	MessageAck
+}
+
+type peerReply struct{
+	From 		string
+	Payload any
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Backend:					 opts.Backend,
+		MaxBytes: 				 opts.MaxBytes,
+		Eviction: 				 opts.Eviction,
+		ShardDepth: 			 opts.ShardDepth,
+		ShardWidth: 			 opts.ShardWidth,
+		AtRestKey: 				 opts.AtRestKey,
+		SyncWrites: 			 opts.SyncWrites,
 	}
 
 	if len(opts.ID)==0{
 		opts.ID=generateID()
 	}
+	if opts.AckTimeout==0{
+		opts.AckTimeout=defaultAckTimeout
+	}
+	if opts.SendTimeout==0{
+		opts.SendTimeout=defaultSendTimeout
+	}
+	if opts.ReconnectBaseDelay==0{
+		opts.ReconnectBaseDelay=defaultReconnectBaseDelay
+	}
+	if opts.MaxPeerFailures==0{
+		opts.MaxPeerFailures=defaultMaxPeerFailures
+	}
+	if opts.ReconnectMaxDelay==0{
+		opts.ReconnectMaxDelay=defaultReconnectMaxDelay
+	}
+	if opts.MaxReconnectAttempts==0{
+		opts.MaxReconnectAttempts=defaultMaxReconnectAttempts
+	}
+	if opts.ChunkSize==0{
+		opts.ChunkSize=defaultChunkSize
+	}
+	if opts.SweepInterval==0{
+		opts.SweepInterval=defaultSweepInterval
+	}
+	if opts.GossipInterval==0{
+		opts.GossipInterval=defaultGossipInterval
+	}
+	if opts.Codec==nil{
+		opts.Codec=GobCodec{}
+	}
+	if opts.GetRetryInterval==0{
+		opts.GetRetryInterval=defaultGetRetryInterval
+	}
+	if opts.SendRetries==0{
+		opts.SendRetries=defaultSendRetries
+	}
+	if opts.SendRetryDelay<=0{
+		opts.SendRetryDelay=defaultSendRetryDelay
+	}
+	if opts.StorageWeight<=0{
+		opts.StorageWeight=defaultStorageWeight
+	}
+	if opts.Compressions==nil{
+		opts.Compressions=supportedCompressions
+	}
+	if opts.BanThreshold==0{
+		opts.BanThreshold=defaultBanThreshold
+	}
+	if opts.BanWindow<=0{
+		opts.BanWindow=defaultBanWindow
+	}
+	if opts.BanDuration<=0{
+		opts.BanDuration=defaultBanDuration
+	}
+	if opts.TransferBufferSize<=0{
+		opts.TransferBufferSize=defaultTransferBufferSize
+	}
+	if opts.Logger==nil{
+		opts.Logger=NewSlogLogger(slog.Default())
+		if opts.Transport!=nil{
+			opts.Logger=opts.Logger.With("addr",opts.Transport.Addr())
+		}
+	}
+	store:= NewStore(storeOpts)
+	optsErr:= checkCompressionLevel(opts.Compression,opts.CompressionLevel)
+	if optsErr!=nil{
+		opts.Logger.Errorf("%s",optsErr)
+	}
+	var keyErr error
+	if opts.EncKey==nil{
+		opts.EncKey = opts.InTransitKey
+	}
+	if opts.EncKey==nil && opts.Passphrase!=""{
+		if opts.KDF==(KDFParams{}){
+			opts.KDF = DefaultKDFParams
+		}
+		salt,err:= store.salt()
+		if err!=nil{
+			keyErr = fmt.Errorf("reading the salt of the passphrase: %w",err)
+			opts.Logger.Errorf("%s",keyErr)
+		}else{
+			opts.EncKey = opts.KDF.DeriveKey(opts.Passphrase,salt)
+		}
+	}
+	keys:= newKeyring(opts.Keys,opts.ActiveKeyID)
+	if opts.EncKey!=nil{
+		if _,ok:= keys.key("");!ok{
+			keys.keys[""] = opts.EncKey
+		}
+	}
 	return &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
+		keyErr: 				keyErr,
+		optsErr: 				optsErr,
+		keys: 					keys,
+		uploads: 				newRateLimiter(opts.MaxUploadBytesPerSec),
+		downloads: 			newRateLimiter(opts.MaxDownloadBytesPerSec),
+		buffers: 				newBufferPool(opts.TransferBufferSize),
+		storeLimit: 		newStoreLimiter(opts.MaxInflightStores,opts.MaxInflightBytes),
+		bans: 					newBanList(opts.Blacklist),
 		quitCh: make(chan struct{}),
 		peers: make(map[string]p2p.Peer),
+		listenAddrs: make(map[string]string),
+		dialing: make(map[string]bool),
+		weights: make(map[string]int),
+		compressions: make(map[string][]Compression),
+		peerIDs: make(map[string]string),
+		pendingStreams: make(map[string]MessageStoreFile),
+		servedStreams: make(map[string]string),
+		transfers: make(map[string]*transfer),
+		fetches: make(map[string]*fetchCall),
+		requests: make(map[string]chan peerReply),
+		created: time.Now(),
+		joined: make(chan struct{}),
 	}
 }
 
@@ -51,39 +441,624 @@ type Message struct{
 }
 
 func (s *FileServer) broadcast(msg *Message) error{
-	buf:= new(bytes.Buffer)
-	if err:= gob.NewEncoder(buf).Encode(msg);err!=nil{
-		return err
+	return s.broadcastContext(context.Background(),msg)
+}
+
+func (s *FileServer) broadcastContext(ctx context.Context,msg *Message) error{
+	_,err:= s.multicast(ctx,msg,s.peerList())
+	return err
+}
+
+//multicast sends msg to the given peers only, all at once, and returns
+//the ones it reached. A peer that fails (it may just have disconnected)
+//or takes longer than SendTimeout is dropped without keeping the message
+//from the others, the failures are returned together. A transient
+//failure is retried first (see SendRetries).
+func (s *FileServer) multicast(ctx context.Context,msg *Message,peers []p2p.Peer) ([]p2p.Peer,error){
+	b,err:= encodeMessage(s.Codec,msg)
+	if err!=nil{
+		return nil,err
+	}
+	if err:= ctx.Err();err!=nil{
+		return nil,err
 	}
+	frame:= p2p.EncodeMessage(b)
 
-	for _,peer :=range s.peers{
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err:= peer.Send(buf.Bytes());err!=nil{
+	var(
+		wg 			sync.WaitGroup
+		mu 			sync.Mutex
+		reached []p2p.Peer
+		errs 		[]error
+	)
+	for _,peer :=range peers{
+		wg.Add(1)
+		go func(peer p2p.Peer){
+			defer wg.Done()
+			err:= s.sendRetrying(peer,frame)
+			mu.Lock()
+			defer mu.Unlock()
+			if err!=nil{
+				s.dropPeer(peer,err)
+				errs = append(errs,fmt.Errorf("send to %s: %w",peer.RemoteAddr(),err))
+				return
+			}
+			reached = append(reached,peer)
+		}(peer)
+	}
+	wg.Wait()
+	return reached,errors.Join(errs...)
+}
+
+//sendRetrying sends frame to peer, trying again up to SendRetries times
+//with a backoff doubling from SendRetryDelay while it fails transiently
+//(see p2p.IsTransient).
+func (s *FileServer) sendRetrying(peer p2p.Peer,frame []byte) error{
+	logger:= s.Logger.With("peer",peer.RemoteAddr().String())
+	delay:= s.SendRetryDelay
+	for attempt:=0;;attempt++{
+		err:= s.writePeer(peer,func() error{
+			return peer.Send(frame)
+		})
+		if err==nil{
+			if attempt>0{
+				logger.Infof("sent after %d retries",attempt)
+			}
+			return nil
+		}
+		if !p2p.IsTransient(err) || attempt>=s.SendRetries{
+			if attempt>0{
+				logger.Errorf("send failed after %d retries: %s",attempt,err)
+			}
+			return err
+		}
+		logger.Infof("send failed, retrying in %s: %s",delay,err)
+		select{
+		case <-time.After(delay):
+		case <-s.quitCh:
 			return err
 		}
+		delay*=2
+	}
+}
+
+//writePeer runs write, a write to peer, and fails it once it takes longer
+//than SendTimeout: closing the connection ends a write that is stuck.
+func (s *FileServer) writePeer(peer p2p.Peer,write func() error) error{
+	timer:= time.AfterFunc(s.SendTimeout,func(){
+		peer.Close()
+	})
+	err:= write()
+	if !timer.Stop(){
+		return fmt.Errorf("write timed out after %s",s.SendTimeout)
+	}
+	return err
+}
+
+//peerList returns a snapshot of the connected peers, so callers can
+//iterate it while peers come and go.
+func (s *FileServer) peerList() []p2p.Peer{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers:= make([]p2p.Peer,0,len(s.peers))
+	for _,peer:= range s.peers{
+		peers = append(peers,peer)
+	}
+	return peers
+}
+
+//peersFull tells whether MaxPeers peers are connected.
+func (s *FileServer) peersFull() bool{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	return s.MaxPeers>0 && len(s.peers)>=s.MaxPeers
+}
+
+//Peers returns the addresses of the connected peers, sorted.
+func (s *FileServer) Peers() []string{
+	peers:= s.peerList()
+	addrs:= make([]string,0,len(peers))
+	for _,peer:= range peers{
+		addrs = append(addrs,peer.RemoteAddr().String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//peer returns the connected peer with the given remote address.
+func (s *FileServer) peer(addr string) (p2p.Peer,bool){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer,ok:= s.peers[addr]
+	return peer,ok
+}
+
+//send encodes msg and sends it to a single peer.
+func (s *FileServer) send(peer p2p.Peer,msg *Message) error{
+	b,err:= encodeMessage(s.Codec,msg)
+	if err!=nil{
+		return err
+	}
+	err= s.writePeer(peer,func() error{
+		return peer.Send(p2p.EncodeMessage(b))
+	})
+	if err!=nil{
+		s.dropPeer(peer,err)
+		return err
 	}
 	return nil
 }
 
+//transferKind keeps a Store, a Get and a probe of the same key apart, so
+//a late ack of one is never taken for an ack of the other. A ranged read
+//is keyed by its request ID, several of one file can run at once.
+type transferKind string
+
+const(
+	kindStore transferKind = "store"
+	kindGet 	transferKind = "get"
+	kindProbe transferKind = "probe"
+	kindRange transferKind = "range"
+)
+
+func transferID(key string,kind transferKind) string{
+	return string(kind)+"/"+key
+}
+
+//addTransfer registers a Store or Get for key that is waiting on acks
+//from up to n peers.
+func (s *FileServer) addTransfer(key string,kind transferKind,n int) *transfer{
+	return s.addStreamTransfer(key,kind,n,1)
+}
+
+//addStreamTransfer is like addTransfer for a transfer that takes up to
+//streams served streams.
+func (s *FileServer) addStreamTransfer(key string,kind transferKind,n int,streams int) *transfer{
+	t:= &transfer{
+		acks: make(chan peerAck,n),
+		streams: make(chan p2p.Peer,streams),
+	}
+	s.transferLock.Lock()
+	s.transfers[transferID(key,kind)] = t
+	s.transferLock.Unlock()
+	return t
+}
+
+//removeTransfer unregisters the transfer, streams it got but didn't take
+//are drained.
+func (s *FileServer) removeTransfer(key string,kind transferKind){
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	t,ok:= s.transfers[transferID(key,kind)]
+	if !ok{
+		return
+	}
+	delete(s.transfers,transferID(key,kind))
+	for{
+		select{
+		case peer:= <-t.streams:
+			peer.CloseStream()
+		default:
+			return
+		}
+	}
+}
+
+func (s *FileServer) getTransfer(key string,kind transferKind) (*transfer,bool){
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	t,ok:= s.transfers[transferID(key,kind)]
+	return t,ok
+}
+
+//nextStreamID returns the ID of a new stream to a peer, the IDs of the
+//streams that are open at once never clash before the counter wraps.
+func (s *FileServer) nextStreamID() uint32{
+	return s.streamIDs.Add(1)
+}
+
+//streamKey is the key of the stream id of the peer at from.
+func streamKey(from string,id uint32) string{
+	return fmt.Sprintf("%s/%d",from,id)
+}
+
+//offerStream hands a served stream to the Get (or ranged read) with the
+//transfer id waiting on it, it returns false when nobody takes it.
+func (s *FileServer) offerStream(id string,peer p2p.Peer) bool{
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+	t,ok:= s.transfers[id]
+	if !ok{
+		return false
+	}
+	select{
+	case t.streams <- peer:
+		return true
+	default:
+		return false
+	}
+}
+
+//addRequest registers a request sent to n peers and returns the id the
+//replies must carry together with the channel they are delivered on.
+func (s *FileServer) addRequest(n int) (string,chan peerReply){
+	id:= generateID()
+	ch:= make(chan peerReply,n)
+	s.transferLock.Lock()
+	s.requests[id] = ch
+	s.transferLock.Unlock()
+	return id,ch
+}
+
+func (s *FileServer) removeRequest(id string){
+	s.transferLock.Lock()
+	delete(s.requests,id)
+	s.transferLock.Unlock()
+}
+
+//deliverReply hands a reply to the request waiting on it, replies to
+//requests that are already done are dropped.
+func (s *FileServer) deliverReply(id string,from string,payload any){
+	s.transferLock.Lock()
+	ch,ok:= s.requests[id]
+	s.transferLock.Unlock()
+	if !ok{
+		return
+	}
+	select{
+	case ch <- peerReply{From: from,Payload: payload}:
+	default:
+	}
+}
+
 type MessageStoreFile struct{
 	ID string
 	Key string
 	Size int64
+	//Expires is zero for files that never expire.
+	Expires time.Time
+	//ChunkSize is set for a resumable stream, see replicate.
+	ChunkSize int64
+	//StreamID is the stream the file follows on.
+	StreamID uint32
+	//Content is set when the key names the content of the file, a peer
+	//holding a copy encrypted with the key of KeyFingerprint (see
+	//keyFingerprint) acks Have and no stream follows.
+	Content 				bool
+	KeyFingerprint 	[]byte
+	//Meta is the metadata of the file, see StoreWithMeta.
+	Meta 						map[string]string
+	//Compression is the one the file was stored with, a peer that
+	//doesn't read it declines the stream.
+	Compression 		Compression
 }
 
+//MessageGetFile asks for a file. A Length above 0 only asks for the
+//Length bytes of the peer's copy starting at Offset, with Sum the peer
+//sends their sha256 ahead of them. A Probe only asks whether the peer
+//has the file.
 type MessageGetFile struct{
 	ID string
 	Key string
+	Offset int64
+	Length int64
+	Sum bool
+	Probe bool
+}
+
+type MessageDeleteFile struct{
+	ID string
+	Key string
+}
+
+//MessageAck is the reply to a MessageStoreFile or MessageGetFile. Ready
+//tells whether the peer accepts the stream, or for a MessageGetFile
+//(Get is set) whether it has the file and its stream follows the ack.
+type MessageAck struct{
+	Key 	string
+	Ready bool
+	Get 	bool
+	//Probe answers a MessageGetFile with Probe set, no stream follows.
+	//Size is the size of the peer's (encrypted) copy.
+	Probe bool
+	Size 	int64
+	//Chunks are the sha256 of the chunks of a resumable file the peer
+	//already holds.
+	Chunks [][]byte
+	//RequestID is set when answering a MessageGetRange, Size is then the
+	//size of the copy the range is served from.
+	RequestID string
+	//StreamID is the stream a Ready MessageGetFile or MessageGetRange is
+	//served on.
+	StreamID 	uint32
+	//Have answers a MessageStoreFile the peer already holds the copy of,
+	//see MessageStoreFile.Content.
+	Have 			bool
+}
+
+//ctxReader fails reads once its context is done, so a long io.Copy
+//can be cancelled in between two reads.
+type ctxReader struct{
+	ctx context.Context
+	r 	io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int,error){
+	if err:= r.ctx.Err();err!=nil{
+		return 0,err
+	}
+	return r.r.Read(b)
+}
+
+//beginStream opens the stream id to peer and sends the size of what
+//follows on it, the caller writes that and closes the stream. A peer
+//that can't take it is dropped.
+func (s *FileServer) beginStream(peer p2p.Peer,id uint32,size int64) (io.WriteCloser,error){
+	w,err:= p2p.OpenStream(peer,id)
+	if err==nil{
+		err = binary.Write(w,binary.LittleEndian,size)
+	}
+	if err!=nil{
+		s.dropPeer(peer,err)
+		return nil,err
+	}
+	return w,nil
+}
+
+//fullWriter fails a write that comes back short without an error. Most
+//callers (binary.Write, a MultiWriter) look at the error only, a peer
+//missing the rest of a write would read the stream out of frame.
+type fullWriter struct{
+	w io.Writer
+}
+
+func (w fullWriter) Write(b []byte) (int,error){
+	n,err:= w.w.Write(b)
+	if err==nil && n<len(b){
+		err = io.ErrShortWrite
+	}
+	return n,err
+}
+
+//exactReader reads the n bytes of r. Running out early is an
+//io.ErrUnexpectedEOF, so a cut off stream is never stored as the file.
+type exactReader struct{
+	r io.Reader
+	n int64
+}
+
+func (r *exactReader) Read(b []byte) (int,error){
+	if r.n<=0{
+		return 0,io.EOF
+	}
+	if int64(len(b))>r.n{
+		b = b[:r.n]
+	}
+	n,err:= r.r.Read(b)
+	r.n-=int64(n)
+	if err==io.EOF && r.n>0{
+		err = io.ErrUnexpectedEOF
+	}
+	return n,err
+}
+
+//FileInfo describes a file returned by GetInfo.
+type FileInfo struct{
+	//Size is the length of the content.
+	Size 				int64
+	Key 				string
+	//FromNetwork is set when the file wasn't on local disk and was
+	//fetched from the peers.
+	FromNetwork bool
 }
 
 func (s *FileServer) Get(key string) (io.Reader,error){
+	return s.GetContext(context.Background(),key)
+}
+
+//GetContext is like Get but gives up waiting for and streaming the file
+//from the network once ctx is done, removing the partially written file.
+//A file no peer served, after GetRetries more tries, is an ErrNotFound.
+func (s *FileServer) GetContext(ctx context.Context,key string) (io.Reader,error){
+	r,_,err:= s.get(ctx,key)
+	return r,err
+}
+
+//GetInfo is like Get but also returns the size of the file and where it
+//was found.
+func (s *FileServer) GetInfo(key string) (io.Reader,FileInfo,error){
+	return s.GetInfoContext(context.Background(),key)
+}
+
+//GetInfoContext is like GetInfo but stops once ctx is done, see GetContext.
+func (s *FileServer) GetInfoContext(ctx context.Context,key string) (io.Reader,FileInfo,error){
+	r,fromNetwork,err:= s.get(ctx,key)
+	if err!=nil{
+		return nil,FileInfo{},err
+	}
+	size,err:= s.localSize(key)
+	if err!=nil{
+		if rc,ok:= r.(io.ReadCloser);ok{
+			rc.Close()
+		}
+		return nil,FileInfo{},err
+	}
+	return r,FileInfo{Size: size,Key: key,FromNetwork: fromNetwork},nil
+}
+
+//get returns the file for key and whether it was fetched from the network.
+func (s *FileServer) get(ctx context.Context,key string) (io.Reader,bool,error){
+	r,fromNetwork,err:= s.getFile(ctx,key)
+	if err==nil{
+		var size int64
+		//The size of our copy, the content of a compressed one isn't counted.
+		if n,rc,err:= s.store.readStream(s.ID,key);err==nil{
+			size = n
+			rc.Close()
+		}
+		s.audit(AuditEntry{Op: AuditGet,ID: s.ID,Key: key,Size: size,Fetched: fromNetwork})
+	}
+	return r,fromNetwork,err
+}
+
+func (s *FileServer) getFile(ctx context.Context,key string) (io.Reader,bool,error){
+	for{
+		r,ok,err:= s.getLocal(key)
+		if ok || err!=nil{
+			return r,false,err
+		}
+
+		//Concurrent Gets of the same key share one fetch, the others read
+		//the file it stored once it is done.
+		f,first:= s.startFetch(key)
+		if first{
+			//The fetch before ours may have ended since we looked.
+			r,ok,err:= s.getLocal(key)
+			if !ok && err==nil{
+				r,err = s.fetch(ctx,key)
+			}
+			s.endFetch(key,f,err)
+			return r,!ok,err
+		}
+		select{
+		case <-f.done:
+		case <-ctx.Done():
+			return nil,false,ctx.Err()
+		}
+		if errors.Is(f.err,context.Canceled) || errors.Is(f.err,context.DeadlineExceeded){
+			//Only the Get that fetched gave up, try again.
+			continue
+		}
+		if f.err!=nil{
+			return nil,false,f.err
+		}
+		r,err = s.readLocal(key)
+		return r,true,err
+	}
+}
+
+//fetchCall is a fetch other Gets of the same key wait for.
+type fetchCall struct{
+	done 	chan struct{}
+	err 	error
+}
+
+//startFetch returns the fetch in flight for key, first is set when there
+//was none and the caller has to fetch and call endFetch.
+func (s *FileServer) startFetch(key string) (*fetchCall,bool){
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+	if f,ok:= s.fetches[key];ok{
+		return f,false
+	}
+	f:= &fetchCall{done: make(chan struct{})}
+	s.fetches[key] = f
+	return f,true
+}
+
+func (s *FileServer) endFetch(key string,f *fetchCall,err error){
+	s.fetchLock.Lock()
+	delete(s.fetches,key)
+	s.fetchLock.Unlock()
+	f.err = err
+	close(f.done)
+}
+
+//getLocal returns our copy of the file for key, ok is false when there is
+//none (left).
+func (s *FileServer) getLocal(key string) (io.Reader,bool,error){
+	if s.store.Has(s.ID,key) && s.store.Expired(s.ID,key){
+		s.Logger.With("key",key).Infof("local file expired")
+		if err:= s.store.purge(s.ID,key);err!=nil{
+			return nil,false,err
+		}
+	}
 	if s.store.Has(s.ID,key){
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(),key)
-		_,r,err:=s.store.Read(s.ID,key)
-		return r,err
+		s.Logger.With("key",key).Infof("serving file from local disk")
+		s.Metrics.fetchedLocal()
+		r,err:= s.readLocal(key)
+		return r,true,err
+	}
+	return nil,false,nil
+}
+
+//fetch fetches the file for key from the network into the store.
+func (s *FileServer) fetch(ctx context.Context,key string) (io.Reader,error){
+	s.Logger.With("key",key).Infof("don't have the file locally, fetching from network...")
+	start:= time.Now()
+
+	if !s.beginTransfer(){
+		return nil,fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+
+	for attempt:=0;;attempt++{
+		r,err:= s.fetchOnce(ctx,key,start)
+		if !errors.Is(err,ErrNotFound) || attempt>=s.GetRetries{
+			return r,err
+		}
+		s.Logger.With("key",key).Infof("no peer served the file, asking again in %s",s.GetRetryInterval)
+		select{
+		case <-time.After(s.GetRetryInterval):
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		case <-s.quitCh:
+			return nil,err
+		}
+	}
+}
+
+//fetchOnce asks the peers for the file once.
+func (s *FileServer) fetchOnce(ctx context.Context,key string,start time.Time) (io.Reader,error){
+	//Large files held by several peers are fetched in chunks from all of
+	//them at once, everything else from the first peer that serves it.
+	candidates:= s.selectPeers(key)
+	if s.ChunkSize>0 && len(candidates)>0{
+		holders,size,err:= s.probeFile(ctx,key,candidates)
+		if err!=nil{
+			return nil,err
+		}
+		if len(holders)>0 && size>s.ChunkSize{
+			st:= &resumeState{Get: true,Key: key,Size: size,ChunkSize: s.ChunkSize,Chunks: make(map[int64][]byte)}
+			return s.fetchChunks(ctx,st,holders,start)
+		}
+		if len(holders)>0{
+			candidates = holders
+		}
 	}
-	fmt.Printf("[%s] don't have the file (%s) locally, fetching from network...\n",s.Transport.Addr(),key)
 
+	peer,err:= s.requestFromOwners(ctx,key,candidates)
+	if errors.Is(err,ErrNotFound){
+		//No peer holds all of the file, maybe they hold parts of it.
+		r,ferr:= s.fetchFragments(ctx,key,s.selectPeers(key),start)
+		if errors.Is(ferr,ErrNotFound){
+			return nil,err
+		}
+		return r,ferr
+	}
+	if err!=nil{
+		return nil,err
+	}
+	return s.receiveFile(ctx,key,peer,start)
+}
+
+//requestFromOwners is requestFile asking the owners of the key among the
+//candidates first when there is a replication factor, only when none of
+//them serves it we fall back to everyone else.
+func (s *FileServer) requestFromOwners(ctx context.Context,key string,candidates []p2p.Peer) (p2p.Peer,error){
+	if s.ReplicationFactor>0{
+		owners,others:= splitPeers(candidates,closestPeers(key,candidates,s.ReplicationFactor,s.peerWeights()))
+		peer,err:= s.requestFile(ctx,key,owners)
+		if err==nil || ctx.Err()!=nil{
+			return peer,err
+		}
+		candidates = others
+	}
+	return s.requestFile(ctx,key,candidates)
+}
+
+//requestFile asks the given peers for the file and returns the first peer
+//that streams it.
+func (s *FileServer) requestFile(ctx context.Context,key string,peers []p2p.Peer) (p2p.Peer,error){
 	msg:= Message{
 		MessageGetFile{
 			Key: hashKey(key),
@@ -91,95 +1066,605 @@ func (s *FileServer) Get(key string) (io.Reader,error){
 		},
 	}
 
-	if err:= s.broadcast(&msg);err!=nil{
-		return nil, err
+	t:= s.addTransfer(hashKey(key),kindGet,len(peers))
+	defer s.removeTransfer(hashKey(key),kindGet)
+
+	//Only the peers we reached will answer.
+	reached,_:= s.multicast(ctx,&msg,peers)
+	if err:= ctx.Err();err!=nil{
+		return nil,err
 	}
-	time.Sleep(500*time.Millisecond)
-	for _,peer := range s.peers{
-		//First read the file size so we can limit the amount of bytes
-		// that we read from connection, so it ll not keep hanging.
-		var fileSize int64
-		binary.Read(peer,binary.LittleEndian,&fileSize)
-		n,err := s.store.WriteDecrypt(s.EncKey,s.ID,key,io.LimitReader(peer,fileSize))
-		if err!=nil{
+	expected:= len(reached)
+	if expected==0{
+		return nil,fmt.Errorf("[%s] no peer to ask for file (%s): %w, %w",s.Transport.Addr(),key,ErrNotFound,ErrNoPeers)
+	}
+
+	//Every peer acks, the ones that have the file stream it right after.
+	//We take the first stream and let loop() drain any later ones.
+	var(
+		declined 	int
+		timeout 	= time.After(s.AckTimeout)
+	)
+	for{
+		if declined==expected{
+			return nil,fmt.Errorf("[%s] no peer served file (%s): %w",s.Transport.Addr(),key,ErrNotFound)
+		}
+		select{
+		case peer:= <-t.streams:
+			return peer,nil
+		case ack:= <-t.acks:
+			if !ack.Ready{
+				declined++
+			}
+		case <-timeout:
+			return nil,fmt.Errorf("[%s] no peer served file (%s): %w",s.Transport.Addr(),key,ErrNotFound)
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+}
+
+//receiveFile reads the file a peer is streaming to us into the store.
+func (s *FileServer) receiveFile(ctx context.Context,key string,peer p2p.Peer,start time.Time) (io.Reader,error){
+	//First read the file size so we can limit the amount of bytes
+	// that we read from connection, so it ll not keep hanging.
+	var fileSize int64
+	err:= binary.Read(peer,binary.LittleEndian,&fileSize)
+	if err==nil{
+		err = s.checkFileSize(fileSize)
+	}
+	if err!=nil{
+		peer.CloseStream()
+		s.dropPeer(peer,err)
 		return nil,err
+	}
+	lr:= &exactReader{r: peer,n: fileSize}
+	n,err := s.store.writeDecrypt(s.keys,s.ID,key,ctxReader{ctx,throttle(lr,s.downloads,ctx.Done())},verifyingReader)
+	if err!=nil{
+		peer.CloseStream()
+		if ctx.Err()!=nil{
+			return nil,ctx.Err()
+		}
+		if errors.Is(err,ErrIntegrity){
+			s.misbehaved(peer.RemoteAddr().String(),err)
 		}
+		return nil,err
+	}
+	peer.CloseStream()
 
-		fmt.Printf("[%s] recieved (%d) bytes over the network from (%s)\n",s.Transport.Addr(),n,peer.RemoteAddr())
+	s.Logger.With("key",key,"peer",peer.RemoteAddr().String()).Infof("received (%d) bytes over the network",n)
+	return s.completeFetch(key,n,start)
+}
 
-		peer.CloseStream()
+//completeFetch records the n bytes just fetched into the store (see
+//recordFetch) and returns the file.
+func (s *FileServer) completeFetch(key string,n int64,start time.Time) (io.Reader,error){
+	s.recordFetch(key,n,start)
+	return s.readLocal(key)
+}
+
+func (s *FileServer) recordFetch(key string,n int64,start time.Time){
+	s.Metrics.addBytesStored(n)
+	s.Metrics.fetchedNetwork(start)
+	s.emit(Event{Type: EventFileFetched,Key: key,Size: n})
+	s.fileStored(key,n,true)
+}
+
+//readLocal returns the decompressed content of our own copy of the file.
+func (s *FileServer) readLocal(key string) (io.Reader,error){
+	_,r,err:= s.store.Read(s.ID,key)
+	if err!=nil{
+		return nil,err
 	}
-	_,r,err:=s.store.Read(s.ID,key)
-	return r,err
+	return decompressReader(r)
+}
+
+//storedCompression returns the Compression our copy of the file was
+//stored with.
+func (s *FileServer) storedCompression(key string) (Compression,error){
+	_,r,err:= s.store.readStream(s.ID,key)
+	if err!=nil{
+		return 0,err
+	}
+	defer r.Close()
+	header:= make([]byte,1)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return 0,err
+	}
+	return Compression(header[0]),nil
+}
+
+//localSize returns the length of the content of our copy of the file. It
+//can only be read off an uncompressed file, a compressed one is counted.
+func (s *FileServer) localSize(key string) (int64,error){
+	size,r,err:= s.store.readStream(s.ID,key)
+	if err!=nil{
+		return 0,err
+	}
+	defer r.Close()
+	header:= make([]byte,1)
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return 0,err
+	}
+	if Compression(header[0])==CompressionNone{
+		return size-1,nil
+	}
+	dr,err:= decompressReader(io.MultiReader(bytes.NewReader(header),r))
+	if err!=nil{
+		return 0,err
+	}
+	defer dr.Close()
+	return io.Copy(io.Discard,dr)
+}
+
+//contentVerifier passes the plain bytes of a fetched file through on
+//their way to the store. Once they are all read it fails the read unless
+//their content hashes to the key, so a corrupt file is never committed.
+type contentVerifier struct{
+	r 			io.Reader
+	pw 			*io.PipeWriter
+	result 	chan error
+	err 		error
+	checked bool
+}
+
+//verifyingReader returns r checked against key, keys that are not content
+//hashes can't be verified and r is passed through as is.
+func verifyingReader(key string,r io.Reader) io.ReadCloser{
+	if _,_,ok:= contentHashFunc(key);!ok{
+		return io.NopCloser(r)
+	}
+	pr,pw:= io.Pipe()
+	v:= &contentVerifier{r: r,pw: pw,result: make(chan error,1)}
+	go func(){
+		//The stored bytes are compressed, the hash is over the content.
+		//decompressReader must not close pr, it is drained below.
+		dr,err:= decompressReader(struct{io.Reader}{pr})
+		if err==nil{
+			err = verifyContentHash(key,dr)
+			dr.Close()
+		}
+		if err==nil{
+			_,err = io.Copy(io.Discard,pr)
+		}
+		pr.CloseWithError(err)
+		v.result <- err
+	}()
+	return v
+}
+
+func (v *contentVerifier) Read(b []byte) (int,error){
+	if v.checked{
+		return 0,v.err
+	}
+	n,err:= v.r.Read(b)
+	if n>0{
+		if _,werr:= v.pw.Write(b[:n]);werr!=nil{
+			return n,werr
+		}
+	}
+	if err==io.EOF{
+		v.pw.Close()
+		v.checked = true
+		if v.err = <-v.result;v.err==nil{
+			v.err = io.EOF
+		}
+		return n,v.err
+	}
+	return n,err
+}
+
+func (v *contentVerifier) Close() error{
+	return v.pw.Close()
 }
 
 func (s *FileServer) Store(key string,r io.Reader) error{
+	return s.StoreContext(context.Background(),key,r)
+}
+
+//StoreContext is like Store but stops writing and broadcasting once ctx
+//is done. A local file that was cancelled mid-write is removed. When some
+//of the peers that accepted the file failed to receive it, or one was
+//too slow, the error is a *ReplicationError naming them.
+func (s *FileServer) StoreContext(ctx context.Context,key string,r io.Reader) error{
+	_,err:= s.storeFile(ctx,key,r,0)
+	return err
+}
+
+//storeFile stores the file, a ttl of 0 never expires it.
+func (s *FileServer) storeFile(ctx context.Context,key string,r io.Reader,ttl time.Duration) (replication,error){
 	//1. Store this file to disk
 	//2. broadcast this file to all known peers in the network
-	var(
-	fileBuffer = new(bytes.Buffer)
-	tee = io.TeeReader(r,fileBuffer)
-	)
-	size,err:= s.store.Write(s.ID,key,tee)
+	//The file is streamed to the peers from disk, so it is never held in memory.
+	if !s.beginTransfer(){
+		return replication{},fmt.Errorf("[%s] server is stopping",s.Transport.Addr())
+	}
+	defer s.endTransfer()
+	if err:= s.storeLimit.acquire(ctx,s.quitCh,1,0);err!=nil{
+		return replication{},err
+	}
+	defer s.storeLimit.release(1,0)
+
+	//The file is compressed once, both our copy and the encrypted copies
+	//of the peers hold the compressed bytes, so it is compressed with one
+	//the peers it is replicated to read.
+	c:= s.Compression
+	if !s.ReadOnly{
+		if c = s.compressionFor(s.replicaTargets(key));c!=s.Compression{
+			s.Logger.With("key",key).Infof("not every peer reads %s, storing the file with %s",s.Compression,c)
+		}
+	}
+	cr:= compressReader(c,s.levelFor(c),ctxReader{ctx,r})
+	size,err:= s.store.Write(s.ID,key,cr)
+	cr.Close()
 	if err!=nil{
-		return err
+		return replication{},err
+	}
+	var expires time.Time
+	if ttl>0{
+		expires = time.Now().Add(ttl)
+	}
+	if err:= s.store.SetExpiry(s.ID,key,expires);err!=nil{
+		//Nothing was replicated yet, the write is undone.
+		s.store.Delete(s.ID,key)
+		return replication{},err
+	}
+	//The key ID is recorded before any peer holds a copy, so the file is
+	//known by its key (see keyIDs) for Replicate to heal it later.
+	if keyID,_,err:= s.keys.activeKey();err==nil{
+		err = s.store.SetKeyID(s.ID,key,keyID)
+		if err!=nil{
+			s.store.Delete(s.ID,key)
+			return replication{},err
+		}
+	}
+	s.Metrics.addBytesStored(size)
+	s.emit(Event{Type: EventFileStored,Key: key,Size: size})
+	s.fileStored(key,size,false)
+	s.audit(AuditEntry{Op: AuditStore,ID: s.ID,Key: key,Size: size})
+
+	if err:= s.storeLimit.acquire(ctx,s.quitCh,0,size);err!=nil{
+		return replication{},err
+	}
+	defer s.storeLimit.release(0,size)
+	return s.replicate(ctx,key,size,expires,nil)
+}
+
+//replicate streams our copy of the file (size bytes) to the peers. Files
+//larger than ChunkSize are streamed resumably: st is the manifest of an
+//earlier try or nil, and a failure returns a TransferError.
+func (s *FileServer) replicate(ctx context.Context,key string,size int64,expires time.Time,st *resumeState) (replication,error){
+	if s.ReadOnly{
+		s.Logger.With("key",key).Infof("read only, stored the file locally only")
+		return replication{},nil
+	}
+	if s.keys.empty(){
+		s.Logger.With("key",key).Infof("no in-transit key, stored the file locally only")
+		return replication{},nil
+	}
+	return s.replicateTo(ctx,key,size,expires,st,s.replicaTargets(key))
+}
+
+//replicaTargets returns the peers a copy of the file is replicated to.
+func (s *FileServer) replicaTargets(key string) []p2p.Peer{
+	targets:= s.selectPeers(key)
+	if s.ReplicationFactor>0{
+		targets = closestPeers(key,targets,s.ReplicationFactor,s.peerWeights())
+	}
+	return targets
+}
+
+//replication is what replicateTo did.
+type replication struct{
+	//streamed are the peers that took the stream, sum is the sha256 of the
+	//copy it made.
+	streamed 	[]p2p.Peer
+	sum 			[]byte
+	//held are the peers that already held the copy, see holdsCopy.
+	held 			[]p2p.Peer
+}
+
+//peers returns the peers holding the file.
+func (r replication) peers() []p2p.Peer{
+	return append(append([]p2p.Peer(nil),r.streamed...),r.held...)
+}
+
+//replicateTo streams the file to targets only.
+func (s *FileServer) replicateTo(ctx context.Context,key string,size int64,expires time.Time,st *resumeState,targets []p2p.Peer) (replication,error){
+	var rep replication
+	keyID,encKey,err:= s.keys.activeKey()
+	if err!=nil{
+		return rep,err
+	}
+	//Each transfer checks its targets read our copy, a resumed stream
+	//goes on with the bytes it started with.
+	var compression Compression
+	if st==nil{
+		compression,size,err = s.recompressFor(ctx,key,size,targets)
+	}else{
+		compression,err = s.storedCompression(key)
+	}
+	if err!=nil{
+		return rep,err
+	}
+	if st==nil && s.ChunkSize>0 && encryptedSize(size)>s.ChunkSize{
+		if st,err = newStoreResume(key,keyID,encryptedSize(size),s.ChunkSize);err!=nil{
+			return rep,err
+		}
+	}
+	if st!=nil{
+		//A resumed stream keeps the key it started with.
+		var ok bool
+		keyID = st.KeyID
+		if encKey,ok = s.keys.key(keyID);!ok{
+			return rep,fmt.Errorf("key ID %q of the interrupted Store is no longer in the keyring",keyID)
+		}
+	}
+	var chunkSize int64
+	if st!=nil{
+		chunkSize = st.ChunkSize
+	}
+
+	meta,err:= s.store.Meta(s.ID,key)
+	if err!=nil{
+		return rep,err
 	}
+
+	streamID:= s.nextStreamID()
 	msg:= Message{
 		Payload: MessageStoreFile{
 			ID: s.ID,
 			Key: hashKey(key),
-			Size: size+16,
+			Size: encryptedSize(size),
+			Expires: expires,
+			ChunkSize: chunkSize,
+			StreamID: streamID,
+			Content: isContentKey(key),
+			KeyFingerprint: keyFingerprint(keyID),
+			Meta: meta,
+			Compression: compression,
 		},
 	}
-	if err:= s.broadcast(&msg);err!=nil{
-		return err
+
+	t:= s.addTransfer(hashKey(key),kindStore,len(targets))
+	defer s.removeTransfer(hashKey(key),kindStore)
+
+	reached,_:= s.multicast(ctx,&msg,targets)
+	if err:= ctx.Err();err!=nil{
+		return rep,err
 	}
+	expected:= len(reached)
 
-	time.Sleep(5*time.Millisecond)
+	//Only stream to the peers that acked they are ready for it, the ones
+	//that have the copy already hold the file. A resumable stream starts
+	//at the first chunk one of them is missing.
+	var(
+		ready 	= []p2p.Peer{}
+		resume 	int64 = -1
+	)
+	timeout:= time.After(s.AckTimeout)
+	for i:=0;i<expected;i++{
+		select{
+		case ack:= <-t.acks:
+			if peer,ok:= s.peer(ack.From);ok && ack.Have{
+				rep.held = append(rep.held,peer)
+			}else if ok && ack.Ready{
+				ready=append(ready, peer)
+				if st!=nil{
+					if n:= st.matchingChunks(ack.Chunks);resume<0 || n<resume{
+						resume = n
+					}
+				}
+			}
+		case <-timeout:
+			s.Logger.With("key",key).Errorf("timed out waiting for acks")
+			i = expected
+		case <-ctx.Done():
+			return rep,ctx.Err()
+		}
+	}
+	if len(ready)==0{
+		if len(rep.held)>0{
+			return rep,s.store.SetKeyID(s.ID,key,keyID)
+		}
+		return rep,nil
+	}
+
+	_,f,err:= s.store.Read(s.ID,key)
+	if err!=nil{
+		return rep,err
+	}
+	if rc,ok:= f.(io.ReadCloser);ok{
+		defer rc.Close()
+	}
+
+	sw:= s.newStreamWriter(key,streamID,ready)
+	defer sw.Close()
+	sum:= sha256.New()
+	if st==nil{
+		n,err:= copyEncrypt(keyID,encKey,ctxReader{ctx,throttle(f,s.uploads,ctx.Done())},io.MultiWriter(sum,sw))
+		if err!=nil{
+			return rep,err
+		}
+		sw.Close()
+		if err:= s.store.SetKeyID(s.ID,key,keyID);err!=nil{
+			return rep,err
+		}
+		s.Logger.With("key",key).Infof("received and written (%d) bytes to disk",n)
+		rep.streamed,rep.sum = sw.received(),sum.Sum(nil)
+		return rep,sw.err()
+	}
 
-	peers:= []io.Writer{}
-	for _,peer := range s.peers{
-		peers=append(peers, peer)
+	offset:= resume*st.ChunkSize
+	if err:= binary.Write(sw,binary.LittleEndian,offset);err!=nil{
+		return rep,&TransferError{Err: err,Token: st.token()}
 	}
-	mw:= io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n,err:= copyEncrypt(s.EncKey,fileBuffer,mw)
+	//The stream skips what the peers hold, the sum is of the whole copy.
+	h:= sha256.New()
+	n,err:= copyEncryptNonce(keyID,encKey,st.Nonce,ctxReader{ctx,throttle(io.TeeReader(f,h),s.uploads,ctx.Done())},io.MultiWriter(sum,newChunkWriter(st,sw,offset)))
 	if err!=nil{
-		return err
+		//The peers wait for the rest of a stream that is cut short. The
+		//connection is closed instead, they keep what they spooled.
+		sw.abort(err)
+		//The nonce may only ever encrypt this content, a resume checks
+		//the file is still the same.
+		if st.Sum==nil{
+			if _,herr:= io.Copy(h,f);herr!=nil{
+				return rep,err
+			}
+			st.Sum = h.Sum(nil)
+		}
+		return rep,&TransferError{Err: err,Token: st.token()}
 	}
+	sw.Close()
+	s.Logger.With("key",key).Infof("received and written (%d) bytes to disk, resumed at %d",n,offset)
+	if err:= s.store.SetKeyID(s.ID,key,keyID);err!=nil{
+		return rep,err
+	}
+	rep.streamed,rep.sum = sw.received(),sum.Sum(nil)
+	return rep,sw.err()
+}
 
-		fmt.Printf("[%s] received and written (%d) bytes to disk\n",s.Transport.Addr(),n)
+//Delete removes the file from local disk and broadcasts the deletion
+//so every connected peer removes its copy as well.
+func (s *FileServer) Delete(key string) error{
+	if s.store.Has(s.ID,key){
+		if err:= s.store.Delete(s.ID,key);err!=nil{
+			return err
+		}
+	}
+	s.audit(AuditEntry{Op: AuditDelete,ID: s.ID,Key: key})
+	//The content is still referenced by another Store, the peers keep
+	//their copies as well.
+	if s.store.Has(s.ID,key){
 		return nil
 	}
 
+	msg:= Message{
+		Payload: MessageDeleteFile{
+			ID: s.ID,
+			Key: hashKey(key),
+		},
+	}
+	return s.broadcast(&msg)
+}
+
+//beginTransfer registers a transfer Stop has to wait for. It returns
+//false once the server is stopping and no new transfers are accepted.
+func (s *FileServer) beginTransfer() bool{
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	if s.stopping{
+		return false
+	}
+	s.active.Add(1)
+	s.inflight++
+	return true
+}
+
+func (s *FileServer) endTransfer(){
+	s.stopLock.Lock()
+	s.inflight--
+	s.stopLock.Unlock()
+	s.active.Done()
+}
+
+//Stop stops accepting new transfers, waits for the ones in flight and
+//then shuts down the message loop and the transport and closes the Store.
 func (s *FileServer) Stop(){
-	close(s.quitCh)
+	s.StopContext(context.Background())
+}
+
+//StopContext is like Stop but forces the shutdown once ctx is done,
+//in which case ctx.Err() is returned.
+func (s *FileServer) StopContext(ctx context.Context) error{
+	s.stopLock.Lock()
+	s.stopping = true
+	s.stopLock.Unlock()
+
+	done:= make(chan struct{})
+	go func(){
+		s.active.Wait()
+		close(done)
+	}()
+
+	var err error
+	select{
+	case <-done:
+	case <-ctx.Done():
+		s.Logger.Errorf("grace period elapsed, forcing shutdown with transfers in flight")
+		err = ctx.Err()
+	}
+	s.stopOnce.Do(func(){
+		close(s.quitCh)
+		s.closeEvents()
+		if s.closeErr = s.store.Close();s.closeErr!=nil{
+			s.Logger.Errorf("close store error: %s",s.closeErr)
+		}
+	})
+	return err
+}
+
+//Close is Stop returning the error of closing the Store, if any. Calling
+//it again (or after Stop) is a no-op.
+func (s *FileServer) Close() error{
+	s.Stop()
+	return s.closeErr
 }
 
 func (s *FileServer) OnPeer(p p2p.Peer)error{
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
-	log.Printf("connected with remote %s",p.RemoteAddr())
+	addr:= p.RemoteAddr().String()
+	if s.bans.banned(addr){
+		delete(s.compressions,addr)
+		delete(s.peerIDs,addr)
+		s.Logger.With("peer",addr).Errorf("rejecting banned remote")
+		return fmt.Errorf("[%s] %w: %s",s.Transport.Addr(),ErrBanned,addr)
+	}
+	if _,ok:= s.peers[addr];!ok && s.MaxPeers>0 && len(s.peers)>=s.MaxPeers{
+		delete(s.compressions,addr)
+		delete(s.peerIDs,addr)
+		s.Metrics.rejectedPeer()
+		s.Logger.With("peer",addr).Errorf("rejecting remote, at the limit of %d peers",s.MaxPeers)
+		return fmt.Errorf("[%s] peer limit of %d reached",s.Transport.Addr(),s.MaxPeers)
+	}
+	s.peers[addr] = p
+	s.Metrics.setPeers(len(s.peers))
+	s.Logger.With("peer",addr).Infof("connected with remote")
+	s.emit(Event{Type: EventPeerConnected,Peer: addr})
+	s.joinOnce.Do(func(){close(s.joined)})
+	if p.Outbound(){
+		go s.rememberPeer(addr)
+	}
+	go s.gossip(p)
+	go s.announceWeight(p)
 	return nil
 }
 
 func (s *FileServer) loop(){
 	defer func(){
-		log.Println("file server stopped due to error or user quit action")
+		s.Logger.Infof("file server stopped due to error or user quit action")
 		s.Transport.Close()
 	}()
 	for{
 		select{
 		case rpc:= <-s.Transport.Consume():
+			if rpc.Stream{
+				if err:= s.handleStream(rpc.From,rpc.StreamID,rpc.Peer);err!=nil{
+					s.Logger.With("peer",rpc.From).Errorf("handle stream error: %s",err)
+				}
+				continue
+			}
 			var msg Message
-			if err:= gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg);err!=nil{
-				log.Println("decoding error:",err)
+			if err:= decodeMessage(s.Codec,rpc.Payload,&msg);err!=nil{
+				s.Logger.With("peer",rpc.From).Errorf("decoding error: %s",err)
+				continue
 			}
 
 			if err:= s.handleMessage(rpc.From,&msg);err!=nil{
-				log.Println("handle message error:",err)
+				s.Logger.With("peer",rpc.From).Errorf("handle message error: %s",err)
 			}
 		case <-s.quitCh: 
 			return
@@ -193,83 +1678,410 @@ func(s *FileServer) handleMessage(from string,msg *Message)error{
 		return s.handleMessageStoreFile(from,v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from,v)
+	case MessageGetRange:
+		return s.handleMessageGetRange(from,v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from,v)
+	case MessageAck:
+		return s.handleMessageAck(from,v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from,v)
+	case MessageFileList:
+		return s.handleMessageFileList(from,v)
+	case MessageHasFile:
+		return s.handleMessageHasFile(from,v)
+	case MessageHasFileReply:
+		return s.handleMessageHasFileReply(from,v)
+	case MessagePeerList:
+		return s.handleMessagePeerList(from,v)
+	case MessageStorageWeight:
+		return s.handleMessageStorageWeight(from,v)
+	case MessageStatus:
+		return s.handleMessageStatus(from,v)
+	case MessageStatusReply:
+		return s.handleMessageStatusReply(from,v)
+	case MessageFileHash:
+		return s.handleMessageFileHash(from,v)
+	case MessageFileHashReply:
+		return s.handleMessageFileHashReply(from,v)
+	case MessageFileMeta:
+		return s.handleMessageFileMeta(from,v)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageAck(from string,msg MessageAck) error{
+	kind,key:= kindStore,msg.Key
+	switch{
+	case msg.Probe:
+		kind = kindProbe
+	case msg.RequestID!="":
+		kind,key = kindRange,msg.RequestID
+		if msg.Ready{
+			s.servedStreams[streamKey(from,msg.StreamID)] = transferID(key,kind)
+		}
+	case msg.Get:
+		kind = kindGet
+		if msg.Ready{
+			s.servedStreams[streamKey(from,msg.StreamID)] = transferID(key,kind)
+		}
+	}
+	t,ok:= s.getTransfer(key,kind)
+	if !ok{
+		//The Store or Get already timed out or got what it needed. A stream
+		//that still follows is discarded by handleStream.
+		return nil
+	}
+	select{
+	case t.acks <- peerAck{From: from,MessageAck: msg}:
+	default:
 	}
 	return nil
 }
 
+//holdsCopy tells whether we already hold the copy a MessageStoreFile
+//announces: the key names the content and our copy has the same size and
+//is encrypted with the same key.
+func (s *FileServer) holdsCopy(msg MessageStoreFile) bool{
+	if !msg.Content || !s.store.Has(msg.ID,msg.Key) || s.store.Expired(msg.ID,msg.Key){
+		return false
+	}
+	size,r,err:= s.store.readStream(msg.ID,msg.Key)
+	if err!=nil{
+		return false
+	}
+	defer r.Close()
+	header:= make([]byte,cipherHeaderSize)
+	if size!=msg.Size || size<cipherHeaderSize{
+		return false
+	}
+	if _,err:= io.ReadFull(r,header);err!=nil{
+		return false
+	}
+	return bytes.Equal(header[:3],cipherMagic) && header[3]==cipherVersionKeyID && bytes.Equal(header[4:4+keyIDSize],msg.KeyFingerprint)
+}
+
+//servesCopy tells whether we hold a copy of a peer's file to serve. Those
+//are encrypted by the peer and sent as they are. The files under our own
+//ID are our plain files, a peer asking for one of them (its key is only
+//ever asked for hashed) is never served.
+func (s *FileServer) servesCopy(id string,key string) bool{
+	return !s.ReadOnly && id!=s.ID && s.store.Has(id,key) && !s.store.Expired(id,key)
+}
+
 func (s *FileServer) handleMessageGetFile(from string,msg MessageGetFile) error{
-	if !s.store.Has(msg.ID,msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exists on disk",s.Transport.Addr(),msg.Key)
+	peer,ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+
+	decline:= func() error{
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false,Get: true,Probe: msg.Probe}})
+	}
+	if !s.servesCopy(msg.ID,msg.Key){
+		//A chunk may be in the part of a copy that reached us.
+		if msg.Length>0 && !msg.Probe && !s.ReadOnly{
+			if p,ok:= s.partialOf(msg.ID,msg.Key);ok && p.holds(msg.Offset,msg.Length){
+				return s.servePartial(peer,from,msg,decline)
+			}
+		}
+		s.Logger.With("key",msg.Key).Infof("need to serve file but it does not exists on disk")
+		return decline()
 	}
-	fmt.Printf("[%s] serving file (%s) over the network\n",s.Transport.Addr(),msg.Key)
+	if !s.beginTransfer(){
+		return decline()
+	}
+	s.serveInBackground(from,msg.Key,func() error{
+		return s.serveCopy(peer,from,msg,decline)
+	})
+	return nil
+}
+
+//serveInBackground runs serve, a transfer begun with beginTransfer, in
+//its own goroutine like handleStream receives a file, so the loop goes on
+//with the messages of the other transfers while it is read, hashed and
+//streamed. Its error is logged.
+func (s *FileServer) serveInBackground(from string,key string,serve func() error){
+	go func(){
+		defer s.endTransfer()
+		if err:= serve();err!=nil{
+			s.Logger.With("key",key,"peer",from).Errorf("serving file error: %s",err)
+		}
+	}()
+}
+
+//serveCopy answers msg with our copy of the file, see
+//handleMessageGetFile.
+func (s *FileServer) serveCopy(peer p2p.Peer,from string,msg MessageGetFile,decline func() error) error{
 	fileSize,r,err:= s.store.Read(msg.ID,msg.Key)
 	if err !=nil{
+		decline()
 		return err
 	}
 
 	if rc,ok:= r.(io.ReadCloser);ok{
-		fmt.Printf("closing readCloser")
 		defer rc.Close()
 	}
+	if msg.Probe{
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: true,Get: true,Probe: true,Size: fileSize}})
+	}
 
-	peer,ok := s.peers[from]
-	if !ok{
-		return fmt.Errorf("peer %s not in map",from)
+	//A chunk of a parallel fetch, see fetchChunks.
+	if msg.Length>0{
+		if msg.Offset<0 || msg.Offset>=fileSize{
+			return decline()
+		}
+		if sk,ok:= r.(io.Seeker);ok{
+			_,err = sk.Seek(msg.Offset,io.SeekStart)
+		}else{
+			_,err = io.CopyN(io.Discard,r,msg.Offset)
+		}
+		if err!=nil{
+			decline()
+			return err
+		}
+		fileSize = min(msg.Length,fileSize-msg.Offset)
+		r = io.LimitReader(r,fileSize)
+		if msg.Sum{
+			sum,err:= s.chunkSum(msg.ID,msg.Key,msg.Offset,fileSize)
+			if err!=nil{
+				decline()
+				return err
+			}
+			r,fileSize = io.MultiReader(bytes.NewReader(sum),r),fileSize+sha256.Size
+		}
 	}
+	s.Logger.With("key",msg.Key,"peer",from).Infof("serving file over the network")
+	return s.serveFile(peer,from,msg,r,fileSize)
+}
 
-	//First send the "incommingStream" byte to the peer and then 
-	//we can send the file size as an int64
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer,binary.LittleEndian,fileSize)
-	n,err := io.Copy(peer,r)
+//serveFile acks msg and streams the fileSize bytes of r to peer.
+func (s *FileServer) serveFile(peer p2p.Peer,from string,msg MessageGetFile,r io.Reader,fileSize int64) error{
+	id:= s.nextStreamID()
+	if err:= s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: true,Get: true,StreamID: id}});err!=nil{
+		return err
+	}
+
+	//First open the stream and send the file size as an int64, then the
+	//file itself.
+	w,err:= s.beginStream(peer,id,fileSize)
+	if err!=nil{
+		return err
+	}
+	n,err := s.copyBuffer(w,throttle(r,s.uploads,s.quitCh))
+	if err==nil{
+		err = w.Close()
+	}
 	if err !=nil{
+		s.dropPeer(peer,err)
 		return err
 	}
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n",s.Transport.Addr(),n,from)
+	s.Metrics.addBytesServed(n)
+	s.emit(Event{Type: EventFileServed,Peer: from,Key: msg.Key,Size: n})
+	s.audit(AuditEntry{Op: AuditGet,ID: msg.ID,Key: msg.Key,Size: n,Peer: from})
+	s.Logger.With("key",msg.Key,"peer",from).Infof("written (%d) bytes over the network",n)
+
+	return nil
+}
 
+//checkFileSize fails the size of a copy a peer announced when it is
+//negative or the file is larger than MaxFileSize.
+func (s *FileServer) checkFileSize(size int64) error{
+	if size<0{
+		return fmt.Errorf("peer announced a copy of %d bytes",size)
+	}
+	if s.MaxFileSize>0 && size>encryptedSize(s.MaxFileSize){
+		return fmt.Errorf("peer announced a %d byte copy, the most MaxFileSize (%d) allows is %d",size,s.MaxFileSize,encryptedSize(s.MaxFileSize))
+	}
 	return nil
 }
 
+//handleMessageStoreFile remembers the announced file, the bytes
+//themselves are read once the peer's stream arrives in handleStream.
 func (s *FileServer) handleMessageStoreFile(from string,msg MessageStoreFile) error{
-	peer,ok:= s.peers[from]
+	peer,ok:= s.peer(from)
 	if !ok{
-		return fmt.Errorf("peer (%s) could not be found in peerlist",from)
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+	if err:= s.checkFileSize(msg.Size);err!=nil{
+		s.dropPeer(peer,err)
+		return err
+	}
+	if err:= s.ownedBy(msg.ID,from);err!=nil{
+		s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false}})
+		return err
+	}
+	if !s.reads(msg.Compression){
+		s.Logger.With("key",msg.Key,"peer",from).Errorf("declining a file stored with %s, it isn't in Compressions",msg.Compression)
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false}})
+	}
+	//A stopping (or draining) server doesn't take on new files, the
+	//transfer ends once the stream is written in handleStream.
+	if s.ReadOnly || s.isDraining() || !s.beginTransfer(){
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false}})
+	}
+	if s.holdsCopy(msg){
+		defer s.endTransfer()
+		//The new Store's expiry and metadata apply to the copy we keep.
+		if err:= s.setExpiryMeta(msg);err!=nil{
+			s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Ready: false}})
+			return err
+		}
+		s.Logger.With("key",msg.Key,"peer",from).Infof("already holding the file, skipping the stream")
+		return s.send(peer,&Message{Payload: MessageAck{Key: msg.Key,Have: true}})
+	}
+	sk:= streamKey(from,msg.StreamID)
+	if _,ok:= s.pendingStreams[sk];ok{
+		//The previous announcement never got its stream.
+		s.endTransfer()
+	}
+	s.pendingStreams[sk] = msg
+	ack:= MessageAck{Key: msg.Key,Ready: true}
+	if msg.ChunkSize>0{
+		chunks,err:= s.spooledChunks(msg)
+		if err!=nil{
+			s.Logger.With("key",msg.Key,"peer",from).Errorf("reading partial file error: %s",err)
+		}
+		ack.Chunks = chunks
+	}
+	return s.send(peer,&Message{Payload: ack})
+}
+
+//handleStream is called when a peer opened the stream id, stream reads
+//it. The stream is either a file announced by MessageStoreFile or a file
+//served in response to our own MessageGetFile. A file to store is
+//received in its own goroutine, the peer may interleave other streams
+//with it.
+func (s *FileServer) handleStream(from string,id uint32,stream p2p.Peer) error{
+	if _,ok:= s.peer(from);!ok{
+		stream.CloseStream()
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+
+	sk:= streamKey(from,id)
+	msg,ok:= s.pendingStreams[sk]
+	if !ok{
+		tid:= s.servedStreams[sk]
+		delete(s.servedStreams,sk)
+		if s.offerStream(tid,stream){
+			return nil
+		}
+		//Nobody is waiting (anymore), another peer served the file first.
+		stream.CloseStream()
+		return nil
+	}
+	delete(s.pendingStreams,sk)
+	go func(){
+		if err:= s.storeStream(from,stream,msg);err!=nil{
+			s.Logger.With("peer",from).Errorf("handle stream error: %s",err)
+		}
+	}()
+	return nil
+}
+
+//storeStream writes the file a peer streams for msg.
+func (s *FileServer) storeStream(from string,peer p2p.Peer,msg MessageStoreFile) error{
+	defer s.endTransfer()
+	defer peer.CloseStream()
+
+	var(
+		n 	int64
+		err error
+	)
+	if msg.ChunkSize>0{
+		n,err = s.receiveSpooled(peer,msg)
+	}else{
+		n,err = s.store.writeStream(msg.ID,msg.Key,bufferedReader{s,&exactReader{r: peer,n: msg.Size}})
 	}
-	n,err:= s.store.Write(msg.ID,msg.Key,io.LimitReader(peer,msg.Size))
 	if err!=nil{
 		return err
 	}
-	fmt.Printf("[%s] written %d bytes to disk\n",s.Transport.Addr(),n)
-	peer.CloseStream()
-	// peer.(*p2p.TCPpeer).Wg.Done()
+	if err:= s.setExpiryMeta(msg);err!=nil{
+		return err
+	}
+	s.Metrics.addBytesStored(n)
+	s.emit(Event{Type: EventFileStored,Peer: from,Key: msg.Key,Size: n})
+	s.fileStored(msg.Key,n,true)
+	s.audit(AuditEntry{Op: AuditStore,ID: msg.ID,Key: msg.Key,Size: n,Peer: from})
+	s.Logger.With("key",msg.Key,"peer",from).Infof("written %d bytes to disk",n)
 	return nil
-} 	
-
-func (s *FileServer) bootstrapNetwork() error{
-	for _,addr := range s.BootstrapNodes{
-		if len(addr)==0{continue}
-		go func(addr string){
-			fmt.Printf("[%s] attempting to connect with remote: %s\n",s.Transport.Addr(),addr)
-			if err:= s.Transport.Dial(addr);err!=nil{
-				log.Println("dial error:",err)
-			}
-		}(addr)
+}
+
+//setExpiryMeta records the expiry and metadata msg announced with our
+//copy of its file.
+func (s *FileServer) setExpiryMeta(msg MessageStoreFile) error{
+	if err:= checkMeta(msg.Meta);err!=nil{
+		return err
+	}
+	if err:= s.store.SetExpiry(msg.ID,msg.Key,msg.Expires);err!=nil{
+		return err
 	}
+	return s.store.SetMeta(msg.ID,msg.Key,msg.Meta)
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string,msg MessageDeleteFile) error{
+	if err:= s.ownedBy(msg.ID,from);err!=nil{
+		return err
+	}
+	//A peer may never have received the file, that is not an error.
+	if !s.store.Has(msg.ID,msg.Key){
+		s.Logger.With("key",msg.Key,"peer",from).Infof("asked to delete file but it does not exist on disk")
+		return nil
+	}
+	if err:= s.store.Delete(msg.ID,msg.Key);err!=nil{
+		return err
+	}
+	s.Logger.With("key",msg.Key,"peer",from).Infof("deleted file on request of peer")
+	s.audit(AuditEntry{Op: AuditDelete,ID: msg.ID,Key: msg.Key,Peer: from})
 	return nil
 }
 
 func (s *FileServer) Start() error{
-	fmt.Printf("[%s] starting fileserver...\n",s.Transport.Addr())
+	s.Logger.Infof("starting fileserver...")
+	if s.optsErr!=nil{
+		return s.optsErr
+	}
+	if s.keyErr!=nil{
+		return s.keyErr
+	}
 	if err:= s.Transport.ListenAndAccept();err!=nil{
 		return err
 	}
 
-	s.bootstrapNetwork()
+	if err:= s.bootstrapNetwork();err!=nil{
+		s.Stop()
+		s.Transport.Close()
+		return err
+	}
+	go s.sweepLoop()
+	if s.GossipInterval>0{
+		go s.gossipLoop()
+	}
+	if s.ReplicateInterval>0{
+		go s.replicateLoop()
+	}
+	if s.DiscoverLAN{
+		go s.discoverLAN()
+	}
 	s.loop()
 	return  nil
 }
 
 func init(){
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
+	registerMessage(MessageStoreFile{})
+	registerMessage(MessageGetFile{})
+	registerMessage(MessageDeleteFile{})
+	registerMessage(MessageAck{})
+	registerMessage(MessageListFiles{})
+	registerMessage(MessageFileList{})
+	registerMessage(MessageHasFile{})
+	registerMessage(MessageHasFileReply{})
+	registerMessage(MessagePeerList{})
+	registerMessage(MessageStorageWeight{})
+	registerMessage(MessageGetRange{})
+	registerMessage(MessageStatus{})
+	registerMessage(MessageStatusReply{})
+	registerMessage(MessageFileHash{})
+	registerMessage(MessageFileHashReply{})
+	registerMessage(MessageFileMeta{})
 }
\ No newline at end of file
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//mockTransport hands the RPCs written to rpcs to the FileServer.
+type mockTransport struct{
+	rpcs chan p2p.RPC
+}
+
+func newMockTransport() *mockTransport{
+	return &mockTransport{rpcs: make(chan p2p.RPC)}
+}
+
+func (t *mockTransport) Addr() string{
+	return "mock"
+}
+
+func (t *mockTransport) ListenAndAccept() error{
+	return nil
+}
+
+func (t *mockTransport) Consume() <-chan p2p.RPC{
+	return t.rpcs
+}
+
+func (t *mockTransport) Close() error{
+	return nil
+}
+
+func (t *mockTransport) Dial(string) error{
+	return nil
+}
+
+//testPeer is a p2p.Peer over one end of a net.Pipe.
+type testPeer struct{
+	net.Conn
+}
+
+func (p testPeer) Send(b []byte) error{
+	n,err:= p.Write(b)
+	if err==nil && n<len(b){
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+func (p testPeer) CloseStream(){}
+
+func (p testPeer) Outbound() bool{
+	return false
+}
+
+func TestGetCoalesced(t *testing.T){
+	s:= newTestFileServer()
+	data:= "fetched once"
+
+	//A fetch of the key is in flight, a Get has to wait for it rather than
+	//fetch again.
+	f,first:= s.startFetch("shared")
+	if !first{
+		t.Fatal("want the first fetch of the key")
+	}
+	type result struct{
+		r 			io.Reader
+		info 		FileInfo
+		err 		error
+	}
+	res:= make(chan result,1)
+	go func(){
+		r,info,err:= s.GetInfoContext(context.Background(),"shared")
+		res <- result{r,info,err}
+	}()
+
+	select{
+	case r:= <-res:
+		t.Fatalf("want Get to wait for the fetch, returned %v",r.err)
+	case <-time.After(50*time.Millisecond):
+	}
+	cr:= compressReader(s.Compression,0,strings.NewReader(data))
+	_,err:= s.store.Write(s.ID,"shared",cr)
+	cr.Close()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	s.endFetch("shared",f,nil)
+
+	r:= <-res
+	if r.err!=nil{
+		t.Fatal(r.err)
+	}
+	b,err:= io.ReadAll(r.r)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if string(b)!=data || !r.info.FromNetwork{
+		t.Errorf("want %q from the network, have %q (%+v)",data,b,r.info)
+	}
+}
+
+func TestEvents(t *testing.T){
+	s:= newTestFileServer()
+	events:= s.Events()
+
+	if err:= s.Store("watched",strings.NewReader("some bytes"));err!=nil{
+		t.Fatal(err)
+	}
+	conn,other:= net.Pipe()
+	defer other.Close()
+	peer:= testPeer{conn}
+	if err:= s.OnPeer(peer);err!=nil{
+		t.Fatal(err)
+	}
+	s.OnPeerDisconnect(peer)
+	s.Stop()
+
+	want:= []Event{
+		{Type: EventFileStored,Key: "watched"},
+		{Type: EventPeerConnected,Peer: "pipe"},
+		{Type: EventPeerDisconnected,Peer: "pipe"},
+	}
+	var have []Event
+	for e:= range events{
+		if e.Time.IsZero(){
+			t.Errorf("%s: want the time of the event",e.Type)
+		}
+		e.Time,e.Size = time.Time{},0
+		have = append(have,e)
+	}
+	if len(have)!=len(want){
+		t.Fatalf("want %v, have %v",want,have)
+	}
+	for i:= range want{
+		if have[i]!=want[i]{
+			t.Errorf("event %d: want %+v, have %+v",i,want[i],have[i])
+		}
+	}
+}
+
+func TestLoopSkipsUndecodableMessages(t *testing.T){
+	tr:= newMockTransport()
+	s:= NewFileServer(FileServerOpts{
+		EncKey: 						newEncryptionKey(),
+		PathTransformFunc: 	CASpathTransformFunc,
+		Backend: 						NewMemoryBackend(),
+		Transport: 					tr,
+		GossipInterval: 		-1,
+	})
+	conn,other:= net.Pipe()
+	defer other.Close()
+	if err:= s.OnPeer(testPeer{conn});err!=nil{
+		t.Fatal(err)
+	}
+	go s.loop()
+	defer s.Stop()
+
+	encode:= func(payload any) []byte{
+		b,err:= encodeMessage(GobCodec{},&Message{Payload: payload})
+		if err!=nil{
+			t.Fatal(err)
+		}
+		return b
+	}
+	getFile:= encode(MessageGetFile{ID: s.ID,Key: "wanted"})
+	garbage:= [][]byte{
+		nil,
+		[]byte("not a gob at all"),
+		append([]byte{codecGob},"not a gob either"...),
+		getFile[:len(getFile)-3],
+		encode(MessageDeleteFile{ID: s.ID,Key: "kept"})[:10],
+	}
+	for _,b:= range garbage{
+		tr.rpcs <- p2p.RPC{From: "pipe",Payload: b}
+	}
+	tr.rpcs <- p2p.RPC{From: "pipe",Payload: encode(MessageHasFile{RequestID: "after",ID: s.ID,Key: "wanted"})}
+
+	//Nothing answered the garbage, the first reply is the one to HasFile.
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	var rpc p2p.RPC
+	if err:= (p2p.Defaultdecoder{}).Decode(other,&rpc);err!=nil{
+		t.Fatal(err)
+	}
+	var msg Message
+	if err:= decodeMessage(GobCodec{},rpc.Payload,&msg);err!=nil{
+		t.Fatal(err)
+	}
+	if reply,ok:= msg.Payload.(MessageHasFileReply);!ok || reply.RequestID!="after"{
+		t.Errorf("want the reply to HasFile first, have %#v",msg.Payload)
+	}
+}
+
+func TestDialAddr(t *testing.T){
+	for _,c:= range []struct{listen,remote,want string}{
+		{":3000","10.0.0.2:51234","10.0.0.2:3000"},
+		{"0.0.0.0:3000","10.0.0.2:51234","10.0.0.2:3000"},
+		{"10.0.0.3:3000","10.0.0.2:51234","10.0.0.3:3000"},
+		{"[::]:3000","[fe80::1]:51234","[fe80::1]:3000"},
+	}{
+		if have:= dialAddr(c.listen,c.remote);have!=c.want{
+			t.Errorf("%s from %s: want %s, have %s",c.listen,c.remote,c.want,have)
+		}
+	}
+}
+
+func TestStreamWriterDropsStuckPeer(t *testing.T){
+	s:= newTestFileServer()
+	s.SendTimeout = 100*time.Millisecond
+	fast,fastOther:= net.Pipe()
+	stuck,stuckOther:= net.Pipe()
+	defer fastOther.Close()
+	defer stuckOther.Close()
+
+	received:= make(chan []byte)
+	go func(){
+		b,_:= io.ReadAll(fastOther)
+		received <- b
+	}()
+	w:= s.newStreamWriter("key",1,[]p2p.Peer{testPeer{fast},testPeer{stuck}})
+	start:= time.Now()
+	for i:=0;i<2*streamBuffer;i++{
+		if _,err:= w.Write([]byte("data"));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	if d:= time.Since(start);d>time.Second{
+		t.Errorf("want the stuck peer dropped after its timeout, took %s",d)
+	}
+	if peers:= w.received();len(peers)!=1 || peers[0].(testPeer).Conn!=fast{
+		t.Errorf("want only the fast peer to receive the stream, have %v",peers)
+	}
+	var replErr *ReplicationError
+	if err:= w.err();!errors.As(err,&replErr) || len(replErr.Failed)!=1 || len(replErr.Peers)!=1{
+		t.Errorf("want a ReplicationError with one failed peer, have %v",err)
+	}
+
+	fast.Close()
+	//The frame opening the stream, one frame per write and the end frame.
+	if b:= <-received;len(b)!=5+2*streamBuffer*(9+4)+9{
+		t.Errorf("want the whole stream, have %d bytes",len(b))
+	}
+}
+
+//shortConn accepts only half of every write without an error.
+type shortConn struct{
+	net.Conn
+}
+
+func (c shortConn) Write(b []byte) (int,error){
+	return c.Conn.Write(b[:(len(b)+1)/2])
+}
+
+func TestStreamWriterDropsShortWriter(t *testing.T){
+	s:= newTestFileServer()
+	good,goodOther:= net.Pipe()
+	short,shortOther:= net.Pipe()
+	defer goodOther.Close()
+	defer shortOther.Close()
+	go io.Copy(io.Discard,shortOther)
+
+	received:= make(chan []byte)
+	go func(){
+		b,_:= io.ReadAll(goodOther)
+		received <- b
+	}()
+	w:= s.newStreamWriter("key",7,[]p2p.Peer{testPeer{good},testPeer{shortConn{short}}})
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:],4)
+	for _,b:= range [][]byte{size[:],[]byte("data")}{
+		if _,err:= w.Write(b);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	var replErr *ReplicationError
+	if err:= w.err();!errors.As(err,&replErr) || len(replErr.Failed)!=1{
+		t.Fatalf("want the short writer failed, have %v",err)
+	}
+	for _,err:= range replErr.Failed{
+		if !errors.Is(err,io.ErrShortWrite){
+			t.Errorf("want %v, have %v",io.ErrShortWrite,err)
+		}
+	}
+
+	//The other peer's stream is framed as it was sent.
+	good.Close()
+	var rpcs []p2p.RPC
+	r:= bytes.NewReader(<-received)
+	for r.Len()>0{
+		var rpc p2p.RPC
+		if err:= (p2p.Defaultdecoder{}).Decode(r,&rpc);err!=nil{
+			t.Fatal(err)
+		}
+		rpcs = append(rpcs,rpc)
+	}
+	if len(rpcs)!=4 || !rpcs[0].Stream || rpcs[0].StreamID!=7{
+		t.Fatalf("want the stream 7 opened, two frames and the end, have %+v",rpcs)
+	}
+	for i,want:= range []string{string(size[:]),"data",""}{
+		if rpc:= rpcs[i+1];rpc.Control!=p2p.StreamData || rpc.StreamID!=7 || string(rpc.Payload)!=want{
+			t.Errorf("frame %d: want %q on stream 7, have %+v",i,want,rpc)
+		}
+	}
+}
+
+func TestBeginStreamShortWrite(t *testing.T){
+	s:= newTestFileServer()
+	conn,other:= net.Pipe()
+	defer other.Close()
+	go io.Copy(io.Discard,other)
+	if err:= p2p.NewTCPpeer(shortConn{conn},false).Send([]byte("frame"));!errors.Is(err,io.ErrShortWrite){
+		t.Errorf("send: want %v, have %v",io.ErrShortWrite,err)
+	}
+	//The frame opening the stream is cut short.
+	if _,err:= s.beginStream(testPeer{shortConn{conn}},1,8);!errors.Is(err,io.ErrShortWrite){
+		t.Errorf("begin stream: want %v, have %v",io.ErrShortWrite,err)
+	}
+}
+
+//flakyPeer fails its first sends with fail.
+type flakyPeer struct{
+	testPeer
+	fails int
+	fail 	error
+	sends *int
+}
+
+func (p flakyPeer) Send(b []byte) error{
+	*p.sends++
+	if *p.sends<=p.fails{
+		return p.fail
+	}
+	return p.testPeer.Send(b)
+}
+
+func TestMulticastRetriesTransientFailures(t *testing.T){
+	s:= newTestFileServer()
+	s.SendRetryDelay = time.Millisecond
+	conn,other:= net.Pipe()
+	defer other.Close()
+	go io.Copy(io.Discard,other)
+
+	for _,test:= range []struct{
+		fails 		int
+		fail 			error
+		reached 	bool
+		sends 		int
+	}{
+		{2,syscall.ENOBUFS,true,3},
+		{s.SendRetries+1,syscall.ENOBUFS,false,s.SendRetries+1},
+		//A closed connection is not sent to again.
+		{1,net.ErrClosed,false,1},
+	}{
+		var sends int
+		peer:= flakyPeer{testPeer{conn},test.fails,test.fail,&sends}
+		reached,err:= s.multicast(context.Background(),&Message{Payload: MessageStoreFile{Key: "key"}},[]p2p.Peer{peer})
+		if test.reached && (err!=nil || len(reached)!=1){
+			t.Errorf("%d x %v: want the peer reached, have %v",test.fails,test.fail,err)
+		}
+		if !test.reached && !errors.Is(err,test.fail){
+			t.Errorf("%d x %v: want %v, have %v",test.fails,test.fail,test.fail,err)
+		}
+		if sends!=test.sends{
+			t.Errorf("%d x %v: want %d sends, have %d",test.fails,test.fail,test.sends,sends)
+		}
+	}
+}
+
+func TestFetchChunkResendsCorruptChunk(t *testing.T){
+	s:= newTestFileServer()
+	conn,other:= net.Pipe()
+	defer other.Close()
+	go io.Copy(io.Discard,other)
+
+	data:= []byte("the bytes of one chunk")
+	sum:= sha256.Sum256(data)
+	c:= fileChunk{offset: 0,length: int64(len(data))}
+	//stream serves the chunk, with a flipped byte when corrupt.
+	stream:= func(corrupt bool) p2p.Peer{
+		local,remote:= net.Pipe()
+		t.Cleanup(func(){ remote.Close() })
+		payload:= append([]byte(nil),data...)
+		if corrupt{
+			payload[3]^=1
+		}
+		go func(){
+			binary.Write(remote,binary.LittleEndian,int64(len(data)+sha256.Size))
+			remote.Write(sum[:])
+			remote.Write(payload)
+		}()
+		return testPeer{local}
+	}
+	fetch:= func(streams ...p2p.Peer) ([]byte,[]byte,error){
+		route:= chunkPeer{streams: make(chan p2p.Peer,len(streams)),declined: make(chan struct{},1)}
+		for _,st:= range streams{
+			route.streams <- st
+		}
+		f,err:= os.CreateTemp(t.TempDir(),"chunk")
+		if err!=nil{
+			t.Fatal(err)
+		}
+		defer f.Close()
+		have,err:= s.fetchChunk(context.Background(),"key",testPeer{conn},route,f,c)
+		written,_:= os.ReadFile(f.Name())
+		return have,written,err
+	}
+
+	have,written,err:= fetch(stream(true),stream(false))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have,sum[:]) || !bytes.Equal(written,data){
+		t.Errorf("want the chunk sent again written, have %q",written)
+	}
+	if _,_,err:= fetch(stream(true),stream(true),stream(true));!errors.Is(err,errChunkCorrupt){
+		t.Errorf("want %v once the resends are used up, have %v",errChunkCorrupt,err)
+	}
+}
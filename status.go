@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//Version is reported by Status, release builds set it with
+//-ldflags "-X main.Version=...".
+var Version = "dev"
+
+//StatusReport is a node's answer to Status. Files and Bytes count all
+//the files it stores, the copies it holds for its peers included.
+type StatusReport struct{
+	Addr 		string
+	Version string
+	Uptime 	time.Duration
+	Files 	int
+	Bytes 	int64
+	Peers 	int
+	//StorageWeight is that of FileServerOpts.
+	StorageWeight int
+}
+
+//MessageStatus asks a peer for its StatusReport.
+type MessageStatus struct{
+	RequestID string
+}
+
+//MessageStatusReply is the reply to MessageStatus.
+type MessageStatusReply struct{
+	RequestID string
+	Status 		StatusReport
+}
+
+//Status returns the StatusReport of this node, its uptime is counted from
+//NewFileServer.
+func (s *FileServer) Status() StatusReport{
+	bytes,files:= s.store.Usage()
+	return StatusReport{
+		Addr: s.Transport.Addr(),
+		Version: Version,
+		Uptime: time.Since(s.created),
+		Files: files,
+		Bytes: bytes,
+		Peers: len(s.peerList()),
+		StorageWeight: s.StorageWeight,
+	}
+}
+
+//PeerStatus asks the connected peer with the remote address addr for its
+//StatusReport, see Peers. It fails if no reply arrives within AckTimeout.
+func (s *FileServer) PeerStatus(addr string) (StatusReport,error){
+	return s.PeerStatusContext(context.Background(),addr)
+}
+
+func (s *FileServer) PeerStatusContext(ctx context.Context,addr string) (StatusReport,error){
+	peer,ok:= s.peer(addr)
+	if !ok{
+		return StatusReport{},fmt.Errorf("%w: %s",ErrPeerNotFound,addr)
+	}
+	id,replies:= s.addRequest(1)
+	defer s.removeRequest(id)
+
+	if err:= s.send(peer,&Message{Payload: MessageStatus{RequestID: id}});err!=nil{
+		return StatusReport{},err
+	}
+	select{
+	case reply:= <-replies:
+		return reply.Payload.(MessageStatusReply).Status,nil
+	case <-time.After(s.AckTimeout):
+		return StatusReport{},fmt.Errorf("timed out waiting for the status of %s",addr)
+	case <-ctx.Done():
+		return StatusReport{},ctx.Err()
+	}
+}
+
+func (s *FileServer) handleMessageStatus(from string,msg MessageStatus) error{
+	peer,ok:= s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+	return s.send(peer,&Message{Payload: MessageStatusReply{RequestID: msg.RequestID,Status: s.Status()}})
+}
+
+func (s *FileServer) handleMessageStatusReply(from string,msg MessageStatusReply) error{
+	s.deliverReply(msg.RequestID,from,msg)
+	return nil
+}
@@ -2,21 +2,48 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
-	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 const defaultRootFolderName = "kknetwork"
 
+//CASpathTransformFunc stores a key at the lowercase hex of its sha1. Keys
+//that differ only in case get different hashes, so their paths don't
+//collide on a case-insensitive filesystem (macOS, Windows) the way those
+//of DefaultPathTransformFunc and PrefixPathTransformFunc can.
 func CASpathTransformFunc(key string) PathKey{
-	hash := sha1.Sum([]byte(key))
-	hashStr := hex.EncodeToString(hash[:])
+	return casPathKey(sha1.New,key)
+}
+
+//CASpathTransformFuncWith is CASpathTransformFunc with another hash, like
+//sha256.New, sha512.New or the New of a BLAKE3 package. A Store records
+//which transform its files were written with, see checkTransform.
+func CASpathTransformFuncWith(newHash func() hash.Hash) PathTransformFunc{
+	return func(key string) PathKey{
+		return casPathKey(newHash,key)
+	}
+}
 
+func casPathKey(newHash func() hash.Hash,key string) PathKey{
+	h:= newHash()
+	h.Write([]byte(key))
+	return blockPathKey(hex.EncodeToString(h.Sum(nil)))
+}
+
+//blockPathKey splits hashStr into directories of 5 characters.
+func blockPathKey(hashStr string) PathKey{
 	blockSize := 5
 	sliceLen := len(hashStr) / blockSize
 	paths := make([]string,sliceLen)
@@ -32,6 +59,87 @@ func CASpathTransformFunc(key string) PathKey{
 	}
 }
 
+//ShardedPathTransformFunc lays the files of a transform hashing the keys,
+//like CASpathTransformFunc, out in depth directories of width characters
+//of the hash: "ab/cd/ef/abcdef..." for a depth of 3 and a width of 2, in
+//place of directories of 5 characters all the way down. Fewer and smaller
+//directories keep filesystem lookups fast with millions of files. Keys f
+//doesn't hash into directories (DefaultPathTransformFunc,
+//PrefixPathTransformFunc) keep their path.
+func ShardedPathTransformFunc(f PathTransformFunc,depth int,width int) PathTransformFunc{
+	return func(key string) PathKey{
+		p:= f(key)
+		if p.PathName!=blockPathKey(p.FileName).PathName{
+			return p
+		}
+		return shardPathKey(p.FileName,depth,width)
+	}
+}
+
+func shardPathKey(hashStr string,depth int,width int) PathKey{
+	paths:= make([]string,0,depth)
+	for i:=0;i<depth && (i+1)*width<=len(hashStr);i++{
+		paths = append(paths,hashStr[i*width:(i+1)*width])
+	}
+	return PathKey{
+		PathName: strings.Join(paths,"/"),
+		FileName: hashStr,
+	}
+}
+
+//PrefixPathTransformFunc keeps the directories of a slash separated key
+//readable, so its keys can be listed by prefix (see Store.ListPrefix),
+//and spreads the files of each directory over subdirectories named by
+//the start of the sha1 of the key: "user/123/photo.jpg" is stored at
+//"user/123/<5 hex>/photo.jpg".
+func PrefixPathTransformFunc(key string) PathKey{
+	dir,file:= path.Split(key)
+	return PathKey{
+		PathName: dir+casPathKey(sha1.New,key).FirstPathName(),
+		FileName: file,
+	}
+}
+
+//transformMarker is where a Store records the fingerprint of the
+//PathTransformFunc its files are written with. Another transform would
+//put the same keys at other paths, so a Store refuses to write into a
+//backend the marker of another transform is found in.
+const transformMarker = ".transform"
+
+//transformFingerprint identifies a PathTransformFunc by the path it
+//gives a fixed key, different hashes give different paths.
+func transformFingerprint(f PathTransformFunc) string{
+	sum:= sha256.Sum256([]byte(f("cas path transform probe").FullPath()))
+	return hex.EncodeToString(sum[:8])
+}
+
+//checkTransform records the fingerprint of our PathTransformFunc with the
+//first write and fails if the backend holds the one of another transform.
+func (s *Store) checkTransform() error{
+	s.transformOnce.Do(func(){
+		want:= transformFingerprint(s.PathTransformFunc)
+		_,r,err:= s.Backend.Read(transformMarker)
+		if errors.Is(err,fs.ErrNotExist){
+			_,s.transformErr = s.Backend.Write(transformMarker,strings.NewReader(want))
+			return
+		}
+		if err!=nil{
+			s.transformErr = err
+			return
+		}
+		defer r.Close()
+		b,err:= io.ReadAll(r)
+		if err!=nil{
+			s.transformErr = err
+			return
+		}
+		if have:= string(b);have!=want{
+			s.transformErr = fmt.Errorf("store holds files of another path transform (%s), this one is %s",have,want)
+		}
+	})
+	return s.transformErr
+}
+
 type PathTransformFunc func(string) PathKey
 
 type PathKey struct{
@@ -54,6 +162,33 @@ func (p PathKey) FullPath() string{
 type StoreOpts struct {
 	Root							string//Root is the folder name of the root,containing all the folders/files of the system.
 	PathTransformFunc PathTransformFunc
+	//Backend persists the files, it defaults to a DiskBackend at Root.
+	Backend						StorageBackend
+	//MaxBytes caps the bytes the Store keeps in the backend, sidecars
+	//included, 0 is unlimited. Eviction decides what happens to a write
+	//that doesn't fit.
+	MaxBytes 					int64
+	Eviction 					EvictionPolicy
+	//ShardDepth lays the files of a hashing PathTransformFunc out in
+	//ShardDepth directories of ShardWidth (default 2) characters of the
+	//hash, see ShardedPathTransformFunc. 0 keeps the layout of the
+	//transform. A Store refuses to open files written with another layout
+	//(see checkTransform), Migrate moves them. It takes the transform as
+	//is, ShardedPathTransformFunc gives it a sharding.
+	ShardDepth 				int
+	ShardWidth 				int
+	//AtRestKey encrypts the content of the files in the backend, nil
+	//keeps it as it is. The sidecars are not encrypted. Files written
+	//without the key (or with another one) can't be read with it, it is
+	//set on an empty Store.
+	AtRestKey 				[]byte
+	//SyncWrites makes the default DiskBackend fsync every file it writes
+	//and its directory before the write returns (see DiskBackend.Sync), so
+	//a stored file isn't lost to a crash right after. Each write then
+	//waits for the disk, a sync takes milliseconds on spinning disks and
+	//network volumes, so small files are stored many times slower (see
+	//BenchmarkStoreSyncWrites). A Backend passed in is left as it is.
+	SyncWrites 				bool
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -65,41 +200,188 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+	quota 	*quotaBackend
+	//atRest holds the AtRestKey, nil without one.
+	atRest 	*keyring
+	//refLock serializes the updates of the reference counts.
+	refLock sync.Mutex
+
+	transformOnce sync.Once
+	transformErr 	error
+
+	//handles are the readers of Read that weren't closed yet, Close
+	//closes them. No reads or writes start once closed is set.
+	handleLock 	sync.Mutex
+	handles 		map[*storeHandle]struct{}
+	closed 			bool
+}
+
+//ErrStoreClosed is returned by reads and writes of a closed Store.
+var ErrStoreClosed = errors.New("store is closed")
+
+//ErrDiskFull and ErrReadOnly are returned (along with the error of the
+//backend) by a write that failed because the disk is full or mounted read
+//only. The write leaves nothing behind.
+var(
+	ErrDiskFull = errors.New("disk is full")
+	ErrReadOnly = errors.New("storage is read only")
+)
+
+//diskError tells ErrDiskFull and ErrReadOnly apart from other errors of
+//a write.
+func diskError(err error) error{
+	switch{
+	case errors.Is(err,syscall.ENOSPC):
+		return fmt.Errorf("%w: %w",ErrDiskFull,err)
+	case errors.Is(err,syscall.EROFS):
+		return fmt.Errorf("%w: %w",ErrReadOnly,err)
+	}
+	return err
 }
 
 func NewStore(opts StoreOpts) *Store {
 	if opts.PathTransformFunc == nil{
 		opts.PathTransformFunc=DefaultPathTransformFunc
 	}
+	if opts.ShardDepth>0{
+		if opts.ShardWidth<=0{
+			opts.ShardWidth=2
+		}
+		opts.PathTransformFunc=ShardedPathTransformFunc(opts.PathTransformFunc,opts.ShardDepth,opts.ShardWidth)
+	}
 	
 	if len(opts.Root)==0{
 		opts.Root=defaultRootFolderName
 	}
 
+	if opts.Backend == nil{
+		opts.Backend=&DiskBackend{Root: opts.Root,Sync: opts.SyncWrites}
+	}
+	//The quota backend tracks the usage and access times even without a
+	//quota, see Usage and EvictLRU.
+	quota:= newQuotaBackend(opts.Backend,opts.MaxBytes,opts.Eviction)
+	opts.Backend=quota
+
+	var atRest *keyring
+	if opts.AtRestKey!=nil{
+		atRest = newKeyring(map[string][]byte{atRestKeyID: opts.AtRestKey},atRestKeyID)
+	}
+
 	return &Store{
 		StoreOpts: opts,
+		quota: 		 quota,
+		atRest: 	 atRest,
+		handles: 	 make(map[*storeHandle]struct{}),
 	}
 }
 
-func (s *Store) Has(id string,key string) bool{
+//backendPath is the path of the file for key under id in the backend.
+func (s *Store) backendPath(id string,key string) string{
 	pathKey:=s.PathTransformFunc(key)
-	fullPathWithRoot:= fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
-	_,err:= os.Stat(fullPathWithRoot)
-	return !errors.Is(err,os.ErrNotExist)
+	return fmt.Sprintf("%s/%s",id,pathKey.FullPath())
+}
+
+func (s *Store) Has(id string,key string) bool{
+	return s.Backend.Has(s.backendPath(id,key))
 }
 
 func (s *Store)Clear() error{
-	return os.RemoveAll(s.Root)
+	return s.Backend.Clear()
 }
 
+//Delete removes the file for key. A content addressed file that is still
+//referenced by another Store only loses a reference.
 func (s *Store) Delete(id string,key string) error{
 	pathKey := s.PathTransformFunc(key)
+	refs,err:= s.release(id,key)
+	if err!=nil{
+		return err
+	}
+	if refs>0{
+		log.Printf("released [%s], %d references left",pathKey.FileName,refs)
+		return nil
+	}
+	return s.purge(id,key)
+}
+
+//purge removes the file for key and its sidecars however many references
+//it has left.
+func (s *Store) purge(id string,key string) error{
+	pathKey := s.PathTransformFunc(key)
 
 	defer func(){
 		log.Printf("deleted [%s] from disk", pathKey.FileName)
 	}()
-	firstPathNameWithRoot:=fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FirstPathName())
-	return os.RemoveAll(firstPathNameWithRoot)
+	//Only the file's own paths are deleted: other keys can share the
+	//directories of its path, like those of PrefixPathTransformFunc.
+	p:= s.backendPath(id,key)
+	for _,del:= range append([]string{p},sidecarPaths(p)...){
+		if err:= s.Backend.Delete(del);err!=nil{
+			return err
+		}
+	}
+	return nil
+}
+
+//List returns the keys of all stored files, whichever id they are
+//stored under. Keys the PathTransformFunc can't be reversed for (like
+//the CAS hashes) are returned as their file name.
+func (s *Store) List() ([]string,error){
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return nil,err
+	}
+	seen:= make(map[string]bool)
+	keys:= []string{}
+	for _,p:= range paths{
+		if isSidecar(p){
+			continue
+		}
+		//The first element is the id the file is stored under.
+		parts:= strings.SplitN(p,"/",2)
+		if len(parts)!=2{
+			continue
+		}
+		key:= s.reverseKey(parts[1])
+		if !seen[key]{
+			seen[key] = true
+			keys = append(keys,key)
+		}
+	}
+	sort.Strings(keys)
+	return keys,nil
+}
+
+//ListPrefix returns the keys List returns that start with prefix. That
+//takes a PathTransformFunc the keys can be read back from, like
+//PrefixPathTransformFunc.
+func (s *Store) ListPrefix(prefix string) ([]string,error){
+	keys,err:= s.List()
+	if err!=nil{
+		return nil,err
+	}
+	matching:= []string{}
+	for _,key:= range keys{
+		if strings.HasPrefix(key,prefix){
+			matching = append(matching,key)
+		}
+	}
+	return matching,nil
+}
+
+//reverseKey finds the key that PathTransformFunc turned into fullPath.
+func (s *Store) reverseKey(fullPath string) string{
+	dir,file:= path.Split(fullPath)
+	dir = strings.TrimSuffix(dir,"/")
+	//PrefixPathTransformFunc puts a hashed directory between the
+	//directories of the key and its file name.
+	parent,_:= path.Split(dir)
+	for _,candidate:= range []string{dir,file,parent+file}{
+		if s.PathTransformFunc(candidate).FullPath()==fullPath{
+			return candidate
+		}
+	}
+	return file
 }
 
 func (s *Store) Read(id string,key string) (int64,io.Reader, error){
@@ -107,54 +389,166 @@ func (s *Store) Read(id string,key string) (int64,io.Reader, error){
 }
 
 func (s *Store) readStream(id string,key string)(int64,io.ReadCloser,error){
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
-	file,err:= os.Open(fullPathWithRoot)
+	n,rc,err:= s.readAtRest(s.backendPath(id,key))
 	if err!=nil{
 		return 0,nil,err
 	}
-	
-	fi,err:= file.Stat()
+	h,err:= s.track(rc)
 	if err!=nil{
 		return 0,nil,err
 	}
-	return fi.Size(),file,nil
+	return n,h,nil
 }
 
+//Write stores the file for key, a content addressed key gets another
+//reference (see Refs) each time it is written.
 func (s *Store) Write(id string,key string,r io.Reader) (int64,error){
-	return s.writeStream(id,key,r)
-}
-
-func (s *Store) WriteDecrypt(encKey []byte,id string,key string,r io.Reader)(int64,error){
-	f,err := s.openfileForWriting(id,key)
+	existed:= s.Has(id,key)
+	n,err:= s.writeStream(id,key,r)
 	if err!=nil{
-		return 0,err
+		return n,err
 	}
+	if err:= s.addRef(id,key,existed);err!=nil{
+		//A file without its reference count would be deleted by the first
+		//Delete of any of its references.
+		if !existed{
+			s.Backend.Delete(s.backendPath(id,key))
+		}
+		return n,diskError(err)
+	}
+	return n,nil
+}
 
-  n,err:= copyDecrypt(encKey,r,f)
+func (s *Store) WriteDecrypt(keys *keyring,id string,key string,r io.Reader)(int64,error){
+	return s.writeDecrypt(keys,id,key,r,nil)
+}
+
+//writeDecrypt is WriteDecrypt with the plain bytes passed through check on
+//their way to the backend, a read of check that fails fails the write.
+func (s *Store) writeDecrypt(keys *keyring,id string,key string,r io.Reader,check func(key string,r io.Reader) io.ReadCloser)(int64,error){
+	//The backend pulls the plain bytes while copyDecrypt pushes them.
+	pr,pw:= io.Pipe()
+	read:= make(chan int,1)
+	go func(){
+		n,err:= copyDecrypt(keys,r,pw)
+		read <- n
+		pw.CloseWithError(err)
+	}()
+
+	var plain io.ReadCloser = pr
+	if check!=nil{
+		plain = check(key,pr)
+	}
+	//The backend only commits the file once a segment that fails its tag
+	//check (or check) can no longer fail the write.
+	_,err:= s.writeStream(id,key,plain)
+	plain.Close()
+	pr.Close()
 	if err!=nil{
 		return 0,err
 	} 
-	return int64(n),err
+	//Like copyDecrypt we report the bytes read including the header.
+	return int64(<-read),nil
 }
 
-func (s *Store) openfileForWriting(id string,key string)(*os.File,error){
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot,os.ModePerm);err!=nil{
-		return nil,err
+//writeStream writes the file for key without adding a reference, for the
+//writes of a file that is stored already or never referenced by a Store
+//of ours: fetches, repairs and the copies of the peers.
+func (s *Store) writeStream(id string,key string, r io.Reader) (int64,error) {
+	if s.isClosed(){
+		return 0,ErrStoreClosed
+	}
+	if err:= s.checkTransform();err!=nil{
+		return 0,err
 	}
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id,pathKey.FullPath())
+	ar:= s.writeAtRest(r)
+	n,err:= s.Backend.Write(s.backendPath(id,key),ar)
+	ar.Close()
+	if err!=nil{
+		return n,diskError(err)
+	}
+	if s.atRest!=nil{
+		n = plainSize(n)
+	}
+	return n,nil
+}
 
-	return os.Create(fullPathWithRoot)
+//Close closes the readers of Read that are still open, so their files
+//can be deleted (Windows won't while they are open), and the Backend if
+//it is an io.Closer. The reference counts and sidecars are written as
+//they change, there is nothing left to flush. Closing twice is a no-op.
+func (s *Store) Close() error{
+	s.handleLock.Lock()
+	if s.closed{
+		s.handleLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	handles:= s.handles
+	s.handles = nil
+	s.handleLock.Unlock()
+
+	var errs []error
+	for h:= range handles{
+		if err:= h.close();err!=nil{
+			errs = append(errs,err)
+		}
+	}
+	if c,ok:= s.Backend.(io.Closer);ok{
+		if err:= c.Close();err!=nil{
+			errs = append(errs,err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (s *Store) writeStream(id string,key string, r io.Reader) (int64,error) {
+func (s *Store) isClosed() bool{
+	s.handleLock.Lock()
+	defer s.handleLock.Unlock()
+	return s.closed
+}
 
-	f,err:= s.openfileForWriting(id ,key)
-	if err!=nil{
-		return 0,err
+//storeHandle is a reader of Read, it is forgotten by the Store once it is
+//closed.
+type storeHandle struct{
+	io.ReadCloser
+	s 		*Store
+	once 	sync.Once
+	err 	error
+}
+
+//seekHandle is a storeHandle of a backend reader that can seek.
+type seekHandle struct{
+	*storeHandle
+	io.Seeker
+}
+
+func (s *Store) track(rc io.ReadCloser) (io.ReadCloser,error){
+	h:= &storeHandle{ReadCloser: rc,s: s}
+	s.handleLock.Lock()
+	if s.closed{
+		s.handleLock.Unlock()
+		rc.Close()
+		return nil,ErrStoreClosed
 	}
-	// defer f.Close()
-  return io.Copy(f,r)
-}
\ No newline at end of file
+	s.handles[h] = struct{}{}
+	s.handleLock.Unlock()
+	if sk,ok:= rc.(io.Seeker);ok{
+		return seekHandle{h,sk},nil
+	}
+	return h,nil
+}
+
+func (h *storeHandle) Close() error{
+	h.s.handleLock.Lock()
+	delete(h.s.handles,h)
+	h.s.handleLock.Unlock()
+	return h.close()
+}
+
+func (h *storeHandle) close() error{
+	h.once.Do(func(){
+		h.err = h.ReadCloser.Close()
+	})
+	return h.err
+}
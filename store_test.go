@@ -2,9 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T){
@@ -22,8 +36,259 @@ func TestPathTransformFunc(t *testing.T){
 	}
 }
 
+func TestCASpathTransformFuncWith(t *testing.T){
+	pathKey:= CASpathTransformFuncWith(sha256.New)("heyKushagrathisSide")
+	sum:= sha256.Sum256([]byte("heyKushagrathisSide"))
+	if want:= hex.EncodeToString(sum[:]);pathKey.FileName!=want{
+		t.Errorf("Have %s , want %s",pathKey.FileName,want)
+	}
+	if have:= CASpathTransformFuncWith(sha1.New)("heyKushagrathisSide");have!=CASpathTransformFunc("heyKushagrathisSide"){
+		t.Errorf("expected sha1 to match CASpathTransformFunc, have %+v",have)
+	}
+}
+
+func TestDeterministicPathTransformFunc(t *testing.T){
+	for key,want:= range map[string]string{
+		"picture.jpg": 			"picture.jpg/picture.jpg",
+		"user/1/pic.jpg": 	"user/1/pic.jpg/pic.jpg",
+		"../etc/passwd": 		"_/etc/passwd/passwd",
+		"a b?c": 						"a_b_c/a_b_c",
+		"dir/": 						"dir/_/_",
+	}{
+		if have:= DeterministicPathTransformFunc(key).FullPath();have!=want{
+			t.Errorf("%q: want %s, have %s",key,want,have)
+		}
+	}
+
+	//The layout and the bytes on disk are the same on every run.
+	root:= t.TempDir()
+	s:= NewStore(StoreOpts{Root: root,PathTransformFunc: DeterministicPathTransformFunc})
+	g:= NewSeeded(42)
+	key,data:= g.Key(),g.Bytes(1000)
+	if _,err:= s.Write("node",key,bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	b,err:= os.ReadFile(root+"/node/"+key+"/"+key)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b,data){
+		t.Errorf("want the %d bytes written on disk, have %d other bytes",len(data),len(b))
+	}
+	again:= NewSeeded(42)
+	if again.Key()!=key{
+		t.Error("want the same key for the same seed")
+	}
+	streamed,err:= io.ReadAll(again.Reader(1000))
+	if err!=nil || !bytes.Equal(streamed,data){
+		t.Errorf("want the Reader to stream the bytes of Bytes, have %d bytes %v",len(streamed),err)
+	}
+}
+
+func TestShardedPathTransformFunc(t *testing.T){
+	pathKey:= ShardedPathTransformFunc(CASpathTransformFunc,3,2)("heyKushagrathisSide")
+	if pathKey.PathName!="50/40/d0" || pathKey.FileName!="5040d03b8f3185a5e84e397d86a468dc448cb3a1"{
+		t.Errorf("want 50/40/d0, have %+v",pathKey)
+	}
+	//Keys that aren't hashed into directories keep their path.
+	if have:= ShardedPathTransformFunc(PrefixPathTransformFunc,3,2)("user/photo.jpg");have!=PrefixPathTransformFunc("user/photo.jpg"){
+		t.Errorf("want the prefix path kept, have %+v",have)
+	}
+
+	backend:= NewMemoryBackend()
+	id:= generateID()
+	s:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend,ShardDepth: 2})
+	if _,err:= s.Write(id,"heyKushagrathisSide",bytes.NewReader([]byte("data")));err!=nil{
+		t.Fatal(err)
+	}
+	if !backend.Has(id+"/50/40/5040d03b8f3185a5e84e397d86a468dc448cb3a1"){
+		t.Error("want the file at two directories of 2 characters")
+	}
+	//The layout is part of the transform.
+	unsharded:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend})
+	if _,err:= unsharded.Write(id,"other",bytes.NewReader([]byte("data")));err==nil{
+		t.Error("want an error writing with another layout into the store")
+	}
+}
+
+var shardBenchFiles = flag.Int("shardfiles",10000,"files BenchmarkStoreSharding stores before it measures, try 1000000")
+
+//BenchmarkStoreSharding measures writes and lookups on disk in a store
+//already holding -shardfiles files, for several layouts of the CAS paths.
+func BenchmarkStoreSharding(b *testing.B){
+	layouts:= []struct{
+		name 					string
+		depth,width 	int
+	}{
+		{"5x8 (default)",0,0},
+		{"1x2",1,2},
+		{"2x2",2,2},
+		{"3x2",3,2},
+		{"2x3",2,3},
+	}
+	for _,layout:= range layouts{
+		b.Run(layout.name,func(b *testing.B){
+			s:= NewStore(StoreOpts{
+				Root: 							b.TempDir(),
+				PathTransformFunc: 	CASpathTransformFunc,
+				ShardDepth: 				layout.depth,
+				ShardWidth: 				layout.width,
+			})
+			id:= generateID()
+			data:= []byte("data")
+			for i:=0;i<*shardBenchFiles;i++{
+				if _,err:= s.Write(id,strconv.Itoa(i),bytes.NewReader(data));err!=nil{
+					b.Fatal(err)
+				}
+			}
+
+			b.Run("write",func(b *testing.B){
+				for i:=0;i<b.N;i++{
+					if _,err:= s.Write(id,fmt.Sprintf("new-%d",i),bytes.NewReader(data));err!=nil{
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("lookup",func(b *testing.B){
+				for i:=0;i<b.N;i++{
+					if !s.Has(id,strconv.Itoa(i%*shardBenchFiles)){
+						b.Fatal("want the file stored")
+					}
+				}
+			})
+		})
+	}
+}
+
+//benchSizes are the payloads the throughput benchmarks run with.
+var benchSizes = []struct{
+	name string
+	size int
+}{
+	{"1KB",1<<10},
+	{"1MB",1<<20},
+	{"64MB",64<<20},
+}
+
+func BenchmarkStoreWrite(b *testing.B){
+	for _,bs:= range benchSizes{
+		b.Run(bs.name,func(b *testing.B){
+			s:= NewStore(StoreOpts{Root: b.TempDir(),PathTransformFunc: CASpathTransformFunc})
+			id:= generateID()
+			data:= randomBytes(b,bs.size)
+			b.SetBytes(int64(bs.size))
+			b.ResetTimer()
+			for i:=0;i<b.N;i++{
+				if _,err:= s.Write(id,"key",bytes.NewReader(data));err!=nil{
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//BenchmarkStoreSyncWrites compares writes on disk with and without
+//SyncWrites.
+func BenchmarkStoreSyncWrites(b *testing.B){
+	for _,sync:= range []bool{false,true}{
+		for _,bs:= range benchSizes[:2]{
+			b.Run(fmt.Sprintf("sync=%t/%s",sync,bs.name),func(b *testing.B){
+				s:= NewStore(StoreOpts{Root: b.TempDir(),PathTransformFunc: CASpathTransformFunc,SyncWrites: sync})
+				id:= generateID()
+				data:= randomBytes(b,bs.size)
+				b.SetBytes(int64(bs.size))
+				b.ResetTimer()
+				for i:=0;i<b.N;i++{
+					if _,err:= s.Write(id,strconv.Itoa(i),bytes.NewReader(data));err!=nil{
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStoreTransformMismatch(t *testing.T){
+	backend:= NewMemoryBackend()
+	id:= generateID()
+	s:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend})
+	if _,err:= s.Write(id,"key",bytes.NewReader([]byte("data")));err!=nil{
+		t.Fatal(err)
+	}
+
+	same:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFuncWith(sha1.New),Backend: backend})
+	if _,err:= same.Write(id,"other",bytes.NewReader([]byte("data")));err!=nil{
+		t.Errorf("expected the same transform to be accepted, have %s",err)
+	}
+	mixed:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFuncWith(sha512.New),Backend: backend})
+	if _,err:= mixed.Write(id,"key",bytes.NewReader([]byte("data")));err==nil{
+		t.Errorf("expected an error writing with another hash into the store")
+	}
+}
+
 func TestStore(t *testing.T) {
-	s := newStore()
+	t.Run("disk",func(t *testing.T){
+		testStore(t,newStore())
+	})
+	t.Run("synced disk",func(t *testing.T){
+		testStore(t,NewStore(StoreOpts{
+			Root: t.TempDir(),
+			PathTransformFunc: CASpathTransformFunc,
+			SyncWrites: true,
+		}))
+	})
+	t.Run("memory",func(t *testing.T){
+		testStore(t,NewStore(StoreOpts{
+			PathTransformFunc: CASpathTransformFunc,
+			Backend: NewMemoryBackend(),
+		}))
+	})
+	t.Run("at rest",func(t *testing.T){
+		testStore(t,NewStore(StoreOpts{
+			PathTransformFunc: CASpathTransformFunc,
+			Backend: NewMemoryBackend(),
+			AtRestKey: newEncryptionKey(),
+		}))
+	})
+}
+
+func TestStoreAtRestKey(t *testing.T){
+	backend:= NewMemoryBackend()
+	s:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend,AtRestKey: newEncryptionKey()})
+	data:= bytes.Repeat([]byte("plain text at rest "),10000)
+	if n,err:= s.Write("id","key",bytes.NewReader(data));err!=nil || n!=int64(len(data)){
+		t.Fatalf("want %d bytes written, have %d %v",len(data),n,err)
+	}
+
+	n,r,err:= backend.Read(s.backendPath("id","key"))
+	if err!=nil{
+		t.Fatal(err)
+	}
+	raw,_:= io.ReadAll(r)
+	r.Close()
+	if n!=encryptedSize(int64(len(data))) || bytes.Contains(raw,data[:64]){
+		t.Errorf("want the %d bytes encrypted in the backend, have %d bytes",len(data),n)
+	}
+	size,r2,err:= s.Read("id","key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if b,_:= io.ReadAll(r2);size!=int64(len(data)) || !bytes.Equal(b,data){
+		t.Errorf("want the %d plain bytes back, have %d of %d",len(data),len(b),size)
+	}
+
+	//Another key can't read the files.
+	other:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend,AtRestKey: newEncryptionKey()})
+	_,r3,err:= other.Read("id","key")
+	if err==nil{
+		_,err = io.ReadAll(r3)
+	}
+	if err==nil{
+		t.Error("want the file unreadable with another key")
+	}
+}
+
+func testStore(t *testing.T,s *Store) {
 	id:=generateID()
 	defer teardown(t,s)
 
@@ -63,6 +328,66 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreList(t *testing.T){
+	s := NewStore(StoreOpts{PathTransformFunc: DefaultPathTransformFunc})
+	id:=generateID()
+	defer teardown(t,s)
+
+	keys,err:= s.List()
+	if err!=nil{
+		t.Error(err)
+	}
+	if len(keys)!=0{
+		t.Errorf("expected empty store, have %v",keys)
+	}
+
+	want := []string{"bar","foo","foo_bar"}
+	for _,key := range want{
+		if _,err := s.Write(id,key,bytes.NewReader([]byte("some jpg bytes")));err!=nil{
+			t.Error(err)
+		}
+	}
+
+	keys,err = s.List()
+	if err!=nil{
+		t.Error(err)
+	}
+	if fmt.Sprint(keys)!=fmt.Sprint(want){
+		t.Errorf("want %v, have %v",want,keys)
+	}
+}
+
+func TestStoreListPrefix(t *testing.T){
+	s := NewStore(StoreOpts{PathTransformFunc: PrefixPathTransformFunc,Root: t.TempDir()})
+	id:=generateID()
+
+	keys:= []string{"user/123/a.jpg","user/123/b.jpg","user/1234/c.jpg","user/9/d.jpg","top"}
+	for _,key := range keys{
+		if _,err := s.Write(id,key,bytes.NewReader([]byte(key)));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	have,err:= s.ListPrefix("user/123/")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if want:= []string{"user/123/a.jpg","user/123/b.jpg"};fmt.Sprint(have)!=fmt.Sprint(want){
+		t.Errorf("want %v, have %v",want,have)
+	}
+	if all,_:= s.ListPrefix("");len(all)!=len(keys){
+		t.Errorf("want all %d keys for no prefix, have %v",len(keys),all)
+	}
+
+	//Deleting a key leaves the others in its directories alone.
+	if err:= s.Delete(id,"user/123/a.jpg");err!=nil{
+		t.Fatal(err)
+	}
+	have,_ = s.ListPrefix("user/")
+	if want:= []string{"user/123/b.jpg","user/1234/c.jpg","user/9/d.jpg"};fmt.Sprint(have)!=fmt.Sprint(want){
+		t.Errorf("want %v, have %v",want,have)
+	}
+}
+
 func newStore() *Store{
 	opts:= StoreOpts{
 		PathTransformFunc: CASpathTransformFunc,
@@ -74,4 +399,649 @@ func teardown(t *testing.T,s *Store){
 	if err:=s.Clear();err!=nil{
 		t.Error(err)
 	}
-}
\ No newline at end of file
+}
+func TestStoreWriteDecryptSizes(t *testing.T){
+	s := newStore()
+	id:=generateID()
+	key := newEncryptionKey()
+	defer teardown(t,s)
+
+	for _,size := range []int64{0,1,15,16,17,gcmSegmentSize,gcmSegmentSize+1,1<<20}{
+		data := make([]byte,size)
+		rand.Read(data)
+		name := fmt.Sprintf("file_%d",size)
+
+		encrypted := new(bytes.Buffer)
+		if _,err := copyEncrypt("",key,bytes.NewReader(data),encrypted);err!=nil{
+			t.Fatal(err)
+		}
+		if int64(encrypted.Len())!=encryptedSize(size){
+			t.Errorf("size %d: want %d encrypted bytes, have %d",size,encryptedSize(size),encrypted.Len())
+		}
+
+		//Trailing bytes on the stream must not end up in the file.
+		encrypted.WriteString("next message")
+		if _,err := s.WriteDecrypt(newKeyring(map[string][]byte{"": key},""),id,name,io.LimitReader(encrypted,encryptedSize(size)));err!=nil{
+			t.Fatal(err)
+		}
+
+		_,r,err := s.Read(id,name)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		b,err := io.ReadAll(r)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b,data){
+			t.Errorf("size %d: round trip mismatch, have %d bytes",size,len(b))
+		}
+	}
+}
+
+func TestStoreExpiry(t *testing.T){
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASpathTransformFunc,
+		Backend: NewMemoryBackend(),
+	})
+	id:=generateID()
+
+	for _,key:= range []string{"expired","fresh","forever"}{
+		if _,err:= s.Write(id,key,bytes.NewReader([]byte("cached bytes")));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	now:= time.Now()
+	if err:= s.SetExpiry(id,"expired",now.Add(-time.Second));err!=nil{
+		t.Fatal(err)
+	}
+	if err:= s.SetExpiry(id,"fresh",now.Add(time.Hour));err!=nil{
+		t.Fatal(err)
+	}
+
+	if !s.Expired(id,"expired"){
+		t.Errorf("expected expired to be expired")
+	}
+	if s.Expired(id,"fresh") || s.Expired(id,"forever"){
+		t.Errorf("expected fresh and forever to not be expired")
+	}
+
+	n,err:= s.Sweep(now)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if n!=1{
+		t.Errorf("want 1 swept file, have %d",n)
+	}
+	if s.Has(id,"expired"){
+		t.Errorf("expected expired to be swept")
+	}
+	if !s.Has(id,"fresh") || !s.Has(id,"forever"){
+		t.Errorf("expected fresh and forever to be kept")
+	}
+
+	keys,err:= s.List()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(keys)!=2{
+		t.Errorf("want 2 keys, have %v",keys)
+	}
+}
+
+func TestStoreRefs(t *testing.T){
+	backend:= NewMemoryBackend()
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASpathTransformFunc,
+		Backend: backend,
+	})
+	id:=generateID()
+	data:= []byte("shared blob")
+	sum:= sha256.Sum256(data)
+	key:= hex.EncodeToString(sum[:])
+
+	for i:=0;i<2;i++{
+		if _,err:= s.Write(id,key,bytes.NewReader(data));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	//Writing the file again, like a fetch or a repair does, isn't another
+	//reference.
+	if _,err:= s.writeStream(id,key,bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	if n,_:= s.Refs(id,key);n!=2{
+		t.Fatalf("want 2 references, have %d",n)
+	}
+
+	if err:= s.Delete(id,key);err!=nil{
+		t.Fatal(err)
+	}
+	if !s.Has(id,key){
+		t.Fatalf("expected the blob to survive while it is still referenced")
+	}
+	if err:= s.Delete(id,key);err!=nil{
+		t.Fatal(err)
+	}
+	if s.Has(id,key){
+		t.Fatalf("expected the blob to be removed with its last reference")
+	}
+
+	//A Delete that released the last reference but crashed before the
+	//blob was removed leaves it to GC, sidecars included.
+	if _,err:= s.Write(id,key,bytes.NewReader(data));err!=nil{
+		t.Fatal(err)
+	}
+	if err:= s.addPins(id,key,[]string{"peer"});err!=nil{
+		t.Fatal(err)
+	}
+	if n,err:= s.release(id,key);err!=nil || n!=0{
+		t.Fatalf("want no references left, have %d (%v)",n,err)
+	}
+	n,err:= s.GC()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if n!=1 || s.Has(id,key){
+		t.Errorf("expected GC to remove the unreferenced blob, removed %d",n)
+	}
+	//Only the marker of the path transform is left.
+	if paths,_:= backend.List();len(paths)!=1 || paths[0]!=transformMarker{
+		t.Errorf("expected an empty store, have %v",paths)
+	}
+}
+
+func TestStoreKeyIDs(t *testing.T){
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASpathTransformFunc,
+		Backend: NewMemoryBackend(),
+	})
+	id:=generateID()
+	for _,key:= range []string{"a","b"}{
+		if _,err:= s.Write(id,key,bytes.NewReader([]byte(key)));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if err:= s.SetKeyID(id,"a","old");err!=nil{
+		t.Fatal(err)
+	}
+	if err:= s.SetKeyID(id,"b","new");err!=nil{
+		t.Fatal(err)
+	}
+	if _,err:= s.Write(generateID(),"c",bytes.NewReader([]byte("c")));err!=nil{
+		t.Fatal(err)
+	}
+
+	keys,err:= s.keyIDs(id)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(keys)!=2 || keys["a"]!="old" || keys["b"]!="new"{
+		t.Errorf("want the key IDs of a and b, have %v",keys)
+	}
+	if list,_:= s.List();len(list)!=3{
+		t.Errorf("want the key ID files left out of List, have %v",list)
+	}
+}
+
+func TestStoreQuota(t *testing.T){
+	id:=generateID()
+	write:= func(s *Store,key string,size int) error{
+		_,err:= s.Write(id,key,bytes.NewReader(make([]byte,size)))
+		return err
+	}
+
+	t.Run("reject",func(t *testing.T){
+		s := NewStore(StoreOpts{Backend: NewMemoryBackend(),MaxBytes: 100})
+		if err:= write(s,"a",60);err!=nil{
+			t.Fatal(err)
+		}
+		if err:= write(s,"b",60);!errors.Is(err,ErrQuotaExceeded){
+			t.Fatalf("want ErrQuotaExceeded, have %v",err)
+		}
+		//Overwriting a file only needs room for the difference.
+		if err:= write(s,"a",90);err!=nil{
+			t.Fatal(err)
+		}
+		if err:= s.Delete(id,"a");err!=nil{
+			t.Fatal(err)
+		}
+		if err:= write(s,"b",100);err!=nil{
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("lru",func(t *testing.T){
+		backend:= NewMemoryBackend()
+		s := NewStore(StoreOpts{Backend: backend,MaxBytes: 100,Eviction: EvictLRU})
+		for _,key:= range []string{"a","b","c"}{
+			if err:= write(s,key,30);err!=nil{
+				t.Fatal(err)
+			}
+		}
+		//Reading a makes b the least recently used.
+		if _,r,err:= s.Read(id,"a");err!=nil{
+			t.Fatal(err)
+		}else{
+			r.(io.ReadCloser).Close()
+		}
+		if err:= write(s,"d",30);err!=nil{
+			t.Fatal(err)
+		}
+		for key,want:= range map[string]bool{"a": true,"b": false,"c": true,"d": true}{
+			if s.Has(id,key)!=want{
+				t.Errorf("%s: want stored %t",key,want)
+			}
+		}
+		if err:= write(s,"e",200);!errors.Is(err,ErrQuotaExceeded){
+			t.Errorf("want ErrQuotaExceeded for a file larger than the quota, have %v",err)
+		}
+		if !s.Has(id,"d"){
+			t.Errorf("expected a file larger than the quota not to evict anything")
+		}
+	})
+
+	t.Run("existing files",func(t *testing.T){
+		backend:= NewMemoryBackend()
+		if err:= write(NewStore(StoreOpts{Backend: backend}),"a",80);err!=nil{
+			t.Fatal(err)
+		}
+		s := NewStore(StoreOpts{Backend: backend,MaxBytes: 100})
+		if err:= write(s,"b",30);!errors.Is(err,ErrQuotaExceeded){
+			t.Errorf("want the files already stored counted, have %v",err)
+		}
+	})
+}
+
+//writeCounter counts the writes that reach a backend.
+type writeCounter struct{
+	StorageBackend
+	writes int
+}
+
+func (b *writeCounter) Write(p string,r io.Reader) (int64,error){
+	b.writes++
+	return b.StorageBackend.Write(p,r)
+}
+
+func TestStoreEvictLRU(t *testing.T){
+	id:= generateID()
+	backend:= &writeCounter{StorageBackend: NewMemoryBackend()}
+	s := NewStore(StoreOpts{Backend: backend})
+	for _,key:= range []string{"a","b","c"}{
+		if _,err:= s.Write(id,key,bytes.NewReader(make([]byte,30)));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	if n,count:= s.Usage();n!=90 || count!=3{
+		t.Errorf("want 90 bytes in 3 files, have %d in %d",n,count)
+	}
+
+	read:= func(s *Store,key string){
+		_,r,err:= s.Read(id,key)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		r.(io.ReadCloser).Close()
+	}
+	writes:= backend.writes
+	read(s,"a")
+	if backend.writes!=writes{
+		t.Error("want reads not to write to the backend")
+	}
+	if n,err:= s.EvictLRU(60);err!=nil || n!=1{
+		t.Fatalf("want 1 file evicted, have %d (%v)",n,err)
+	}
+	if s.Has(id,"b") || !s.Has(id,"a") || !s.Has(id,"c"){
+		t.Error("want b evicted as the least recently used")
+	}
+
+	//The access times outlive the Store.
+	read(s,"c")
+	read(s,"a")
+	if err:= s.Close();err!=nil{
+		t.Fatal(err)
+	}
+	s = NewStore(StoreOpts{Backend: backend})
+	if n,err:= s.EvictLRU(30);err!=nil || n!=1{
+		t.Fatalf("want 1 file evicted, have %d (%v)",n,err)
+	}
+	if s.Has(id,"c") || !s.Has(id,"a"){
+		t.Error("want c evicted as the least recently used")
+	}
+	if n,count:= s.Usage();n!=30 || count!=1{
+		t.Errorf("want 30 bytes in 1 file, have %d in %d",n,count)
+	}
+}
+
+func TestStoreAtomicWrite(t *testing.T){
+	s := NewStore(StoreOpts{Root: t.TempDir()})
+	id:= generateID()
+	if _,err:= s.Write(id,"key",bytes.NewReader([]byte("old content")));err!=nil{
+		t.Fatal(err)
+	}
+
+	//A write that fails half way keeps the old file and leaves no
+	//temporary file behind.
+	failed:= io.MultiReader(bytes.NewReader([]byte("new")),iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _,err:= s.Write(id,"key",failed);!errors.Is(err,io.ErrUnexpectedEOF){
+		t.Fatalf("want %v, have %v",io.ErrUnexpectedEOF,err)
+	}
+	//Nor does one whose content doesn't hash to its content key.
+	data:= []byte("some content")
+	sum:= sha256.Sum256(data)
+	key:= hex.EncodeToString(sum[:])
+	if _,err:= s.Write(id,key,verifyingReader(key,compressReader(CompressionNone,0,bytes.NewReader([]byte("other content")))));err==nil{
+		t.Fatal("want a hash mismatch")
+	}
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(paths)!=2 || paths[0]!=transformMarker{
+		t.Fatalf("want only the old file, have %v",paths)
+	}
+	_,r,err:= s.Read(id,"key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	b,_:= io.ReadAll(r)
+	r.(io.ReadCloser).Close()
+	if string(b)!="old content"{
+		t.Errorf("want the old content, have %q",b)
+	}
+
+	if _,err:= s.Write(id,key,verifyingReader(key,compressReader(CompressionGzip,0,bytes.NewReader(data))));err!=nil{
+		t.Fatal(err)
+	}
+}
+
+func TestStorePathTraversal(t *testing.T){
+	root:= t.TempDir()
+	outside:= t.TempDir()
+	s:= NewStore(StoreOpts{Root: root})
+	id:= generateID()
+	for _,tc:= range []struct{
+		id 	string
+		key string
+	}{
+		{id,"../../escape"},
+		{id,"a/../../../escape"},
+		{"..","escape"},
+		{id,"..\\..\\escape"},
+		{"/tmp","escape"},
+	}{
+		if _,err:= s.Write(tc.id,tc.key,strings.NewReader("data"));!errors.Is(err,ErrInvalidPath){
+			t.Errorf("%s/%s: want %v, have %v",tc.id,tc.key,ErrInvalidPath,err)
+		}
+		if s.Has(tc.id,tc.key){
+			t.Errorf("%s/%s: want no file",tc.id,tc.key)
+		}
+	}
+
+	//A symlink below the root doesn't lead out of it.
+	if err:= os.Symlink(outside,root+"/"+id);err!=nil{
+		t.Fatal(err)
+	}
+	if _,err:= s.Write(id,"key",strings.NewReader("data"));!errors.Is(err,ErrInvalidPath){
+		t.Errorf("want %v, have %v",ErrInvalidPath,err)
+	}
+	if _,_,err:= s.Read(id,"key");!errors.Is(err,ErrInvalidPath){
+		t.Errorf("want %v, have %v",ErrInvalidPath,err)
+	}
+	if entries,_:= os.ReadDir(outside);len(entries)>0{
+		t.Errorf("want nothing written outside the root, have %v",entries)
+	}
+
+	//The CAS paths are lowercase hex, keys differing in case don't collide.
+	upper,lower:= CASpathTransformFunc("KEY"),CASpathTransformFunc("key")
+	if upper.FullPath()!=strings.ToLower(upper.FullPath()) || strings.EqualFold(upper.FullPath(),lower.FullPath()){
+		t.Errorf("want distinct lowercase paths, have %s and %s",upper.FullPath(),lower.FullPath())
+	}
+}
+
+//failingBackend fails the writes of the paths fail matches with err, like
+//a disk that is full or read only.
+type failingBackend struct{
+	StorageBackend
+	err 	error
+	fail 	func(p string) bool
+}
+
+func (b *failingBackend) Write(p string,r io.Reader) (int64,error){
+	if b.fail(p){
+		return 0,&fs.PathError{Op: "write",Path: p,Err: b.err}
+	}
+	return b.StorageBackend.Write(p,r)
+}
+
+func TestStoreDiskErrors(t *testing.T){
+	data:= []byte("some content")
+	sum:= sha256.Sum256(data)
+	contentKey:= hex.EncodeToString(sum[:])
+	for _,tc:= range []struct{
+		name 	string
+		errno syscall.Errno
+		want 	error
+		//suffix picks the paths whose writes fail.
+		suffix string
+	}{
+		{"full",syscall.ENOSPC,ErrDiskFull,""},
+		{"read only",syscall.EROFS,ErrReadOnly,""},
+		{"full refs",syscall.ENOSPC,ErrDiskFull,refsSuffix},
+	}{
+		t.Run(tc.name,func(t *testing.T){
+			backend:= &failingBackend{StorageBackend: NewMemoryBackend(),err: tc.errno}
+			s:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend})
+			id:= generateID()
+			backend.fail = func(p string) bool{
+				return strings.Contains(p,id) && strings.HasSuffix(p,tc.suffix)
+			}
+			_,err:= s.Write(id,contentKey,bytes.NewReader(data))
+			if !errors.Is(err,tc.want) || !errors.Is(err,tc.errno){
+				t.Fatalf("want %v wrapping %v, have %v",tc.want,tc.errno,err)
+			}
+			if s.Has(id,contentKey){
+				t.Error("want no file left behind by the failed write")
+			}
+		})
+	}
+}
+
+func TestStoreReadAt(t *testing.T){
+	data:= []byte("0123456789abcdefghij")
+	for _,c:= range []Compression{CompressionNone,CompressionGzip}{
+		//The disk backend seeks, the memory one is read up to the offset.
+		for name,backend:= range map[string]StorageBackend{"disk": NewDiskBackend(t.TempDir()),"memory": NewMemoryBackend()}{
+			s:= NewStore(StoreOpts{Backend: backend})
+			id:= generateID()
+			if _,err:= s.Write(id,"key",compressReader(c,0,bytes.NewReader(data)));err!=nil{
+				t.Fatal(err)
+			}
+			for _,tc:= range []struct{
+				off,length 	int64
+				want 				string
+			}{
+				{0,4,"0123"},
+				{10,5,"abcde"},
+				{18,10,"ij"},
+				{5,0,""},
+			}{
+				r,err:= s.ReadAt(id,"key",tc.off,tc.length)
+				if err!=nil{
+					t.Fatalf("%s %s: %s",c,name,err)
+				}
+				b,_:= io.ReadAll(r)
+				r.(io.ReadCloser).Close()
+				if string(b)!=tc.want{
+					t.Errorf("%s %s: want %q at %d, have %q",c,name,tc.want,tc.off,b)
+				}
+			}
+			if _,err:= s.ReadAt(id,"key",int64(len(data)),1);err==nil{
+				t.Errorf("%s %s: want an error for an offset beyond the end",c,name)
+			}
+		}
+	}
+}
+
+func TestStorePins(t *testing.T){
+	s := NewStore(StoreOpts{Backend: NewMemoryBackend()})
+	id:= generateID()
+	if _,err:= s.Write(id,"key",bytes.NewReader([]byte("pinned")));err!=nil{
+		t.Fatal(err)
+	}
+	for _,addrs:= range [][]string{{"b:3000"},{"a:3000","b:3000"}}{
+		if err:= s.addPins(id,"key",addrs);err!=nil{
+			t.Fatal(err)
+		}
+	}
+	pins,err:= s.Pins(id,"key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pins)!="[a:3000 b:3000]"{
+		t.Errorf("want [a:3000 b:3000], have %v",pins)
+	}
+
+	//The pins go with the file.
+	if err:= s.Delete(id,"key");err!=nil{
+		t.Fatal(err)
+	}
+	if pins,err:= s.Pins(id,"key");err!=nil || len(pins)!=0{
+		t.Errorf("want no pins after delete, have %v (%v)",pins,err)
+	}
+}
+
+func TestStoreClose(t *testing.T){
+	s := NewStore(StoreOpts{Root: t.TempDir()})
+	id:= generateID()
+	if _,err:= s.Write(id,"key",bytes.NewReader([]byte("some content")));err!=nil{
+		t.Fatal(err)
+	}
+	_,r,err:= s.Read(id,"key")
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if _,ok:= r.(io.Seeker);!ok{
+		t.Error("want the reader of a file on disk to seek")
+	}
+
+	if err:= s.Close();err!=nil{
+		t.Fatal(err)
+	}
+	//The reader left open was closed.
+	if _,err:= r.Read(make([]byte,1));err==nil{
+		t.Error("want reading a file after Close to fail")
+	}
+	if err:= r.(io.Closer).Close();err!=nil{
+		t.Errorf("want closing it again to be a no-op, have %v",err)
+	}
+	if _,err:= s.Write(id,"other",bytes.NewReader(nil));!errors.Is(err,ErrStoreClosed){
+		t.Errorf("want ErrStoreClosed, have %v",err)
+	}
+	if _,_,err:= s.Read(id,"key");!errors.Is(err,ErrStoreClosed){
+		t.Errorf("want ErrStoreClosed, have %v",err)
+	}
+	if err:= s.Close();err!=nil{
+		t.Errorf("want a second Close to be a no-op, have %v",err)
+	}
+}
+
+func TestStoreVerify(t *testing.T){
+	s := NewStore(StoreOpts{PathTransformFunc: CIDPathTransformFunc,Backend: NewMemoryBackend()})
+	id:= generateID()
+	write:= func(key string,content string){
+		if _,err:= s.Write(id,key,compressReader(CompressionGzip,0,strings.NewReader(content)));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	keyOf:= func(content string) string{
+		sum:= sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	intact,rotten:= keyOf("intact"),keyOf("rotten")
+	write(intact,"intact")
+	write(rotten,"not what it was")
+	//Names can't be verified.
+	write("name","anything")
+
+	corrupt,err:= s.Verify()
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if len(corrupt)!=1 || corrupt[0]!=rotten{
+		t.Errorf("want only %s corrupt, have %v",rotten,corrupt)
+	}
+}
+
+func TestStoreMigrate(t *testing.T){
+	backend:= NewMemoryBackend()
+	id:= generateID()
+	s:= NewStore(StoreOpts{Backend: backend})
+	keys:= []string{"first","second"}
+	for _,key:= range keys{
+		if _,err:= s.Write(id,key,bytes.NewReader([]byte(key)));err!=nil{
+			t.Fatal(err)
+		}
+	}
+	expires:= time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err:= s.SetExpiry(id,"first",expires);err!=nil{
+		t.Fatal(err)
+	}
+
+	//The flat layout can be reversed, no keys are needed.
+	if err:= s.Migrate(CASpathTransformFunc);err!=nil{
+		t.Fatal(err)
+	}
+	reopened:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend})
+	for _,key:= range keys{
+		_,r,err:= reopened.Read(id,key)
+		if err!=nil{
+			t.Fatal(err)
+		}
+		if b,_:= io.ReadAll(r);string(b)!=key{
+			t.Errorf("%s: want %q, have %q",key,key,b)
+		}
+		if backend.Has(id+"/"+key){
+			t.Errorf("%s: want the old path removed",key)
+		}
+	}
+	if have,ok,err:= reopened.Expiry(id,"first");err!=nil || !ok || !have.Equal(expires){
+		t.Errorf("want the expiry moved along, have %s %v %v",have,ok,err)
+	}
+
+	//The hashes can't, unless the keys are given.
+	if err:= reopened.Migrate(CASpathTransformFuncWith(sha256.New));err==nil{
+		t.Fatal("want an error without the keys of hashed paths")
+	}
+	if !reopened.Has(id,"first"){
+		t.Fatal("want nothing moved by the failed migration")
+	}
+
+	//An interrupted migration is finished by the next one.
+	to:= CASpathTransformFuncWith(sha256.New)
+	moves,err:= reopened.planMigration(to,keys)
+	if err!=nil{
+		t.Fatal(err)
+	}
+	if err:= reopened.writeJournal(transformFingerprint(to),moves);err!=nil{
+		t.Fatal(err)
+	}
+	if err:= reopened.move(moves[0][0],moves[0][1]);err!=nil{
+		t.Fatal(err)
+	}
+	if err:= reopened.Migrate(to);err!=nil{
+		t.Fatal(err)
+	}
+	for _,key:= range keys{
+		if !reopened.Has(id,key){
+			t.Errorf("%s: want the file at its new path",key)
+		}
+	}
+	if backend.Has(migrateJournal){
+		t.Error("want the journal removed")
+	}
+	if _,err:= NewStore(StoreOpts{PathTransformFunc: CASpathTransformFunc,Backend: backend}).Write(id,"third",bytes.NewReader(nil));err==nil{
+		t.Error("want the old transform refused after the migration")
+	}
+}
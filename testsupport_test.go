@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+//The helpers below make tests reproducible: files land at paths that can
+//be asserted on and hold the same bytes on every run. They are only
+//compiled into the tests, package main can't be imported by others.
+
+//DeterministicPathTransformFunc stores a key at itself like
+//DefaultPathTransformFunc, "user/1/pic.jpg" at "user/1/pic.jpg/pic.jpg",
+//without hashing it but safe for any key: every slash separated part is
+//kept to letters, digits, '-', '_' and '.', anything else becomes '_',
+//and an empty, "." or ".." part is "_". Keys that only differ in those
+//characters share a path, it is meant for tests choosing their keys.
+func DeterministicPathTransformFunc(key string) PathKey{
+	parts:= strings.Split(key,"/")
+	for i,part:= range parts{
+		parts[i] = sanitizePathPart(part)
+	}
+	return PathKey{
+		PathName: strings.Join(parts,"/"),
+		FileName: parts[len(parts)-1],
+	}
+}
+
+func sanitizePathPart(part string) string{
+	if part=="" || part=="." || part==".."{
+		return "_"
+	}
+	return strings.Map(func(r rune) rune{
+		switch{
+		case r>='a' && r<='z',r>='A' && r<='Z',r>='0' && r<='9',r=='-',r=='_',r=='.':
+			return r
+		}
+		return '_'
+	},part)
+}
+
+//Seeded generates keys and file contents that are the same for the same
+//seed, in the order they are asked for. It is not safe for concurrent use
+//and not for anything that needs real randomness.
+type Seeded struct{
+	r *rand.Rand
+}
+
+func NewSeeded(seed int64) *Seeded{
+	return &Seeded{r: rand.New(rand.NewSource(seed))}
+}
+
+//Key returns the next key, "key-" and 16 hex characters.
+func (g *Seeded) Key() string{
+	b:= make([]byte,8)
+	g.r.Read(b)
+	return "key-"+hex.EncodeToString(b)
+}
+
+//Bytes returns the next n bytes of content.
+func (g *Seeded) Bytes(n int) []byte{
+	b:= make([]byte,n)
+	g.r.Read(b)
+	return b
+}
+
+//Reader streams the next n bytes of content without holding them, for
+//files too large for Bytes. The bytes are those Bytes(n) would return.
+func (g *Seeded) Reader(n int64) io.Reader{
+	return io.LimitReader(g.r,n)
+}
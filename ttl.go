@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+const(
+	//expirySuffix marks the sidecar file holding the expiry of a file.
+	expirySuffix 					= ".expires"
+	defaultSweepInterval 	= time.Minute
+)
+
+func (s *Store) expiryPath(id string,key string) string{
+	return s.backendPath(id,key)+expirySuffix
+}
+
+//SetExpiry records when the file for key expires, a zero time removes
+//the expiry so the file is kept forever.
+func (s *Store) SetExpiry(id string,key string,expires time.Time) error{
+	if expires.IsZero(){
+		return s.Backend.Delete(s.expiryPath(id,key))
+	}
+	b,err:= expires.UTC().MarshalText()
+	if err!=nil{
+		return err
+	}
+	_,err = s.Backend.Write(s.expiryPath(id,key),bytes.NewReader(b))
+	return diskError(err)
+}
+
+//Expiry returns when the file for key expires, ok is false for files
+//without an expiry.
+func (s *Store) Expiry(id string,key string) (time.Time,bool,error){
+	return s.readExpiry(s.expiryPath(id,key))
+}
+
+func (s *Store) readExpiry(p string) (time.Time,bool,error){
+	_,r,err:= s.Backend.Read(p)
+	if errors.Is(err,fs.ErrNotExist){
+		return time.Time{},false,nil
+	}
+	if err!=nil{
+		return time.Time{},false,err
+	}
+	defer r.Close()
+
+	b,err:= io.ReadAll(r)
+	if err!=nil{
+		return time.Time{},false,err
+	}
+	var expires time.Time
+	if err:= expires.UnmarshalText(b);err!=nil{
+		return time.Time{},false,err
+	}
+	return expires,true,nil
+}
+
+//Expired tells whether the file for key has an expiry in the past.
+func (s *Store) Expired(id string,key string) bool{
+	expires,ok,err:= s.Expiry(id,key)
+	return err==nil && ok && !time.Now().Before(expires)
+}
+
+//Sweep deletes every file that expired before now and returns how many
+//files were removed.
+func (s *Store) Sweep(now time.Time) (int,error){
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return 0,err
+	}
+	removed:= 0
+	for _,p:= range paths{
+		if !strings.HasSuffix(p,expirySuffix){
+			continue
+		}
+		expires,ok,err:= s.readExpiry(p)
+		if err!=nil{
+			return removed,err
+		}
+		if !ok || now.Before(expires){
+			continue
+		}
+		file:= strings.TrimSuffix(p,expirySuffix)
+		for _,del:= range []string{file,file+keyIDSuffix,file+metaSuffix,p}{
+			if err:= s.Backend.Delete(del);err!=nil{
+				return removed,err
+			}
+		}
+		removed++
+	}
+	return removed,nil
+}
+
+//StoreWithTTL is like Store but the file expires after ttl, both here
+//and on the peers it is replicated to. Expired files are treated as
+//missing and removed by the sweeper.
+func (s *FileServer) StoreWithTTL(key string,r io.Reader,ttl time.Duration) error{
+	_,err:= s.storeFile(context.Background(),key,r,ttl)
+	return err
+}
+
+//sweepLoop deletes expired files and tokens (see StoreEphemeral) every
+//SweepInterval until the server stops. It also evicts files down to TargetBytes and saves the access
+//times.
+func (s *FileServer) sweepLoop(){
+	ticker:= time.NewTicker(s.SweepInterval)
+	defer ticker.Stop()
+	for{
+		select{
+		case <-ticker.C:
+			n,err:= s.store.Sweep(time.Now())
+			if err!=nil{
+				s.Logger.Errorf("sweep error: %s",err)
+			}
+			if n>0{
+				s.Logger.Infof("swept %d expired files",n)
+			}
+			if n,err:= s.sweepTokens(time.Now());err!=nil{
+				s.Logger.Errorf("sweep tokens error: %s",err)
+			}else if n>0{
+				s.Logger.Infof("swept %d expired tokens",n)
+			}
+			if s.TargetBytes>0{
+				s.evictToTarget()
+			}
+			if err:= s.store.FlushAccessTimes();err!=nil{
+				s.Logger.Errorf("flush access times error: %s",err)
+			}
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+func (s *FileServer) evictToTarget(){
+	n,err:= s.store.EvictLRU(s.TargetBytes)
+	if err!=nil{
+		s.Logger.Errorf("evict error: %s",err)
+	}
+	if n>0{
+		s.Logger.Infof("evicted %d files down to %d bytes",n,s.TargetBytes)
+	}
+}
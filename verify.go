@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+//Verify re-reads every stored file whose key is a content hash and
+//returns the keys whose content no longer hashes to them (bit rot, a bad
+//write), sorted. It changes nothing. A file is checked if its key can be
+//recovered, see Migrate: the CAS hash of a file that was never
+//replicated can't be and is skipped.
+func (s *Store) Verify() ([]string,error){
+	paths,err:= s.Backend.List()
+	if err!=nil{
+		return nil,err
+	}
+	known,err:= s.knownKeys(paths,nil)
+	if err!=nil{
+		return nil,err
+	}
+
+	existing:= make(map[string]bool,len(paths))
+	for _,p:= range paths{
+		existing[p] = true
+	}
+	seen:= make(map[string]bool)
+	corrupt:= []string{}
+	for _,p:= range paths{
+		_,fullPath,ok:= strings.Cut(p,"/")
+		//Only content addressed files are reference counted. A name can be
+		//stored at the path of a hash as well, see CIDPathTransformFunc.
+		if !ok || isSidecar(p) || !existing[p+refsSuffix]{
+			continue
+		}
+		key,ok:= known[fullPath]
+		if !ok{
+			key,ok = s.recoverKey(fullPath)
+		}
+		if !ok || !isContentKey(key){
+			continue
+		}
+		intact,err:= s.verifyFile(p,key)
+		if err!=nil{
+			return nil,err
+		}
+		if !intact && !seen[key]{
+			seen[key] = true
+			corrupt = append(corrupt,key)
+		}
+	}
+	sort.Strings(corrupt)
+	return corrupt,nil
+}
+
+//verifyFile tells whether the (compressed) content of the file at p
+//hashes to key. Content that can't be decompressed is corrupt as well.
+func (s *Store) verifyFile(p string,key string) (bool,error){
+	_,r,err:= s.readAtRest(p)
+	if err!=nil{
+		return false,err
+	}
+	defer r.Close()
+	dr,err:= decompressReader(struct{io.Reader}{r})
+	if err!=nil{
+		return false,nil
+	}
+	defer dr.Close()
+	return verifyContentHash(key,dr)==nil,nil
+}
+
+//VerifyAndRepair is Store.Verify on our own files, the corrupt ones are
+//then fetched again from the peers. It returns the corrupt keys and the
+//errors of the ones that couldn't be repaired, those are deleted so they
+//are never served.
+func (s *FileServer) VerifyAndRepair() ([]string,error){
+	return s.VerifyAndRepairContext(context.Background())
+}
+
+func (s *FileServer) VerifyAndRepairContext(ctx context.Context) ([]string,error){
+	corrupt,err:= s.store.Verify()
+	if err!=nil{
+		return nil,err
+	}
+	var errs []error
+	for _,key:= range corrupt{
+		//The corrupt copy may be one we hold for a peer.
+		if !s.store.Has(s.ID,key){
+			continue
+		}
+		intact,err:= s.store.verifyFile(s.store.backendPath(s.ID,key),key)
+		if err!=nil{
+			errs = append(errs,err)
+			continue
+		}
+		if intact{
+			continue
+		}
+		s.Logger.With("key",key).Errorf("corrupt file, fetching it again")
+		if err:= s.repair(ctx,key);err!=nil{
+			errs = append(errs,fmt.Errorf("repair %s: %w",key,err))
+		}
+	}
+	return corrupt,errors.Join(errs...)
+}
+
+//repair replaces our corrupt copy of the file with one from the network.
+//The sidecars are kept, and the reference count the fetch would add to.
+func (s *FileServer) repair(ctx context.Context,key string) error{
+	refs,counted,err:= s.store.readRefs(s.store.refsPath(s.ID,key))
+	if err!=nil{
+		return err
+	}
+	if err:= s.store.Backend.Delete(s.store.backendPath(s.ID,key));err!=nil{
+		return err
+	}
+	r,err:= s.fetch(ctx,key)
+	if err!=nil{
+		return err
+	}
+	if rc,ok:= r.(io.ReadCloser);ok{
+		rc.Close()
+	}
+	if counted{
+		return s.store.writeRefs(s.store.refsPath(s.ID,key),refs)
+	}
+	return nil
+}
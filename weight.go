@@ -0,0 +1,46 @@
+package main
+
+import "github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+
+const defaultStorageWeight = 1
+
+//MessageStorageWeight is sent to every peer on connect by a node whose
+//StorageWeight isn't the default, see closestPeers.
+type MessageStorageWeight struct{
+	Weight int
+}
+
+//announceWeight tells a peer that just connected our StorageWeight, a
+//peer that never hears of it counts us at the default.
+func (s *FileServer) announceWeight(p p2p.Peer){
+	if s.StorageWeight==defaultStorageWeight{
+		return
+	}
+	if err:= s.send(p,&Message{Payload: MessageStorageWeight{Weight: s.StorageWeight}});err!=nil{
+		s.Logger.With("peer",p.RemoteAddr().String()).Errorf("announcing the storage weight error: %s",err)
+	}
+}
+
+func (s *FileServer) handleMessageStorageWeight(from string,msg MessageStorageWeight) error{
+	if msg.Weight<=0{
+		return nil
+	}
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if _,ok:= s.peers[from];ok{
+		s.weights[from] = msg.Weight
+	}
+	return nil
+}
+
+//peerWeights returns the StorageWeight the peers announced by remote
+//address, those that didn't are left out.
+func (s *FileServer) peerWeights() map[string]int{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	weights:= make(map[string]int,len(s.weights))
+	for addr,w:= range s.weights{
+		weights[addr] = w
+	}
+	return weights
+}
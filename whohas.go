@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"github.com/kushagra-gupta01/Content_Addressable_Storage/p2p"
+)
+
+//MessageHasFile asks a peer whether it holds the file for Key stored by
+//the node with ID, with Sum set for the sha256 of its copy as well.
+type MessageHasFile struct{
+	RequestID string
+	ID 				string
+	Key 			string
+	Sum 			bool
+}
+
+//MessageHasFileReply is the reply to MessageHasFile. Size is that of the
+//peer's copy, Ranges the parts of it the peer holds: all of it when Has,
+//what reached it of a Store that failed otherwise.
+type MessageHasFileReply struct{
+	RequestID string
+	Has 			bool
+	Sum 			[]byte
+	Size 			int64
+	Ranges 		[]ByteRange
+}
+
+//WhoHas returns the addresses of the connected peers that hold the file
+//for key, without fetching it. Peers that don't answer within AckTimeout
+//are left out.
+func (s *FileServer) WhoHas(key string) ([]string,error){
+	return s.WhoHasContext(context.Background(),key)
+}
+
+func (s *FileServer) WhoHasContext(ctx context.Context,key string) ([]string,error){
+	return s.whoHas(ctx,key,s.peerList(),nil)
+}
+
+//whoHas asks peers only. With a sum only the peers whose copy has that
+//sha256 count.
+func (s *FileServer) whoHas(ctx context.Context,key string,peers []p2p.Peer,sum []byte) ([]string,error){
+	replies,err:= s.hasFileReplies(ctx,key,peers,sum!=nil)
+	if err!=nil{
+		return nil,err
+	}
+	holders:= []string{}
+	for addr,r:= range replies{
+		if r.Has && (sum==nil || bytes.Equal(r.Sum,sum)){
+			holders = append(holders,addr)
+		}
+	}
+	sort.Strings(holders)
+	return holders,nil
+}
+
+//hasFileReplies sends peers a MessageHasFile and returns the replies that
+//arrived within AckTimeout by peer address.
+func (s *FileServer) hasFileReplies(ctx context.Context,key string,peers []p2p.Peer,sum bool) (map[string]MessageHasFileReply,error){
+	id,replies:= s.addRequest(len(peers))
+	defer s.removeRequest(id)
+
+	msg:= &Message{Payload: MessageHasFile{RequestID: id,ID: s.ID,Key: hashKey(key),Sum: sum}}
+	peers,_ = s.multicast(ctx,msg,peers)
+	if err:= ctx.Err();err!=nil{
+		return nil,err
+	}
+
+	got:= make(map[string]MessageHasFileReply,len(peers))
+	timeout:= time.After(s.AckTimeout)
+	for i:=0;i<len(peers);i++{
+		select{
+		case reply:= <-replies:
+			got[reply.From] = reply.Payload.(MessageHasFileReply)
+		case <-timeout:
+			s.Logger.With("key",key).Errorf("timed out waiting for has file replies")
+			i = len(peers)
+		case <-ctx.Done():
+			return nil,ctx.Err()
+		}
+	}
+	return got,nil
+}
+
+func (s *FileServer) handleMessageHasFile(from string,msg MessageHasFile) error{
+	peer,ok:= s.peer(from)
+	if !ok{
+		return fmt.Errorf("%w: %s",ErrPeerNotFound,from)
+	}
+	reply:= MessageHasFileReply{RequestID: msg.RequestID,Has: s.servesCopy(msg.ID,msg.Key)}
+	switch{
+	case reply.Has && msg.Sum:
+		sum,size,err:= s.copySum(msg.ID,msg.Key)
+		if err!=nil{
+			s.Logger.With("key",msg.Key,"peer",from).Errorf("hashing copy error: %s",err)
+		}
+		reply.Has,reply.Sum,reply.Size = err==nil,sum,size
+	case reply.Has:
+		size,r,err:= s.store.Read(msg.ID,msg.Key)
+		if rc,ok:= r.(io.ReadCloser);ok{
+			rc.Close()
+		}
+		reply.Has,reply.Size = err==nil,size
+	case !s.ReadOnly:
+		if p,ok:= s.partialOf(msg.ID,msg.Key);ok{
+			reply.Size,reply.Ranges = p.Size,p.Ranges
+		}
+	}
+	if reply.Has{
+		reply.Ranges = []ByteRange{{Offset: 0,Length: reply.Size}}
+	}
+	return s.send(peer,&Message{Payload: reply})
+}
+
+//copySum returns the sha256 and the size of our copy of a peer's file.
+func (s *FileServer) copySum(id string,key string) ([]byte,int64,error){
+	size,r,err:= s.store.readStream(id,key)
+	if err!=nil{
+		return nil,0,err
+	}
+	defer r.Close()
+	h:= sha256.New()
+	if _,err:= s.copyBuffer(h,r);err!=nil{
+		return nil,0,err
+	}
+	return h.Sum(nil),size,nil
+}
+
+func (s *FileServer) handleMessageHasFileReply(from string,msg MessageHasFileReply) error{
+	s.deliverReply(msg.RequestID,from,msg)
+	return nil
+}